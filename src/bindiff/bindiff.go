@@ -11,6 +11,7 @@ import (
 	"time"
 	"unsafe"
 	"io/ioutil"
+	"hash"
 	"crypto/sha1"
 	"encoding/json"
 	"encoding/hex"
@@ -31,7 +32,9 @@ const (
 
 const RDIFF_BLOCKSIZE = 512 //4096
 
-const S3_TRITON_ROOT string = "/opt/s3_triton/"
+// S3_TRITON_ROOT holds the meta data, patches and journals of every backed up file.
+// Tests point it at a temporary directory.
+var S3_TRITON_ROOT string = "/opt/s3_triton/"
 
 type SHAValue [20]byte
 
@@ -48,10 +51,11 @@ type RDiffBlock struct {
 }
 
 type FileMetaData struct {
-	Backuptime int64       `json:"backuptime, string"`
-	Atime int64            `json:"atime, string"`
-	Mtime int64            `json:"mtime, string"`
-	Ctime int64            `json:"ctime, string"`
+	SchemaVersion int      `json:"schema_version"`
+	Backuptime int64       `json:"backuptime"`
+	Atime int64            `json:"atime"`
+	Mtime int64            `json:"mtime"`
+	Ctime int64            `json:"ctime"`
 	FileSize int64          `json:"file_size"`
 	PatchSize int64         `json:"patch_size"`
 	PatchType int8         `json:"patch_type"`
@@ -247,6 +251,10 @@ func GetFileMetaData(filepath string) (metadata FileMetaData, err error) {
 		return
 	}
 	
+	if jsondata, _, err = MigrateMetaData(jsondata); err != nil {
+		return
+	}
+	
 	err = json.Unmarshal(jsondata, &metadata)	
 	return
 }
@@ -271,6 +279,43 @@ func IsBaseline(filepath string) (isBaseline bool) {
 
 func UpdateFileMetaData(filepath string, state []RDiffBlock, prevPatchHash SHAValue, isBaseline bool)  (err error) {
 	
+	var fileStat syscall.Stat_t
+	var patchType int8
+	var hash []byte
+	
+	if isBaseline == false {
+		patchType = FORMAT_PATCH
+		patchFilePath := S3_TRITON_ROOT + filepath + ".patch"
+					
+		if err = syscall.Stat(patchFilePath, &fileStat); err != nil {
+			return
+		}
+		
+		if hash, err = GetFileHash(patchFilePath); err != nil {
+			return
+		}
+	} else {
+		patchType = FORMAT_BASELINE
+		
+		if err = syscall.Stat(filepath, &fileStat); err != nil {
+			return
+		}
+		
+		if hash, err = GetFileHash(filepath); err != nil {
+			return
+		}
+	}
+	
+	var patchHash SHAValue
+	copy(patchHash[:], hash)
+	
+	err = writeFileMetaData(filepath, state, patchType, fileStat.Size, patchHash, prevPatchHash)
+	return
+}
+
+// writeFileMetaData records that filepath, as it is now, is stored as the patchSize bytes object patchHash.
+func writeFileMetaData(filepath string, state []RDiffBlock, patchType int8, patchSize int64, patchHash SHAValue, prevPatchHash SHAValue) (err error) {
+	
 	var fileStat syscall.Stat_t
 	if err = syscall.Stat(filepath, &fileStat); err != nil {
 		return
@@ -283,41 +328,18 @@ func UpdateFileMetaData(filepath string, state []RDiffBlock, prevPatchHash SHAVa
 		return
 	}
 		
-	metaData := &FileMetaData{}	
+	metaData := &FileMetaData{SchemaVersion: METADATA_SCHEMA_VERSION}	
 	metaData.Atime = fileStat.Atim.Nano() / int64(math.Pow(10, 9))
 	metaData.Mtime = fileStat.Mtim.Nano() / int64(math.Pow(10, 9))
 	metaData.Ctime = fileStat.Ctim.Nano() / int64(math.Pow(10, 9))
 	metaData.Backuptime = time.Now().Unix()
 	metaData.FileSize = fileStat.Size
+	metaData.PatchType = patchType
+	metaData.PatchSize = patchSize
+	metaData.PatchHash = patchHash
 	
-	patchFilePath := S3_TRITON_ROOT + filepath + ".patch"
-	
-	if isBaseline == false {
-		metaData.PatchType = FORMAT_PATCH
-					
-		if err = syscall.Stat(patchFilePath, &fileStat); err != nil {
-			return
-		}
-		
-		metaData.PatchSize = fileStat.Size
-		
-		copy(metaData.PrevPatchHash[:], prevPatchHash[:])
-		
-		var hash []byte
-		if hash, err = GetFileHash(patchFilePath); err != nil {
-			return
-		}
-		copy(metaData.PatchHash[:], hash)
-		
-	} else {
-		metaData.PatchType = FORMAT_BASELINE	
-		metaData.PatchSize = metaData.FileSize
-		
-		var hash []byte
-		if hash, err = GetFileHash(filepath); err != nil {
-			return
-		}
-		copy(metaData.PatchHash[:], hash)
+	if patchType != FORMAT_BASELINE {
+		metaData.PrevPatchHash = prevPatchHash
 	}
 	
 	if state != nil && len(state) > 0 {
@@ -338,34 +360,15 @@ func UpdateFileMetaData(filepath string, state []RDiffBlock, prevPatchHash SHAVa
 }
 
 
-func MergePatch(base string, patch string) (err error) {
-	
-	var fileStat syscall.Stat_t
-	if err = syscall.Stat(base, &fileStat); err != nil {
-		return
-	}
-	
-	basefileSize := fileStat.Size
-	
-	var basefile *os.File	
-	if basefile, err = os.OpenFile(base, os.O_WRONLY, 0666); err != nil {
-		return
-	}
-	defer basefile.Close()
-	
-	var patchfile *os.File
-	if patchfile, err = os.Open(patch); err != nil {
-		return
-	}
-	defer patchfile.Close()
-	
-	patchFileReader := bufio.NewReader(patchfile)
+// ReadPatchTable reads the record table at the head of a patch file, headerSize is where the patch data starts.
+func ReadPatchTable(reader *bufio.Reader) (patches []Patch, headerSize int64, err error) {
 	
 	var strline string
-	strline, err = patchFileReader.ReadString('\n') 
-	if err != nil && err != io.EOF {
+	strline, err = reader.ReadString('\n') 
+	if err != nil {
 		return
 	}
+	headerSize += int64(len(strline))
 	
 	patchlineCnt := int64(0) 
 	if patchlineCnt, err= strconv.ParseInt(strline[:len(strline) - 1], 10, 64); err != nil {
@@ -374,13 +377,12 @@ func MergePatch(base string, patch string) (err error) {
 	
 	slog.Infof("patch line is %d\n", patchlineCnt)
 	
-	var patchlines []Patch
-	
 	for i := int64(0); i < patchlineCnt; i++ {
-		strline, err = patchFileReader.ReadString('\n') 
-		if err != nil && err != io.EOF {
+		strline, err = reader.ReadString('\n') 
+		if err != nil {
 			return
 		}
+		headerSize += int64(len(strline))
 		
 		fields := strings.Split(strline[:len(strline) - 1], ":")
 		
@@ -399,7 +401,39 @@ func MergePatch(base string, patch string) (err error) {
 			return
 		}
 		
-		patchlines = append(patchlines, Patch{Offset: offset, Size: size, Type: int8(patchType)})
+		patches = append(patches, Patch{Offset: offset, Size: size, Type: int8(patchType)})
+	}
+	
+	return
+}
+
+
+func MergePatch(base string, patch string) (err error) {
+	
+	var fileStat syscall.Stat_t
+	if err = syscall.Stat(base, &fileStat); err != nil {
+		return
+	}
+	
+	basefileSize := fileStat.Size
+	
+	var basefile *os.File	
+	if basefile, err = os.OpenFile(base, os.O_WRONLY, 0666); err != nil {
+		return
+	}
+	defer basefile.Close()
+	
+	var patchfile *os.File
+	if patchfile, err = os.Open(patch); err != nil {
+		return
+	}
+	defer patchfile.Close()
+	
+	patchFileReader := bufio.NewReader(patchfile)
+	
+	var patchlines []Patch
+	if patchlines, _, err = ReadPatchTable(patchFileReader); err != nil {
+		return
 	}
 	
 	slog.Infoln(patchlines)
@@ -414,10 +448,17 @@ func MergePatch(base string, patch string) (err error) {
 			return
 		}
 		
-		rc, err = patchFileReader.Read(buf)
-		if err != nil && err != io.EOF {
+		if patchline.Size > int64(len(buf)) {
+			err = errors.Errorf("patch line %d is larger than a block", i)
+			return
+		}
+		
+		// A single Read stops short where the bufio buffer runs out.
+		rc, err = io.ReadFull(patchFileReader, buf[:patchline.Size])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 			return
 		}
+		err = nil
 		if int64(rc) != patchline.Size {
 			slog.Errorf("failed at %d patch line, rc = %d, patch size = %d", i, rc, patchline.Size)
 			err = errors.New("patchline size mismatched")
@@ -509,30 +550,15 @@ func CreateRangeFile(filepath string, patches []Patch) (err error) {
 }
 
 
-func CreatePatch(filepath string) (err error) {
+// diffFile compares the blocks of filepath with the state its meta data recorded, no patches
+// means nothing changed. A file that got shorter ends its patches with a PATCH_TRUNCATE.
+func diffFile(filepath string) (rdiffBlocks []RDiffBlock, metadata FileMetaData, patches []Patch, err error) {
 	
-	var fileStat syscall.Stat_t
-	if err = syscall.Stat(filepath, &fileStat); err != nil {
-		slog.Error(err)
-		return
-	}
-	
-	isBaseline := IsBaseline(filepath)	
-	
-	var rdiffBlocks []RDiffBlock
 	if rdiffBlocks, err = MakeRDiffBlocks(filepath); err != nil && err != io.EOF {
 		slog.Error(err)
 		return
 	}
 	
-	if isBaseline {
-		if err = UpdateFileMetaData(filepath, rdiffBlocks, SHAValue{}, true); err != nil {
-			slog.Error(err)
-		}
-		return
-	}
-	
-	var metadata FileMetaData
 	if metadata, err = GetFileMetaData(filepath); err != nil {
 		slog.Error(err)
 		return
@@ -544,8 +570,6 @@ func CreatePatch(filepath string) (err error) {
 	fileSize := rdiffBlocks[curRdiffLen - 1].Offset + rdiffBlocks[curRdiffLen - 1].Size
 	minLen := Minimum(curRdiffLen, orgRdiffLen).(int)
 	
-	var patches []Patch
-	
 	for i := 0; i < minLen; i++ {
 		if 	rdiffBlocks[i].Signature != metadata.PatchState[i].Signature {
 			patches = append(patches, Patch{rdiffBlocks[i].Offset, rdiffBlocks[i].Size, PATCH_CHANGE})
@@ -553,15 +577,6 @@ func CreatePatch(filepath string) (err error) {
 	}
 	
 	if curRdiffLen == orgRdiffLen && len(patches) == 0 {		
-		if _, err := os.Stat(S3_TRITON_ROOT + filepath + ".patch"); os.IsNotExist(err) {
-			isBaseline = true
-		} else if err == nil {
-			isBaseline = false
-		}			
-		
-		if err = UpdateFileMetaData(filepath, rdiffBlocks, metadata.PatchHash, isBaseline); err != nil {
-			slog.Error(err)
-		}		
 		return
 	}
 	
@@ -572,26 +587,25 @@ func CreatePatch(filepath string) (err error) {
 	} else if orgRdiffLen >= minLen {
 		patches = append(patches, Patch{fileSize, 0, PATCH_TRUNCATE})
 	}
+	return
+}
 
-	patchFile := S3_TRITON_ROOT + filepath + ".patch"
+// writePatch writes the patch table and then the changed blocks of filepath to w.
+func writePatch(w io.Writer, filepath string, patches []Patch) (err error) {
 	
-	var infile *os.File
-	var outfile *os.File
+	table := strconv.Itoa(len(patches)) + "\n"
 	
-	if outfile, err = os.OpenFile(patchFile, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0666); err != nil {
-		slog.Error(err)
-		return
+	for _, patch := range patches {
+		table += strconv.FormatInt(patch.Offset, 10) + ":" + strconv.FormatInt(patch.Size, 10) + ":" +
+			     strconv.FormatInt(int64(patch.Type), 10) + "\n"
 	}
-	defer outfile.Close()
-	outfile.WriteString(strconv.Itoa(len(patches)) + "\n")
 	
-	for _, patch := range patches {
-		outfile.WriteString(strconv.FormatInt(patch.Offset, 10) + ":" + strconv.FormatInt(patch.Size, 10) + ":" +
-			                strconv.FormatInt(int64(patch.Type), 10) + "\n")
+	if _, err = io.WriteString(w, table); err != nil {
+		return
 	}
 	
+	var infile *os.File
 	if infile, err = os.Open(filepath); err != nil {
-		slog.Error(err)
 		return
 	}
 	defer infile.Close()
@@ -606,7 +620,6 @@ func CreatePatch(filepath string) (err error) {
 		var rc int
 		rc, err = infile.ReadAt(buf, patch.Offset)
 		if err != nil && err != io.EOF {
-			slog.Error(err)
 			return
 		}
 		
@@ -614,7 +627,72 @@ func CreatePatch(filepath string) (err error) {
 			buf = buf[:rc]
 		}
 			
-		outfile.Write(buf)
+		if _, err = w.Write(buf); err != nil {
+			return
+		}
+	}
+	
+	err = nil
+	return
+}
+
+func CreatePatch(filepath string) (err error) {
+	
+	var fileStat syscall.Stat_t
+	if err = syscall.Stat(filepath, &fileStat); err != nil {
+		slog.Error(err)
+		return
+	}
+	
+	isBaseline := IsBaseline(filepath)	
+	
+	if isBaseline {
+		var rdiffBlocks []RDiffBlock
+		if rdiffBlocks, err = MakeRDiffBlocks(filepath); err != nil && err != io.EOF {
+			slog.Error(err)
+			return
+		}
+		
+		if err = UpdateFileMetaData(filepath, rdiffBlocks, SHAValue{}, true); err != nil {
+			slog.Error(err)
+		}
+		return
+	}
+	
+	var rdiffBlocks []RDiffBlock
+	var metadata FileMetaData
+	var patches []Patch
+	
+	if rdiffBlocks, metadata, patches, err = diffFile(filepath); err != nil {
+		return
+	}
+	
+	if len(patches) == 0 {		
+		if _, err := os.Stat(S3_TRITON_ROOT + filepath + ".patch"); os.IsNotExist(err) {
+			isBaseline = true
+		} else if err == nil {
+			isBaseline = false
+		}			
+		
+		if err = UpdateFileMetaData(filepath, rdiffBlocks, metadata.PatchHash, isBaseline); err != nil {
+			slog.Error(err)
+		}		
+		return
+	}
+
+	patchFile := S3_TRITON_ROOT + filepath + ".patch"
+	
+	var outfile *os.File
+	
+	if outfile, err = os.OpenFile(patchFile, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0666); err != nil {
+		slog.Error(err)
+		return
+	}
+	defer outfile.Close()
+	
+	if err = writePatch(outfile, filepath, patches); err != nil {
+		slog.Error(err)
+		return
 	}
 	
 	if err = outfile.Sync(); err != nil {
@@ -633,3 +711,71 @@ func CreatePatch(filepath string) (err error) {
 	
 	return
 }
+
+type hashingWriter struct {
+	writer io.Writer
+	hash hash.Hash
+	size int64
+}
+
+func (hw *hashingWriter) Write(p []byte) (n int, err error) {
+	n, err = hw.writer.Write(p)
+	hw.hash.Write(p[:n])
+	hw.size += int64(n)
+	return
+}
+
+// CreatePatchStream is CreatePatch writing the patch to w rather than to S3_TRITON_ROOT/<file>.patch,
+// hashing it on the way for the meta data, so a big patch never has to fit on local disk.
+// streamed is false for a baseline, which is the file itself, and for an unchanged file, which
+// stays stored as the object its meta data already names.
+func CreatePatchStream(filepath string, w io.Writer) (streamed bool, err error) {
+	
+	if IsBaseline(filepath) {
+		err = CreatePatch(filepath)
+		return
+	}
+	
+	var rdiffBlocks []RDiffBlock
+	var metadata FileMetaData
+	var patches []Patch
+	
+	if rdiffBlocks, metadata, patches, err = diffFile(filepath); err != nil {
+		return
+	}
+	
+	if len(patches) == 0 {
+		if err = writeFileMetaData(filepath, rdiffBlocks, metadata.PatchType, metadata.PatchSize, metadata.PatchHash, metadata.PatchHash); err != nil {
+			slog.Error(err)
+		}
+		return
+	}
+	
+	hw := &hashingWriter{writer: w, hash: sha1.New()}
+	
+	if err = writePatch(hw, filepath, patches); err != nil {
+		slog.Error(err)
+		return
+	}
+	
+	streamed = true
+	
+	if err = CreateRangeFile(filepath, patches); err != nil {
+		slog.Error(err)
+		return
+	}
+	
+	// A .patch left by an earlier put describes another version now.
+	if err = os.Remove(S3_TRITON_ROOT + filepath + ".patch"); err != nil && os.IsNotExist(err) == false {
+		slog.Error(err)
+		return
+	}
+	
+	var patchHash SHAValue
+	copy(patchHash[:], hw.hash.Sum(nil))
+	
+	if err = writeFileMetaData(filepath, rdiffBlocks, FORMAT_PATCH, hw.size, patchHash, metadata.PatchHash); err != nil {
+		slog.Error(err)
+	}
+	return
+}
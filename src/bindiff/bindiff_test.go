@@ -1,8 +1,12 @@
 package bindiff
 
 import (
+	"os"
 	"flag"
+	"bytes"
 	"testing"
+	"io/ioutil"
+	"crypto/sha1"
 )
 
 var filename = flag.String("f", "", "test file name")
@@ -41,3 +45,73 @@ func TestGetMetaData(t *testing.T) {
 	t.Logf("file hash is %x", metadata.PatchHash)
 }
 
+func TestCreatePatchStream(t *testing.T) {
+
+	root, rootCleanup := tempRoot(t)
+	defer rootCleanup()
+
+	dir, err := ioutil.TempDir("", "bindiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	original := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	changed := append(append([]byte{}, original[:12000]...), []byte("changed tail")...)
+	changed[700] = 'x'
+
+	// The same change goes through CreatePatch in one copy and CreatePatchStream in the other.
+	onDisk, streamedPath := dir + "/disk", dir + "/stream"
+
+	for _, path := range []string{onDisk, streamedPath} {
+		if err = ioutil.WriteFile(path, original, 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = CreatePatch(path); err != nil {
+			t.Fatalf("Fail to create meta data under %s: %s", root, err.Error())
+		}
+
+		if err = ioutil.WriteFile(path, changed, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = CreatePatch(onDisk); err != nil {
+		t.Fatalf("Fail to create patch of %s: %s", onDisk, err.Error())
+	}
+
+	var stream bytes.Buffer
+	streamed, err := CreatePatchStream(streamedPath, &stream)
+	if err != nil || streamed == false {
+		t.Fatalf("Fail to stream patch of %s, streamed %v: %v", streamedPath, streamed, err)
+	}
+
+	patch, err := ioutil.ReadFile(S3_TRITON_ROOT + onDisk + ".patch")
+	if err != nil || bytes.Equal(patch, stream.Bytes()) == false {
+		t.Fatalf("Streamed patch differs from the one on disk: %v", err)
+	}
+
+	if _, err = os.Stat(S3_TRITON_ROOT + streamedPath + ".patch"); os.IsNotExist(err) == false {
+		t.Errorf("Streaming left a .patch behind: %v", err)
+	}
+
+	metadata, err := GetFileMetaData(streamedPath)
+	if err != nil {
+		t.Fatalf("Fail to get meta data of %s: %s", streamedPath, err.Error())
+	}
+
+	if sum := sha1.Sum(patch); metadata.PatchType != FORMAT_PATCH || metadata.PatchHash != SHAValue(sum) || metadata.PatchSize != int64(len(patch)) {
+		t.Errorf("Streamed meta data is %d %x %d", metadata.PatchType, metadata.PatchHash, metadata.PatchSize)
+	}
+
+	// Unchanged since, the file stays stored as the patch just streamed.
+	stream.Reset()
+	if streamed, err = CreatePatchStream(streamedPath, &stream); err != nil || streamed || stream.Len() > 0 {
+		t.Fatalf("Unchanged file streamed %v %d bytes: %v", streamed, stream.Len(), err)
+	}
+
+	if again, err := GetFileMetaData(streamedPath); err != nil || again.PatchHash != metadata.PatchHash || again.PatchType != FORMAT_PATCH {
+		t.Errorf("Unchanged file meta data is %x: %v", again.PatchHash, err)
+	}
+}
@@ -0,0 +1,205 @@
+package bindiff
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"syscall"
+	"strings"
+	"strconv"
+	"io/ioutil"
+
+	"../slog"
+	"github.com/pkg/errors"
+)
+
+// A negative wait blocks until the lock is granted.
+const LOCK_WAIT_FOREVER = time.Duration(-1)
+
+const LOCK_POLL_INTERVAL = 100 * time.Millisecond
+
+// REPOSITORY_LOCK is kept under S3_TRITON_ROOT, next to the meta data it guards.
+const REPOSITORY_LOCK string = ".repository.lock"
+
+var ErrLockTimeout = errors.New("Timed out waiting for lock")
+
+type FileLock struct {
+	Path string
+	file *os.File
+}
+
+type LockHolder struct {
+	Pid int
+	Host string
+	Since time.Time
+}
+
+
+func (holder LockHolder) String() string {
+	return fmt.Sprintf("pid %d on %s since %s", holder.Pid, holder.Host, holder.Since.Format(time.RFC3339))
+}
+
+func ReadLockHolder(path string) (holder LockHolder, err error) {
+
+	var data []byte
+	if data, err = ioutil.ReadFile(path); err != nil {
+		return
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 3 {
+		err = errors.Errorf("Invalid lock file %s", path)
+		return
+	}
+
+	if holder.Pid, err = strconv.Atoi(fields[0]); err != nil {
+		return
+	}
+
+	holder.Host = fields[1]
+
+	var since int64
+	if since, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+		return
+	}
+	holder.Since = time.Unix(since, 0)
+	return
+}
+
+// A holder is stale when it is a process on this host that no longer exists. The kernel
+// dropped its flock when it died, so whoever blocks a lock with a stale holder is a shared
+// holder that hasn't cleared the file yet, or a process on another host of an NFS root.
+func (holder LockHolder) Stale() bool {
+
+	host, err := os.Hostname()
+	if err != nil || host != holder.Host || holder.Pid <= 0 {
+		return false
+	}
+
+	return syscall.Kill(holder.Pid, 0) == syscall.ESRCH
+}
+
+
+func tryLock(path string, how int) (file *os.File, locked bool, err error) {
+
+	if file, err = os.OpenFile(path, os.O_RDWR | os.O_CREATE, 0666); err != nil {
+		return
+	}
+
+	if err = syscall.Flock(int(file.Fd()), how | syscall.LOCK_NB); err != nil {
+		file.Close()
+		file = nil
+
+		if err == syscall.EWOULDBLOCK {
+			err = nil
+		}
+		return
+	}
+
+	// The file may have been removed by hand while we were locking it, then the lock is worthless.
+	var fileStat, pathStat syscall.Stat_t
+	if err = syscall.Fstat(int(file.Fd()), &fileStat); err == nil {
+		err = syscall.Stat(path, &pathStat)
+	}
+
+	if err != nil || fileStat.Ino != pathStat.Ino || fileStat.Dev != pathStat.Dev {
+		file.Close()
+		file = nil
+
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	locked = true
+	return
+}
+
+// LockPath takes a flock on path, exclusive or shared, waiting up to wait for it.
+func LockPath(path string, exclusive bool, wait time.Duration) (lock *FileLock, err error) {
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	if lastSlash := strings.LastIndex(path, "/"); lastSlash > 0 {
+		if err = CreateDirIfNotExist(path[:lastSlash]); err != nil {
+			return
+		}
+	}
+
+	deadline := time.Now().Add(wait)
+
+	for {
+		var file *os.File
+		var locked bool
+
+		if file, locked, err = tryLock(path, how); err != nil {
+			slog.Errorf("Fail to lock %s: %s", path, err.Error())
+			return
+		}
+
+		if locked {
+			lock = &FileLock{Path: path, file: file}
+
+			// Shared holders clear what a crashed exclusive holder left, so it can't be taken for stale.
+			file.Truncate(0)
+			if exclusive {
+				host, _ := os.Hostname()
+				file.WriteAt([]byte(fmt.Sprintf("%d %s %d\n", os.Getpid(), host, time.Now().Unix())), 0)
+			}
+			return
+		}
+
+		if wait >= 0 && time.Now().After(deadline) {
+			// The lock file is never removed, a new inode would let a second holder in
+			// next to one still running. The recorded holder is only reported.
+			holder, holderErr := ReadLockHolder(path)
+
+			if holderErr == nil && holder.Stale() {
+				err = errors.Wrapf(ErrLockTimeout, "%s was last held by %s, which is gone, and is held by another process now", path, holder)
+			} else if holderErr == nil {
+				err = errors.Wrapf(ErrLockTimeout, "%s is held by %s", path, holder)
+			} else {
+				err = errors.Wrapf(ErrLockTimeout, "%s", path)
+			}
+			return
+		}
+
+		time.Sleep(LOCK_POLL_INTERVAL)
+	}
+}
+
+// LockFile serializes backups of filepath, it guards the .patch, .range and .meta files.
+func LockFile(filepath string, wait time.Duration) (lock *FileLock, err error) {
+	return LockPath(S3_TRITON_ROOT + filepath + ".lock", true, wait)
+}
+
+// RepositoryLockPath follows S3_TRITON_ROOT, so a repository moved elsewhere brings its lock along.
+func RepositoryLockPath() string {
+	return S3_TRITON_ROOT + REPOSITORY_LOCK
+}
+
+// LockRepository is taken shared by backups and exclusive by maintenance commands.
+func LockRepository(exclusive bool, wait time.Duration) (lock *FileLock, err error) {
+	return LockPath(RepositoryLockPath(), exclusive, wait)
+}
+
+func (lock *FileLock) Unlock() (err error) {
+
+	if lock == nil || lock.file == nil {
+		return
+	}
+
+	lock.file.Truncate(0)
+	
+	if err = syscall.Flock(int(lock.file.Fd()), syscall.LOCK_UN); err != nil {
+		slog.Errorf("Fail to unlock %s: %s", lock.Path, err.Error())
+	}
+
+	lock.file.Close()
+	lock.file = nil
+	return
+}
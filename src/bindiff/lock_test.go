@@ -0,0 +1,159 @@
+package bindiff
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"syscall"
+	"testing"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// tempRoot points S3_TRITON_ROOT at a temporary directory until cleanup.
+func tempRoot(t *testing.T) (root string, cleanup func()) {
+
+	dir, err := ioutil.TempDir("", "s3_triton")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := S3_TRITON_ROOT
+	S3_TRITON_ROOT = dir + "/"
+
+	root = S3_TRITON_ROOT
+	cleanup = func() {
+		S3_TRITON_ROOT = saved
+		os.RemoveAll(dir)
+	}
+	return
+}
+
+func TestLockPath(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bindiff_lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/test.lock"
+
+	first, err := LockPath(path, true, 0)
+	if err != nil {
+		t.Fatalf("Fail to lock %s: %s", path, err.Error())
+	}
+
+	holder, err := ReadLockHolder(path)
+	if err != nil || holder.Pid != os.Getpid() {
+		t.Errorf("Lock holder is %v: %v", holder, err)
+	}
+
+	if _, err = LockPath(path, true, 2 * LOCK_POLL_INTERVAL); errors.Cause(err) != ErrLockTimeout {
+		t.Errorf("Second exclusive lock should time out, got %v", err)
+	}
+
+	if _, err = LockPath(path, false, 0); errors.Cause(err) != ErrLockTimeout {
+		t.Errorf("Shared lock should time out while exclusive is held, got %v", err)
+	}
+
+	first.Unlock()
+
+	shared, err := LockPath(path, false, 0)
+	if err != nil {
+		t.Fatalf("Fail to take shared lock: %s", err.Error())
+	}
+	defer shared.Unlock()
+
+	another, err := LockPath(path, false, 0)
+	if err != nil {
+		t.Fatalf("Fail to take a second shared lock: %s", err.Error())
+	}
+	another.Unlock()
+
+	if _, err = LockPath(path, true, 0); errors.Cause(err) != ErrLockTimeout {
+		t.Errorf("Exclusive lock should time out while shared is held, got %v", err)
+	}
+}
+
+func TestLockPathKeepsStaleFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bindiff_lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/test.lock"
+
+	shared, err := LockPath(path, false, 0)
+	if err != nil {
+		t.Fatalf("Fail to take shared lock: %s", err.Error())
+	}
+	defer shared.Unlock()
+
+	// What a crashed exclusive holder leaves behind before the shared holder clears it.
+	host, _ := os.Hostname()
+	if err = ioutil.WriteFile(path, []byte(fmt.Sprintf("%d %s %d\n", 1 << 22 + 1, host, time.Now().Unix())), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	var before, after syscall.Stat_t
+	syscall.Stat(path, &before)
+
+	if _, err = LockPath(path, true, 2 * LOCK_POLL_INTERVAL); errors.Cause(err) != ErrLockTimeout {
+		t.Errorf("Exclusive lock next to a shared holder should time out, got %v", err)
+	}
+
+	if err = syscall.Stat(path, &after); err != nil || after.Ino != before.Ino {
+		t.Errorf("Lock file with a stale holder was replaced: %v", err)
+	}
+}
+
+func TestLockRepository(t *testing.T) {
+
+	root, cleanup := tempRoot(t)
+	defer cleanup()
+
+	backup, err := LockRepository(false, 0)
+	if err != nil {
+		t.Fatalf("Fail to lock repository under %s: %s", root, err.Error())
+	}
+
+	if RepositoryLockPath() != root + REPOSITORY_LOCK {
+		t.Errorf("Repository lock is %s, not under %s", RepositoryLockPath(), root)
+	}
+
+	another, err := LockRepository(false, 0)
+	if err != nil {
+		t.Fatalf("Backups should share the repository: %s", err.Error())
+	}
+	another.Unlock()
+
+	if _, err = LockRepository(true, 0); errors.Cause(err) != ErrLockTimeout {
+		t.Errorf("Maintenance should wait for backups, got %v", err)
+	}
+	backup.Unlock()
+
+	maintenance, err := LockRepository(true, 0)
+	if err != nil {
+		t.Fatalf("Fail to lock repository for maintenance: %s", err.Error())
+	}
+
+	if holder, err := ReadLockHolder(root + REPOSITORY_LOCK); err != nil || holder.Pid != os.Getpid() {
+		t.Errorf("Repository lock holder is %v: %v", holder, err)
+	}
+	maintenance.Unlock()
+
+	// A file lock lives next to the meta data of the file.
+	file, err := LockFile("/some/dir/file", 0)
+	if err != nil || file.Path != root + "/some/dir/file.lock" {
+		t.Fatalf("File lock is %v: %v", file, err)
+	}
+	defer file.Unlock()
+
+	if _, err = LockFile("/some/dir/file", 0); errors.Cause(err) != ErrLockTimeout {
+		t.Errorf("Second lock of the file should time out, got %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package bindiff
+
+import (
+	"bytes"
+	"strconv"
+	"io/ioutil"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+
+	"../journal"
+)
+
+// Bump METADATA_SCHEMA_VERSION together with registering the migration from the previous version.
+const METADATA_SCHEMA_VERSION = 1
+
+// A MetaDataMigration upgrades a decoded .meta document by exactly one schema version.
+type MetaDataMigration func(doc map[string]interface{}) error
+
+var metaDataMigrations = map[int]MetaDataMigration{}
+
+
+func init() {
+	RegisterMetaDataMigration(0, migrateMetaDataV0)
+}
+
+
+func RegisterMetaDataMigration(fromVersion int, migration MetaDataMigration) {
+	metaDataMigrations[fromVersion] = migration
+}
+
+// Documents without a schema version used `json:"backuptime, string"` style tags, the
+// space made the string option a no-op, but accept quoted times anyway.
+func migrateMetaDataV0(doc map[string]interface{}) (err error) {
+
+	for _, key := range []string{"backuptime", "atime", "mtime", "ctime"} {
+		value, ok := doc[key].(string)
+		if ok == false {
+			continue
+		}
+
+		var number int64
+		if number, err = strconv.ParseInt(value, 10, 64); err != nil {
+			err = errors.Errorf("Invalid %s: %s", key, value)
+			return
+		}
+		doc[key] = json.Number(strconv.FormatInt(number, 10))
+	}
+	return
+}
+
+
+func MetaDataSchemaVersion(doc map[string]interface{}) (version int, err error) {
+
+	value, ok := doc["schema_version"]
+	if ok == false {
+		return
+	}
+
+	number, ok := value.(json.Number)
+	if ok == false {
+		err = errors.Errorf("Invalid schema version: %v", value)
+		return
+	}
+
+	var version64 int64
+	if version64, err = number.Int64(); err != nil {
+		return
+	}
+
+	version = int(version64)
+	return
+}
+
+// MigrateMetaData upgrades jsondata to METADATA_SCHEMA_VERSION, it is returned untouched when already current.
+func MigrateMetaData(jsondata []byte) (migrated []byte, fromVersion int, err error) {
+
+	doc := map[string]interface{}{}
+
+	decoder := json.NewDecoder(bytes.NewReader(jsondata))
+	decoder.UseNumber()
+
+	if err = decoder.Decode(&doc); err != nil {
+		return
+	}
+
+	if fromVersion, err = MetaDataSchemaVersion(doc); err != nil {
+		return
+	}
+
+	if fromVersion > METADATA_SCHEMA_VERSION {
+		err = errors.Errorf("Meta data schema version %d is newer than supported version %d", fromVersion, METADATA_SCHEMA_VERSION)
+		return
+	}
+
+	if fromVersion == METADATA_SCHEMA_VERSION {
+		migrated = jsondata
+		return
+	}
+
+	for version := fromVersion; version < METADATA_SCHEMA_VERSION; version++ {
+		migration, ok := metaDataMigrations[version]
+		if ok == false {
+			err = errors.Errorf("No meta data migration from schema version %d", version)
+			return
+		}
+
+		if err = migration(doc); err != nil {
+			return
+		}
+		doc["schema_version"] = version + 1
+	}
+
+	migrated, err = json.Marshal(doc)
+	return
+}
+
+// MigrateMetaDataFile rewrites the .meta file at metaFilePath in the current schema unless dryRun is set.
+func MigrateMetaDataFile(metaFilePath string, dryRun bool) (fromVersion int, err error) {
+
+	var jsondata []byte
+	if jsondata, err = ioutil.ReadFile(metaFilePath); err != nil {
+		return
+	}
+
+	var migrated []byte
+	if migrated, fromVersion, err = MigrateMetaData(jsondata); err != nil {
+		return
+	}
+
+	if dryRun || fromVersion == METADATA_SCHEMA_VERSION {
+		return
+	}
+
+	// Round trip through FileMetaData so the file is written exactly as UpdateFileMetaData would.
+	var metadata FileMetaData
+	if err = json.Unmarshal(migrated, &metadata); err != nil {
+		return
+	}
+
+	if migrated, err = json.Marshal(metadata); err != nil {
+		return
+	}
+
+	// A crash must leave the old meta data or the new, never an empty file.
+	err = journal.WriteFileDurable(metaFilePath, migrated)
+	return
+}
@@ -0,0 +1,52 @@
+package bindiff
+
+import (
+	"testing"
+	"encoding/json"
+)
+
+const metaDataV0 = `{"backuptime":1500000000,"atime":"1500000001","mtime":1500000002,"ctime":1500000003,` +
+                   `"file_size":1024,"patch_size":1024,"patch_type":0,"prev_patch_hash":"",` +
+                   `"patch_hash":"0123456789abcdef0123456789abcdef01234567",` +
+                   `"patch_state":["0:512:0123456789abcdef0123456789abcdef01234567"]}`
+
+func TestMigrateMetaData(t *testing.T) {
+
+	migrated, fromVersion, err := MigrateMetaData([]byte(metaDataV0))
+	if err != nil {
+		t.Fatalf("Fail to migrate meta data: %s", err.Error())
+	}
+
+	if fromVersion != 0 {
+		t.Errorf("Schema version is %d, expected 0", fromVersion)
+	}
+
+	var metadata FileMetaData
+	if err = json.Unmarshal(migrated, &metadata); err != nil {
+		t.Fatalf("Fail to parse migrated meta data: %s", err.Error())
+	}
+
+	if metadata.SchemaVersion != METADATA_SCHEMA_VERSION {
+		t.Errorf("Migrated schema version is %d", metadata.SchemaVersion)
+	}
+
+	if metadata.Backuptime != 1500000000 || metadata.Atime != 1500000001 || metadata.FileSize != 1024 {
+		t.Errorf("Migrated meta data is wrong: %v", metadata)
+	}
+
+	if len(metadata.PatchState) != 1 || metadata.PatchState[0].Size != 512 {
+		t.Errorf("Migrated patch state is wrong: %v", metadata.PatchState)
+	}
+
+	again, fromVersion, err := MigrateMetaData(migrated)
+	if err != nil || fromVersion != METADATA_SCHEMA_VERSION || string(again) != string(migrated) {
+		t.Errorf("Current meta data should be left untouched, from %d: %v", fromVersion, err)
+	}
+}
+
+func TestMigrateMetaDataFromFuture(t *testing.T) {
+
+	if _, _, err := MigrateMetaData([]byte(`{"schema_version":1000}`)); err == nil {
+		t.Error("Meta data newer than supported should be rejected")
+	}
+}
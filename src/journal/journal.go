@@ -0,0 +1,251 @@
+package journal
+
+import (
+	"io"
+	"os"
+	"time"
+	"strings"
+	"strconv"
+	"io/ioutil"
+	"encoding/json"
+	"github.com/pkg/errors"
+
+	"../slog"
+)
+
+// Stages of a put, every one of them is on disk before the next step starts.
+const (
+	STAGE_BEGIN = "begin"
+	STAGE_PREPARED = "prepared"
+	STAGE_UPLOADED = "uploaded"
+	STAGE_POSTED = "posted"
+)
+
+type Snapshot struct {
+	Path string     `json:"path"`
+	Saved string    `json:"saved,omitempty"`
+	Existed bool    `json:"existed"`
+}
+
+type Journal struct {
+	Path string           `json:"-"`
+	Filepath string       `json:"filepath"`
+	Stage string          `json:"stage"`
+	ObjectId string       `json:"object_id,omitempty"`
+	Snapshots []Snapshot  `json:"snapshots"`
+	Started int64         `json:"started"`
+	Updated int64         `json:"updated"`
+}
+
+
+func init() {
+	err := slog.SetSyslog("journal")
+	if err != nil {
+		slog.Error(err)
+	}
+}
+
+
+func syncDir(dir string) (err error) {
+
+	var file *os.File
+	if file, err = os.Open(dir); err != nil {
+		return
+	}
+	defer file.Close()
+
+	err = file.Sync()
+	return
+}
+
+func dirOf(path string) string {
+
+	if lastSlash := strings.LastIndex(path, "/"); lastSlash > 0 {
+		return path[:lastSlash]
+	}
+	return "."
+}
+
+// WriteFileDurable replaces path with data so that either the old or the new content survives a crash.
+func WriteFileDurable(path string, data []byte) (err error) {
+
+	tmpPath := path + ".tmp"
+
+	var file *os.File
+	if file, err = os.OpenFile(tmpPath, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0666); err != nil {
+		return
+	}
+
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmpPath)
+		return
+	}
+
+	if err = os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return
+	}
+
+	err = syncDir(dirOf(path))
+	return
+}
+
+func copyFileDurable(src string, dst string) (err error) {
+
+	var infile, outfile *os.File
+
+	if infile, err = os.Open(src); err != nil {
+		return
+	}
+	defer infile.Close()
+
+	if outfile, err = os.OpenFile(dst, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0666); err != nil {
+		return
+	}
+
+	if _, err = io.Copy(outfile, infile); err == nil {
+		err = outfile.Sync()
+	}
+
+	if closeErr := outfile.Close(); err == nil {
+		err = closeErr
+	}
+	return
+}
+
+
+func (journal *Journal) snapshotDir() string {
+	return journal.Path + ".d"
+}
+
+func (journal *Journal) save() (err error) {
+
+	journal.Updated = time.Now().Unix()
+
+	var jsondata []byte
+	if jsondata, err = json.Marshal(journal); err != nil {
+		return
+	}
+
+	if err = WriteFileDurable(journal.Path, jsondata); err != nil {
+		slog.Errorf("Fail to write journal %s: %s", journal.Path, err.Error())
+	}
+	return
+}
+
+// Begin copies files aside and records the journal at path, files are what the put is about to change.
+func Begin(path string, filepath string, files []string) (journal *Journal, err error) {
+
+	journal = &Journal{Path: path, Filepath: filepath, Stage: STAGE_BEGIN, Started: time.Now().Unix()}
+
+	os.RemoveAll(journal.snapshotDir())
+
+	if err = os.MkdirAll(journal.snapshotDir(), 0755); err != nil {
+		return
+	}
+
+	for i, file := range files {
+		snapshot := Snapshot{Path: file}
+
+		if _, statErr := os.Stat(file); statErr == nil {
+			snapshot.Existed = true
+			snapshot.Saved = journal.snapshotDir() + "/" + strconv.Itoa(i)
+
+			if err = copyFileDurable(file, snapshot.Saved); err != nil {
+				slog.Errorf("Fail to snapshot %s: %s", file, err.Error())
+				return
+			}
+		} else if os.IsNotExist(statErr) == false {
+			err = statErr
+			return
+		}
+
+		journal.Snapshots = append(journal.Snapshots, snapshot)
+	}
+
+	if err = syncDir(journal.snapshotDir()); err != nil {
+		return
+	}
+
+	err = journal.save()
+	return
+}
+
+// Load returns a nil journal when there is nothing pending at path.
+func Load(path string) (journal *Journal, err error) {
+
+	var jsondata []byte
+	if jsondata, err = ioutil.ReadFile(path); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	journal = &Journal{}
+	if err = json.Unmarshal(jsondata, journal); err != nil {
+		err = errors.Wrapf(err, "Invalid journal %s", path)
+		journal = nil
+		return
+	}
+
+	journal.Path = path
+	return
+}
+
+func (journal *Journal) Advance(stage string, objectId string) (err error) {
+
+	journal.Stage = stage
+	if objectId != "" {
+		journal.ObjectId = objectId
+	}
+
+	err = journal.save()
+	return
+}
+
+// Rollback puts every snapshotted file back the way Begin found it and drops the journal.
+func (journal *Journal) Rollback() (err error) {
+
+	for _, snapshot := range journal.Snapshots {
+		if snapshot.Existed {
+			if err = copyFileDurable(snapshot.Saved, snapshot.Path); err != nil {
+				slog.Errorf("Fail to restore %s: %s", snapshot.Path, err.Error())
+				return
+			}
+		} else if err = os.Remove(snapshot.Path); err != nil && os.IsNotExist(err) == false {
+			slog.Errorf("Fail to remove %s: %s", snapshot.Path, err.Error())
+			return
+		}
+	}
+
+	err = journal.remove()
+	return
+}
+
+// Commit makes the current state final and drops the journal.
+func (journal *Journal) Commit() (err error) {
+	return journal.remove()
+}
+
+func (journal *Journal) remove() (err error) {
+
+	if err = os.Remove(journal.Path); err != nil && os.IsNotExist(err) == false {
+		return
+	}
+
+	if err = syncDir(dirOf(journal.Path)); err != nil {
+		return
+	}
+
+	err = os.RemoveAll(journal.snapshotDir())
+	return
+}
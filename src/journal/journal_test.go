@@ -0,0 +1,90 @@
+package journal
+
+import (
+	"os"
+	"testing"
+	"io/ioutil"
+)
+
+func TestRollback(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	meta := dir + "/file.meta"
+	patch := dir + "/file.patch"
+
+	if err = ioutil.WriteFile(meta, []byte("old meta"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	journal, err := Begin(dir + "/file.journal", "/data/file", []string{meta, patch})
+	if err != nil {
+		t.Fatalf("Fail to begin journal: %s", err.Error())
+	}
+
+	ioutil.WriteFile(meta, []byte("new meta"), 0666)
+	ioutil.WriteFile(patch, []byte("new patch"), 0666)
+
+	if err = journal.Advance(STAGE_PREPARED, "0123456789abcdef0123456789abcdef01234567"); err != nil {
+		t.Fatalf("Fail to advance journal: %s", err.Error())
+	}
+
+	loaded, err := Load(dir + "/file.journal")
+	if err != nil || loaded == nil {
+		t.Fatalf("Fail to load journal: %v", err)
+	}
+
+	if loaded.Stage != STAGE_PREPARED || loaded.ObjectId != journal.ObjectId || loaded.Filepath != "/data/file" {
+		t.Errorf("Loaded journal is wrong: %v", loaded)
+	}
+
+	if err = loaded.Rollback(); err != nil {
+		t.Fatalf("Fail to roll back: %s", err.Error())
+	}
+
+	if data, _ := ioutil.ReadFile(meta); string(data) != "old meta" {
+		t.Errorf("Meta is %q after roll back", data)
+	}
+
+	if _, err = os.Stat(patch); os.IsNotExist(err) == false {
+		t.Errorf("Patch should be removed by roll back: %v", err)
+	}
+
+	if loaded, err = Load(dir + "/file.journal"); err != nil || loaded != nil {
+		t.Errorf("Journal should be gone after roll back: %v %v", loaded, err)
+	}
+}
+
+func TestCommit(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	meta := dir + "/file.meta"
+
+	journal, err := Begin(dir + "/file.journal", "/data/file", []string{meta})
+	if err != nil {
+		t.Fatalf("Fail to begin journal: %s", err.Error())
+	}
+
+	ioutil.WriteFile(meta, []byte("new meta"), 0666)
+
+	if err = journal.Commit(); err != nil {
+		t.Fatalf("Fail to commit: %s", err.Error())
+	}
+
+	if data, _ := ioutil.ReadFile(meta); string(data) != "new meta" {
+		t.Errorf("Meta is %q after commit", data)
+	}
+
+	if _, err = os.Stat(journal.snapshotDir()); os.IsNotExist(err) == false {
+		t.Errorf("Snapshots should be gone after commit: %v", err)
+	}
+}
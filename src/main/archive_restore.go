@@ -0,0 +1,274 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"strings"
+	"io/ioutil"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pkg/errors"
+
+	"../slog"
+	"../bindiff"
+	"../journal"
+	"../storage"
+)
+
+// RESTORE_JOB_DIR keeps one <sha1 of the chain>.json per archive restore being waited for,
+// so that a restore run again after an interruption doesn't request and pay twice. It is
+// under S3_TRITON_ROOT, wherever that is when the restore runs.
+const RESTORE_JOB_DIR = ".restores/"
+
+const DEFAULT_RESTORE_TIER = "Standard"
+
+var restoreTier = DEFAULT_RESTORE_TIER
+
+var restoreDays = 7
+
+var restorePollInterval = 15 * time.Minute
+
+// restoreMaxWait bounds how long a get waits for a restore, Bulk restores from DEEP_ARCHIVE
+// take up to 48 hours. The restore job is kept, so the next get carries on waiting.
+var restoreMaxWait = 72 * time.Hour
+
+type restoreJob struct {
+	Filepath string      `json:"filepath"`
+	VersionId string     `json:"version_id"`
+	Tier string          `json:"tier"`
+	Days int             `json:"days"`
+	Objects []string     `json:"objects"`
+	Bytes int64          `json:"bytes"`
+	Requested int64      `json:"requested"`
+}
+
+type retrievalPrice struct {
+	perGB float64
+	perThousand float64
+	eta string
+}
+
+// retrievalPrices are us-east-1 list prices in USD, only good for an estimate. Archive
+// tiers of INTELLIGENT_TIERING charge nothing for Standard and Bulk restores.
+var retrievalPrices = map[string]map[string]retrievalPrice{
+	"GLACIER": {
+		"Expedited": {0.03, 10, "1-5 minutes"},
+		"Standard": {0.01, 0.05, "3-5 hours"},
+		"Bulk": {0, 0.025, "5-12 hours"},
+	},
+	"DEEP_ARCHIVE": {
+		"Standard": {0.02, 0.10, "up to 12 hours"},
+		"Bulk": {0.0025, 0.025, "up to 48 hours"},
+	},
+	"INTELLIGENT_TIERING": {
+		"Expedited": {0.03, 10, "1-5 minutes"},
+		"Standard": {0, 0, "3-5 hours, up to 12 hours from deep archive access"},
+		"Bulk": {0, 0, "5-12 hours, up to 48 hours from deep archive access"},
+	},
+}
+
+
+func restoreJobDir() string {
+	return bindiff.S3_TRITON_ROOT + RESTORE_JOB_DIR
+}
+
+func restoreJobPath(objectIds []string) string {
+	sum := sha1.Sum([]byte(strings.Join(objectIds, ",")))
+	return restoreJobDir() + hex.EncodeToString(sum[:]) + ".json"
+}
+
+func loadRestoreJob(path string) (job *restoreJob, err error) {
+
+	var data []byte
+	if data, err = ioutil.ReadFile(path); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	job = &restoreJob{}
+	if err = json.Unmarshal(data, job); err != nil {
+		slog.Errorf("Fail to parse restore job %s: %s", path, err.Error())
+		job = nil
+	}
+	return
+}
+
+func (job *restoreJob) save(path string) (err error) {
+
+	var data []byte
+	if data, err = json.Marshal(job); err != nil {
+		return
+	}
+
+	if err = bindiff.CreateDirIfNotExist(restoreJobDir()); err != nil {
+		return
+	}
+
+	err = journal.WriteFileDurable(path, data)
+	return
+}
+
+// estimateRestore tells what restoring the archived objects at tier costs and how long it
+// takes, and fails for a tier the storage classes don't offer.
+func estimateRestore(archived []storage.ObjectInfo, tier string) (cost float64, eta string, err error) {
+
+	if _, ok := retrievalPrices["GLACIER"][tier]; ok == false {
+		err = errors.Errorf("Unknown restore tier %s, use Expedited, Standard or Bulk", tier)
+		return
+	}
+
+	etas := []string{}
+	seen := map[string]bool{}
+
+	for _, info := range archived {
+		price, ok := retrievalPrices[info.StorageClass][tier]
+		if ok == false {
+			if _, known := retrievalPrices[info.StorageClass]; known {
+				err = errors.Errorf("%s restores are not offered for %s", tier, info.StorageClass)
+				return
+			}
+			price = retrievalPrices["GLACIER"][tier]
+		}
+
+		cost += float64(info.Size) / (1 << 30) * price.perGB + price.perThousand / 1000
+
+		if seen[price.eta] == false {
+			seen[price.eta] = true
+			etas = append(etas, price.eta)
+		}
+	}
+
+	eta = strings.Join(etas, ", ")
+	return
+}
+
+// archivedObjects are the objects of objectIds that can't be read without a restore, and the
+// ones of them no restore was requested for yet. Objects restored earlier and still readable
+// are neither.
+func archivedObjects(archiver storage.Archiver, objectIds []string) (archived []storage.ObjectInfo, frozen []storage.ObjectInfo, err error) {
+
+	for _, objectId := range objectIds {
+		var state storage.ArchiveState
+		var info storage.ObjectInfo
+		if state, info, err = archiver.ArchiveState(ObjectKey(objectId)); err != nil {
+			slog.Errorf("Fail to check storage class of %s: %s", objectId, err.Error())
+			return
+		}
+
+		if state.Readable() {
+			continue
+		}
+
+		archived = append(archived, info)
+
+		if state == storage.ARCHIVE_FROZEN {
+			frozen = append(frozen, info)
+		}
+	}
+	return
+}
+
+// RestoreArchivedChain makes the archived objects of a version chain readable before it is
+// downloaded: it requests their restore at restoreTier, reports cost and ETA up front, and
+// polls every restorePollInterval until all of them are back or restoreMaxWait is up.
+func RestoreArchivedChain(filepath string, versionId string, objectIds []string) (err error) {
+
+	archiver, ok := objectStore.(storage.Archiver)
+	if ok == false {
+		return
+	}
+
+	var archived, frozen []storage.ObjectInfo
+	if archived, frozen, err = archivedObjects(archiver, objectIds); err != nil || len(archived) == 0 {
+		return
+	}
+
+	var bytes int64
+	for _, info := range archived {
+		bytes += info.Size
+	}
+
+	path := restoreJobPath(objectIds)
+
+	var job *restoreJob
+	if job, err = loadRestoreJob(path); err != nil {
+		return
+	}
+
+	if job != nil {
+		fmt.Printf("Resuming the %s restore of %d archived objects requested at %s\n", job.Tier, len(job.Objects), time.Unix(job.Requested, 0).Format(time.RFC3339))
+	} else {
+		var cost float64
+		var eta string
+		if cost, eta, err = estimateRestore(frozen, restoreTier); err != nil {
+			return
+		}
+
+		fmt.Printf("%d of %d objects of %s are archived and not readable, %.2f GB in all\n", len(archived), len(objectIds), filepath, float64(bytes) / (1 << 30))
+		fmt.Printf("A %s restore of %d objects costs about $%.2f and takes %s\n", restoreTier, len(frozen), cost, eta)
+
+		job = &restoreJob{
+			Filepath: filepath,
+			VersionId: versionId,
+			Tier: restoreTier,
+			Days: restoreDays,
+			Bytes: bytes,
+			Requested: time.Now().Unix(),
+		}
+		for _, info := range archived {
+			job.Objects = append(job.Objects, info.Key)
+		}
+
+		if err = job.save(path); err != nil {
+			slog.Errorf("Fail to save restore job %s: %s", path, err.Error())
+			return
+		}
+	}
+
+	// Requested again on a resumed job too, a restored copy may have expired meanwhile.
+	for _, info := range frozen {
+		if err = archiver.RestoreArchived(info, job.Tier, job.Days); err != nil {
+			return
+		}
+	}
+
+	waitStart := time.Now()
+
+	for {
+		pending := 0
+		for _, key := range job.Objects {
+			var state storage.ArchiveState
+			if state, _, err = archiver.ArchiveState(key); err != nil {
+				slog.Errorf("Fail to check restore of %s: %s", key, err.Error())
+				return
+			}
+
+			if state.Readable() == false {
+				pending += 1
+			}
+		}
+
+		if pending == 0 {
+			break
+		}
+
+		if time.Since(waitStart) + restorePollInterval > restoreMaxWait {
+			err = errors.Errorf("%d of %d objects of %s are still being restored after %s, get it again to carry on waiting",
+			                    pending, len(job.Objects), filepath, time.Since(waitStart).Round(time.Second))
+			slog.Error(err)
+			return
+		}
+
+		slog.Infof("%d of %d objects of %s are still being restored", pending, len(job.Objects), filepath)
+		fmt.Printf("%d of %d objects still being restored, checking again in %s\n", pending, len(job.Objects), restorePollInterval)
+		time.Sleep(restorePollInterval)
+	}
+
+	os.Remove(path)
+	fmt.Printf("All %d archived objects of %s are restored\n", len(job.Objects), filepath)
+	return
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"../bindiff"
+	"../storage"
+)
+
+func TestEstimateRestore(t *testing.T) {
+
+	gb := int64(1 << 30)
+
+	for _, c := range []struct {
+		archived []storage.ObjectInfo
+		tier string
+		cost float64
+		eta string
+		fails bool
+	}{
+		{[]storage.ObjectInfo{{Size: gb, StorageClass: "GLACIER"}}, "Standard", 0.01 + 0.05 / 1000, "3-5 hours", false},
+		{[]storage.ObjectInfo{{Size: 2 * gb, StorageClass: "DEEP_ARCHIVE"}, {Size: gb, StorageClass: "GLACIER"}}, "Bulk", 2 * 0.0025 + 0.025 / 1000 + 0.025 / 1000, "up to 48 hours, 5-12 hours", false},
+		{[]storage.ObjectInfo{{Size: gb, StorageClass: "INTELLIGENT_TIERING"}, {Size: gb, StorageClass: "INTELLIGENT_TIERING"}}, "Standard", 0, "3-5 hours, up to 12 hours from deep archive access", false},
+		// A class without prices of its own is charged like GLACIER.
+		{[]storage.ObjectInfo{{Size: gb, StorageClass: "GLACIER_IR"}}, "Expedited", 0.03 + 10.0 / 1000, "1-5 minutes", false},
+		{nil, "Standard", 0, "", false},
+		{[]storage.ObjectInfo{{Size: gb, StorageClass: "DEEP_ARCHIVE"}}, "Expedited", 0, "", true},
+		{[]storage.ObjectInfo{{Size: gb, StorageClass: "GLACIER"}}, "Fast", 0, "", true},
+	} {
+		cost, eta, err := estimateRestore(c.archived, c.tier)
+		if (err != nil) != c.fails {
+			t.Errorf("%s restore of %v: %v", c.tier, c.archived, err)
+			continue
+		}
+
+		if c.fails == false && (math.Abs(cost - c.cost) > 1e-9 || eta != c.eta) {
+			t.Errorf("%s restore of %v costs %f and takes %s, want %f and %s", c.tier, c.archived, cost, eta, c.cost, c.eta)
+		}
+	}
+}
+
+// frozenStore never finishes a restore.
+type frozenStore struct {
+	storage.ObjectStore
+	requested int
+}
+
+func (store *frozenStore) ArchiveState(key string) (storage.ArchiveState, storage.ObjectInfo, error) {
+
+	state := storage.ARCHIVE_FROZEN
+	if store.requested > 0 {
+		state = storage.ARCHIVE_RESTORING
+	}
+	return state, storage.ObjectInfo{Key: key, Size: 100, StorageClass: "GLACIER"}, nil
+}
+
+func (store *frozenStore) RestoreArchived(info storage.ObjectInfo, tier string, days int) error {
+
+	store.requested += 1
+	return nil
+}
+
+func TestRestoreArchivedChainGivesUp(t *testing.T) {
+
+	_, cleanup := newTestStore(t)
+	defer cleanup()
+
+	store := &frozenStore{ObjectStore: objectStore}
+	objectStore = store
+	defer func() { objectStore = store.ObjectStore }()
+
+	defer func(interval time.Duration, maxWait time.Duration) {
+		restorePollInterval, restoreMaxWait = interval, maxWait
+	}(restorePollInterval, restoreMaxWait)
+	restorePollInterval, restoreMaxWait = time.Millisecond, 20 * time.Millisecond
+
+	objectIds := []string{"0123456789abcdef0123456789abcdef01234567"}
+
+	start := time.Now()
+	if err := RestoreArchivedChain("/file", "v1", objectIds); err == nil {
+		t.Fatal("Restore that never finishes was waited out")
+	}
+
+	if waited := time.Since(start); waited > time.Second || store.requested != 1 {
+		t.Errorf("Waited %s after %d requests", waited, store.requested)
+	}
+
+	// The job stays, the next get carries on with it. It is kept with the meta data.
+	if strings.HasPrefix(restoreJobPath(objectIds), bindiff.S3_TRITON_ROOT) == false {
+		t.Errorf("Restore job %s is outside %s", restoreJobPath(objectIds), bindiff.S3_TRITON_ROOT)
+	}
+
+	if _, err := os.Stat(restoreJobPath(objectIds)); err != nil {
+		t.Errorf("Restore job is gone: %v", err)
+	}
+	os.Remove(restoreJobPath(objectIds))
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"sync"
+	"bufio"
+	"strings"
+	"runtime"
+
+	"../slog"
+)
+
+const DEFAULT_UPLOAD_SLOTS = 4
+
+const DEFAULT_POST_SLOTS = 4
+
+// DEFAULT_MAX_IN_FLIGHT caps the files a batch put has begun and not finished yet.
+const DEFAULT_MAX_IN_FLIGHT = 32
+
+var hashWorkers = runtime.NumCPU()
+
+var uploadSlots = DEFAULT_UPLOAD_SLOTS
+
+var postSlots = DEFAULT_POST_SLOTS
+
+var maxInFlight = DEFAULT_MAX_IN_FLIGHT
+
+type PutReport struct {
+	Put []string
+	Failed []string
+}
+
+
+func (report PutReport) String() string {
+
+	result := ""
+
+	for _, filepath := range report.Put {
+		result += fmt.Sprintf("PUT %s\n", filepath)
+	}
+
+	for _, failure := range report.Failed {
+		result += fmt.Sprintf("FAILED %s\n", failure)
+	}
+
+	result += fmt.Sprintf("Files: %d, put: %d, failed: %d\n", len(report.Put) + len(report.Failed), len(report.Put), len(report.Failed))
+	return result
+}
+
+// putSlots are the semaphores of the put stages. Every file takes them in the order
+// hash, upload, post, and holds at most hash and upload at once, so no two files wait on each other.
+// The zero putSlots, the ones PutFile goes with, limit nothing.
+type putSlots struct {
+	hash chan bool
+	upload chan bool
+	post chan bool
+}
+
+func newSlots(n int) chan bool {
+
+	if n <= 0 {
+		n = 1
+	}
+	return make(chan bool, n)
+}
+
+// run calls fn holding a place in slot, a nil slot has room for everyone.
+func run(slot chan bool, fn func() error) error {
+
+	if slot != nil {
+		slot <- true
+		defer func() { <-slot }()
+	}
+	return fn()
+}
+
+// put runs filepath through the stages of PutFile, each stage within its slots.
+// Recovering an unfinished put of the file uploads and posts within them too.
+func (slots putSlots) put(filepath string) (err error) {
+
+	var job *putJob
+	if job, err = beginPut(filepath, slots); err != nil {
+		return
+	}
+	defer job.release()
+
+	if err = run(slots.hash, func() error {
+		if _, streaming := patchStreamer(); streaming {
+			// A streamed patch goes up while it is created.
+			return run(slots.upload, job.prepare)
+		}
+		return job.prepare()
+	}); err != nil {
+		return
+	}
+
+	if err = run(slots.upload, job.upload); err != nil {
+		return
+	}
+
+	err = run(slots.post, job.post)
+	return
+}
+
+// keyLocks serializes what is done to the same key. A key only has an entry while
+// someone holds or waits for it.
+type keyLocks struct {
+	mu sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	users int
+}
+
+// uploadLocks are taken by object key: files with the same content share the object, and
+// the state of its multipart upload.
+var uploadLocks = &keyLocks{locks: map[string]*keyLock{}}
+
+
+func (locks *keyLocks) lock(key string) (unlock func()) {
+
+	locks.mu.Lock()
+	lock, ok := locks.locks[key]
+	if ok == false {
+		lock = &keyLock{}
+		locks.locks[key] = lock
+	}
+	lock.users += 1
+	locks.mu.Unlock()
+
+	lock.Lock()
+
+	return func() {
+		lock.Unlock()
+
+		locks.mu.Lock()
+		lock.users -= 1
+		if lock.users == 0 {
+			delete(locks.locks, key)
+		}
+		locks.mu.Unlock()
+	}
+}
+
+// PutFiles puts every file coming from filepaths, at most hashWorkers creating patches,
+// uploadSlots uploading and postSlots posting to Triton at a time. Reading filepaths stops
+// while maxInFlight files are on their way, which bounds the locks, journals and local
+// patches held at once; the memory of uploads is bounded by uploadSlots times the part
+// buffers of one upload. A file that fails is reported and left to its journal, the
+// others go on.
+func PutFiles(filepaths <-chan string) (report PutReport) {
+
+	slots := putSlots{hash: newSlots(hashWorkers), upload: newSlots(uploadSlots), post: newSlots(postSlots)}
+	inFlight := newSlots(maxInFlight)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	// The same file again while it is on its way would only wait on its own lock. Only
+	// the files on their way are kept, at most maxInFlight.
+	putting := map[string]bool{}
+
+	for filepath := range filepaths {
+		mu.Lock()
+		duplicate := putting[filepath]
+		mu.Unlock()
+
+		if duplicate {
+			continue
+		}
+
+		inFlight <- true
+
+		mu.Lock()
+		putting[filepath] = true
+		mu.Unlock()
+
+		wg.Add(1)
+		go func(filepath string) {
+			defer wg.Done()
+
+			err := slots.put(filepath)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			delete(putting, filepath)
+			<-inFlight
+
+			if err != nil {
+				slog.Errorf("Fail to put %s: %s", filepath, err.Error())
+				report.Failed = append(report.Failed, filepath + ": " + err.Error())
+				return
+			}
+			report.Put = append(report.Put, filepath)
+		}(filepath)
+	}
+
+	wg.Wait()
+	return
+}
+
+// readFileList calls fn with every path of the list, one per line. Empty lines are skipped.
+func readFileList(r io.Reader, fn func(string)) (err error) {
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		filepath := strings.TrimRight(scanner.Text(), "\r")
+		if filepath == "" {
+			continue
+		}
+		fn(filepath)
+	}
+
+	err = scanner.Err()
+	return
+}
+
+// PutFileList puts files, then the files listed in listPath, "-" being stdin, through PutFiles.
+// The list is read as the batch goes rather than up front.
+func PutFileList(files []string, listPath string) (report PutReport, err error) {
+
+	filepaths := make(chan string)
+	var listErr error
+
+	go func() {
+		defer close(filepaths)
+
+		for _, filepath := range files {
+			filepaths <- filepath
+		}
+
+		if listPath == "" {
+			return
+		}
+
+		list := os.Stdin
+		if listPath != "-" {
+			if list, listErr = os.Open(listPath); listErr != nil {
+				return
+			}
+			defer list.Close()
+		}
+
+		listErr = readFileList(list, func(filepath string) {
+			filepaths <- filepath
+		})
+	}()
+
+	report = PutFiles(filepaths)
+
+	if listErr != nil {
+		err = listErr
+		slog.Errorf("Fail to read file list %s: %s", listPath, err.Error())
+	}
+	return
+}
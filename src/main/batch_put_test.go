@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"strings"
+	"testing"
+	"net/http"
+	"io/ioutil"
+
+	"../journal"
+	"../storage"
+)
+
+// concurrency counts the calls running at once and remembers the most there were.
+type concurrency struct {
+	mu sync.Mutex
+	running int
+	most int
+	keys map[string]bool
+	sameKey bool
+}
+
+func (counter *concurrency) enter(key string) {
+
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+
+	counter.running += 1
+	if counter.running > counter.most {
+		counter.most = counter.running
+	}
+
+	if counter.keys[key] {
+		counter.sameKey = true
+	}
+	counter.keys[key] = true
+}
+
+func (counter *concurrency) leave(key string) {
+
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+
+	counter.running -= 1
+	delete(counter.keys, key)
+}
+
+// slowStore takes its time over every upload and counts the ones going on.
+type slowStore struct {
+	storage.ObjectStore
+	uploads concurrency
+}
+
+func (store *slowStore) Put(key string, filepath string) error {
+
+	store.uploads.enter(key)
+	defer store.uploads.leave(key)
+
+	time.Sleep(50 * time.Millisecond)
+	return store.ObjectStore.Put(key, filepath)
+}
+
+// putBatch puts files through PutFiles, the way PutFileList hands them over.
+func putBatch(files []string) PutReport {
+
+	filepaths := make(chan string)
+	go func() {
+		for _, file := range files {
+			filepaths <- file
+		}
+		close(filepaths)
+	}()
+
+	return PutFiles(filepaths)
+}
+
+func TestPutFiles(t *testing.T) {
+
+	dir, cleanup := newTestStore(t)
+	defer cleanup()
+
+	store := &slowStore{ObjectStore: objectStore, uploads: concurrency{keys: map[string]bool{}}}
+	objectStore = store
+	defer func() { objectStore = store.ObjectStore }()
+
+	posts := concurrency{keys: map[string]bool{}}
+	defer newTestTriton(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			posts.enter(r.URL.String())
+			time.Sleep(20 * time.Millisecond)
+			posts.leave(r.URL.String())
+		}
+	})()
+
+	defer func(hash int, upload int, post int) {
+		hashWorkers, uploadSlots, postSlots = hash, upload, post
+	}(hashWorkers, uploadSlots, postSlots)
+	hashWorkers, uploadSlots, postSlots = 2, 2, 1
+
+	// Files with the same content go up under the same key. In a batch of their own,
+	// they all reach their uploads together.
+	same := []string{dir + "/same1", dir + "/same2", dir + "/same3"}
+	for _, file := range same {
+		if err := ioutil.WriteFile(file, []byte("the same content"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if report := putBatch(same); len(report.Put) != len(same) {
+		t.Errorf("Files with the same content failed: %v", report.Failed)
+	}
+
+	if store.uploads.sameKey {
+		t.Error("Two files uploaded to the same key at once")
+	}
+
+	files := []string{}
+	for i := 0; i < 8; i++ {
+		file := fmt.Sprintf("%s/file%d", dir, i)
+		if err := ioutil.WriteFile(file, []byte(fmt.Sprintf("content of file %d", i)), 0666); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+
+	// A put that stopped before its upload is recovered within the slots too.
+	backupVersions(t, dir + "/pending", testContents()[:1])
+	pendingPut(t, dir + "/pending", testContents()[1], journal.STAGE_PREPARED)
+
+	missing := dir + "/missing"
+	files = append(files, missing, dir + "/pending", files[0])
+
+	report := putBatch(files)
+
+	// The missing file fails alone, the others all go up.
+	if len(report.Failed) != 1 || strings.HasPrefix(report.Failed[0], missing + ":") == false {
+		t.Errorf("Failed puts are %v", report.Failed)
+	}
+
+	put := map[string]bool{}
+	for _, file := range report.Put {
+		put[file] = true
+	}
+
+	for _, file := range files {
+		if file != missing && put[file] == false {
+			t.Errorf("%s was not put", file)
+		}
+	}
+
+	if store.uploads.most > uploadSlots || posts.most > postSlots {
+		t.Errorf("%d uploads and %d posts at once", store.uploads.most, posts.most)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"strings"
+	"encoding/hex"
+
+	"../slog"
+	"../bindiff"
+)
+
+const DEFAULT_DOWNLOAD_CONCURRENCY = 4
+
+var downloadConcurrency = DEFAULT_DOWNLOAD_CONCURRENCY
+
+
+// downloadedIntact tells whether path already holds objectId, left there by an earlier run.
+func downloadedIntact(path string, objectId string) bool {
+
+	if _, err := os.Stat(path); err != nil {
+		return false
+	}
+
+	hash, err := bindiff.GetFileHash(path)
+	return err == nil && strings.EqualFold(hex.EncodeToString(hash), objectId)
+}
+
+// DownloadChain fetches the objects of a version chain into dir, at most downloadConcurrency
+// at a time. The files come back in the order of objectIds whatever order they finish in,
+// so they can go straight to ConsolidatePatches.
+func DownloadChain(objectIds []string, dir string) (files []string, err error) {
+
+	files = make([]string, len(objectIds))
+	for i, objectId := range objectIds {
+		files[i] = dir + objectId + ".dat"
+	}
+
+	concurrency := downloadConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indexes {
+				if downloadedIntact(files[idx], objectIds[idx]) {
+					slog.Infof("%s is already downloaded", files[idx])
+					continue
+				}
+
+				if downloadErr := objectStore.Get(ObjectKey(objectIds[idx]), files[idx]); downloadErr != nil {
+					slog.Errorf("Fail to download %s.dat: %s", objectIds[idx], downloadErr.Error())
+
+					mu.Lock()
+					if err == nil {
+						err = downloadErr
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for idx := range objectIds {
+		mu.Lock()
+		failed := err != nil
+		mu.Unlock()
+
+		// Stop handing out work after a failure, the finished files are reused next time.
+		if failed {
+			break
+		}
+		indexes <- idx
+	}
+	close(indexes)
+	wg.Wait()
+
+	if err != nil {
+		files = nil
+	}
+	return
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"strings"
+	"encoding/hex"
+	"path/filepath"
+	"github.com/pkg/errors"
+
+	"../slog"
+	"../bindiff"
+	"../journal"
+	"../triton"
+	"../storage"
+)
+
+const DEFAULT_GC_GRACE_DAYS = 7
+
+var gcGraceDays = DEFAULT_GC_GRACE_DAYS
+
+type GCReport struct {
+	DryRun bool
+	Objects int
+	Referenced int
+	// Young are unreferenced objects still within the grace period, maybe from a put in flight.
+	Young []string
+	Deleted []string
+	DeletedBytes int64
+	Failed []string
+}
+
+
+func (report GCReport) String() string {
+
+	result := ""
+	action := "DELETED"
+	if report.DryRun {
+		action = "WOULD DELETE"
+	}
+
+	for _, key := range report.Deleted {
+		result += fmt.Sprintf("%s %s\n", action, key)
+	}
+
+	for _, key := range report.Young {
+		result += fmt.Sprintf("KEPT %s: younger than %d days\n", key, gcGraceDays)
+	}
+
+	for _, failure := range report.Failed {
+		result += fmt.Sprintf("FAILED %s\n", failure)
+	}
+
+	result += fmt.Sprintf("Objects: %d, referenced: %d, kept young: %d, %s: %d (%d bytes), failed: %d\n",
+		                  report.Objects, report.Referenced, len(report.Young), strings.ToLower(action), len(report.Deleted), report.DeletedBytes, len(report.Failed))
+	return result
+}
+
+// checkDeleted refuses a listing that doesn't say whether something of fullpath is deleted,
+// what IsDeleted makes of that would leave the objects of a live version unreferenced.
+func checkDeleted(fullpath string, deleted string) (err error) {
+
+	if deleted != "true" && deleted != "false" {
+		err = errors.Errorf("Triton lists %s with deleted=%q", fullpath, deleted)
+		slog.Error(err)
+	}
+	return
+}
+
+// tritonReferences are the objects the chains of the live versions Triton lists are made of.
+// A deleted intermediate version still has its patch in such a chain, the objects of other
+// deleted versions are garbage. Any doubt about the listing or a chain is an error.
+func tritonReferences(referenced map[string]bool) (err error) {
+
+	var listResult triton.ListNamedObjectResults
+
+	if err = tritonConveyor.ListAllNamedObjects(&listResult); err != nil {
+		slog.Errorf("Fail to list named objects of %s: %s", accountSetting.MachineId, err.Error())
+		return
+	}
+
+	// Versions missing from a partial listing would look unreferenced.
+	if listResult.Complete() == false {
+		err = errors.Errorf("Triton does not confirm the listing of %s is complete", accountSetting.MachineId)
+		slog.Error(err)
+		return
+	}
+
+	for _, namedObject := range listResult.Objects.NamedObjects {
+		if err = checkDeleted(namedObject.Fullpath, namedObject.Deleted); err != nil {
+			return
+		}
+
+		if namedObject.IsDeleted() {
+			continue
+		}
+
+		versions := namedObject.Versions.Versions
+		for idx, version := range versions {
+			if err = checkDeleted(namedObject.Fullpath, version.Deleted); err != nil {
+				return
+			}
+
+			if version.IsDeleted() {
+				continue
+			}
+
+			var objectIds []string
+			if objectIds, err = ChainObjects(idx, versions); err != nil {
+				err = errors.Wrapf(err, "Chain of %s is broken", namedObject.Fullpath)
+				slog.Error(err)
+				return
+			}
+
+			for _, objectId := range objectIds {
+				referenced[strings.ToLower(objectId)] = true
+			}
+		}
+	}
+	return
+}
+
+// localReferences are the objects the local meta data and unfinished put journals point at,
+// which a put resumed later posts to Triton.
+func localReferences(referenced map[string]bool) (err error) {
+
+	empty := bindiff.SHAValue{}
+
+	err = filepath.Walk(bindiff.S3_TRITON_ROOT, func(path string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			if os.IsNotExist(walkErr) {
+				return nil
+			}
+			return walkErr
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		switch {
+			case strings.HasSuffix(path, ".meta"):
+				metadata, loadErr := bindiff.GetFileMetaData(strings.TrimSuffix(strings.TrimPrefix(path, strings.TrimSuffix(bindiff.S3_TRITON_ROOT, "/")), ".meta"))
+				if loadErr != nil {
+					return errors.Wrapf(loadErr, "Fail to read %s", path)
+				}
+
+				for _, hash := range []bindiff.SHAValue{metadata.PatchHash, metadata.PrevPatchHash} {
+					if hash != empty {
+						referenced[hex.EncodeToString(hash[:])] = true
+					}
+				}
+			case strings.HasSuffix(path, ".journal"):
+				pending, loadErr := journal.Load(path)
+				if loadErr != nil {
+					return errors.Wrapf(loadErr, "Fail to read %s", path)
+				}
+
+				if pending != nil && pending.ObjectId != "" {
+					referenced[strings.ToLower(pending.ObjectId)] = true
+				}
+		}
+		return nil
+	})
+	return
+}
+
+// GC deletes the objects under MachineId that no live version in Triton or local state needs
+// and that are older than gcGraceDays. Any doubt about the references stops it before it
+// deletes anything.
+func GC(dryRun bool) (report GCReport, err error) {
+
+	var repoLock *bindiff.FileLock
+	if repoLock, err = bindiff.LockRepository(true, lockWait); err != nil {
+		slog.Errorf("Fail to lock repository: %s", err.Error())
+		return
+	}
+	defer repoLock.Unlock()
+
+	report.DryRun = dryRun
+
+	referenced := map[string]bool{}
+
+	if err = tritonReferences(referenced); err != nil {
+		return
+	}
+
+	tritonCount := len(referenced)
+
+	if err = localReferences(referenced); err != nil {
+		slog.Errorf("Fail to collect local references: %s", err.Error())
+		return
+	}
+
+	report.Referenced = len(referenced)
+
+	deadline := time.Now().Add(-time.Duration(gcGraceDays) * 24 * time.Hour)
+	unreferenced := []storage.ObjectInfo{}
+
+	if err = objectStore.List(accountSetting.MachineId + "/", func(info storage.ObjectInfo) bool {
+		objectId, ok := storage.ObjectIdOfKey(info.Key)
+		if ok == false {
+			// Not laid out by ObjectKey, so not ours to judge.
+			return true
+		}
+
+		report.Objects += 1
+
+		if referenced[objectId] {
+			return true
+		}
+
+		if info.LastModified.After(deadline) {
+			report.Young = append(report.Young, info.Key)
+			return true
+		}
+
+		unreferenced = append(unreferenced, info)
+		return true
+	}); err != nil {
+		slog.Errorf("Fail to list objects of %s: %s", accountSetting.MachineId, err.Error())
+		return
+	}
+
+	// An empty listing from Triton more likely means a wrong account than no backups at all.
+	if tritonCount == 0 && len(unreferenced) > 0 {
+		err = errors.Errorf("Triton lists no versions for %s, refusing to delete %d objects", accountSetting.MachineId, len(unreferenced))
+		return
+	}
+
+	for _, info := range unreferenced {
+		if dryRun == false {
+			if deleteErr := objectStore.Delete(info.Key); deleteErr != nil {
+				slog.Errorf("Fail to delete %s: %s", info.Key, deleteErr.Error())
+				report.Failed = append(report.Failed, fmt.Sprintf("%s: %s", info.Key, deleteErr.Error()))
+				continue
+			}
+			slog.Infof("Deleted unreferenced object %s", info.Key)
+		}
+
+		report.Deleted = append(report.Deleted, info.Key)
+		report.DeletedBytes += info.Size
+	}
+	return
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"bytes"
+	"time"
+	"testing"
+	"net/http"
+	"io/ioutil"
+	"crypto/sha1"
+	"encoding/xml"
+	"encoding/hex"
+
+	"../bindiff"
+	"../triton"
+)
+
+// tritonListing answers a container listing with namedObjects, marked complete or cut
+// short with nowhere to go on.
+func tritonListing(namedObjects *[]triton.NamedObject, complete *bool) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		result := triton.ListNamedObjectResults{Objects: triton.ObjectList{NamedObjects: *namedObjects}, IsTruncated: "true"}
+		if *complete {
+			result.IsTruncated = "false"
+		}
+
+		data, _ := xml.Marshal(result)
+		w.Write(data)
+	}
+}
+
+// putOrphan stores content under its object id, as a put that never got posted leaves it.
+func putOrphan(t *testing.T, dir string, content string) (key string) {
+
+	sum := sha1.Sum([]byte(content))
+	key = ObjectKey(hex.EncodeToString(sum[:]))
+
+	file := dir + "/orphan"
+	if err := ioutil.WriteFile(file, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := objectStore.Put(key, file); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestGC(t *testing.T) {
+
+	dir, cleanup := newTestStore(t)
+	defer cleanup()
+
+	contents := testContents()
+
+	// a keeps its newest version, its deleted middle version is a patch that chain needs.
+	a := backupVersions(t, dir + "/a", contents)
+	a[1].Deleted = "true"
+
+	// The newest version of b is deleted and the file is gone locally, its patch is garbage.
+	b := backupVersions(t, dir + "/b", [][]byte{contents[2], contents[0]})
+	b[0].Deleted = "true"
+	os.Remove(bindiff.S3_TRITON_ROOT + dir + "/b.meta")
+
+	oldOrphan := putOrphan(t, dir, "old orphan")
+
+	// Everything so far is past the grace period.
+	old := time.Now().Add(-time.Duration(gcGraceDays + 1) * 24 * time.Hour)
+	keys := []string{oldOrphan}
+	for _, version := range append(append([]triton.Version{}, a...), b...) {
+		keys = append(keys, ObjectKey(version.ObjectId))
+	}
+
+	for _, key := range keys {
+		if err := os.Chtimes(dir + "/objects/" + key, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	youngOrphan := putOrphan(t, dir, "young orphan")
+
+	namedObjects := []triton.NamedObject{
+		{Deleted: "false", Fullpath: dir + "/a", Versions: triton.VersionList{Versions: a}},
+		{Deleted: "false", Fullpath: dir + "/b", Versions: triton.VersionList{Versions: b}},
+	}
+	complete := false
+	defer newTestTriton(tritonListing(&namedObjects, &complete))()
+
+	// Without Triton saying the listing is complete nothing is judged.
+	if _, err := GC(false); err == nil {
+		t.Fatal("GC went ahead on a listing that may be partial")
+	}
+
+	complete = true
+
+	// Nor with a live version whose chain has no baseline.
+	namedObjects[1].Versions.Versions = b[:1]
+	b[0].Deleted = "false"
+	if _, err := GC(false); err == nil {
+		t.Fatal("GC went ahead with a broken chain")
+	}
+
+	namedObjects[1].Versions.Versions = b
+	b[0].Deleted = "true"
+
+	// Nor with a version the listing doesn't say is deleted or not.
+	a[2].Deleted = ""
+	if _, err := GC(false); err == nil {
+		t.Fatal("GC went ahead without knowing if a version is deleted")
+	}
+	a[2].Deleted = "false"
+
+	report, err := GC(true)
+	if err != nil {
+		t.Fatalf("Fail to collect garbage: %s", err.Error())
+	}
+
+	want := []string{oldOrphan, ObjectKey(b[0].ObjectId)}
+	sort.Strings(want)
+	sort.Strings(report.Deleted)
+
+	if report.DryRun == false || len(report.Deleted) != 2 || report.Deleted[0] != want[0] || report.Deleted[1] != want[1] {
+		t.Fatalf("Dry run would delete %v, want %v", report.Deleted, want)
+	}
+
+	if len(report.Young) != 1 || report.Young[0] != youngOrphan {
+		t.Errorf("Young objects are %v", report.Young)
+	}
+
+	if _, err = objectStore.Head(oldOrphan); err != nil {
+		t.Fatalf("Dry run deleted %s: %v", oldOrphan, err)
+	}
+
+	if report, err = GC(false); err != nil || len(report.Deleted) != 2 || len(report.Failed) != 0 {
+		t.Fatalf("GC deleted %v, failed %v: %v", report.Deleted, report.Failed, err)
+	}
+
+	for _, key := range want {
+		if _, err = objectStore.Head(key); err == nil {
+			t.Errorf("%s survived", key)
+		}
+	}
+
+	// Every live version still restores.
+	for _, c := range []struct {
+		versions []triton.Version
+		idx int
+		content []byte
+	}{
+		{a, 0, contents[2]},
+		{a, 2, contents[0]},
+		{b, 1, contents[2]},
+	} {
+		if data := consolidate(t, dir, c.idx, c.versions); bytes.Equal(data, c.content) == false {
+			t.Errorf("Version %s restores %d bytes that differ", c.versions[c.idx].VersionId, len(data))
+		}
+	}
+}
+
+func TestAbortStaleUploadsSweepsStreams(t *testing.T) {
+
+	dir, cleanup := newTestStore(t)
+	defer cleanup()
+
+	file := dir + "/stream"
+	if err := ioutil.WriteFile(file, []byte("streamed patch"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := accountSetting.MachineId + "/" + STREAM_TMP_DIR
+	for _, key := range []string{prefix + "old.stream", prefix + "young.stream"} {
+		if err := objectStore.Put(key, file); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old := time.Now().Add(-time.Duration(staleUploadDays + 1) * 24 * time.Hour)
+	if err := os.Chtimes(dir + "/objects/" + prefix + "old.stream", old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	AbortStaleUploads()
+
+	if _, err := objectStore.Head(prefix + "old.stream"); err == nil {
+		t.Error("Stream left by a crash survived")
+	}
+
+	// It may be one a put is copying right now.
+	if _, err := objectStore.Head(prefix + "young.stream"); err != nil {
+		t.Errorf("Young stream was deleted: %v", err)
+	}
+}
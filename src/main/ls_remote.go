@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"fmt"
+	"time"
+	"github.com/pkg/errors"
+
+	"../slog"
+	"../storage"
+)
+
+
+// listObjects goes through the store with options, through Iterate where the store has it.
+// Other stores only list by prefix and can't roll keys up by a delimiter.
+func listObjects(options storage.ListOptions, fn func(storage.ObjectInfo) bool) (err error) {
+
+	if iterable, ok := objectStore.(storage.Iterable); ok {
+		iterator := iterable.Iterate(options)
+		for iterator.Next() {
+			if fn(iterator.Object()) == false {
+				break
+			}
+		}
+
+		err = iterator.Err()
+		return
+	}
+
+	if options.Delimiter != "" {
+		err = errors.Errorf("The %s backend can't list by delimiter", accountSetting.Backend)
+		return
+	}
+
+	err = objectStore.List(options.Prefix, func(info storage.ObjectInfo) bool {
+		if info.Key <= options.StartAfter {
+			return true
+		}
+		return fn(info)
+	})
+	return
+}
+
+// ListRemote writes a line for every object and common prefix of the listing to w, like
+//
+//	2026-10-01T12:00:00Z   1048576  STANDARD  9e107d9d372bb6826bd81d3542a419d6  <key>
+//	                             PRE  <prefix>
+func ListRemote(options storage.ListOptions, w io.Writer) (err error) {
+
+	objects := 0
+	var bytes int64
+
+	if err = listObjects(options, func(info storage.ObjectInfo) bool {
+		if info.CommonPrefix {
+			fmt.Fprintf(w, "%32s  %s\n", "PRE", info.Key)
+			return true
+		}
+
+		storageClass := info.StorageClass
+		if storageClass == "" {
+			storageClass = "-"
+		}
+
+		etag := info.ETag
+		if etag == "" {
+			etag = "-"
+		}
+
+		fmt.Fprintf(w, "%s  %10d  %s  %s  %s\n", info.LastModified.UTC().Format(time.RFC3339), info.Size, storageClass, etag, info.Key)
+
+		objects += 1
+		bytes += info.Size
+		return true
+	}); err != nil {
+		slog.Errorf("Fail to list %s: %s", options.Prefix, err.Error())
+		return
+	}
+
+	fmt.Fprintf(w, "Objects: %d, bytes: %d\n", objects, bytes)
+	return
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"strings"
+	"path/filepath"
+
+	"../slog"
+	"../bindiff"
+)
+
+
+type MigrateReport struct {
+	Current int
+	Migrated []string
+	Failed []string
+	DryRun bool
+}
+
+
+func (report MigrateReport) String() string {
+
+	result := ""
+	action := "migrated"
+	if report.DryRun {
+		action = "to migrate"
+	}
+
+	for _, line := range report.Migrated {
+		result += line + "\n"
+	}
+
+	for _, line := range report.Failed {
+		result += "FAILED " + line + "\n"
+	}
+
+	result += fmt.Sprintf("Up to date: %d, %s: %d, failed: %d\n", report.Current, action, len(report.Migrated), len(report.Failed))
+	return result
+}
+
+
+func MigrateMetaData(dryRun bool) (report MigrateReport, err error) {
+
+	var repoLock *bindiff.FileLock
+	if repoLock, err = bindiff.LockRepository(true, lockWait); err != nil {
+		slog.Errorf("Fail to lock repository: %s", err.Error())
+		return
+	}
+	defer repoLock.Unlock()
+
+	report.DryRun = dryRun
+
+	err = filepath.Walk(bindiff.S3_TRITON_ROOT, func(path string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+
+		if info.IsDir() || strings.HasSuffix(path, ".meta") == false {
+			return nil
+		}
+
+		fromVersion, migrateErr := bindiff.MigrateMetaDataFile(path, dryRun)
+		if migrateErr != nil {
+			slog.Errorf("Fail to migrate %s: %s", path, migrateErr.Error())
+			report.Failed = append(report.Failed, fmt.Sprintf("%s: %s", path, migrateErr.Error()))
+			return nil
+		}
+
+		if fromVersion == bindiff.METADATA_SCHEMA_VERSION {
+			report.Current += 1
+		} else {
+			report.Migrated = append(report.Migrated, fmt.Sprintf("%s: schema version %d -> %d", path, fromVersion, bindiff.METADATA_SCHEMA_VERSION))
+		}
+		return nil
+	})
+
+	return
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"io/ioutil"
+	"path/filepath"
+	"encoding/json"
+
+	"../bindiff"
+)
+
+// The meta data of an unversioned installation, before schema_version was written.
+const unversionedMetaData = `{"backuptime":1500000000,"atime":"1500000001","mtime":1500000002,"ctime":1500000003,` +
+                            `"file_size":1024,"patch_size":1024,"patch_type":0,"prev_patch_hash":"",` +
+                            `"patch_hash":"0123456789abcdef0123456789abcdef01234567",` +
+                            `"patch_state":["0:512:0123456789abcdef0123456789abcdef01234567"]}`
+
+func TestMigrateMetaData(t *testing.T) {
+
+	dir, cleanup := newTestStore(t)
+	defer cleanup()
+
+	// current is in the schema the patches are written in, old has to be migrated.
+	current := dir + "/current"
+	backupVersions(t, current, testContents()[:1])
+
+	old := bindiff.S3_TRITON_ROOT + dir + "/old.meta"
+	if err := ioutil.WriteFile(old, []byte(unversionedMetaData), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	currentMeta, err := ioutil.ReadFile(bindiff.S3_TRITON_ROOT + current + ".meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A dry run reports the migration and leaves the file alone.
+	report, err := MigrateMetaData(true)
+	if err != nil || report.Current != 1 || len(report.Migrated) != 1 || len(report.Failed) != 0 {
+		t.Fatalf("Dry run reported %v, %v", report, err)
+	}
+
+	if data, _ := ioutil.ReadFile(old); string(data) != unversionedMetaData {
+		t.Errorf("Dry run rewrote %s: %s", old, data)
+	}
+
+	if report, err = MigrateMetaData(false); err != nil || report.Current != 1 || len(report.Migrated) != 1 {
+		t.Fatalf("Migration reported %v, %v", report, err)
+	}
+
+	// The file itself is in the current schema, not just what reading it migrates to.
+	var metadata bindiff.FileMetaData
+	if data, err := ioutil.ReadFile(old); err != nil || json.Unmarshal(data, &metadata) != nil {
+		t.Errorf("Migrated meta data is %s, %v", data, err)
+	} else if metadata.SchemaVersion != bindiff.METADATA_SCHEMA_VERSION || metadata.FileSize != 1024 {
+		t.Errorf("Migrated meta data is %v", metadata)
+	}
+
+	// Meta data already current is not rewritten.
+	if data, _ := ioutil.ReadFile(bindiff.S3_TRITON_ROOT + current + ".meta"); bytes.Equal(data, currentMeta) == false {
+		t.Errorf("Current meta data was rewritten: %s", data)
+	}
+
+	// Once migrated, everything is up to date.
+	if report, err = MigrateMetaData(false); err != nil || report.Current != 2 || len(report.Migrated) != 0 {
+		t.Errorf("Second migration reported %v, %v", report, err)
+	}
+
+	if matches, _ := filepath.Glob(bindiff.S3_TRITON_ROOT + dir + "/*.tmp"); len(matches) != 0 {
+		t.Errorf("Migration left %v", matches)
+	}
+}
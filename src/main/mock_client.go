@@ -4,17 +4,22 @@ import (
 	"os"
 	"fmt"
 	"flag"
+	"time"
+	"reflect"
 	"strings"
 	"strconv"
 	"io/ioutil"
 	"encoding/xml"
-	"encoding/hex"
 	"github.com/pkg/errors"
 
 	"../slog"
 	"../bindiff"
 	"../s3"
+	"../retry"
 	"../triton"
+	"../journal"
+	"../storage"
+	"../throttle"
 )
 
 
@@ -25,20 +30,39 @@ type AccountSetting struct {
 	Passwd string      	`xml:"Passwd"`
 	MachineId string   	`xml:"MachineId"`
 	DownloadBase string `xml:"DownloadBase"`
+	Backend string      `xml:"Backend"`
+	LocalRoot string    `xml:"LocalRoot"`
+	S3 s3.S3Config      `xml:"S3"`
+	Throttle throttle.Config `xml:"Throttle"`
 }
 
 
 var tritonConveyor = triton.NewTritonConveyor()
 
-var s3Conveyor = s3.NewS3Conveyor("us-east-2")
+var objectStore storage.ObjectStore
 
 var listNamedObjects = triton.ListNamedObjectResults{}
 
 var accountSetting = AccountSetting{} 
 
+var lockWait = 30 * time.Second
+
+var staleUploadDays = 7
+
+var retryPolicy = retry.DefaultPolicy
+
 func ExitErrorf(msg string, args ...interface{}) {
+    ExitCodef(EXIT_FAILURE, msg, args...)
+}
+
+func ExitCodef(code int, msg string, args ...interface{}) {
     fmt.Fprintf(os.Stderr, msg + "\n", args...)
-    os.Exit(1)
+    os.Exit(code)
+}
+
+
+func ObjectKey(objectId string) string {
+	return storage.ObjectKey(accountSetting.MachineId, objectId)
 }
 
 
@@ -78,9 +102,15 @@ func ListFile(filepath string, fileVersions *[]triton.Version) (result string, e
 	    return		
 	}
 	
+	if len(listResult.Objects.NamedObjects) == 0 {
+		err = errNoVersionMatched
+		result = fmt.Sprintf("No named object found for %s", filepath)
+		return
+	}
+	
 	namedObject := listResult.Objects.NamedObjects[0]
 	
-	if namedObject.Deleted != "false" {
+	if namedObject.IsDeleted() {
 		err = errors.New("Named object deleted")
 		result = fmt.Sprintf("Named object is deleted for %s", filepath)
 		return
@@ -89,7 +119,7 @@ func ListFile(filepath string, fileVersions *[]triton.Version) (result string, e
 	idx := 1
 	
 	for _, version := range namedObject.Versions.Versions {
-		if version.Deleted != "false" {
+		if version.IsDeleted() {
 			continue
 		}
 		
@@ -118,48 +148,20 @@ func GetFile(filepath string, idx int, fileVersions [] triton.Version) (err erro
 		return		
 	}
 	
-	downloadFiles := []string{} 
-	
-	for _, version := range fileVersions[idx:] {
-		found := false
-		
-		for _, file := range downloadFiles {
-			if file == (tmpDownloadPath + version.ObjectId + ".dat") {
-				found = true
-				break
-			}
-		}
-		
-		if found == true {
-			continue
-		}
-		
-		if err = s3Conveyor.DownloadObject(accountSetting.Bucket, 
-			                               accountSetting.MachineId + "/" + version.ObjectId[0:2] + "/" + version.ObjectId[2:4] + "/" + version.ObjectId + ".dat", 
-			                               tmpDownloadPath + version.ObjectId + ".dat"); err != nil {
-			slog.Errorf("Fail to download %s.dat: %s", version.ObjectId, err.Error())
-			return
-		}
-		
-		downloadFiles = append(downloadFiles, tmpDownloadPath + version.ObjectId + ".dat")	                               
-	
-		if version.Type == "baseline" {
-			break
-		}
+	var objectIds []string
+	if objectIds, err = ChainObjects(idx, fileVersions); err != nil {
+		slog.Errorf("Fail to get version chain of %s: %s", filepath, err.Error())
+		return
 	}
 	
-	i := 0
-	j := len(downloadFiles) - 1
+	if err = RestoreArchivedChain(filepath, fileVersions[idx].VersionId, objectIds); err != nil {
+		slog.Errorf("Fail to restore archived objects of %s: %s", filepath, err.Error())
+		return
+	}
 	
-	for {	
-		if i >= j {
-			break
-		}
-		
-		downloadFiles[i], downloadFiles[j] = downloadFiles[j], downloadFiles[i]
-		
-		i += 1
-		j -= 1		
+	var downloadFiles []string
+	if downloadFiles, err = DownloadChain(objectIds, tmpDownloadPath); err != nil {
+		return
 	}
 	
 	if err = bindiff.ConsolidatePatches(downloadFiles[0], downloadFiles[1:]); err != nil {
@@ -180,60 +182,199 @@ func GetFile(filepath string, idx int, fileVersions [] triton.Version) (err erro
 	return
 }
 
-func PutFile(filepath string) (err error) {
+// putJob is a put of one file going through its stages, it holds the locks of the file from
+// beginPut to release.
+type putJob struct {
+	filepath string
+	repoLock *bindiff.FileLock
+	fileLock *bindiff.FileLock
+	journal *journal.Journal
+	uploaded bool
+}
+
+// patchStreamer is the object store when put streams patches into it.
+func patchStreamer() (streamer storage.StreamWriter, ok bool) {
 	
-	emptyAccount := AccountSetting{}
+	if streamPatches == false {
+		return
+	}
+	streamer, ok = objectStore.(storage.StreamWriter)
+	return
+}
+
+// beginPut locks filepath, recovers an unfinished put of it within slots and begins a new journal.
+func beginPut(filepath string, slots putSlots) (job *putJob, err error) {
 	
-	if accountSetting == emptyAccount {
+	if reflect.DeepEqual(accountSetting, AccountSetting{}) {
 		err = errors.New("Account is missing")
 		return
 	}
 	
-	found := false
-	if found, err = s3Conveyor.CheckPathInBucket(accountSetting.Bucket, accountSetting.MachineId); err != nil {
-		slog.Error(err)
+	if err = MakeMachineFolder(); err != nil {
 		return
 	}
 	
-	if found == false {
-		if err = s3Conveyor.CreatePathInBucket(accountSetting.Bucket, accountSetting.MachineId); err != nil {
-			slog.Error(err)
-			return		
-		}	
+	job = &putJob{filepath: filepath}
+	
+	defer func() {
+		if err != nil {
+			job.release()
+			job = nil
+		}
+	}()
+	
+	if job.repoLock, err = bindiff.LockRepository(false, lockWait); err != nil {
+		slog.Errorf("Fail to lock repository: %s", err.Error())
+		return
 	}
 	
-	if err = bindiff.CreatePatch(filepath); err != nil {
-		slog.Errorf("Failed to create patch for %s: %s", filepath, err.Error())
-		return		
+	if job.fileLock, err = bindiff.LockFile(filepath, lockWait); err != nil {
+		slog.Errorf("Fail to lock %s: %s", filepath, err.Error())
+		return
 	}
 	
-	if err = s3Conveyor.UploadObject(accountSetting.Bucket, accountSetting.MachineId, filepath); err != nil {
-		slog.Errorf("Failed to upload %s: %s", filepath, err.Error())
-		return	
+	var pending *journal.Journal
+	if pending, err = journal.Load(JournalPath(filepath)); err != nil {
+		slog.Errorf("Fail to load journal of %s: %s", filepath, err.Error())
+		return
 	}
 	
-	var metadata bindiff.FileMetaData
+	if pending != nil {
+		if err = recoverPut(pending, slots); err != nil {
+			slog.Errorf("Fail to recover previous put of %s: %s", filepath, err.Error())
+			return
+		}
+	}
+	
+	if job.journal, err = journal.Begin(JournalPath(filepath), filepath, journalFiles(filepath)); err != nil {
+		slog.Errorf("Fail to begin journal of %s: %s", filepath, err.Error())
+		return
+	}
+	return
+}
 
-	if metadata, err = bindiff.GetFileMetaData(filepath); err != nil {
-		slog.Errorf("Fail to get meta data of %s: %s", filepath, err.Error())
+// prepare creates the patch, or streams it straight into the object store.
+func (job *putJob) prepare() (err error) {
+	
+	if streamer, ok := patchStreamer(); ok {
+		// Nothing is left locally to resume an upload from, a failed stream starts over next time.
+		if job.uploaded, err = StreamPatch(streamer, job.filepath); err != nil {
+			job.rollback()
+			return
+		}
+	} else if err = bindiff.CreatePatch(job.filepath); err != nil {
+		slog.Errorf("Failed to create patch for %s: %s", job.filepath, err.Error())
+		job.rollback()
+		return		
+	}
+	
+	var object string
+	if object, err = metadataObjectId(job.filepath); err != nil {
+		job.rollback()
 		return
 	}
-			
-	hash := make([]byte, len(metadata.PatchHash))
-	copy(hash, metadata.PatchHash[:])
-	object := hex.EncodeToString(hash)
 	
-	var url, etag string
-	if url, etag, err = s3Conveyor.GeneratePresignedURL(accountSetting.Bucket, accountSetting.MachineId, object); err != nil {
-		slog.Errorf("Fail to create presigned url for %s in bucket: %s", object, err.Error())
-		return			
+	err = job.journal.Advance(journal.STAGE_PREPARED, object)
+	return
+}
+
+// rollback undoes a put that failed before anything was uploaded. A rollback that fails
+// leaves the journal for RecoverPut to try again on the next run.
+func (job *putJob) rollback() {
+	
+	if err := job.journal.Rollback(); err != nil {
+		slog.Errorf("Fail to roll back put of %s: %s", job.filepath, err.Error())
 	}
+}
+
+func (job *putJob) upload() (err error) {
 	
-	if err = tritonConveyor.PostNamedObjects(filepath, url, map[string] string{"ETag" : etag}); err != nil {
-		slog.Errorf("Fail to post namedObjects: %s", err.Error())
+	if job.uploaded == false {
+		if err = uploadStep(job.filepath); err != nil {
+			return	
+		}
+	}
+	
+	err = job.journal.Advance(journal.STAGE_UPLOADED, "")
+	return
+}
+
+func (job *putJob) post() (err error) {
+	
+	if err = postStep(job.filepath); err != nil {
 		return			
 	}	
 	
+	if err = job.journal.Advance(journal.STAGE_POSTED, ""); err != nil {
+		return
+	}
+	
+	err = job.journal.Commit()
+	return
+}
+
+// release unlocks the file, a put that failed halfway leaves its journal for the next run.
+func (job *putJob) release() {
+	
+	if job.fileLock != nil {
+		job.fileLock.Unlock()
+	}
+	
+	if job.repoLock != nil {
+		job.repoLock.Unlock()
+	}
+}
+
+func PutFile(filepath string) (err error) {
+	
+	var job *putJob
+	if job, err = beginPut(filepath, putSlots{}); err != nil {
+		return
+	}
+	defer job.release()
+	
+	if err = job.prepare(); err != nil {
+		return
+	}
+	
+	if err = job.upload(); err != nil {
+		return
+	}
+	
+	err = job.post()
+	return
+}
+
+
+// ChooseVersion picks the version of filepath the selector names, or asks for one when it names none.
+func ChooseVersion(filepath string, selector VersionSelector) (versionIdx int, fileVersions []triton.Version) {
+	
+	listResult, err := ListFile(filepath, &fileVersions)
+	if err != nil {
+		if err == errNoVersionMatched {
+			ExitCodef(EXIT_NO_MATCH, "%s", listResult)
+		}
+		ExitErrorf("%s: %s", listResult, err.Error())
+	}
+	
+	if selector.IsSet() {
+		if versionIdx, err = SelectVersion(fileVersions, selector); err == errNoVersionMatched {
+			ExitCodef(EXIT_NO_MATCH, "No version of %s matched", filepath)
+		} else if err != nil {
+			ExitErrorf("Fail to select version of %s: %s", filepath, err.Error())
+		}
+		return
+	}
+	
+	fmt.Print(listResult)
+	fmt.Print("Please select a version index:\n")
+	
+	fmt.Scanf("%d", &versionIdx)
+	
+	if versionIdx < 1 || versionIdx > len(fileVersions) {
+		ExitCodef(EXIT_NO_MATCH, "Invalid version index: %d", versionIdx)
+	}
+	versionIdx -= 1
 	return
 }
 
@@ -243,6 +384,15 @@ func main() {
 	flag.Usage = func() {
 		fmt.Printf("Usage of %s:\n", os.Args[0])
 		fmt.Printf("    -f <file full path> -h <tds host> -a <account file path> -m <get / put>\n ")
+		fmt.Printf("    -f <file full path> -h <tds host> -a <account file path> -m get <-at time / -version-id id / -latest / -oldest>\n ")
+		fmt.Printf("    -f <file full path> -h <tds host> -a <account file path> -m get -offset <offset> -length <length> [-o <output>]\n ")
+		fmt.Printf("    -h <tds host> -a <account file path> -m put [-files-from <list file>] [-hash-workers <n>] [-upload-slots <n>] [-post-slots <n>] [-max-in-flight <n>] [<file full path> ...]\n ")
+		fmt.Printf("    -f <file full path> -h <tds host> -a <account file path> -m share [-share-format <script / manifest>] [-share-expiry <duration>] [-o <output>]\n ")
+		fmt.Printf("    -h <tds host> -a <account file path> -m scrub [-verify]\n ")
+		fmt.Printf("    -h <tds host> -a <account file path> -m gc [-dry-run] [-gc-grace-days <days>]\n ")
+		fmt.Printf("    -h <tds host> -a <account file path> -m serve [-listen <address>]\n ")
+		fmt.Printf("    -a <account file path> -m migrate-metadata [-dry-run]\n ")
+		fmt.Printf("    -a <account file path> -m ls-remote [-prefix <prefix>] [-delimiter <delimiter>] [-start-after <key>]\n ")
 		flag.PrintDefaults()
 	}
 	
@@ -250,11 +400,51 @@ func main() {
 	var tds string
 	var accountFile string
 	var method string
+	var verify bool
+	var selector VersionSelector
+	var offset, length int64
+	var output string
+	var listen string
+	var dryRun bool
+	var filesFrom string
+	var listOptions storage.ListOptions
 	
 	flag.StringVar(&accountFile, "a", "", "The account file full path")
 	flag.StringVar(&filepath, "f", "", "The full file path to upload or download")
 	flag.StringVar(&tds, "h", "172.16.31.68", "The trogdor host")
-	flag.StringVar(&method, "m", "", "Whether get or put")
+	flag.StringVar(&method, "m", "", "Whether get, put, share, scrub, gc, serve, migrate-metadata or ls-remote")
+	flag.StringVar(&selector.At, "at", "", "Restore the newest version stored at or before this time, e.g. 2026-10-01T12:00Z")
+	flag.StringVar(&selector.VersionId, "version-id", "", "Restore the version with this id")
+	flag.BoolVar(&selector.Latest, "latest", false, "Restore the newest version")
+	flag.BoolVar(&selector.Oldest, "oldest", false, "Restore the oldest version")
+	flag.Int64Var(&offset, "offset", 0, "Only restore the bytes of the version starting at this offset")
+	flag.Int64Var(&length, "length", 0, "Only restore this many bytes of the version, 0 means up to the end")
+	flag.StringVar(&output, "o", "", "Where to write a partial restore, by default under the download base, or a share, by default to stdout")
+	flag.StringVar(&listen, "listen", "127.0.0.1:8080", "The address the browse server listens on")
+	flag.DurationVar(&lockWait, "lock-wait", lockWait, "How long to wait for a busy file or repository lock, negative waits forever")
+	flag.StringVar(&journalRecovery, "journal-recovery", journalRecovery, "Whether an unfinished put is resumed or rolled back on the next run: resume / rollback")
+	flag.BoolVar(&dryRun, "dry-run", false, "Only report what a maintenance command would change")
+	flag.BoolVar(&verify, "verify", false, "Download every object and check its SHA-1 while scrubbing")
+	flag.IntVar(&retryPolicy.MaxAttempts, "retry-attempts", retryPolicy.MaxAttempts, "How many times to try a transfer or Triton call that fails transiently")
+	flag.DurationVar(&retryPolicy.Budget, "retry-budget", retryPolicy.Budget, "How long to keep retrying one transfer or Triton call, 0 means no limit")
+	flag.IntVar(&downloadConcurrency, "download-concurrency", downloadConcurrency, "How many objects of a version chain to download at once")
+	flag.StringVar(&restoreTier, "restore-tier", restoreTier, "How fast archived objects are restored before a get: Expedited / Standard / Bulk")
+	flag.IntVar(&restoreDays, "restore-days", restoreDays, "How many days a restored copy of an archived object stays readable")
+	flag.DurationVar(&restorePollInterval, "restore-poll", restorePollInterval, "How often to check on archived objects being restored")
+	flag.DurationVar(&restoreMaxWait, "restore-max-wait", restoreMaxWait, "How long a get waits for archived objects to be restored before it gives up")
+	flag.IntVar(&gcGraceDays, "gc-grace-days", gcGraceDays, "Only let gc delete unreferenced objects older than this many days")
+	flag.StringVar(&shareFormat, "share-format", shareFormat, "Whether share writes a restore script or a JSON manifest: script / manifest")
+	flag.DurationVar(&shareExpiry, "share-expiry", shareExpiry, "How long the download links of a share stay valid, a week at most on S3")
+	flag.StringVar(&listOptions.Prefix, "prefix", "", "Only list keys starting with this, by default the keys of the machine")
+	flag.StringVar(&listOptions.Delimiter, "delimiter", "", "List the keys sharing what follows the prefix up to this once, e.g. /")
+	flag.StringVar(&listOptions.StartAfter, "start-after", "", "Only list keys sorting after this one")
+	flag.BoolVar(&streamPatches, "stream-patches", streamPatches, "Stream patches into the object store on put instead of writing them to local disk first")
+	flag.StringVar(&filesFrom, "files-from", "", "Put every file listed in this file, one path per line, - reads stdin")
+	flag.IntVar(&hashWorkers, "hash-workers", hashWorkers, "How many files of a batch put create their patch at once")
+	flag.IntVar(&uploadSlots, "upload-slots", uploadSlots, "How many files of a batch put upload at once")
+	flag.IntVar(&postSlots, "post-slots", postSlots, "How many files of a batch put post to Triton at once")
+	flag.IntVar(&maxInFlight, "max-in-flight", maxInFlight, "How many files of a batch put are on their way at once, at most")
+	flag.IntVar(&staleUploadDays, "abort-uploads-after", staleUploadDays, "Abort unfinished multipart uploads and delete streamed leftovers older than this many days on put, 0 keeps them")
 	
 	flag.Parse()
 	
@@ -273,28 +463,125 @@ func main() {
 	}
 	
 	tritonConveyor.AddEndpoints([]string{tds})	
+	tritonConveyor.Retry = retryPolicy
+	
+	if objectStore, err = NewObjectStore(accountSetting); err != nil {
+		ExitErrorf("Fail to create object store: %s", err.Error())
+	}
+	
+	batchPut := method == "put" && (filesFrom != "" || flag.NArg() > 0)
+	StartThrottle(accountFile, method == "serve" || batchPut)
 	
 	switch method {
 		case "get":
-			var listResult string
-			var fileVersions []triton.Version
-			if listResult, err = ListFile(filepath, &fileVersions); err != nil {
-				ExitErrorf("%s: %s", listResult, err.Error())
+			versionIdx, fileVersions := ChooseVersion(filepath, selector)
+			
+			if offset != 0 || length != 0 {
+				if output == "" {
+					output = accountSetting.DownloadBase + filepath + "." + strconv.FormatInt(offset, 10) + "+" + strconv.FormatInt(length, 10)
+				}
+				
+				if err = RestoreRange(filepath, versionIdx, fileVersions, offset, length, output); err != nil {
+					ExitErrorf("Fail to get range %d+%d of %s whose version is %s: %s", offset, length, filepath, fileVersions[versionIdx].VersionId, err.Error())
+				}
+			} else if err = GetFile(filepath, versionIdx, fileVersions); err != nil {
+				ExitErrorf("Fail to get file of %s whose version is %s: %s", filepath, fileVersions[versionIdx].VersionId, err.Error())
 			}
 			
-			fmt.Print(listResult)
-			fmt.Print("Please select a version index to restore:\n")
+			PrintTransferStats()
+		case "put":
+			AbortStaleUploads()
+			
+			if batchPut == false {
+				if err = PutFile(filepath); err != nil {
+					ExitErrorf("Fail to put %s: %s", filepath, err.Error())
+				}
+				
+				PrintTransferStats()
+				break
+			}
 			
-			var versionIdx int
-			fmt.Scanf("%d", &versionIdx)
-		
-			if err = GetFile(filepath, versionIdx - 1, fileVersions); err != nil {
-				ExitErrorf("Fail to get file of %s whose version is %s: %s", filepath, fileVersions[versionIdx - 1].VersionId, err.Error())
+			files := flag.Args()
+			if filepath != "" {
+				files = append([]string{filepath}, files...)
+			}
+			
+			report, listErr := PutFileList(files, filesFrom)
+			
+			fmt.Print(report)
+			PrintTransferStats()
+			
+			if listErr != nil {
+				ExitErrorf("Fail to read file list %s: %s", filesFrom, listErr.Error())
+			}
+			
+			if len(report.Failed) > 0 {
+				os.Exit(1)
+			}
+		case "share":
+			versionIdx, fileVersions := ChooseVersion(filepath, selector)
+			
+			var manifest ShareManifest
+			if manifest, err = NewShareManifest(filepath, versionIdx, fileVersions); err != nil {
+				ExitErrorf("Fail to share %s whose version is %s: %s", filepath, fileVersions[versionIdx].VersionId, err.Error())
+			}
+			
+			out := os.Stdout
+			if output != "" {
+				if out, err = os.OpenFile(output, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0755); err != nil {
+					ExitErrorf("Fail to create %s: %s", output, err.Error())
+				}
+				defer out.Close()
+			}
+			
+			if err = WriteShare(manifest, out); err != nil {
+				ExitErrorf("Fail to write share of %s: %s", filepath, err.Error())
+			}
+		case "scrub":
+			var report ScrubReport
+			if report, err = Scrub(verify); err != nil {
+				ExitErrorf("Fail to scrub container %s: %s", accountSetting.MachineId, err.Error())
+			}
+			
+			fmt.Print(report)
+			
+			if report.Healthy() == false {
+				os.Exit(1)
+			}
+		case "gc":
+			var report GCReport
+			if report, err = GC(dryRun); err != nil {
+				ExitErrorf("Fail to collect garbage of container %s: %s", accountSetting.MachineId, err.Error())
+			}
+			
+			fmt.Print(report)
+			
+			if len(report.Failed) > 0 {
+				os.Exit(1)
+			}
+		case "migrate-metadata":
+			var report MigrateReport
+			if report, err = MigrateMetaData(dryRun); err != nil {
+				ExitErrorf("Fail to migrate meta data under %s: %s", bindiff.S3_TRITON_ROOT, err.Error())
+			}
+			
+			fmt.Print(report)
+			
+			if len(report.Failed) > 0 {
+				os.Exit(1)
+			}
+		case "ls-remote":
+			if listOptions.Prefix == "" {
+				listOptions.Prefix = accountSetting.MachineId + "/"
+			}
+			
+			if err = ListRemote(listOptions, os.Stdout); err != nil {
+				ExitErrorf("Fail to list %s: %s", listOptions.Prefix, err.Error())
+			}
+		case "serve":
+			if err = Serve(listen); err != nil {
+				ExitErrorf("Fail to serve container %s: %s", accountSetting.MachineId, err.Error())
 			}
-		case "put":
-			if err = PutFile(filepath); err != nil {
-				ExitErrorf("Fail to put %s: %s", filepath, err.Error())
-			}	
 		default:
 			ExitErrorf("Unsupport method: %s", method)
 	}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"github.com/pkg/errors"
+
+	"../slog"
+	"../s3"
+	"../bindiff"
+	"../storage"
+	"../throttle"
+)
+
+
+// NewObjectStore builds the backend named by the account's Backend setting, S3 when it is empty.
+func NewObjectStore(account AccountSetting) (store storage.ObjectStore, err error) {
+
+	switch account.Backend {
+		case "", "s3":
+			var conveyor *s3.S3Conveyor
+			if conveyor, err = s3.NewS3ConveyorWithConfig(account.S3); err != nil {
+				return
+			}
+			conveyor.Bucket = account.Bucket
+			conveyor.Retry = retryPolicy
+			store = conveyor
+		case "local":
+			store, err = storage.NewLocalStore(account.LocalRoot)
+		default:
+			err = errors.Errorf("Unsupported backend: %s", account.Backend)
+	}
+	return
+}
+
+var machineFolder struct {
+	sync.Mutex
+	made bool
+}
+
+// MakeMachineFolder creates the folder of the machine in stores that keep folder markers,
+// the way puts always have. It only goes to the store once per run.
+func MakeMachineFolder() (err error) {
+
+	maker, ok := objectStore.(storage.FolderMaker)
+	if ok == false {
+		return
+	}
+
+	machineFolder.Lock()
+	defer machineFolder.Unlock()
+
+	if machineFolder.made {
+		return
+	}
+
+	if err = maker.MakeFolder(accountSetting.MachineId); err != nil {
+		slog.Errorf("Fail to create folder %s: %s", accountSetting.MachineId, err.Error())
+		return
+	}
+
+	machineFolder.made = true
+	return
+}
+
+// PrintTransferStats reports what the job moved, for stores that count it.
+func PrintTransferStats() {
+
+	reporter, ok := objectStore.(storage.StatsReporter)
+	if ok == false {
+		return
+	}
+
+	stats := reporter.Stats().Snapshot()
+	slog.Infof("Transfer stats: %s", stats)
+	fmt.Printf("Transfer stats: %s\n", stats)
+}
+
+// AbortStaleUploads drops this machine's multipart uploads that nobody resumed within
+// staleUploadDays, and the streamed patches a crash left under STREAM_TMP_DIR, which gc
+// doesn't look at. It is best effort, a failure only gets logged.
+func AbortStaleUploads() {
+
+	if staleUploadDays <= 0 {
+		return
+	}
+
+	olderThan := time.Duration(staleUploadDays) * 24 * time.Hour
+
+	if aborter, ok := objectStore.(storage.StaleUploadAborter); ok {
+		aborted, err := aborter.AbortStaleUploads(accountSetting.MachineId + "/", olderThan)
+		if err != nil {
+			slog.Warningf("Fail to abort stale uploads: %s", err.Error())
+		} else if aborted > 0 {
+			slog.Infof("Aborted %d stale uploads", aborted)
+		}
+	}
+
+	deadline := time.Now().Add(-olderThan)
+	stale := []string{}
+
+	if err := objectStore.List(accountSetting.MachineId + "/" + STREAM_TMP_DIR, func(info storage.ObjectInfo) bool {
+		if info.LastModified.Before(deadline) {
+			stale = append(stale, info.Key)
+		}
+		return true
+	}); err != nil {
+		slog.Warningf("Fail to list streamed leftovers: %s", err.Error())
+		return
+	}
+
+	for _, key := range stale {
+		if err := objectStore.Delete(key); err != nil {
+			slog.Warningf("Fail to delete streamed leftover %s: %s", key, err.Error())
+			return
+		}
+	}
+
+	if len(stale) > 0 {
+		slog.Infof("Deleted %d streamed leftovers", len(stale))
+	}
+}
+
+// StartThrottle sets the store's bandwidth to the <Throttle> schedule of the account file.
+// With follow, meant for serve and batch puts, the limits keep following the schedule, and
+// editing the file or sending SIGHUP changes them. Other commands apply the limits of their
+// start and leave SIGHUP alone.
+func StartThrottle(accountFile string, follow bool) {
+
+	throttler, ok := objectStore.(storage.Throttler)
+	if ok == false {
+		return
+	}
+
+	upload, download := throttler.BandwidthLimiters()
+
+	controller := throttle.NewController(upload, download, accountFile, func() (config throttle.Config, err error) {
+		var account AccountSetting
+		if account, err = ParseAccount(accountFile); err != nil {
+			return
+		}
+		config = account.Throttle
+		return
+	})
+
+	start := controller.Reload
+	if follow {
+		start = controller.Start
+	}
+
+	if err := start(); err != nil {
+		slog.Warningf("Fail to apply bandwidth limits, transfers are unlimited: %s", err.Error())
+	}
+}
+
+// PutObject uploads source, the new version of filepath, as object. Stores that take metadata
+// get what ties the object back to filepath and its previous version.
+func PutObject(filepath string, source string, object string) (err error) {
+
+	writer, ok := objectStore.(storage.MetadataWriter)
+	if ok == false {
+		return objectStore.Put(ObjectKey(object), source)
+	}
+
+	var fileMetaData bindiff.FileMetaData
+	if fileMetaData, err = bindiff.GetFileMetaData(filepath); err != nil {
+		slog.Errorf("Fail to get meta data of %s: %s", filepath, err.Error())
+		return
+	}
+
+	err = writer.PutWithMetadata(ObjectKey(object), source, storage.NewObjectMetadata(accountSetting.MachineId, filepath, fileMetaData))
+	return
+}
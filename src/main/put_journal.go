@@ -0,0 +1,198 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"encoding/hex"
+	"github.com/pkg/errors"
+
+	"../slog"
+	"../bindiff"
+	"../journal"
+)
+
+const (
+	JOURNAL_RESUME = "resume"
+	JOURNAL_ROLLBACK = "rollback"
+)
+
+var journalRecovery = JOURNAL_RESUME
+
+
+func JournalPath(filepath string) string {
+	return bindiff.S3_TRITON_ROOT + filepath + ".journal"
+}
+
+// journalFiles are the local state files CreatePatch rewrites.
+func journalFiles(filepath string) []string {
+	return []string{
+		bindiff.S3_TRITON_ROOT + filepath + ".meta",
+		bindiff.S3_TRITON_ROOT + filepath + ".patch",
+		bindiff.S3_TRITON_ROOT + filepath + ".range",
+	}
+}
+
+func metadataObjectId(filepath string) (object string, err error) {
+
+	var metadata bindiff.FileMetaData
+
+	if metadata, err = bindiff.GetFileMetaData(filepath); err != nil {
+		slog.Errorf("Fail to get meta data of %s: %s", filepath, err.Error())
+		return
+	}
+
+	hash := make([]byte, len(metadata.PatchHash))
+	copy(hash, metadata.PatchHash[:])
+	object = hex.EncodeToString(hash)
+	return
+}
+
+// UploadSource returns the local file holding the new version of filepath and the object id it is stored under.
+func UploadSource(filepath string) (source string, object string, err error) {
+
+	var metadata bindiff.FileMetaData
+
+	if metadata, err = bindiff.GetFileMetaData(filepath); err != nil {
+		slog.Errorf("Fail to get meta data of %s: %s", filepath, err.Error())
+		return
+	}
+
+	object = hex.EncodeToString(metadata.PatchHash[:])
+
+	if metadata.PatchType == bindiff.FORMAT_BASELINE {
+		source = filepath
+	} else {
+		source = bindiff.S3_TRITON_ROOT + filepath + ".patch"
+	}
+	return
+}
+
+func uploadStep(filepath string) (err error) {
+
+	var source, object string
+	if source, object, err = UploadSource(filepath); err != nil {
+		return
+	}
+
+	defer uploadLocks.lock(object)()
+
+	if err = PutObject(filepath, source, object); err != nil {
+		slog.Errorf("Failed to upload %s: %s", filepath, err.Error())
+	}
+	return
+}
+
+func postStep(filepath string) (err error) {
+
+	var object string
+	if object, err = metadataObjectId(filepath); err != nil {
+		return
+	}
+
+	var url, etag string
+	if url, etag, err = objectStore.Locator(ObjectKey(object)); err != nil {
+		slog.Errorf("Fail to locate %s in object store: %s", object, err.Error())
+		return
+	}
+
+	if err = tritonConveyor.PostNamedObjects(filepath, url, map[string] string{"ETag" : etag}); err != nil {
+		slog.Errorf("Fail to post namedObjects: %s", err.Error())
+		return
+	}
+	return
+}
+
+// uploadSourceIntact tells whether what a pending put would upload still hashes to its object id.
+// A streamed patch leaves no .patch to hash, it was stored before the journal was prepared: it
+// is intact when the store holds the journal's object at the size the meta data gives, and
+// stored tells it needs no upload.
+func uploadSourceIntact(pending *journal.Journal) (intact bool, stored bool) {
+
+	source, object, err := UploadSource(pending.Filepath)
+	if err != nil || strings.EqualFold(object, pending.ObjectId) == false {
+		return
+	}
+
+	hash, err := bindiff.GetFileHash(source)
+	if err == nil {
+		intact = strings.EqualFold(hex.EncodeToString(hash), pending.ObjectId)
+		return
+	}
+
+	if os.IsNotExist(err) == false || source == pending.Filepath {
+		return
+	}
+
+	var metadata bindiff.FileMetaData
+	if metadata, err = bindiff.GetFileMetaData(pending.Filepath); err != nil {
+		return
+	}
+
+	info, err := objectStore.Head(ObjectKey(object))
+	stored = err == nil && info.Size == metadata.PatchSize
+	intact = stored
+	return
+}
+
+// RecoverPut finishes or undoes a put that failed or crashed before it was committed.
+func RecoverPut(pending *journal.Journal) (err error) {
+	return recoverPut(pending, putSlots{})
+}
+
+// recoverPut is RecoverPut uploading and posting within slots.
+func recoverPut(pending *journal.Journal, slots putSlots) (err error) {
+
+	slog.Infof("Recovering put of %s from stage %s", pending.Filepath, pending.Stage)
+
+	switch pending.Stage {
+		case journal.STAGE_POSTED:
+			err = pending.Commit()
+			return
+		case journal.STAGE_PREPARED, journal.STAGE_UPLOADED:
+		case journal.STAGE_BEGIN:
+			err = pending.Rollback()
+			return
+		default:
+			err = errors.Errorf("Unknown journal stage %s of %s", pending.Stage, pending.Filepath)
+			return
+	}
+
+	// Checking the source hashes it again.
+	intact, stored := false, false
+	if journalRecovery != JOURNAL_ROLLBACK {
+		run(slots.hash, func() error {
+			intact, stored = uploadSourceIntact(pending)
+			return nil
+		})
+	}
+
+	if intact == false {
+		slog.Infof("Rolling back put of %s", pending.Filepath)
+		err = pending.Rollback()
+		return
+	}
+
+	if pending.Stage == journal.STAGE_PREPARED {
+		// A streamed patch went up before the prepare, there is nothing left to upload.
+		if stored == false {
+			if err = run(slots.upload, func() error { return uploadStep(pending.Filepath) }); err != nil {
+				return
+			}
+		}
+
+		if err = pending.Advance(journal.STAGE_UPLOADED, ""); err != nil {
+			return
+		}
+	}
+
+	if err = run(slots.post, func() error { return postStep(pending.Filepath) }); err != nil {
+		return
+	}
+
+	if err = pending.Advance(journal.STAGE_POSTED, ""); err != nil {
+		return
+	}
+
+	err = pending.Commit()
+	return
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"os"
+	"bytes"
+	"testing"
+	"net/http"
+	"io/ioutil"
+	"sync/atomic"
+	"net/http/httptest"
+
+	"../bindiff"
+	"../journal"
+)
+
+// newTestTriton points tritonConveyor at a server handling requests with handler.
+func newTestTriton(handler http.HandlerFunc) (cleanup func()) {
+
+	server := httptest.NewServer(handler)
+
+	tritonConveyor.Endpoints = []string{server.Listener.Addr().String()}
+	tritonConveyor.Account.Container = accountSetting.MachineId
+
+	return server.Close
+}
+
+// pendingPut begins the put of content as the next version of path and advances its
+// journal up to stage, the way PutFile leaves it when it stops there.
+func pendingPut(t *testing.T, path string, content []byte, stage string) (object string) {
+
+	pending, err := journal.Begin(JournalPath(path), path, journalFiles(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(path, content, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if stage == journal.STAGE_BEGIN {
+		return
+	}
+
+	var source string
+	if err = bindiff.CreatePatch(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if source, object, err = UploadSource(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = pending.Advance(journal.STAGE_PREPARED, object); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, next := range []string{journal.STAGE_UPLOADED, journal.STAGE_POSTED} {
+		if stage == journal.STAGE_PREPARED {
+			break
+		}
+
+		if next == journal.STAGE_UPLOADED {
+			if err = objectStore.Put(ObjectKey(object), source); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err = pending.Advance(next, ""); err != nil {
+			t.Fatal(err)
+		}
+
+		if next == stage {
+			break
+		}
+	}
+	return
+}
+
+func TestRecoverPut(t *testing.T) {
+
+	dir, cleanup := newTestStore(t)
+	defer cleanup()
+
+	var posts int32
+	defer newTestTriton(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			atomic.AddInt32(&posts, 1)
+		}
+	})()
+
+	path := dir + "/file"
+	contents := testContents()
+	backupVersions(t, path, contents[:1])
+
+	meta, err := ioutil.ReadFile(bindiff.S3_TRITON_ROOT + path + ".meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		stage string
+		recovery string
+		// intact false overwrites the upload source, so it no longer hashes to the journal's object.
+		intact bool
+		// streamed puts leave no .patch, only the object in the store. intact false deletes it.
+		streamed bool
+		posts int32
+		rolledBack bool
+	}{
+		{journal.STAGE_BEGIN, JOURNAL_RESUME, true, false, 0, true},
+		{journal.STAGE_PREPARED, JOURNAL_RESUME, true, false, 1, false},
+		{journal.STAGE_PREPARED, JOURNAL_RESUME, false, false, 0, true},
+		{journal.STAGE_PREPARED, JOURNAL_ROLLBACK, true, false, 0, true},
+		{journal.STAGE_UPLOADED, JOURNAL_RESUME, true, false, 1, false},
+		{journal.STAGE_POSTED, JOURNAL_RESUME, true, false, 0, false},
+		{journal.STAGE_PREPARED, JOURNAL_RESUME, true, true, 1, false},
+		{journal.STAGE_UPLOADED, JOURNAL_RESUME, true, true, 1, false},
+		{journal.STAGE_UPLOADED, JOURNAL_RESUME, false, true, 0, true},
+	}
+
+	defer func() {
+		journalRecovery = JOURNAL_RESUME
+	}()
+
+	for _, c := range cases {
+		// Every case starts from the committed first version.
+		if err = ioutil.WriteFile(bindiff.S3_TRITON_ROOT + path + ".meta", meta, 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		object := pendingPut(t, path, contents[1], c.stage)
+
+		source, _, _ := UploadSource(path)
+		if c.streamed {
+			if err = objectStore.Put(ObjectKey(object), source); err != nil {
+				t.Fatal(err)
+			}
+
+			if err = os.Remove(source); err != nil {
+				t.Fatal(err)
+			}
+
+			if c.intact == false {
+				if err = objectStore.Delete(ObjectKey(object)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		} else if c.intact == false {
+			if err = ioutil.WriteFile(source, []byte("changed"), 0666); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		atomic.StoreInt32(&posts, 0)
+		journalRecovery = c.recovery
+
+		if loaded, loadErr := journal.Load(JournalPath(path)); loadErr != nil || loaded == nil {
+			t.Fatalf("Fail to load journal at %s: %v", c.stage, loadErr)
+		} else if err = RecoverPut(loaded); err != nil {
+			t.Errorf("Fail to recover from %s, streamed %v: %s", c.stage, c.streamed, err.Error())
+		}
+
+		if _, statErr := os.Stat(JournalPath(path)); os.IsNotExist(statErr) == false {
+			t.Errorf("Journal left after recovering from %s", c.stage)
+		}
+
+		if got := atomic.LoadInt32(&posts); got != c.posts {
+			t.Errorf("Recovery from %s, %s, streamed %v posted %d times", c.stage, c.recovery, c.streamed, got)
+		}
+
+		current, _ := ioutil.ReadFile(bindiff.S3_TRITON_ROOT + path + ".meta")
+		if rolledBack := bytes.Equal(current, meta); rolledBack != c.rolledBack {
+			t.Errorf("Recovery from %s, %s, streamed %v rolled back: %v", c.stage, c.recovery, c.streamed, rolledBack)
+		}
+
+		if c.rolledBack == false {
+			if _, err = objectStore.Head(ObjectKey(object)); err != nil {
+				t.Errorf("Object of the put recovered from %s is missing: %v", c.stage, err)
+			}
+		}
+	}
+
+	if err = RecoverPut(&journal.Journal{Path: JournalPath(path), Filepath: path, Stage: "unknown"}); err == nil {
+		t.Error("Unknown stage was recovered")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"time"
+	"strconv"
+	"github.com/pkg/errors"
+
+	"../triton"
+)
+
+const (
+	EXIT_FAILURE = 1
+	EXIT_NO_MATCH = 2
+)
+
+var errNoVersionMatched = errors.New("No version matched")
+
+var versionTimeLayouts = []string{
+	time.RFC3339Nano,
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+type VersionSelector struct {
+	At string
+	VersionId string
+	Latest bool
+	Oldest bool
+}
+
+
+func (selector VersionSelector) IsSet() bool {
+	return selector.At != "" || selector.VersionId != "" || selector.Latest || selector.Oldest
+}
+
+func ParseVersionTime(value string) (t time.Time, err error) {
+
+	if seconds, convErr := strconv.ParseInt(value, 10, 64); convErr == nil {
+		t = time.Unix(seconds, 0)
+		return
+	}
+
+	for _, layout := range versionTimeLayouts {
+		if t, err = time.Parse(layout, value); err == nil {
+			return
+		}
+	}
+
+	err = errors.Errorf("Unrecognized time: %s", value)
+	return
+}
+
+// SelectVersion returns the index in fileVersions, which ListFile fills newest first.
+func SelectVersion(fileVersions []triton.Version, selector VersionSelector) (idx int, err error) {
+
+	set := 0
+	for _, option := range []bool{selector.At != "", selector.VersionId != "", selector.Latest, selector.Oldest} {
+		if option {
+			set += 1
+		}
+	}
+
+	if set != 1 {
+		err = errors.New("Exactly one of -at, -version-id, -latest and -oldest is allowed")
+		return
+	}
+
+	if len(fileVersions) == 0 {
+		err = errNoVersionMatched
+		return
+	}
+
+	switch {
+		case selector.Latest:
+			idx = 0
+			return
+		case selector.Oldest:
+			idx = len(fileVersions) - 1
+			return
+		case selector.VersionId != "":
+			for i, version := range fileVersions {
+				if version.VersionId == selector.VersionId {
+					idx = i
+					return
+				}
+			}
+	}
+
+	if selector.At != "" {
+		var at time.Time
+		if at, err = ParseVersionTime(selector.At); err != nil {
+			return
+		}
+
+		for i, version := range fileVersions {
+			var stime time.Time
+			if stime, err = ParseVersionTime(version.Stime); err != nil {
+				return
+			}
+
+			if stime.After(at) == false {
+				idx = i
+				return
+			}
+		}
+	}
+
+	err = errNoVersionMatched
+	return
+}
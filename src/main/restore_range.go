@@ -0,0 +1,342 @@
+package main
+
+import (
+	"io"
+	"os"
+	"bytes"
+	"bufio"
+	"strings"
+	"github.com/pkg/errors"
+
+	"../slog"
+	"../bindiff"
+	"../triton"
+	"../storage"
+)
+
+// Gaps in patch data smaller than this are downloaded rather than split into another ranged GET.
+const RANGE_MERGE_GAP = 64 * 1024
+
+const PATCH_TABLE_PROBE = 4096
+
+const RANGE_COPY_CHUNK = 8 * 1024 * 1024
+
+type chainPatch struct {
+	ObjectId string
+	Records []bindiff.Patch
+	DataOffsets []int64
+}
+
+type VersionChain struct {
+	Baseline string
+	BaselineSize int64
+	Patches []chainPatch
+	size int64
+}
+
+type rangeSegment struct {
+	dataOffset int64
+	length int64
+	bufPos int64
+}
+
+
+// ChainObjects returns the object ids needed to rebuild fileVersions[idx], baseline first.
+func ChainObjects(idx int, fileVersions []triton.Version) (objectIds []string, err error) {
+
+	foundBaseline := false
+
+	for _, version := range fileVersions[idx:] {
+		found := false
+
+		for _, objectId := range objectIds {
+			if objectId == version.ObjectId {
+				found = true
+				break
+			}
+		}
+
+		if found == true {
+			continue
+		}
+
+		objectIds = append(objectIds, version.ObjectId)
+
+		if version.Type == "baseline" {
+			foundBaseline = true
+			break
+		}
+	}
+
+	if foundBaseline == false {
+		err = errors.Errorf("No baseline found for version %s", fileVersions[idx].VersionId)
+		return
+	}
+
+	for i, j := 0, len(objectIds) - 1; i < j; i, j = i + 1, j - 1 {
+		objectIds[i], objectIds[j] = objectIds[j], objectIds[i]
+	}
+	return
+}
+
+
+func loadPatchTable(objectId string) (patch chainPatch, err error) {
+
+	patch.ObjectId = objectId
+	probe := int64(PATCH_TABLE_PROBE)
+
+	for {
+		var data []byte
+		if data, err = objectStore.GetRange(ObjectKey(objectId), 0, probe); err != nil {
+			return
+		}
+
+		var headerSize int64
+		patch.Records, headerSize, err = bindiff.ReadPatchTable(bufio.NewReader(bytes.NewReader(data)))
+
+		if err == io.EOF && int64(len(data)) == probe {
+			probe *= 4
+			continue
+		}
+
+		if err != nil {
+			slog.Errorf("Fail to read patch table of %s: %s", objectId, err.Error())
+			return
+		}
+
+		dataOffset := headerSize
+		for _, record := range patch.Records {
+			patch.DataOffsets = append(patch.DataOffsets, dataOffset)
+			dataOffset += record.Size
+		}
+		return
+	}
+}
+
+
+func LoadVersionChain(idx int, fileVersions []triton.Version) (chain *VersionChain, err error) {
+
+	var objectIds []string
+	if objectIds, err = ChainObjects(idx, fileVersions); err != nil {
+		return
+	}
+
+	chain = &VersionChain{Baseline: objectIds[0]}
+
+	var info storage.ObjectInfo
+	if info, err = objectStore.Head(ObjectKey(chain.Baseline)); err != nil {
+		slog.Errorf("Fail to head baseline %s: %s", chain.Baseline, err.Error())
+		return
+	}
+
+	chain.BaselineSize = info.Size
+	chain.size = chain.BaselineSize
+
+	for _, objectId := range objectIds[1:] {
+		var patch chainPatch
+		if patch, err = loadPatchTable(objectId); err != nil {
+			return
+		}
+
+		for _, record := range patch.Records {
+			if record.Size == 0 {
+				chain.size = record.Offset
+			} else if record.Offset + record.Size > chain.size {
+				chain.size = record.Offset + record.Size
+			}
+		}
+
+		chain.Patches = append(chain.Patches, patch)
+	}
+
+	return
+}
+
+func (chain *VersionChain) Size() int64 {
+	return chain.size
+}
+
+func fetchSegments(objectId string, segments []rangeSegment, buf []byte) (err error) {
+
+	for i := 0; i < len(segments); {
+		j := i
+		end := segments[i].dataOffset + segments[i].length
+
+		for j + 1 < len(segments) && segments[j + 1].dataOffset - end <= RANGE_MERGE_GAP {
+			j += 1
+			end = segments[j].dataOffset + segments[j].length
+		}
+
+		var data []byte
+		if data, err = objectStore.GetRange(ObjectKey(objectId), segments[i].dataOffset, end - segments[i].dataOffset); err != nil {
+			return
+		}
+
+		for _, segment := range segments[i : j + 1] {
+			start := segment.dataOffset - segments[i].dataOffset
+			if start + segment.length > int64(len(data)) {
+				err = errors.Errorf("Short read of %s at %d", objectId, segment.dataOffset)
+				return
+			}
+			copy(buf[segment.bufPos : segment.bufPos + segment.length], data[start : start + segment.length])
+		}
+
+		i = j + 1
+	}
+	return
+}
+
+// ReadAt rebuilds p from the baseline and only the patch records that overlap it.
+func (chain *VersionChain) ReadAt(p []byte, off int64) (n int, err error) {
+
+	if off >= chain.size {
+		return 0, io.EOF
+	}
+
+	end := off + int64(len(p))
+	if end > chain.size {
+		end = chain.size
+	}
+
+	buf := p[: end - off]
+	for i := range buf {
+		buf[i] = 0
+	}
+
+	if off < chain.BaselineSize {
+		baselineEnd := end
+		if baselineEnd > chain.BaselineSize {
+			baselineEnd = chain.BaselineSize
+		}
+
+		if err = fetchSegments(chain.Baseline, []rangeSegment{{off, baselineEnd - off, 0}}, buf); err != nil {
+			return
+		}
+	}
+
+	for _, patch := range chain.Patches {
+		var segments []rangeSegment
+
+		for i, record := range patch.Records {
+			if record.Size == 0 {
+				if record.Offset < end {
+					truncateAt := record.Offset
+					if truncateAt < off {
+						truncateAt = off
+					}
+
+					// Earlier segments of this patch may still land before the truncation point.
+					if err = fetchSegments(patch.ObjectId, segments, buf); err != nil {
+						return
+					}
+					segments = nil
+
+					for j := truncateAt - off; j < int64(len(buf)); j++ {
+						buf[j] = 0
+					}
+				}
+				break
+			}
+
+			start := record.Offset
+			if start < off {
+				start = off
+			}
+
+			stop := record.Offset + record.Size
+			if stop > end {
+				stop = end
+			}
+
+			if start >= stop {
+				continue
+			}
+
+			segments = append(segments, rangeSegment{patch.DataOffsets[i] + start - record.Offset, stop - start, start - off})
+		}
+
+		if err = fetchSegments(patch.ObjectId, segments, buf); err != nil {
+			return
+		}
+	}
+
+	n = len(buf)
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+
+func RestoreRange(filepath string, idx int, fileVersions []triton.Version, offset int64, length int64, output string) (err error) {
+
+	if offset < 0 || length < 0 {
+		err = errors.Errorf("Offset %d and length %d can't be negative", offset, length)
+		return
+	}
+
+	var objectIds []string
+	if objectIds, err = ChainObjects(idx, fileVersions); err != nil {
+		slog.Errorf("Fail to get version chain of %s: %s", filepath, err.Error())
+		return
+	}
+
+	if err = RestoreArchivedChain(filepath, fileVersions[idx].VersionId, objectIds); err != nil {
+		slog.Errorf("Fail to restore archived objects of %s: %s", filepath, err.Error())
+		return
+	}
+
+	var chain *VersionChain
+	if chain, err = LoadVersionChain(idx, fileVersions); err != nil {
+		slog.Errorf("Fail to load version chain of %s: %s", filepath, err.Error())
+		return
+	}
+
+	if offset >= chain.Size() {
+		err = errors.Errorf("Offset %d is beyond the file size %d", offset, chain.Size())
+		return
+	}
+
+	if length <= 0 || offset + length > chain.Size() {
+		length = chain.Size() - offset
+	}
+
+	if lastSlash := strings.LastIndex(output, "/"); lastSlash > 0 {
+		if err = bindiff.CreateDirIfNotExist(output[:lastSlash]); err != nil {
+			slog.Errorf("Fail to create directory of %s: %s", output, err.Error())
+			return
+		}
+	}
+
+	var outfile *os.File
+	if outfile, err = os.Create(output); err != nil {
+		slog.Errorf("Fail to create %s: %s", output, err.Error())
+		return
+	}
+	defer outfile.Close()
+
+	buf := make([]byte, RANGE_COPY_CHUNK)
+
+	for pos := offset; pos < offset + length; {
+		chunk := buf
+		if int64(len(chunk)) > offset + length - pos {
+			chunk = chunk[: offset + length - pos]
+		}
+
+		var rc int
+		if rc, err = chain.ReadAt(chunk, pos); err != nil && err != io.EOF {
+			slog.Errorf("Fail to restore %d+%d of %s: %s", pos, len(chunk), filepath, err.Error())
+			return
+		}
+
+		if _, err = outfile.Write(chunk[:rc]); err != nil {
+			slog.Errorf("Fail to write %s: %s", output, err.Error())
+			return
+		}
+
+		pos += int64(rc)
+	}
+
+	err = outfile.Sync()
+	return
+}
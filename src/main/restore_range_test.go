@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"bytes"
+	"testing"
+	"math/rand"
+	"io/ioutil"
+
+	"../bindiff"
+	"../triton"
+	"../storage"
+)
+
+// TestMain keeps the meta data of the tests out of the real S3_TRITON_ROOT.
+func TestMain(m *testing.M) {
+
+	root, err := ioutil.TempDir("", "s3_triton")
+	if err != nil {
+		panic(err)
+	}
+
+	bindiff.S3_TRITON_ROOT = root + "/"
+	accountSetting.MachineId = "4097"
+	code := m.Run()
+
+	os.RemoveAll(root)
+	os.Exit(code)
+}
+
+// newTestStore points objectStore at a LocalStore in a temporary directory, which also
+// has room for the backed up files.
+func newTestStore(t *testing.T) (dir string, cleanup func()) {
+
+	var err error
+	if dir, err = ioutil.TempDir("", "main"); err != nil {
+		t.Fatal(err)
+	}
+
+	if objectStore, err = storage.NewLocalStore(dir + "/objects"); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Fail to create local store: %s", err.Error())
+	}
+
+	cleanup = func() {
+		os.RemoveAll(dir)
+		os.RemoveAll(bindiff.S3_TRITON_ROOT + dir)
+	}
+	return
+}
+
+// backupVersions stores every content in turn as a version of path, the way PutFile creates
+// and uploads them, and returns the versions newest first, as Triton lists them.
+func backupVersions(t *testing.T, path string, contents [][]byte) (versions []triton.Version) {
+
+	for i, content := range contents {
+		if err := ioutil.WriteFile(path, content, 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := bindiff.CreatePatch(path); err != nil {
+			t.Fatalf("Fail to create patch of version %d: %s", i, err.Error())
+		}
+
+		source, object, err := UploadSource(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = PutObject(path, source, object); err != nil {
+			t.Fatalf("Fail to put version %d: %s", i, err.Error())
+		}
+
+		version := triton.Version{Deleted: "false", Type: "patch", VersionId: fmt.Sprintf("v%d", i + 1), ObjectId: object}
+		if i == 0 {
+			version.Type = "baseline"
+		}
+
+		versions = append([]triton.Version{version}, versions...)
+	}
+	return
+}
+
+// testContents are versions that change blocks in place, shrink and grow again.
+func testContents() [][]byte {
+
+	random := rand.New(rand.NewSource(1))
+
+	v1 := make([]byte, 300000)
+	random.Read(v1)
+
+	v2 := append([]byte{}, v1[:200000]...)
+	random.Read(v2[12345:30001])
+	random.Read(v2[150000:150100])
+
+	v3 := append(append([]byte{}, v2...), make([]byte, 133333)...)
+	random.Read(v3[180000:])
+
+	return [][]byte{v1, v2, v3}
+}
+
+// consolidate rebuilds fileVersions[idx] the way GetFile does, downloading the whole chain.
+func consolidate(t *testing.T, dir string, idx int, fileVersions []triton.Version) []byte {
+
+	objectIds, err := ChainObjects(idx, fileVersions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []string{}
+	for _, objectId := range objectIds {
+		file := dir + "/" + objectId + ".dat"
+		if err = objectStore.Get(ObjectKey(objectId), file); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+
+	if err = bindiff.ConsolidatePatches(files[0], files[1:]); err != nil {
+		t.Fatalf("Fail to consolidate %s: %s", fileVersions[idx].VersionId, err.Error())
+	}
+
+	data, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestVersionChainReadAt(t *testing.T) {
+
+	dir, cleanup := newTestStore(t)
+	defer cleanup()
+
+	contents := testContents()
+	versions := backupVersions(t, dir + "/file", contents)
+
+	for idx := range versions {
+		want := consolidate(t, dir, idx, versions)
+		if bytes.Equal(want, contents[len(contents) - 1 - idx]) == false {
+			t.Fatalf("Consolidated %s differs from what was backed up", versions[idx].VersionId)
+		}
+
+		chain, err := LoadVersionChain(idx, versions)
+		if err != nil {
+			t.Fatalf("Fail to load chain of %s: %s", versions[idx].VersionId, err.Error())
+		}
+
+		if chain.Size() != int64(len(want)) {
+			t.Errorf("%s has size %d, want %d", versions[idx].VersionId, chain.Size(), len(want))
+		}
+
+		for _, span := range [][2]int64{{0, 1000}, {12000, 20000}, {149990, 200}, {199000, 5000}, {0, int64(len(want))}, {int64(len(want)) - 10, 100}} {
+			p := make([]byte, span[1])
+			n, err := chain.ReadAt(p, span[0])
+
+			end := span[0] + span[1]
+			if end > int64(len(want)) {
+				end = int64(len(want))
+			}
+
+			if (err != nil && err != io.EOF) || bytes.Equal(p[:n], want[span[0]:end]) == false {
+				t.Errorf("%s at %d+%d: %d bytes, %v", versions[idx].VersionId, span[0], span[1], n, err)
+			}
+		}
+
+		if _, err = chain.ReadAt(make([]byte, 10), int64(len(want))); err != io.EOF {
+			t.Errorf("Read past the end of %s gave %v", versions[idx].VersionId, err)
+		}
+	}
+
+	output := dir + "/range"
+	if err := RestoreRange(dir + "/file", 1, versions, 12000, 50000, output); err != nil {
+		t.Fatalf("Fail to restore range: %s", err.Error())
+	}
+
+	if data, _ := ioutil.ReadFile(output); bytes.Equal(data, contents[1][12000:62000]) == false {
+		t.Errorf("Restored range has %d bytes and differs", len(data))
+	}
+
+	for _, span := range [][2]int64{{-1, 10}, {0, -10}} {
+		if err := RestoreRange(dir + "/file", 0, versions, span[0], span[1], output); err == nil {
+			t.Errorf("Restore of %d+%d was accepted", span[0], span[1])
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"time"
+	"testing"
+
+	"../triton"
+)
+
+func TestParseVersionTime(t *testing.T) {
+
+	cases := []struct {
+		value string
+		want time.Time
+	}{
+		{"1790000000", time.Unix(1790000000, 0)},
+		{"2026-10-01T12:00:00.5Z", time.Date(2026, 10, 1, 12, 0, 0, 500000000, time.UTC)},
+		{"2026-10-01T12:00:00+02:00", time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)},
+		{"2026-10-01T12:00Z", time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)},
+		{"2026-10-01T12:00", time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)},
+		{"2026-10-01 12:00:30", time.Date(2026, 10, 1, 12, 0, 30, 0, time.UTC)},
+		{"2026-10-01", time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, c := range cases {
+		got, err := ParseVersionTime(c.value)
+		if err != nil || got.Equal(c.want) == false {
+			t.Errorf("%s parsed to %s, %v, want %s", c.value, got, err, c.want)
+		}
+	}
+
+	for _, value := range []string{"", "yesterday", "2026-13-01"} {
+		if _, err := ParseVersionTime(value); err == nil {
+			t.Errorf("%q parsed", value)
+		}
+	}
+}
+
+func TestSelectVersion(t *testing.T) {
+
+	// Newest first, as ListFile fills them.
+	versions := []triton.Version{
+		{VersionId: "v3", Stime: "2026-10-03T00:00:00Z"},
+		{VersionId: "v2", Stime: "2026-10-02T00:00:00Z"},
+		{VersionId: "v1", Stime: "2026-10-01T00:00:00Z"},
+	}
+
+	cases := []struct {
+		name string
+		selector VersionSelector
+		idx int
+		err error
+	}{
+		{"latest", VersionSelector{Latest: true}, 0, nil},
+		{"oldest", VersionSelector{Oldest: true}, 2, nil},
+		{"version id", VersionSelector{VersionId: "v2"}, 1, nil},
+		{"unknown version id", VersionSelector{VersionId: "v9"}, 0, errNoVersionMatched},
+		{"at a version", VersionSelector{At: "2026-10-02"}, 1, nil},
+		{"between versions", VersionSelector{At: "2026-10-02T12:00Z"}, 1, nil},
+		{"after the newest", VersionSelector{At: "2027-01-01"}, 0, nil},
+		{"before the oldest", VersionSelector{At: "2026-09-30"}, 0, errNoVersionMatched},
+	}
+
+	for _, c := range cases {
+		idx, err := SelectVersion(versions, c.selector)
+		if err != c.err || (err == nil && idx != c.idx) {
+			t.Errorf("%s: got %d, %v, want %d, %v", c.name, idx, err, c.idx, c.err)
+		}
+	}
+
+	if _, err := SelectVersion(versions, VersionSelector{Latest: true, Oldest: true}); err == nil || err == errNoVersionMatched {
+		t.Errorf("Two selectors gave %v", err)
+	}
+
+	if _, err := SelectVersion(versions, VersionSelector{}); err == nil || err == errNoVersionMatched {
+		t.Errorf("No selector gave %v", err)
+	}
+
+	if _, err := SelectVersion(nil, VersionSelector{Latest: true}); err != errNoVersionMatched {
+		t.Errorf("No versions gave %v", err)
+	}
+
+	if _, err := SelectVersion(versions, VersionSelector{At: "someday"}); err == nil || err == errNoVersionMatched {
+		t.Errorf("Bad time gave %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"strings"
+	"encoding/hex"
+
+	"../slog"
+	"../bindiff"
+	"../triton"
+	"../storage"
+)
+
+
+type ScrubIssue struct {
+	Fullpath string
+	VersionId string
+	ObjectId string
+	Reason string
+}
+
+type ScrubReport struct {
+	Objects int
+	Versions int
+	Missing []ScrubIssue
+	Corrupt []ScrubIssue
+	BrokenChains []ScrubIssue
+	// Unverified are links between versions nothing records the previous object of,
+	// such as patches uploaded before objects carried metadata.
+	Unverified int
+	Orphaned []string
+}
+
+
+func (report ScrubReport) Healthy() bool {
+	return len(report.Missing) == 0 && len(report.Corrupt) == 0 && len(report.BrokenChains) == 0 && len(report.Orphaned) == 0
+}
+
+func (report ScrubReport) String() string {
+
+	result := fmt.Sprintf("Scrubbed %d named objects, %d versions\n", report.Objects, report.Versions)
+
+	for _, issue := range report.Missing {
+		result += fmt.Sprintf("MISSING %s %s version %s: %s\n", issue.ObjectId, issue.Fullpath, issue.VersionId, issue.Reason)
+	}
+
+	for _, issue := range report.Corrupt {
+		result += fmt.Sprintf("CORRUPT %s %s version %s: %s\n", issue.ObjectId, issue.Fullpath, issue.VersionId, issue.Reason)
+	}
+
+	for _, issue := range report.BrokenChains {
+		result += fmt.Sprintf("BROKEN CHAIN %s %s version %s: %s\n", issue.ObjectId, issue.Fullpath, issue.VersionId, issue.Reason)
+	}
+
+	for _, key := range report.Orphaned {
+		result += fmt.Sprintf("ORPHANED %s\n", key)
+	}
+
+	result += fmt.Sprintf("Missing: %d, corrupt: %d, broken chains: %d, unverified links: %d, orphaned: %d\n",
+		                  len(report.Missing), len(report.Corrupt), len(report.BrokenChains), report.Unverified, len(report.Orphaned))
+	return result
+}
+
+
+// CheckVersionChain checks every patch of namedObject applies to the version listed right
+// after it. previous tells what object a patch applies to, false when nothing records it.
+func CheckVersionChain(namedObject triton.NamedObject, previous func(objectId string) (string, bool)) (issues []ScrubIssue, unverified int) {
+
+	// Versions are listed newest first, so every patch must link to the version right after it.
+	// A put of an unchanged file lists the object of the version before it again, a run of
+	// them stands for the oldest one, which was uploaded.
+	versions := []triton.Version{}
+	for i, version := range namedObject.Versions.Versions {
+		if i + 1 < len(namedObject.Versions.Versions) && strings.EqualFold(version.ObjectId, namedObject.Versions.Versions[i + 1].ObjectId) {
+			continue
+		}
+		versions = append(versions, version)
+	}
+
+	for i, version := range versions {
+		if version.Type == "baseline" {
+			continue
+		}
+
+		if i == len(versions) - 1 {
+			issues = append(issues, ScrubIssue{namedObject.Fullpath, version.VersionId, version.ObjectId, "patch has no previous version"})
+			continue
+		}
+
+		prevObjectId, ok := previous(strings.ToLower(version.ObjectId))
+		if ok == false {
+			unverified += 1
+			continue
+		}
+
+		if strings.EqualFold(prevObjectId, versions[i + 1].ObjectId) == false {
+			issues = append(issues, ScrubIssue{namedObject.Fullpath, version.VersionId, version.ObjectId,
+			                                   "previous object is " + prevObjectId + " but chain has " + versions[i + 1].ObjectId})
+		}
+	}
+	return
+}
+
+// localPrevious records what the last patch put of fullpath applies to, from its meta data.
+// A put of an unchanged file records its patch as applying to itself, which says nothing.
+func localPrevious(fullpath string, previous map[string]string) {
+
+	metadata, err := bindiff.GetFileMetaData(fullpath)
+	if err != nil || metadata.PatchType == bindiff.FORMAT_BASELINE || metadata.PatchHash == metadata.PrevPatchHash {
+		return
+	}
+
+	previous[hex.EncodeToString(metadata.PatchHash[:])] = hex.EncodeToString(metadata.PrevPatchHash[:])
+}
+
+
+func VerifyObject(objectId string, tmpPath string) (err error) {
+
+	downloadfile := tmpPath + objectId + ".dat"
+
+	if err = objectStore.Get(ObjectKey(objectId), downloadfile); err != nil {
+		return
+	}
+	defer os.Remove(downloadfile)
+
+	var hash []byte
+	if hash, err = bindiff.GetFileHash(downloadfile); err != nil {
+		return
+	}
+
+	if strings.EqualFold(hex.EncodeToString(hash), objectId) == false {
+		err = fmt.Errorf("content hash is %s", hex.EncodeToString(hash))
+	}
+	return
+}
+
+
+func Scrub(verify bool) (report ScrubReport, err error) {
+
+	var repoLock *bindiff.FileLock
+	if repoLock, err = bindiff.LockRepository(true, lockWait); err != nil {
+		slog.Errorf("Fail to lock repository: %s", err.Error())
+		return
+	}
+	defer repoLock.Unlock()
+
+	var listResult triton.ListNamedObjectResults
+
+	if err = tritonConveyor.ListAllNamedObjects(&listResult); err != nil {
+		slog.Errorf("Fail to list named objects of %s: %s", accountSetting.MachineId, err.Error())
+		return
+	}
+
+	tmpPath := bindiff.S3_TRITON_ROOT + "scrub_tmp/"
+
+	if verify {
+		if err = bindiff.CreateDirIfNotExist(tmpPath); err != nil {
+			slog.Errorf("Fail to create %s: %s", tmpPath, err.Error())
+			return
+		}
+		defer os.RemoveAll(tmpPath)
+	}
+
+	// Every object is only checked once, no matter how many versions reference it.
+	referenced := map[string]bool{}
+
+	// previous maps patch objects to the object they apply to, as far as their metadata tells.
+	previous := map[string]string{}
+
+	for _, namedObject := range listResult.Objects.NamedObjects {
+		report.Objects += 1
+
+		for _, version := range namedObject.Versions.Versions {
+			report.Versions += 1
+
+			objectId := strings.ToLower(version.ObjectId)
+			if _, checked := referenced[objectId]; checked {
+				continue
+			}
+			referenced[objectId] = true
+
+			issue := ScrubIssue{namedObject.Fullpath, version.VersionId, objectId, ""}
+
+			if len(objectId) != 40 {
+				issue.Reason = "invalid object id"
+				report.Corrupt = append(report.Corrupt, issue)
+				continue
+			}
+
+			var info storage.ObjectInfo
+			if info, err = objectStore.Head(ObjectKey(objectId)); err == storage.ErrNotFound {
+				err = nil
+				issue.Reason = "not found in object store"
+				report.Missing = append(report.Missing, issue)
+				continue
+			} else if err != nil {
+				slog.Errorf("Fail to head %s: %s", objectId, err.Error())
+				return
+			}
+
+			if metadata, metaErr := storage.ParseObjectMetadata(info.Metadata); metaErr == nil && metadata.VersionType == storage.VERSION_PATCH {
+				previous[objectId] = strings.ToLower(metadata.PreviousObjectId)
+			}
+
+			if verify {
+				if verifyErr := VerifyObject(objectId, tmpPath); verifyErr != nil {
+					issue.Reason = verifyErr.Error()
+					report.Corrupt = append(report.Corrupt, issue)
+				}
+			}
+		}
+
+	}
+
+	for _, namedObject := range listResult.Objects.NamedObjects {
+		localPrevious(namedObject.Fullpath, previous)
+	}
+
+	for _, namedObject := range listResult.Objects.NamedObjects {
+		issues, unverified := CheckVersionChain(namedObject, func(objectId string) (prevObjectId string, ok bool) {
+			prevObjectId, ok = previous[objectId]
+			return
+		})
+
+		report.BrokenChains = append(report.BrokenChains, issues...)
+		report.Unverified += unverified
+	}
+
+	err = objectStore.List(accountSetting.MachineId + "/", func(info storage.ObjectInfo) bool {
+		if objectId, ok := storage.ObjectIdOfKey(info.Key); ok && referenced[objectId] == false {
+			report.Orphaned = append(report.Orphaned, info.Key)
+		}
+		return true
+	})
+
+	return
+}
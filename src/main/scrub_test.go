@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"../bindiff"
+	"../triton"
+)
+
+func chainObject(versions ...triton.Version) triton.NamedObject {
+	return triton.NamedObject{Fullpath: "/a/b", Versions: triton.VersionList{Versions: versions}}
+}
+
+func TestCheckVersionChain(t *testing.T) {
+
+	baseline := triton.Version{Type: "baseline", VersionId: "1", ObjectId: strings.Repeat("a", 40)}
+	patch := triton.Version{Type: "patch", VersionId: "2", ObjectId: strings.Repeat("b", 40)}
+	newest := triton.Version{Type: "patch", VersionId: "3", ObjectId: strings.Repeat("C", 40)}
+
+	previous := map[string]string{
+		strings.Repeat("b", 40): strings.Repeat("a", 40),
+		strings.Repeat("c", 40): strings.Repeat("b", 40),
+	}
+
+	lookup := func(objectId string) (prevObjectId string, ok bool) {
+		prevObjectId, ok = previous[objectId]
+		return
+	}
+
+	if issues, unverified := CheckVersionChain(chainObject(newest, patch, baseline), lookup); len(issues) != 0 || unverified != 0 {
+		t.Errorf("Intact chain gave %v, %d unverified", issues, unverified)
+	}
+
+	// The newest patch claims to apply to the baseline, skipping version 2.
+	previous[strings.Repeat("c", 40)] = strings.Repeat("a", 40)
+	if issues, _ := CheckVersionChain(chainObject(newest, patch, baseline), lookup); len(issues) != 1 || issues[0].VersionId != "3" {
+		t.Errorf("Broken link gave %v", issues)
+	}
+
+	delete(previous, strings.Repeat("c", 40))
+	if issues, unverified := CheckVersionChain(chainObject(newest, patch, baseline), lookup); len(issues) != 0 || unverified != 1 {
+		t.Errorf("Unknown link gave %v, %d unverified", issues, unverified)
+	}
+
+	// Puts of the unchanged file list version 2's object again, in any case.
+	previous[strings.Repeat("c", 40)] = strings.Repeat("b", 40)
+	repeated := triton.Version{Type: "patch", VersionId: "4", ObjectId: strings.Repeat("B", 40)}
+	again := triton.Version{Type: "patch", VersionId: "5", ObjectId: strings.Repeat("b", 40)}
+	if issues, unverified := CheckVersionChain(chainObject(again, repeated, patch, baseline), lookup); len(issues) != 0 || unverified != 0 {
+		t.Errorf("Chain with repeated versions gave %v, %d unverified", issues, unverified)
+	}
+
+	if issues, _ := CheckVersionChain(chainObject(repeated, newest, patch, baseline), lookup); len(issues) != 1 || issues[0].VersionId != "4" {
+		t.Errorf("Repeated object after another version gave %v", issues)
+	}
+
+	if issues, _ := CheckVersionChain(chainObject(patch), lookup); len(issues) != 1 || issues[0].Reason != "patch has no previous version" {
+		t.Errorf("Patch without baseline gave %v", issues)
+	}
+
+	if issues, unverified := CheckVersionChain(chainObject(baseline), lookup); len(issues) != 0 || unverified != 0 {
+		t.Errorf("Lone baseline gave %v, %d unverified", issues, unverified)
+	}
+}
+
+func TestLocalPreviousRepeatedPut(t *testing.T) {
+
+	dir, cleanup := newTestStore(t)
+	defer cleanup()
+
+	contents := testContents()
+	versions := backupVersions(t, dir + "/file", [][]byte{contents[0], contents[1], contents[1]})
+
+	if strings.EqualFold(versions[0].ObjectId, versions[1].ObjectId) == false {
+		t.Fatalf("Unchanged put has object %s, the version before it %s", versions[0].ObjectId, versions[1].ObjectId)
+	}
+
+	previous := map[string]string{}
+	localPrevious(dir + "/file", previous)
+
+	if prevObjectId, ok := previous[strings.ToLower(versions[0].ObjectId)]; ok {
+		t.Errorf("Unchanged put links %s to %s", versions[0].ObjectId, prevObjectId)
+	}
+
+	previous[strings.ToLower(versions[1].ObjectId)] = strings.ToLower(versions[2].ObjectId)
+
+	issues, unverified := CheckVersionChain(chainObject(versions...), func(objectId string) (prevObjectId string, ok bool) {
+		prevObjectId, ok = previous[objectId]
+		return
+	})
+
+	if len(issues) != 0 || unverified != 0 {
+		t.Errorf("Chain with an unchanged put gave %v, %d unverified", issues, unverified)
+	}
+}
+
+func TestScrubLocalStore(t *testing.T) {
+
+	dir, cleanup := newTestStore(t)
+	defer cleanup()
+
+	versions := backupVersions(t, dir + "/file", testContents())
+
+	// Without the local meta data, only what the store kept links the patches.
+	os.Remove(bindiff.S3_TRITON_ROOT + dir + "/file.meta")
+
+	namedObjects := []triton.NamedObject{chainObject(versions...)}
+	complete := true
+	defer newTestTriton(tritonListing(&namedObjects, &complete))()
+
+	report, err := Scrub(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Healthy() == false || report.Unverified != 0 || report.Versions != len(versions) {
+		t.Errorf("Scrub of a local store reported %s", report)
+	}
+}
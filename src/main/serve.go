@@ -0,0 +1,307 @@
+package main
+
+import (
+	"io"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"html"
+	"strings"
+	"net/url"
+	"net/http"
+	"github.com/pkg/errors"
+
+	"../slog"
+	"../triton"
+	"../storage"
+)
+
+const SERVE_BLOCK_SIZE = 4 * 1024 * 1024
+
+const SERVE_LIST_TTL = time.Minute
+
+const SERVE_MAX_CHAINS = 64
+
+// serveMaxChains bounds the version chains the server keeps loaded.
+var serveMaxChains = SERVE_MAX_CHAINS
+
+// errArchived is what a version fails with when objects of its chain need a restore first.
+var errArchived = errors.New("Version is archived")
+
+// blockReaderAt keeps the last block read, so the small reads of http.ServeContent
+// don't turn into one round of ranged GETs each.
+type blockReaderAt struct {
+	src io.ReaderAt
+	size int64
+	mu sync.Mutex
+	block []byte
+	blockOff int64
+}
+
+type BrowseServer struct {
+	mu sync.Mutex
+	listedAt time.Time
+	objects map[string]triton.NamedObject
+	chains map[string]*blockReaderAt
+}
+
+
+func (reader *blockReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+
+	reader.mu.Lock()
+	defer reader.mu.Unlock()
+
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= reader.size {
+			err = io.EOF
+			return
+		}
+
+		if reader.block == nil || pos < reader.blockOff || pos >= reader.blockOff + int64(len(reader.block)) {
+			blockOff := pos - pos % SERVE_BLOCK_SIZE
+			block := make([]byte, SERVE_BLOCK_SIZE)
+
+			var rc int
+			if rc, err = reader.src.ReadAt(block, blockOff); err != nil && err != io.EOF {
+				reader.block = nil
+				return
+			}
+			err = nil
+
+			reader.block = block[:rc]
+			reader.blockOff = blockOff
+		}
+
+		n += copy(p[n:], reader.block[pos - reader.blockOff:])
+	}
+	return
+}
+
+
+func NewBrowseServer() *BrowseServer {
+	return &BrowseServer{chains: map[string]*blockReaderAt{}}
+}
+
+func LiveVersions(namedObject triton.NamedObject) (versions []triton.Version) {
+	for _, version := range namedObject.Versions.Versions {
+		if version.IsDeleted() == false {
+			versions = append(versions, version)
+		}
+	}
+	return
+}
+
+func (server *BrowseServer) namedObjects() (objects map[string]triton.NamedObject, err error) {
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if server.objects != nil && time.Since(server.listedAt) < SERVE_LIST_TTL {
+		objects = server.objects
+		return
+	}
+
+	var listResult triton.ListNamedObjectResults
+	if err = tritonConveyor.ListAllNamedObjects(&listResult); err != nil {
+		slog.Errorf("Fail to list named objects of %s: %s", accountSetting.MachineId, err.Error())
+		return
+	}
+
+	objects = map[string]triton.NamedObject{}
+	for _, namedObject := range listResult.Objects.NamedObjects {
+		if namedObject.IsDeleted() {
+			continue
+		}
+		objects[namedObject.Fullpath] = namedObject
+	}
+
+	server.objects = objects
+	server.listedAt = time.Now()
+	return
+}
+
+func (server *BrowseServer) versionReader(namedObject triton.NamedObject, idx int, versions []triton.Version) (reader *blockReaderAt, err error) {
+
+	cacheKey := namedObject.Fullpath + "\x00" + versions[idx].VersionId
+
+	server.mu.Lock()
+	reader = server.chains[cacheKey]
+	server.mu.Unlock()
+
+	if reader != nil {
+		return
+	}
+
+	// Reading an archived object only fails, and a restore takes hours: get restores it.
+	if archiver, ok := objectStore.(storage.Archiver); ok {
+		var objectIds []string
+		if objectIds, err = ChainObjects(idx, versions); err != nil {
+			return
+		}
+
+		var archived []storage.ObjectInfo
+		if archived, _, err = archivedObjects(archiver, objectIds); err != nil {
+			return
+		}
+
+		if len(archived) > 0 {
+			err = errors.Wrapf(errArchived, "%d of %d objects of version %s of %s need a restore, get the version to restore them",
+			                    len(archived), len(objectIds), versions[idx].VersionId, namedObject.Fullpath)
+			return
+		}
+	}
+
+	var chain *VersionChain
+	if chain, err = LoadVersionChain(idx, versions); err != nil {
+		slog.Errorf("Fail to load version chain of %s: %s", namedObject.Fullpath, err.Error())
+		return
+	}
+
+	reader = &blockReaderAt{src: chain, size: chain.Size()}
+
+	server.mu.Lock()
+	if len(server.chains) >= serveMaxChains {
+		for key := range server.chains {
+			delete(server.chains, key)
+			break
+		}
+	}
+	server.chains[cacheKey] = reader
+	server.mu.Unlock()
+	return
+}
+
+func writeListing(w http.ResponseWriter, title string, entries []string, details map[string]string) {
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	fmt.Fprintf(w, "<html><head><title>%s</title></head><body>\n<h1>%s</h1>\n<ul>\n", html.EscapeString(title), html.EscapeString(title))
+	for _, entry := range entries {
+		fmt.Fprintf(w, "<li><a href=\"%s\">%s</a> %s</li>\n", (&url.URL{Path: entry}).EscapedPath(), html.EscapeString(entry), html.EscapeString(details[entry]))
+	}
+	fmt.Fprint(w, "</ul>\n</body></html>\n")
+}
+
+func (server *BrowseServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "read only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	objects, err := server.namedObjects()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	path := r.URL.Path
+
+	if namedObject, ok := objects[strings.TrimSuffix(path, "/")]; ok {
+		server.serveVersionList(w, r, namedObject)
+		return
+	}
+
+	if lastSlash := strings.LastIndex(path, "/"); lastSlash > 0 {
+		if namedObject, ok := objects[path[:lastSlash]]; ok {
+			server.serveVersion(w, r, namedObject, path[lastSlash + 1:])
+			return
+		}
+	}
+
+	server.serveDirectory(w, r, objects, path)
+}
+
+func (server *BrowseServer) serveDirectory(w http.ResponseWriter, r *http.Request, objects map[string]triton.NamedObject, path string) {
+
+	if strings.HasSuffix(path, "/") == false {
+		http.Redirect(w, r, path + "/", http.StatusMovedPermanently)
+		return
+	}
+
+	children := map[string]bool{}
+	for fullpath := range objects {
+		if strings.HasPrefix(fullpath, path) == false {
+			continue
+		}
+
+		child := fullpath[len(path):]
+		if slash := strings.Index(child, "/"); slash != -1 {
+			child = child[:slash]
+		}
+		children[path + child + "/"] = true
+	}
+
+	if len(children) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	entries := []string{}
+	for child := range children {
+		entries = append(entries, child)
+	}
+	sort.Strings(entries)
+
+	writeListing(w, path, entries, nil)
+}
+
+func (server *BrowseServer) serveVersionList(w http.ResponseWriter, r *http.Request, namedObject triton.NamedObject) {
+
+	if strings.HasSuffix(r.URL.Path, "/") == false {
+		http.Redirect(w, r, r.URL.Path + "/", http.StatusMovedPermanently)
+		return
+	}
+
+	entries := []string{}
+	details := map[string]string{}
+
+	for _, version := range LiveVersions(namedObject) {
+		entry := namedObject.Fullpath + "/" + version.VersionId
+		entries = append(entries, entry)
+		details[entry] = fmt.Sprintf("%s, %d bytes, stored %s, modified %s", version.Type, version.Size, version.Stime, version.Mtime)
+	}
+
+	writeListing(w, namedObject.Fullpath, entries, details)
+}
+
+func (server *BrowseServer) serveVersion(w http.ResponseWriter, r *http.Request, namedObject triton.NamedObject, versionId string) {
+
+	versions := LiveVersions(namedObject)
+
+	for idx, version := range versions {
+		if version.VersionId != versionId {
+			continue
+		}
+
+		reader, err := server.versionReader(namedObject, idx, versions)
+		if errors.Cause(err) == errArchived {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		modtime, _ := ParseVersionTime(version.Mtime)
+		name := namedObject.Fullpath[strings.LastIndex(namedObject.Fullpath, "/") + 1:]
+
+		w.Header().Set("ETag", `"` + version.ObjectId + `"`)
+		http.ServeContent(w, r, name, modtime, io.NewSectionReader(reader, 0, reader.size))
+		return
+	}
+
+	http.NotFound(w, r)
+}
+
+
+func Serve(listen string) (err error) {
+
+	slog.Infof("Serving %s on %s", accountSetting.MachineId, listen)
+	fmt.Printf("Serving %s on http://%s/\n", accountSetting.MachineId, listen)
+
+	err = http.ListenAndServe(listen, NewBrowseServer())
+	return
+}
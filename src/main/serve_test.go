@@ -0,0 +1,254 @@
+package main
+
+import (
+	"io"
+	"bytes"
+	"strings"
+	"testing"
+	"net/http"
+	"io/ioutil"
+	"math/rand"
+	"net/http/httptest"
+
+	"../triton"
+)
+
+// countingReaderAt counts the reads that reach the source.
+type countingReaderAt struct {
+	src io.ReaderAt
+	reads int
+}
+
+func (reader *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+
+	reader.reads += 1
+	return reader.src.ReadAt(p, off)
+}
+
+// newTestBrowser serves the versions of path, backed up from contents, the way Serve does.
+func newTestBrowser(t *testing.T, path string, contents [][]byte) (server *BrowseServer, url string, cleanup func()) {
+
+	namedObjects := []triton.NamedObject{{
+		Fullpath: path,
+		Deleted: "false",
+		Versions: triton.VersionList{Versions: backupVersions(t, path, contents)},
+	}}
+	complete := true
+	tritonCleanup := newTestTriton(tritonListing(&namedObjects, &complete))
+
+	server = NewBrowseServer()
+	httpServer := httptest.NewServer(server)
+
+	url = httpServer.URL
+	cleanup = func() {
+		httpServer.Close()
+		tritonCleanup()
+	}
+	return
+}
+
+// get requests url with the headers given as name, value pairs.
+func get(t *testing.T, url string, headers ...string) (response *http.Response, body []byte) {
+
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i + 1 < len(headers); i += 2 {
+		request.Header.Set(headers[i], headers[i + 1])
+	}
+
+	// Redirects are what some of the tests look for.
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	if response, err = client.Do(request); err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if body, err = ioutil.ReadAll(response.Body); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestServeRouting(t *testing.T) {
+
+	dir, cleanup := newTestStore(t)
+	defer cleanup()
+
+	contents := testContents()
+	_, url, serverCleanup := newTestBrowser(t, dir + "/file", contents)
+	defer serverCleanup()
+
+	response, body := get(t, url + "/")
+	if response.StatusCode != http.StatusOK || strings.Contains(string(body), dir[:strings.Index(dir[1:], "/") + 2]) == false {
+		t.Errorf("Root is %d: %s", response.StatusCode, body)
+	}
+
+	if response, _ = get(t, url + dir); response.StatusCode != http.StatusMovedPermanently || response.Header.Get("Location") != dir + "/" {
+		t.Errorf("Directory without a slash is %d to %s", response.StatusCode, response.Header.Get("Location"))
+	}
+
+	if response, body = get(t, url + dir + "/"); strings.Contains(string(body), dir + "/file/") == false {
+		t.Errorf("Directory is %d: %s", response.StatusCode, body)
+	}
+
+	if response, _ = get(t, url + dir + "/file"); response.StatusCode != http.StatusMovedPermanently {
+		t.Errorf("File without a slash is %d", response.StatusCode)
+	}
+
+	// The version list has every version, newest first.
+	response, body = get(t, url + dir + "/file/")
+	listing := string(body)
+	v3, v1 := strings.Index(listing, dir + "/file/v3"), strings.Index(listing, dir + "/file/v1")
+	if response.StatusCode != http.StatusOK || v3 == -1 || v1 == -1 || v3 > v1 {
+		t.Errorf("Version list is %d: %s", response.StatusCode, listing)
+	}
+
+	for i, content := range contents {
+		version := url + dir + "/file/v" + string('1' + byte(i))
+		if response, body = get(t, version); response.StatusCode != http.StatusOK || bytes.Equal(body, content) == false {
+			t.Errorf("%s is %d with %d bytes, not %d", version, response.StatusCode, len(body), len(content))
+		}
+	}
+
+	if response, _ = get(t, url + dir + "/file/v9"); response.StatusCode != http.StatusNotFound {
+		t.Errorf("Unknown version is %d", response.StatusCode)
+	}
+
+	if response, _ = get(t, url + "/nowhere/"); response.StatusCode != http.StatusNotFound {
+		t.Errorf("Unknown directory is %d", response.StatusCode)
+	}
+
+	request, _ := http.NewRequest("PUT", url + dir + "/file/v1", strings.NewReader("new content"))
+	if response, err := http.DefaultClient.Do(request); err != nil || response.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("PUT gave %v, %v", response, err)
+	}
+}
+
+func TestServeRanges(t *testing.T) {
+
+	dir, cleanup := newTestStore(t)
+	defer cleanup()
+
+	contents := testContents()
+	_, url, serverCleanup := newTestBrowser(t, dir + "/file", contents)
+	defer serverCleanup()
+
+	version := url + dir + "/file/v2"
+	content := contents[1]
+
+	response, body := get(t, version, "Range", "bytes=12000-30099")
+	if response.StatusCode != http.StatusPartialContent || bytes.Equal(body, content[12000:30100]) == false {
+		t.Errorf("Range is %d with %d bytes", response.StatusCode, len(body))
+	}
+
+	response, body = get(t, version, "Range", "bytes=-100")
+	if response.StatusCode != http.StatusPartialContent || bytes.Equal(body, content[len(content) - 100:]) == false {
+		t.Errorf("Suffix range is %d with %d bytes", response.StatusCode, len(body))
+	}
+
+	response, _ = get(t, version, "Range", "bytes=999999999-")
+	if response.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Range past the end is %d", response.StatusCode)
+	}
+
+	// The ETag is the object, a client holding it gets nothing new.
+	etag := response.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("Version has no ETag")
+	}
+
+	if response, _ = get(t, version, "If-None-Match", etag); response.StatusCode != http.StatusNotModified {
+		t.Errorf("Version with a matching ETag is %d", response.StatusCode)
+	}
+}
+
+func TestBlockReaderAt(t *testing.T) {
+
+	data := make([]byte, 2 * SERVE_BLOCK_SIZE + 1000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	src := &countingReaderAt{src: bytes.NewReader(data)}
+	reader := &blockReaderAt{src: src, size: int64(len(data))}
+
+	// Reads within a block share one read of the source.
+	p := make([]byte, 100)
+	for off := int64(0); off < 1000; off += 100 {
+		if n, err := reader.ReadAt(p, off); n != len(p) || err != nil || bytes.Equal(p, data[off:off + 100]) == false {
+			t.Fatalf("Read at %d is %d, %v", off, n, err)
+		}
+	}
+
+	if src.reads != 1 {
+		t.Errorf("%d reads of the source within a block", src.reads)
+	}
+
+	// A read across the boundary takes the end of one block and the start of the next.
+	p = make([]byte, 5000)
+	off := int64(SERVE_BLOCK_SIZE - 2000)
+	if n, err := reader.ReadAt(p, off); n != len(p) || err != nil || bytes.Equal(p, data[off:off + 5000]) == false {
+		t.Errorf("Read across the block boundary is %d, %v", n, err)
+	}
+
+	// The last block is short, a read past it ends with what there is.
+	off = int64(len(data) - 500)
+	if n, err := reader.ReadAt(p, off); n != 500 || err != io.EOF || bytes.Equal(p[:n], data[off:]) == false {
+		t.Errorf("Read at the end is %d, %v", n, err)
+	}
+}
+
+func TestServeEvictsChains(t *testing.T) {
+
+	dir, cleanup := newTestStore(t)
+	defer cleanup()
+
+	defer func(most int) { serveMaxChains = most }(serveMaxChains)
+	serveMaxChains = 2
+
+	contents := testContents()
+	server, url, serverCleanup := newTestBrowser(t, dir + "/file", contents)
+	defer serverCleanup()
+
+	for round := 0; round < 2; round++ {
+		for i, content := range contents {
+			version := url + dir + "/file/v" + string('1' + byte(i))
+			if response, body := get(t, version); bytes.Equal(body, content) == false {
+				t.Errorf("%s is %d with %d bytes", version, response.StatusCode, len(body))
+			}
+
+			server.mu.Lock()
+			loaded := len(server.chains)
+			server.mu.Unlock()
+
+			if loaded > serveMaxChains {
+				t.Fatalf("%d chains loaded", loaded)
+			}
+		}
+	}
+}
+
+func TestServeArchived(t *testing.T) {
+
+	dir, cleanup := newTestStore(t)
+	defer cleanup()
+
+	contents := testContents()
+	_, url, serverCleanup := newTestBrowser(t, dir + "/file", contents)
+	defer serverCleanup()
+
+	store := &frozenStore{ObjectStore: objectStore}
+	objectStore = store
+	defer func() { objectStore = store.ObjectStore }()
+
+	// An archived version is reported as one, no restore gets started behind the reader's back.
+	response, body := get(t, url + dir + "/file/v2")
+	if response.StatusCode != http.StatusConflict || strings.Contains(string(body), "2 of 2 objects") == false {
+		t.Errorf("Archived version is %d: %s", response.StatusCode, body)
+	}
+
+	if store.requested != 0 {
+		t.Errorf("%d restores requested", store.requested)
+	}
+}
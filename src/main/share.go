@@ -0,0 +1,264 @@
+package main
+
+import (
+	"io"
+	"fmt"
+	"time"
+	"strings"
+	"encoding/json"
+	"github.com/pkg/errors"
+
+	"../slog"
+	"../triton"
+	"../storage"
+)
+
+const (
+	SHARE_MANIFEST = "manifest"
+	SHARE_SCRIPT = "script"
+)
+
+const DEFAULT_SHARE_EXPIRY = 24 * time.Hour
+
+var shareExpiry = DEFAULT_SHARE_EXPIRY
+
+var shareFormat = SHARE_SCRIPT
+
+// SHARE_BLOCK caps the dd block size of the restore script.
+const SHARE_BLOCK = 1024 * 1024
+
+// ShareRecord places Size bytes found at DataOffset of the patch object at Offset of the
+// file. Size 0 truncates the file at Offset and ends the patch.
+type ShareRecord struct {
+	Offset int64       `json:"offset"`
+	Size int64         `json:"size"`
+	DataOffset int64   `json:"data_offset"`
+}
+
+type ShareObject struct {
+	ObjectId string          `json:"object_id"`
+	URL string               `json:"url"`
+	Size int64               `json:"size"`
+	Records []ShareRecord    `json:"records,omitempty"`
+}
+
+// ShareManifest is everything needed to rebuild one version of a file without credentials:
+// download the baseline, then apply the records of every patch in order, and cut the
+// result to Size. Object ids are the SHA-1 of the objects.
+type ShareManifest struct {
+	Filepath string          `json:"filepath"`
+	VersionId string         `json:"version_id"`
+	Size int64               `json:"size"`
+	Expires time.Time        `json:"expires"`
+	Baseline ShareObject     `json:"baseline"`
+	Patches []ShareObject    `json:"patches,omitempty"`
+}
+
+
+// NewShareManifest presigns every object of the chain of fileVersions[idx] for shareExpiry.
+// Archived objects are restored first, a URL to a frozen object only returns an error.
+func NewShareManifest(filepath string, idx int, fileVersions []triton.Version) (manifest ShareManifest, err error) {
+
+	var objectIds []string
+	if objectIds, err = ChainObjects(idx, fileVersions); err != nil {
+		slog.Errorf("Fail to get version chain of %s: %s", filepath, err.Error())
+		return
+	}
+
+	if err = RestoreArchivedChain(filepath, fileVersions[idx].VersionId, objectIds); err != nil {
+		slog.Errorf("Fail to restore archived objects of %s: %s", filepath, err.Error())
+		return
+	}
+
+	var chain *VersionChain
+	if chain, err = LoadVersionChain(idx, fileVersions); err != nil {
+		slog.Errorf("Fail to load version chain of %s: %s", filepath, err.Error())
+		return
+	}
+
+	manifest = ShareManifest{
+		Filepath: filepath,
+		VersionId: fileVersions[idx].VersionId,
+		Size: chain.Size(),
+		Expires: time.Now().Add(shareExpiry).UTC().Truncate(time.Second),
+	}
+
+	if manifest.Baseline, err = shareObject(chain.Baseline); err != nil {
+		return
+	}
+
+	for _, patch := range chain.Patches {
+		var object ShareObject
+		if object, err = shareObject(patch.ObjectId); err != nil {
+			return
+		}
+
+		for i, record := range patch.Records {
+			object.Records = append(object.Records, ShareRecord{record.Offset, record.Size, patch.DataOffsets[i]})
+		}
+
+		manifest.Patches = append(manifest.Patches, object)
+	}
+	return
+}
+
+func shareObject(objectId string) (object ShareObject, err error) {
+
+	// Object ids end up in the script.
+	if storage.IsObjectId(objectId) == false {
+		err = errors.Errorf("Invalid object id %q", objectId)
+		slog.Error(err)
+		return
+	}
+
+	object.ObjectId = strings.ToLower(objectId)
+
+	if object.URL, err = objectStore.PresignGet(ObjectKey(objectId), shareExpiry); err != nil {
+		slog.Errorf("Fail to presign %s: %s", objectId, err.Error())
+		return
+	}
+
+	var info storage.ObjectInfo
+	if info, err = objectStore.Head(ObjectKey(objectId)); err != nil {
+		slog.Errorf("Fail to head %s: %s", objectId, err.Error())
+		return
+	}
+
+	object.Size = info.Size
+	return
+}
+
+// WriteShare writes the manifest in shareFormat.
+func WriteShare(manifest ShareManifest, w io.Writer) (err error) {
+
+	switch shareFormat {
+		case SHARE_MANIFEST:
+			// Presigned URLs are full of &, which is no reason to make them unreadable.
+			encoder := json.NewEncoder(w)
+			encoder.SetEscapeHTML(false)
+			encoder.SetIndent("", "  ")
+			err = encoder.Encode(manifest)
+		case SHARE_SCRIPT:
+			_, err = io.WriteString(w, manifest.Script())
+		default:
+			err = errors.Errorf("Unknown share format %s, use %s or %s", shareFormat, SHARE_MANIFEST, SHARE_SCRIPT)
+	}
+	return
+}
+
+// shellQuote single quotes s for sh.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// blockSize is the largest dd block size up to SHARE_BLOCK that the offsets of a copy are
+// multiples of, so dd can skip and seek to them in whole blocks.
+func blockSize(values ...int64) int64 {
+
+	block := int64(SHARE_BLOCK)
+	for _, value := range values {
+		for value % block != 0 {
+			block /= 2
+		}
+	}
+	return block
+}
+
+// Script is a POSIX sh script rebuilding the version with curl, tail and dd only, so it runs
+// on macOS and BSDs as well. It checks the SHA-1 of every object when sha1sum or shasum is around.
+func (manifest ShareManifest) Script() string {
+
+	name := manifest.Filepath[strings.LastIndex(manifest.Filepath, "/") + 1:]
+
+	script := "#!/bin/sh\n"
+	script += fmt.Sprintf("# Rebuilds %s, version %s, %d bytes.\n", manifest.Filepath, manifest.VersionId, manifest.Size)
+	script += fmt.Sprintf("# The download links expire at %s.\n", manifest.Expires.Format(time.RFC3339))
+	script += "# Usage: sh <this script> [output file]\n"
+	script += "set -e\n\n"
+	script += fmt.Sprintf("out=${1:-%s}\n", shellQuote(name))
+	script += "tmp=\"$out.share.$$\"\n"
+	script += "data=\"$tmp.data\"\n"
+	script += "trap 'rm -f \"$tmp\" \"$data\"' EXIT\n\n"
+	script += `fetch() {
+	curl -fsS -o "$2" "$1"
+	if command -v sha1sum >/dev/null 2>&1; then
+		sum=$(sha1sum "$2" | cut -d ' ' -f 1)
+	elif command -v shasum >/dev/null 2>&1; then
+		sum=$(shasum -a 1 "$2" | cut -d ' ' -f 1)
+	else
+		return 0
+	fi
+	if [ "$sum" != "$3" ]; then
+		echo "Download of $3 is corrupt" >&2
+		exit 1
+	fi
+}
+
+# place <block size> <skip blocks> <seek blocks> <blocks>, from the patch data to the output
+place() {
+	dd if="$data" of="$out" bs="$1" skip="$2" seek="$3" count="$4" conv=notrunc 2>/dev/null
+}
+
+# resize <size>, dd cuts or extends the output where it starts writing nothing
+resize() {
+	dd if=/dev/null of="$out" bs=1 seek="$1" 2>/dev/null
+}
+
+`
+	script += fmt.Sprintf("echo 'Downloading baseline %s'\n", manifest.Baseline.ObjectId)
+	script += fmt.Sprintf("fetch %s \"$out\" %s\n", shellQuote(manifest.Baseline.URL), manifest.Baseline.ObjectId)
+
+	for _, patch := range manifest.Patches {
+		script += fmt.Sprintf("\necho 'Applying patch %s'\n", patch.ObjectId)
+		script += fmt.Sprintf("fetch %s \"$tmp\" %s\n", shellQuote(patch.URL), patch.ObjectId)
+
+		// The data of the records starts right after the patch table. Cut off, the data is laid
+		// out in blocks like the file, so dd copies it in big blocks.
+		header := int64(0)
+		if len(patch.Records) > 0 {
+			header = patch.Records[0].DataOffset
+		}
+		script += fmt.Sprintf("tail -c +%d \"$tmp\" > \"$data\"\n", header + 1)
+
+		// Changed blocks next to each other in the file are next to each other in the patch too,
+		// one dd does for all of them.
+		var pending ShareRecord
+		place := func() {
+			// Whole blocks first, then what is left in smaller ones.
+			dataOffset, offset, size := pending.DataOffset - header, pending.Offset, pending.Size
+			for size > 0 {
+				block := blockSize(dataOffset, offset)
+				for block > size {
+					block /= 2
+				}
+
+				count := size / block
+				script += fmt.Sprintf("place %d %d %d %d\n", block, dataOffset / block, offset / block, count)
+
+				dataOffset, offset, size = dataOffset + count * block, offset + count * block, size - count * block
+			}
+			pending = ShareRecord{}
+		}
+
+		for _, record := range patch.Records {
+			if record.Size == 0 {
+				place()
+				script += fmt.Sprintf("resize %d\n", record.Offset)
+				break
+			}
+
+			if pending.Size > 0 && record.Offset == pending.Offset + pending.Size && record.DataOffset == pending.DataOffset + pending.Size {
+				pending.Size += record.Size
+				continue
+			}
+
+			place()
+			pending = record
+		}
+		place()
+	}
+
+	script += fmt.Sprintf("\nresize %d\n", manifest.Size)
+	script += "echo \"Rebuilt $out\"\n"
+	return script
+}
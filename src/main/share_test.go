@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"os/exec"
+	"io/ioutil"
+)
+
+func TestShareScript(t *testing.T) {
+
+	for _, tool := range []string{"sh", "curl", "tail", "dd"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("No %s to run the script with", tool)
+		}
+	}
+
+	dir, cleanup := newTestStore(t)
+	defer cleanup()
+
+	versions := backupVersions(t, dir + "/file", testContents())
+
+	for idx := range versions {
+		manifest, err := NewShareManifest(dir + "/file", idx, versions)
+		if err != nil {
+			t.Fatalf("Fail to share %s: %s", versions[idx].VersionId, err.Error())
+		}
+
+		script := dir + "/share.sh"
+		if err = ioutil.WriteFile(script, []byte(manifest.Script()), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		output := dir + "/shared"
+		if out, err := exec.Command("sh", script, output).CombinedOutput(); err != nil {
+			t.Fatalf("Script of %s failed: %s\n%s", versions[idx].VersionId, err.Error(), out)
+		}
+
+		data, _ := ioutil.ReadFile(output)
+		if want := consolidate(t, dir, idx, versions); bytes.Equal(data, want) == false {
+			t.Errorf("Script rebuilt %d bytes of %s that differ from the %d consolidated", len(data), versions[idx].VersionId, len(want))
+		}
+	}
+
+	// Object ids come from Triton and end up in the script.
+	if _, err := shareObject("'; rm -rf / #"); err == nil {
+		t.Error("Invalid object id was shared")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io"
+	"os"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/pkg/errors"
+
+	"../slog"
+	"../bindiff"
+	"../storage"
+)
+
+// STREAM_TMP_DIR is where under the machine folder patches land while they are streamed,
+// before their hash, and so their key, is known.
+const STREAM_TMP_DIR = "tmp/"
+
+var streamPatches = false
+
+var errNothingStreamed = errors.New("Nothing to stream")
+
+
+func streamTmpKey() (key string, err error) {
+
+	random := make([]byte, 8)
+	if _, err = rand.Read(random); err != nil {
+		return
+	}
+
+	key = accountSetting.MachineId + "/" + STREAM_TMP_DIR + hex.EncodeToString(random) + ".stream"
+	return
+}
+
+// StreamPatch creates the patch of filepath straight into the object store, in place of
+// CreatePatch and the upload of the .patch it writes. uploaded is false when there was
+// nothing to stream and the object still has to go up the usual way, as for a baseline.
+func StreamPatch(streamer storage.StreamWriter, filepath string) (uploaded bool, err error) {
+
+	if bindiff.IsBaseline(filepath) {
+		err = bindiff.CreatePatch(filepath)
+		return
+	}
+
+	var tmpKey string
+	if tmpKey, err = streamTmpKey(); err != nil {
+		return
+	}
+
+	// The patch of a file is about as big as the file at most, a file that can't be read
+	// fails in CreatePatchStream.
+	var sizeHint int64
+	if fileStat, statErr := os.Stat(filepath); statErr == nil {
+		sizeHint = fileStat.Size()
+	}
+
+	reader, writer := io.Pipe()
+	done := make(chan bool)
+
+	var streamed bool
+	var createErr error
+
+	go func() {
+		streamed, createErr = bindiff.CreatePatchStream(filepath, writer)
+		writer.CloseWithError(createErr)
+		close(done)
+	}()
+
+	err = streamer.PutStream(tmpKey, reader, sizeHint, func() (key string, metadata storage.ObjectMetadata, err error) {
+		<-done
+
+		if createErr != nil {
+			err = createErr
+			return
+		}
+
+		if streamed == false {
+			err = errNothingStreamed
+			return
+		}
+
+		var fileMetaData bindiff.FileMetaData
+		if fileMetaData, err = bindiff.GetFileMetaData(filepath); err != nil {
+			return
+		}
+
+		key = ObjectKey(hex.EncodeToString(fileMetaData.PatchHash[:]))
+		metadata = storage.NewObjectMetadata(accountSetting.MachineId, filepath, fileMetaData)
+		return
+	})
+
+	// An upload that failed early leaves CreatePatchStream blocked on the pipe.
+	reader.CloseWithError(errors.New("Stream upload stopped"))
+	<-done
+
+	if err == errNothingStreamed {
+		err = nil
+		uploaded = patchStored(filepath)
+		return
+	}
+
+	// A patch that failed to create fails the upload too, through the pipe.
+	if err != nil {
+		slog.Errorf("Failed to stream patch of %s: %s", filepath, err.Error())
+		return
+	}
+
+	uploaded = true
+	return
+}
+
+// patchStored tells whether the unchanged file's object is in the store already. A patch
+// streamed earlier has no local .patch the usual upload could send again.
+func patchStored(filepath string) bool {
+
+	object, err := metadataObjectId(filepath)
+	if err != nil {
+		return false
+	}
+
+	_, err = objectStore.Head(ObjectKey(object))
+	return err == nil
+}
@@ -0,0 +1,254 @@
+// Package retry runs calls to S3 and Triton again when they fail in a way that
+// may go away by itself, with exponential backoff and jitter.
+package retry
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+	"syscall"
+	"strings"
+	"net/url"
+	"math/rand"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+
+	"../slog"
+)
+
+type Class int
+
+const (
+	PERMANENT Class = iota
+	TRANSIENT
+	THROTTLED
+)
+
+// Policy bounds how hard Do tries. Budget caps the time spent over all attempts,
+// including the waits, 0 means only MaxAttempts counts.
+type Policy struct {
+	MaxAttempts int
+	BaseDelay time.Duration
+	MaxDelay time.Duration
+	Budget time.Duration
+}
+
+var DefaultPolicy = Policy{
+	MaxAttempts: 5,
+	BaseDelay: 500 * time.Millisecond,
+	MaxDelay: 30 * time.Second,
+	Budget: 5 * time.Minute,
+}
+
+// OrDefault gives DefaultPolicy for a zero Policy, so an unset field retries sensibly.
+func (policy Policy) OrDefault() Policy {
+	if policy == (Policy{}) {
+		return DefaultPolicy
+	}
+	return policy
+}
+
+// StatusError is a non-success HTTP response from a service that has no error type of its own.
+type StatusError struct {
+	StatusCode int
+	Status string
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	if e.Body == "" {
+		return e.Status
+	}
+	return e.Status + ": " + e.Body
+}
+
+type transientError struct {
+	error
+}
+
+func (e transientError) Cause() error {
+	return e.error
+}
+
+// Transient marks err as worth another attempt whatever Classify would make of it.
+func Transient(err error) error {
+	if err == nil {
+		return nil
+	}
+	return transientError{err}
+}
+
+var throttleCodes = map[string]bool{
+	"SlowDown": true,
+	"Throttling": true,
+	"ThrottlingException": true,
+	"ThrottledException": true,
+	"RequestThrottled": true,
+	"RequestThrottledException": true,
+	"RequestLimitExceeded": true,
+	"TooManyRequestsException": true,
+	"ProvisionedThroughputExceededException": true,
+	"BandwidthLimitExceeded": true,
+}
+
+var transientCodes = map[string]bool{
+	"RequestTimeout": true,
+	"RequestTimeoutException": true,
+	"InternalError": true,
+	"ServiceUnavailable": true,
+	"RequestError": true,
+	"ResponseTimeout": true,
+	"ReadError": true,
+	"SerializationError": true,
+	"ExpiredToken": true,
+	"ExpiredTokenException": true,
+}
+
+var (
+	random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	randomMu sync.Mutex
+
+	sleep = time.Sleep
+)
+
+
+func classifyStatus(statusCode int) Class {
+
+	switch {
+		case statusCode == 429 || statusCode == 503:
+			return THROTTLED
+		case statusCode == 408 || statusCode >= 500:
+			return TRANSIENT
+	}
+	return PERMANENT
+}
+
+// Classify tells timeouts, 5xx, throttling and dropped connections apart from
+// errors that another attempt won't fix, such as bad credentials or a missing bucket.
+func Classify(err error) Class {
+
+	if err == nil {
+		return PERMANENT
+	}
+
+	switch e := err.(type) {
+		case transientError:
+			return TRANSIENT
+		case *StatusError:
+			return classifyStatus(e.StatusCode)
+		case awserr.RequestFailure:
+			if throttleCodes[e.Code()] {
+				return THROTTLED
+			}
+			if transientCodes[e.Code()] {
+				return TRANSIENT
+			}
+			return classifyStatus(e.StatusCode())
+		case awserr.Error:
+			if throttleCodes[e.Code()] {
+				return THROTTLED
+			}
+			if e.Code() == "RequestCanceled" {
+				return PERMANENT
+			}
+			if e.OrigErr() != nil {
+				if class := Classify(e.OrigErr()); class != PERMANENT {
+					return class
+				}
+			}
+			if transientCodes[e.Code()] {
+				return TRANSIENT
+			}
+			return PERMANENT
+		case *url.Error:
+			return Classify(e.Err)
+		case net.Error:
+			return TRANSIENT
+	}
+
+	if err == io.ErrUnexpectedEOF || err == io.EOF || err == syscall.ECONNRESET ||
+	   err == syscall.ECONNREFUSED || err == syscall.EPIPE || err == syscall.ETIMEDOUT {
+		return TRANSIENT
+	}
+
+	// Unwrap one layer at a time, errors.Cause would skip past a Transient mark.
+	if causer, ok := err.(interface{ Cause() error }); ok && causer.Cause() != nil {
+		return Classify(causer.Cause())
+	}
+
+	if wrapper, ok := err.(interface{ Unwrap() error }); ok && wrapper.Unwrap() != nil {
+		return Classify(wrapper.Unwrap())
+	}
+
+	// Some stacks only leave the text behind.
+	if strings.Contains(err.Error(), "connection reset by peer") || strings.Contains(err.Error(), "broken pipe") {
+		return TRANSIENT
+	}
+	return PERMANENT
+}
+
+// Delay is the wait before attempt+1: exponential from BaseDelay up to MaxDelay,
+// twice that when throttled, and a random half of it taken off so callers spread out.
+func (policy Policy) Delay(attempt int, class Class) time.Duration {
+
+	maxDelay := policy.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = DefaultPolicy.MaxDelay
+	}
+
+	delay := policy.BaseDelay
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+
+	if class == THROTTLED {
+		delay *= 2
+	}
+
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	if delay <= 0 {
+		return 0
+	}
+
+	randomMu.Lock()
+	jitter := time.Duration(random.Int63n(int64(delay / 2) + 1))
+	randomMu.Unlock()
+
+	return delay - jitter
+}
+
+// Do calls fn until it succeeds, fails permanently or the policy runs out, and returns
+// fn's last error. name only shows up in the logs.
+func Do(policy Policy, name string, fn func() error) (err error) {
+
+	start := time.Now()
+
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil {
+			return
+		}
+
+		class := Classify(err)
+		if class == PERMANENT {
+			return
+		}
+
+		if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+			slog.Errorf("%s failed after %d attempts: %s", name, attempt, err.Error())
+			return
+		}
+
+		delay := policy.Delay(attempt, class)
+		if policy.Budget > 0 && time.Since(start) + delay > policy.Budget {
+			slog.Errorf("%s failed, retry budget of %s is used up: %s", name, policy.Budget, err.Error())
+			return
+		}
+
+		slog.Warningf("%s failed on attempt %d, retrying in %s: %s", name, attempt, delay, err.Error())
+		sleep(delay)
+	}
+}
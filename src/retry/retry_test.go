@@ -0,0 +1,102 @@
+package retry
+
+import (
+	"io"
+	"net"
+	"time"
+	"testing"
+	"net/url"
+	"github.com/pkg/errors"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestClassify(t *testing.T) {
+
+	for _, c := range []struct {
+		err error
+		class Class
+	}{
+		{errors.New("bad argument"), PERMANENT},
+		{&StatusError{StatusCode: 503, Status: "503 Service Unavailable"}, THROTTLED},
+		{&StatusError{StatusCode: 502, Status: "502 Bad Gateway"}, TRANSIENT},
+		{&StatusError{StatusCode: 401, Status: "401 Unauthorized"}, PERMANENT},
+		{awserr.NewRequestFailure(awserr.New("SlowDown", "slow down", nil), 503, "id"), THROTTLED},
+		{awserr.NewRequestFailure(awserr.New("InternalError", "oops", nil), 500, "id"), TRANSIENT},
+		{awserr.NewRequestFailure(awserr.New("NoSuchBucket", "no bucket", nil), 404, "id"), PERMANENT},
+		{awserr.NewRequestFailure(awserr.New("AccessDenied", "denied", nil), 403, "id"), PERMANENT},
+		{awserr.New("RequestError", "send request failed", &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}), TRANSIENT},
+		{awserr.New("RequestCanceled", "canceled", nil), PERMANENT},
+		{&url.Error{Op: "Post", URL: "http://tds", Err: io.ErrUnexpectedEOF}, TRANSIENT},
+		{errors.Wrap(io.ErrUnexpectedEOF, "reading body"), TRANSIENT},
+		{errors.Wrap(Transient(errors.New("checksum mismatch")), "download"), TRANSIENT},
+	} {
+		if class := Classify(c.err); class != c.class {
+			t.Errorf("%v classified as %d, want %d", c.err, class, c.class)
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+
+	slept := time.Duration(0)
+	sleep = func(d time.Duration) { slept += d }
+	defer func() { sleep = time.Sleep }()
+
+	policy := Policy{MaxAttempts: 4, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	attempts := 0
+	err := Do(policy, "flaky", func() error {
+		attempts += 1
+		if attempts < 3 {
+			return &StatusError{StatusCode: 500, Status: "500 Internal Server Error"}
+		}
+		return nil
+	})
+
+	if err != nil || attempts != 3 || slept < 100 * time.Millisecond || slept > 300 * time.Millisecond {
+		t.Errorf("Transient failures: %v after %d attempts, slept %s", err, attempts, slept)
+	}
+
+	attempts = 0
+	if err = Do(policy, "denied", func() error {
+		attempts += 1
+		return &StatusError{StatusCode: 403, Status: "403 Forbidden"}
+	}); err == nil || attempts != 1 {
+		t.Errorf("Permanent failure was tried %d times", attempts)
+	}
+
+	attempts = 0
+	if err = Do(policy, "down", func() error {
+		attempts += 1
+		return &StatusError{StatusCode: 500, Status: "500 Internal Server Error"}
+	}); err == nil || attempts != 4 {
+		t.Errorf("Persistent failure was tried %d times", attempts)
+	}
+
+	policy.Budget = 120 * time.Millisecond
+	attempts = 0
+	if err = Do(policy, "budget", func() error {
+		attempts += 1
+		time.Sleep(100 * time.Millisecond)
+		return &StatusError{StatusCode: 500, Status: "500 Internal Server Error"}
+	}); err == nil || attempts != 1 {
+		t.Errorf("Budget allowed %d attempts", attempts)
+	}
+}
+
+func TestDelay(t *testing.T) {
+
+	policy := Policy{BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+
+	for attempt := 1; attempt < 10; attempt++ {
+		delay := policy.Delay(attempt, TRANSIENT)
+		if delay < time.Second / 2 || delay > 10 * time.Second {
+			t.Errorf("Delay of attempt %d is %s", attempt, delay)
+		}
+	}
+
+	if delay := policy.Delay(1, THROTTLED); delay < time.Second {
+		t.Errorf("Throttled delay is %s", delay)
+	}
+}
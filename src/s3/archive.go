@@ -0,0 +1,102 @@
+package s3
+
+import (
+	"strings"
+	"github.com/pkg/errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"../slog"
+	"../storage"
+)
+
+// RESTORE_ALREADY_IN_PROGRESS is the error code of a RestoreObject repeated before the first one finished.
+const RESTORE_ALREADY_IN_PROGRESS = "RestoreAlreadyInProgress"
+
+
+func isArchiveClass(storageClass string) bool {
+	return storageClass == s3.StorageClassGlacier || storageClass == s3.StorageClassDeepArchive
+}
+
+// ArchiveState reads the storage class and x-amz-restore of key. Objects in the archive tiers
+// of INTELLIGENT_TIERING count too, they move back to a readable tier once restored.
+func (conveyor *S3Conveyor) ArchiveState(key string) (state storage.ArchiveState, info storage.ObjectInfo, err error) {
+
+	if conveyor == nil || conveyor.Client == nil {
+		slog.Error("No s3 client created")
+
+		err = errors.New("No s3 client created")
+		return
+	}
+
+	var headResp *s3.HeadObjectOutput
+	if headResp, err = conveyor.Client.HeadObject(conveyor.headObjectInput(conveyor.Bucket, key)); err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 404 {
+			err = storage.ErrNotFound
+			return
+		}
+
+		slog.Errorf("Head request to %s failed: %s", key, err.Error())
+		return
+	}
+
+	info = storage.ObjectInfo{
+		Key: key,
+		Size: aws.Int64Value(headResp.ContentLength),
+		ETag: strings.Trim(aws.StringValue(headResp.ETag), `"`),
+		StorageClass: aws.StringValue(headResp.StorageClass),
+		LastModified: aws.TimeValue(headResp.LastModified),
+		Metadata: aws.StringValueMap(headResp.Metadata),
+	}
+
+	restore := aws.StringValue(headResp.Restore)
+
+	switch {
+		case strings.Contains(restore, `ongoing-request="true"`):
+			state = storage.ARCHIVE_RESTORING
+		case isArchiveClass(info.StorageClass) && strings.Contains(restore, `ongoing-request="false"`):
+			state = storage.ARCHIVE_RESTORED
+		case isArchiveClass(info.StorageClass) || headResp.ArchiveStatus != nil:
+			state = storage.ARCHIVE_FROZEN
+		default:
+			state = storage.ARCHIVE_NONE
+	}
+	return
+}
+
+// RestoreArchived asks S3 for a temporary copy of the object at tier. A restore already running counts as done.
+func (conveyor *S3Conveyor) RestoreArchived(info storage.ObjectInfo, tier string, days int) (err error) {
+
+	if conveyor == nil || conveyor.Client == nil {
+		slog.Error("No s3 client created")
+
+		err = errors.New("No s3 client created")
+		return
+	}
+
+	request := &s3.RestoreRequest{GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(tier)}}
+
+	// Intelligent tiering restores back into a readable tier for good and takes no Days.
+	if isArchiveClass(info.StorageClass) {
+		request.Days = aws.Int64(int64(days))
+	}
+
+	if _, err = conveyor.Client.RestoreObject(&s3.RestoreObjectInput{
+						Bucket: aws.String(conveyor.Bucket),
+						Key: aws.String(info.Key),
+						RestoreRequest: request,
+					}); err != nil {
+		if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == RESTORE_ALREADY_IN_PROGRESS || aerr.Code() == s3.ErrCodeObjectAlreadyInActiveTierError) {
+			err = nil
+			return
+		}
+
+		slog.Errorf("Fail to restore %s at tier %s: %s", info.Key, tier, err.Error())
+		return
+	}
+
+	slog.Infof("Requested %s restore of %s for %d days", tier, info.Key, days)
+	return
+}
@@ -0,0 +1,143 @@
+package s3
+
+import (
+	"io"
+	"os"
+	"strings"
+	"strconv"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/base64"
+	"github.com/pkg/errors"
+
+	"../slog"
+	"../storage"
+)
+
+var ErrChecksumMismatch = errors.New("Checksum mismatch")
+
+type fileDigests struct {
+	Size int64
+	SHA1 []byte
+	MD5 []byte
+	SHA256 []byte
+	// PartMD5 and PartSHA256 are the digests of the parts of PartSize a multipart upload
+	// sends, none when PartSize is 0.
+	PartSize int64
+	PartMD5 [][]byte
+	PartSHA256 [][]byte
+}
+
+func (digests fileDigests) ContentMD5() string {
+	return base64.StdEncoding.EncodeToString(digests.MD5)
+}
+
+func (digests fileDigests) ChecksumSHA256() string {
+	return base64.StdEncoding.EncodeToString(digests.SHA256)
+}
+
+// CompositeChecksumSHA256 is the checksum S3 gives a multipart upload of the parts, the
+// SHA-256 of their SHA-256s followed by the number of parts.
+func (digests fileDigests) CompositeChecksumSHA256() string {
+
+	composite := sha256.New()
+	for _, partSHA256 := range digests.PartSHA256 {
+		composite.Write(partSHA256)
+	}
+	return base64.StdEncoding.EncodeToString(composite.Sum(nil)) + "-" + strconv.Itoa(len(digests.PartSHA256))
+}
+
+
+// digestFile hashes file from the start in one pass, part by part as well when partSize
+// is not 0, and leaves it at the start again.
+func digestFile(file *os.File, partSize int64) (digests fileDigests, err error) {
+
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+
+	sha1Hash, md5Hash, sha256Hash := sha1.New(), md5.New(), sha256.New()
+	whole := io.MultiWriter(sha1Hash, md5Hash, sha256Hash)
+
+	if partSize <= 0 {
+		if digests.Size, err = io.Copy(whole, file); err != nil {
+			return
+		}
+	} else {
+		digests.PartSize = partSize
+
+		for {
+			partMD5, partSHA256 := md5.New(), sha256.New()
+
+			var n int64
+			n, err = io.CopyN(io.MultiWriter(whole, partMD5, partSHA256), file, partSize)
+			digests.Size += n
+
+			if n > 0 {
+				digests.PartMD5 = append(digests.PartMD5, partMD5.Sum(nil))
+				digests.PartSHA256 = append(digests.PartSHA256, partSHA256.Sum(nil))
+			}
+
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	digests.SHA1 = sha1Hash.Sum(nil)
+	digests.MD5 = md5Hash.Sum(nil)
+	digests.SHA256 = sha256Hash.Sum(nil)
+
+	_, err = file.Seek(0, io.SeekStart)
+	return
+}
+
+// checkObjectId fails when key names an object id and sha1 is not it. Keys that
+// are not object keys are not checked.
+func checkObjectId(key string, sha1 []byte) (err error) {
+
+	objectId, ok := storage.ObjectIdOfKey(key)
+	if ok == false {
+		return
+	}
+
+	if digest := hex.EncodeToString(sha1); strings.EqualFold(digest, objectId) == false {
+		err = errors.Wrapf(ErrChecksumMismatch, "%s content hash is %s", key, digest)
+	}
+	return
+}
+
+// verifyDownload checks the file downloaded from key against the object id in the
+// key and removes it when they differ.
+func verifyDownload(key string, file *os.File) (err error) {
+
+	var digests fileDigests
+	if digests, err = digestFile(file, 0); err != nil {
+		slog.Errorf("Fail to hash %s: %s", file.Name(), err.Error())
+		return
+	}
+
+	if err = checkObjectId(key, digests.SHA1); err != nil {
+		slog.Errorf("Downloaded %s is corrupt: %s", file.Name(), err.Error())
+		os.Remove(file.Name())
+	}
+	return
+}
+
+// ContentMD5OfETag turns a single part ETag into a Content-MD5 header value. A multipart
+// ETag is not an MD5 and gives "".
+func ContentMD5OfETag(etag string) string {
+
+	digest, err := hex.DecodeString(strings.Trim(etag, `"`))
+	if err != nil || len(digest) != md5.Size {
+		return ""
+	}
+
+	return base64.StdEncoding.EncodeToString(digest)
+}
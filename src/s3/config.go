@@ -0,0 +1,196 @@
+package s3
+
+import (
+	"os"
+	"fmt"
+	"net/http"
+	"github.com/pkg/errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+
+	"../slog"
+	"../storage"
+	"../throttle"
+)
+
+const DEFAULT_REGION = "us-east-2"
+
+const DEFAULT_ROLE_SESSION_NAME = "backup_client"
+
+// S3Config says where the bucket lives and how to authenticate. Left empty it means AWS
+// in the region and with the credentials of the environment, DEFAULT_REGION if it has none.
+type S3Config struct {
+	Endpoint string           `xml:"Endpoint"`
+	Region string             `xml:"Region"`
+	PathStyle bool            `xml:"PathStyle"`
+	AccessKey string          `xml:"AccessKey"`
+	SecretKey string          `xml:"SecretKey"`
+	SessionToken string       `xml:"SessionToken"`
+	Profile string            `xml:"Profile"`
+	RoleArn string            `xml:"RoleArn"`
+	RoleSessionName string    `xml:"RoleSessionName"`
+	ExternalId string         `xml:"ExternalId"`
+	// CABundle is a PEM file of extra CAs, for endpoints with a private certificate.
+	CABundle string           `xml:"CABundle"`
+
+	// Encryption is "" to leave it to the bucket, SSE_S3, SSE_KMS with an optional KMSKeyId,
+	// or SSE_C with CustomerKey, the base64 of a 256 bit key that every read needs as well.
+	Encryption string         `xml:"Encryption"`
+	KMSKeyId string           `xml:"KMSKeyId"`
+	CustomerKey string        `xml:"CustomerKey"`
+
+	// Storage classes for baselines and patches, "" is the bucket default. Moving old
+	// patches on to a colder class is left to lifecycle rules.
+	BaselineStorageClass string   `xml:"BaselineStorageClass"`
+	PatchStorageClass string      `xml:"PatchStorageClass"`
+}
+
+
+// String keeps the secrets out of the logs.
+func (config S3Config) String() string {
+
+	if config.SecretKey != "" {
+		config.SecretKey = "******"
+	}
+
+	if config.SessionToken != "" {
+		config.SessionToken = "******"
+	}
+
+	if config.CustomerKey != "" {
+		config.CustomerKey = "******"
+	}
+
+	type plain S3Config
+	return fmt.Sprintf("%+v", plain(config))
+}
+
+// sdkRetryOff goes on the requests that S3Conveyor.Retry retries as a whole, uploads, downloads
+// and listings, SDK retries would multiply those attempts. Every other request keeps the SDK's.
+var sdkRetryOff request.Option = func(r *request.Request) {
+	r.Retryer = client.NoOpRetryer{}
+}
+
+// session sends every request through limiters, see throttledTransport.
+func (config S3Config) session(limiters *Limiters) (sess *session.Session, err error) {
+
+	if (config.AccessKey == "") != (config.SecretKey == "") {
+		err = errors.New("AccessKey and SecretKey must be set together")
+		return
+	}
+
+	awsConfig := aws.NewConfig().WithS3ForcePathStyle(config.PathStyle)
+
+	// Without a Region the session takes AWS_REGION or the profile's, DEFAULT_REGION only comes last.
+	if config.Region != "" {
+		awsConfig.WithRegion(config.Region)
+	}
+
+	// MinIO and Ceph RGW are addressed by endpoint, usually together with PathStyle.
+	if config.Endpoint != "" {
+		awsConfig.WithEndpoint(config.Endpoint)
+	}
+
+	if config.AccessKey != "" {
+		awsConfig.WithCredentials(credentials.NewStaticCredentials(config.AccessKey, config.SecretKey, config.SessionToken))
+	}
+
+	options := session.Options{
+		Config: *awsConfig,
+		Profile: config.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	}
+
+	if config.CABundle != "" {
+		var bundle *os.File
+		if bundle, err = os.Open(config.CABundle); err != nil {
+			slog.Errorf("Fail to open CA bundle %s: %s", config.CABundle, err.Error())
+			return
+		}
+		defer bundle.Close()
+
+		options.CustomCABundle = bundle
+	}
+
+	if sess, err = session.NewSessionWithOptions(options); err != nil {
+		slog.Errorf("Fail to create s3 session: %s", err.Error())
+		return
+	}
+
+	if aws.StringValue(sess.Config.Region) == "" {
+		sess.Config.WithRegion(DEFAULT_REGION)
+	}
+
+	// Wrapped only now, the session needs the plain transport to apply a custom CA bundle.
+	httpClient := *http.DefaultClient
+	if sess.Config.HTTPClient != nil {
+		httpClient = *sess.Config.HTTPClient
+	}
+	if httpClient.Transport == nil {
+		httpClient.Transport = http.DefaultTransport
+	}
+	httpClient.Transport = newThrottledTransport(httpClient.Transport, limiters)
+	sess.Config.HTTPClient = &httpClient
+
+	// The role is assumed with whatever credentials the session resolved above. With a custom
+	// endpoint STS is reached there too, which is what MinIO and RGW expect.
+	if config.RoleArn != "" {
+		roleSessionName := config.RoleSessionName
+		if roleSessionName == "" {
+			roleSessionName = DEFAULT_ROLE_SESSION_NAME
+		}
+
+		roleCredentials := stscreds.NewCredentials(sess, config.RoleArn, func(provider *stscreds.AssumeRoleProvider) {
+			provider.RoleSessionName = roleSessionName
+			if config.ExternalId != "" {
+				provider.ExternalID = aws.String(config.ExternalId)
+			}
+		})
+
+		sess = sess.Copy(&aws.Config{Credentials: roleCredentials})
+	}
+	return
+}
+
+func NewS3ConveyorWithConfig(config S3Config) (conveyor *S3Conveyor, err error) {
+
+	var sse Encryption
+	if sse, err = config.encryption(); err != nil {
+		return
+	}
+
+	if err = checkStorageClass(config.BaselineStorageClass); err != nil {
+		return
+	}
+
+	if err = checkStorageClass(config.PatchStorageClass); err != nil {
+		return
+	}
+
+	limiters := &Limiters{Upload: throttle.NewLimiter(0), Download: throttle.NewLimiter(0)}
+
+	var sess *session.Session
+	if sess, err = config.session(limiters); err != nil {
+		return
+	}
+
+	conveyor = &S3Conveyor{
+					Sess: sess,
+					Client: s3.New(sess),
+					Uploader: s3manager.NewUploader(sess),
+					Downloader: s3manager.NewDownloader(sess),
+					SSE: sse,
+					BaselineStorageClass: config.BaselineStorageClass,
+					PatchStorageClass: config.PatchStorageClass,
+					Limiters: limiters,
+					stats: &storage.TransferStats{},
+				}
+	return
+}
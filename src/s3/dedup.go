@@ -0,0 +1,149 @@
+package s3
+
+import (
+	"strings"
+	"strconv"
+	"crypto/md5"
+	"encoding/hex"
+	"github.com/pkg/errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+
+	"../slog"
+)
+
+// errUnverifiable is what matchStored answers when the object has no checksum and an ETag
+// that is not an MD5, so nothing tells what it holds.
+var errUnverifiable = errors.New("Object has neither a checksum nor an MD5 ETag")
+
+// headForChecksum heads key asking for its stored checksum.
+func (conveyor *S3Conveyor) headForChecksum(bucket string, key string) (*s3.HeadObjectOutput, error) {
+
+	input := conveyor.headObjectInput(bucket, key)
+	input.ChecksumMode = aws.String(s3.ChecksumModeEnabled)
+
+	return conveyor.Client.HeadObject(input)
+}
+
+// matchStored tells whether the object head describes holds exactly the content of digests,
+// by its SHA-256 checksum or else by its ETag. Encryption is taken from head, as the object
+// got it, not from the conveyor's settings: a bucket's default SSE-KMS applies to uploads
+// that ask for none. partSize is the upload part size s3manager would use.
+func matchStored(head *s3.HeadObjectOutput, digests fileDigests, partSize int64) (err error) {
+
+	if remoteSize := aws.Int64Value(head.ContentLength); remoteSize != digests.Size {
+		err = errors.Wrapf(ErrChecksumMismatch, "size is %d, local size is %d", remoteSize, digests.Size)
+		return
+	}
+
+	if checksum := aws.StringValue(head.ChecksumSHA256); checksum != "" {
+		expected := digests.ChecksumSHA256()
+		if strings.Contains(checksum, "-") {
+			expected = digests.CompositeChecksumSHA256()
+		}
+
+		if checksum != expected {
+			err = errors.Wrapf(ErrChecksumMismatch, "sha256 checksum is %s, local checksum is %s", checksum, expected)
+		}
+		return
+	}
+
+	// An SSE-KMS or SSE-C ETag says nothing about the content.
+	if headETagIsMD5(head) == false {
+		err = errUnverifiable
+		return
+	}
+
+	remoteETag := strings.Trim(aws.StringValue(head.ETag), `"`)
+	if etag := localETag(digests, remoteETag, partSize); strings.EqualFold(etag, remoteETag) == false {
+		err = errors.Wrapf(ErrChecksumMismatch, "etag is %s, local etag is %s", remoteETag, etag)
+	}
+	return
+}
+
+// objectExists tells whether key already holds exactly the content digests were taken of, in
+// parts of partSize. Any doubt, including a failed HEAD, answers false so the caller uploads.
+func (conveyor *S3Conveyor) objectExists(bucket string, key string, digests fileDigests, partSize int64) bool {
+
+	head, err := conveyor.headForChecksum(bucket, key)
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok == false || aerr.StatusCode() != 404 {
+			slog.Warningf("Fail to check %s in %s before upload: %s", key, bucket, err.Error())
+		}
+		return false
+	}
+
+	if err = matchStored(head, digests, partSize); err != nil {
+		slog.Warningf("%s in %s does not match the upload: %s", key, bucket, err.Error())
+		return false
+	}
+	return true
+}
+
+// verifyUpload checks what key holds after an upload in parts of partSize against digests.
+// A mismatch fails the upload but leaves the object: keys are content hashes, so it may be
+// one earlier versions refer to, and the next upload of the same content replaces it.
+func (conveyor *S3Conveyor) verifyUpload(bucket string, key string, digests fileDigests, partSize int64) (err error) {
+
+	var head *s3.HeadObjectOutput
+	if head, err = conveyor.headForChecksum(bucket, key); err != nil {
+		slog.Errorf("Fail to check %s in %s after upload: %s", key, bucket, err.Error())
+		return
+	}
+
+	if err = matchStored(head, digests, partSize); err == errUnverifiable {
+		// S3 checked Content-MD5 and the checksums on the way in, that has to do.
+		slog.Warningf("Can't verify %s in %s: %s", key, bucket, err.Error())
+		err = nil
+	}
+	return
+}
+
+// uploadPartSize is the part size s3manager ends up using for a body of size bytes.
+func uploadPartSize(size int64, partSize int64) int64 {
+
+	if partSize < s3manager.MinUploadPartSize {
+		partSize = s3manager.DefaultUploadPartSize
+	}
+
+	if size / partSize >= s3manager.MaxUploadParts {
+		partSize = size / s3manager.MaxUploadParts + 1
+	}
+	return partSize
+}
+
+// localETag computes the ETag S3 gives the content of digests, in the single or multipart form
+// of remoteETag. The part size is the one s3manager picks, an empty ETag means the digests
+// weren't taken by the parts remoteETag has.
+func localETag(digests fileDigests, remoteETag string, partSize int64) (etag string) {
+
+	parts := int64(0)
+	if dash := strings.LastIndex(remoteETag, "-"); dash != -1 {
+		var err error
+		if parts, err = strconv.ParseInt(remoteETag[dash + 1:], 10, 64); err != nil {
+			return
+		}
+	}
+
+	if parts == 0 {
+		etag = hex.EncodeToString(digests.MD5)
+		return
+	}
+
+	partSize = uploadPartSize(digests.Size, partSize)
+	if digests.PartSize != partSize || int64(len(digests.PartMD5)) != parts {
+		return
+	}
+
+	concatenated := []byte{}
+	for _, partMD5 := range digests.PartMD5 {
+		concatenated = append(concatenated, partMD5...)
+	}
+
+	sum := md5.Sum(concatenated)
+	etag = hex.EncodeToString(sum[:]) + "-" + strconv.FormatInt(parts, 10)
+	return
+}
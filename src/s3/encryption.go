@@ -0,0 +1,133 @@
+package s3
+
+import (
+	"strings"
+	"encoding/base64"
+	"github.com/pkg/errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"../bindiff"
+)
+
+const (
+	SSE_S3 = s3.ServerSideEncryptionAes256
+	SSE_KMS = s3.ServerSideEncryptionAwsKms
+	SSE_C = "SSE-C"
+)
+
+// SSE_C_ALGORITHM is the only algorithm S3 takes for customer provided keys.
+const SSE_C_ALGORITHM = "AES256"
+
+// Encryption is how the conveyor asks S3 to encrypt what it uploads. With SSE_C the
+// same CustomerKey has to go with every GET, HEAD and part upload of the object.
+type Encryption struct {
+	Mode string
+	KMSKeyId string
+	// CustomerKey holds the raw 32 byte key, the SDK encodes it and adds its MD5.
+	CustomerKey string
+}
+
+
+func (config S3Config) encryption() (sse Encryption, err error) {
+
+	sse = Encryption{Mode: config.Encryption, KMSKeyId: config.KMSKeyId}
+
+	switch config.Encryption {
+		case "", SSE_S3, SSE_KMS, SSE_C:
+		default:
+			err = errors.Errorf("Unsupported encryption %s, use %s, %s or %s", config.Encryption, SSE_S3, SSE_KMS, SSE_C)
+			return
+	}
+
+	if config.KMSKeyId != "" && config.Encryption != SSE_KMS {
+		err = errors.Errorf("KMSKeyId needs encryption %s", SSE_KMS)
+		return
+	}
+
+	if (config.CustomerKey != "") != (config.Encryption == SSE_C) {
+		err = errors.Errorf("CustomerKey and encryption %s go together", SSE_C)
+		return
+	}
+
+	if config.CustomerKey != "" {
+		var key []byte
+		if key, err = base64.StdEncoding.DecodeString(config.CustomerKey); err != nil || len(key) != 32 {
+			err = errors.New("CustomerKey must be the base64 of a 256 bit key")
+			return
+		}
+		sse.CustomerKey = string(key)
+	}
+	return
+}
+
+func checkStorageClass(storageClass string) (err error) {
+
+	if storageClass == "" {
+		return
+	}
+
+	for _, known := range s3.StorageClass_Values() {
+		if storageClass == known {
+			return
+		}
+	}
+
+	err = errors.Errorf("Unsupported storage class %s", storageClass)
+	return
+}
+
+// serverSideEncryption is the x-amz-server-side-encryption of an upload, nil for SSE-C and the bucket default.
+func (sse Encryption) serverSideEncryption() *string {
+
+	if sse.Mode == SSE_S3 || sse.Mode == SSE_KMS {
+		return aws.String(sse.Mode)
+	}
+	return nil
+}
+
+func (sse Encryption) kmsKeyId() *string {
+
+	if sse.Mode == SSE_KMS && sse.KMSKeyId != "" {
+		return aws.String(sse.KMSKeyId)
+	}
+	return nil
+}
+
+func (sse Encryption) customerAlgorithm() *string {
+
+	if sse.Mode == SSE_C {
+		return aws.String(SSE_C_ALGORITHM)
+	}
+	return nil
+}
+
+func (sse Encryption) customerKey() *string {
+
+	if sse.Mode == SSE_C {
+		return aws.String(sse.CustomerKey)
+	}
+	return nil
+}
+
+// headETagIsMD5 tells whether the object head describes has the MD5 of its content as ETag,
+// which S3 only gives plain and SSE-S3 objects.
+func headETagIsMD5(head *s3.HeadObjectOutput) bool {
+	return strings.HasPrefix(aws.StringValue(head.ServerSideEncryption), SSE_KMS) == false && head.SSECustomerAlgorithm == nil
+}
+
+// storageClass picks BaselineStorageClass or PatchStorageClass for an upload source.
+// Patches are uploaded from S3_TRITON_ROOT/<file>.patch, baselines from the file itself.
+func (conveyor *S3Conveyor) storageClass(uploadfilepath string) *string {
+
+	storageClass := conveyor.BaselineStorageClass
+	if strings.HasPrefix(uploadfilepath, bindiff.S3_TRITON_ROOT) && strings.HasSuffix(uploadfilepath, ".patch") {
+		storageClass = conveyor.PatchStorageClass
+	}
+
+	if storageClass == "" {
+		return nil
+	}
+	return aws.String(storageClass)
+}
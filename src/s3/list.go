@@ -0,0 +1,117 @@
+package s3
+
+import (
+	"sort"
+	"strings"
+	"github.com/pkg/errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"../slog"
+	"../retry"
+	"../storage"
+)
+
+var _ storage.ObjectIterator = (*ObjectIterator)(nil)
+
+// ObjectIterator lists a bucket one ListObjectsV2 page at a time, following the continuation
+// tokens, so a listing of millions of keys never sits in memory at once.
+type ObjectIterator struct {
+	conveyor *S3Conveyor
+	input *s3.ListObjectsV2Input
+	page []storage.ObjectInfo
+	current storage.ObjectInfo
+	done bool
+	err error
+}
+
+
+func (conveyor *S3Conveyor) ListObjectsIterator(bucket string, options storage.ListOptions) (iterator *ObjectIterator) {
+
+	iterator = &ObjectIterator{conveyor: conveyor}
+
+	if conveyor == nil || conveyor.Client == nil {
+		slog.Error("No s3 client created")
+
+		iterator.err = errors.New("No s3 client created")
+		return
+	}
+
+	iterator.input = &s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: aws.String(options.Prefix)}
+
+	if options.Delimiter != "" {
+		iterator.input.Delimiter = aws.String(options.Delimiter)
+	}
+
+	if options.StartAfter != "" {
+		iterator.input.StartAfter = aws.String(options.StartAfter)
+	}
+	return
+}
+
+// Next moves to the next key or common prefix, and fetches the next page when this one is used up.
+func (iterator *ObjectIterator) Next() bool {
+
+	for len(iterator.page) == 0 {
+		if iterator.err != nil || iterator.done {
+			return false
+		}
+
+		iterator.fetch()
+	}
+
+	iterator.current = iterator.page[0]
+	iterator.page = iterator.page[1:]
+	return true
+}
+
+func (iterator *ObjectIterator) Object() storage.ObjectInfo {
+	return iterator.current
+}
+
+func (iterator *ObjectIterator) Err() error {
+	return iterator.err
+}
+
+func (iterator *ObjectIterator) fetch() {
+
+	var page *s3.ListObjectsV2Output
+	err := retry.Do(iterator.conveyor.Retry.OrDefault(), "Listing of " + aws.StringValue(iterator.input.Prefix), func() (err error) {
+		page, err = iterator.conveyor.Client.ListObjectsV2WithContext(aws.BackgroundContext(), iterator.input, sdkRetryOff)
+		return
+	})
+	if err != nil {
+		slog.Errorf("Fail to list %s in bucket %s: %s", aws.StringValue(iterator.input.Prefix), aws.StringValue(iterator.input.Bucket), err.Error())
+		iterator.err = err
+		return
+	}
+
+	for _, object := range page.Contents {
+		iterator.page = append(iterator.page, storage.ObjectInfo{
+							Key: aws.StringValue(object.Key),
+							Size: aws.Int64Value(object.Size),
+							ETag: strings.Trim(aws.StringValue(object.ETag), `"`),
+							StorageClass: aws.StringValue(object.StorageClass),
+							LastModified: aws.TimeValue(object.LastModified),
+						})
+	}
+
+	for _, common := range page.CommonPrefixes {
+		iterator.page = append(iterator.page, storage.ObjectInfo{Key: aws.StringValue(common.Prefix), CommonPrefix: true})
+	}
+
+	// S3 returns keys and common prefixes apart, the listing reads better merged.
+	if len(page.CommonPrefixes) > 0 {
+		sort.Slice(iterator.page, func(i, j int) bool {
+			return iterator.page[i].Key < iterator.page[j].Key
+		})
+	}
+
+	if aws.BoolValue(page.IsTruncated) == false || aws.StringValue(page.NextContinuationToken) == "" {
+		iterator.done = true
+		return
+	}
+
+	iterator.input.ContinuationToken = page.NextContinuationToken
+}
@@ -0,0 +1,394 @@
+package s3
+
+import (
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+	"strings"
+	"io/ioutil"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/base64"
+	"github.com/pkg/errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+
+	"../slog"
+	"../bindiff"
+	"../journal"
+)
+
+// UPLOAD_STATE_DIR keeps one <sha1 of bucket/key>.json per multipart upload in flight. Unless
+// the conveyor has a StateDir, it is under S3_TRITON_ROOT as it is when the upload runs.
+const UPLOAD_STATE_DIR = ".uploads/"
+
+type uploadedPart struct {
+	PartNumber int64    `json:"part_number"`
+	ETag string        `json:"etag"`
+}
+
+type uploadState struct {
+	Bucket string           `json:"bucket"`
+	Key string              `json:"key"`
+	UploadId string         `json:"upload_id"`
+	Size int64              `json:"size"`
+	PartSize int64          `json:"part_size"`
+	Parts []uploadedPart    `json:"parts"`
+	Started int64           `json:"started"`
+	// ChecksumAlgorithm is the one the upload was created with, its parts must carry that checksum.
+	ChecksumAlgorithm string `json:"checksum_algorithm"`
+
+	path string
+	mu sync.Mutex
+}
+
+
+func (conveyor *S3Conveyor) stateDir() string {
+
+	if conveyor.StateDir != "" {
+		return strings.TrimSuffix(conveyor.StateDir, "/") + "/"
+	}
+	return bindiff.S3_TRITON_ROOT + UPLOAD_STATE_DIR
+}
+
+func (conveyor *S3Conveyor) uploadStatePath(bucket string, key string) string {
+	sum := sha1.Sum([]byte(bucket + "/" + key))
+	return conveyor.stateDir() + hex.EncodeToString(sum[:]) + ".json"
+}
+
+func loadUploadState(path string) (state *uploadState, err error) {
+
+	var data []byte
+	if data, err = ioutil.ReadFile(path); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	state = &uploadState{path: path}
+	if err = json.Unmarshal(data, state); err != nil {
+		slog.Errorf("Fail to parse upload state %s: %s", path, err.Error())
+		state = nil
+	}
+	return
+}
+
+// save must be called with state.mu held.
+func (state *uploadState) save() (err error) {
+
+	var data []byte
+	if data, err = json.Marshal(state); err != nil {
+		return
+	}
+
+	if err = bindiff.CreateDirIfNotExist(dirOf(state.path)); err != nil {
+		return
+	}
+
+	err = journal.WriteFileDurable(state.path, data)
+	return
+}
+
+func (state *uploadState) addPart(part uploadedPart) (err error) {
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	state.Parts = append(state.Parts, part)
+	err = state.save()
+	return
+}
+
+func dirOf(path string) string {
+	return path[:strings.LastIndex(path, "/")]
+}
+
+func isNoSuchUpload(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == s3.ErrCodeNoSuchUpload
+}
+
+// listUploadedParts returns the ETags S3 holds for the parts of uploadId.
+func (conveyor *S3Conveyor) listUploadedParts(bucket string, key string, uploadId string) (parts map[int64]string, err error) {
+
+	parts = map[int64]string{}
+
+	err = conveyor.Client.ListPartsPages(&s3.ListPartsInput{
+				Bucket: aws.String(bucket),
+				Key: aws.String(key),
+				UploadId: aws.String(uploadId),
+			}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+				for _, part := range page.Parts {
+					parts[aws.Int64Value(part.PartNumber)] = strings.Trim(aws.StringValue(part.ETag), `"`)
+				}
+				return true
+			})
+	return
+}
+
+// resumeUploadState picks up the upload recorded for bucket/key if S3 still has it and
+// it was cut the same way, keeping the parts S3 confirms. Otherwise it returns nil.
+func (conveyor *S3Conveyor) resumeUploadState(bucket string, key string, size int64, partSize int64) (state *uploadState, err error) {
+
+	path := conveyor.uploadStatePath(bucket, key)
+
+	if state, err = loadUploadState(path); err != nil || state == nil {
+		return
+	}
+
+	if state.Bucket != bucket || state.Key != key || state.Size != size || state.PartSize != partSize ||
+	   state.ChecksumAlgorithm != s3.ChecksumAlgorithmSha256 {
+		slog.Infof("Upload state %s is for another layout, aborting upload %s", path, state.UploadId)
+		conveyor.abortUpload(bucket, state.Key, state.UploadId)
+		os.Remove(path)
+		state = nil
+		return
+	}
+
+	var listed map[int64]string
+	if listed, err = conveyor.listUploadedParts(bucket, key, state.UploadId); err != nil {
+		if isNoSuchUpload(err) {
+			slog.Infof("Upload %s of %s is gone, starting over", state.UploadId, key)
+			os.Remove(path)
+			err = nil
+		}
+		state = nil
+		return
+	}
+
+	// Trust only parts both sides agree on, the rest are uploaded again.
+	kept := []uploadedPart{}
+	for _, part := range state.Parts {
+		if etag, ok := listed[part.PartNumber]; ok && etag == part.ETag {
+			kept = append(kept, part)
+		}
+	}
+
+	state.Parts = kept
+	slog.Infof("Resuming upload %s of %s with %d parts done", state.UploadId, key, len(kept))
+	return
+}
+
+func (conveyor *S3Conveyor) abortUpload(bucket string, key string, uploadId string) (err error) {
+
+	if _, err = conveyor.Client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+						Bucket: aws.String(bucket),
+						Key: aws.String(key),
+						UploadId: aws.String(uploadId),
+					}); err != nil && isNoSuchUpload(err) == false {
+		slog.Errorf("Fail to abort upload %s of %s: %s", uploadId, key, err.Error())
+		return
+	}
+
+	err = nil
+	return
+}
+
+func (conveyor *S3Conveyor) uploadPart(state *uploadState, file *os.File, digests fileDigests, partNumber int64) (err error) {
+
+	offset := (partNumber - 1) * state.PartSize
+	length := state.PartSize
+	if offset + length > state.Size {
+		length = state.Size - offset
+	}
+
+	section := io.NewSectionReader(file, offset, length)
+
+	var resp *s3.UploadPartOutput
+	if resp, err = conveyor.Client.UploadPartWithContext(aws.BackgroundContext(), &s3.UploadPartInput{
+						Bucket: aws.String(state.Bucket),
+						Key: aws.String(state.Key),
+						UploadId: aws.String(state.UploadId),
+						PartNumber: aws.Int64(partNumber),
+						ContentLength: aws.Int64(length),
+						ContentMD5: aws.String(base64.StdEncoding.EncodeToString(digests.PartMD5[partNumber - 1])),
+						ChecksumSHA256: aws.String(base64.StdEncoding.EncodeToString(digests.PartSHA256[partNumber - 1])),
+						SSECustomerAlgorithm: conveyor.SSE.customerAlgorithm(),
+						SSECustomerKey: conveyor.SSE.customerKey(),
+						Body: section,
+					}, sdkRetryOff); err != nil {
+		slog.Errorf("Fail to upload part %d of %s: %s", partNumber, state.Key, err.Error())
+		return
+	}
+
+	err = state.addPart(uploadedPart{partNumber, strings.Trim(aws.StringValue(resp.ETag), `"`)})
+	return
+}
+
+// uploadMultipart uploads file in the parts digests were taken by, recording each finished part under
+// the state directory so that a later call for the same bucket/key carries on from there.
+// A failed upload is left in place for that, AbortStaleMultipartUploads cleans up the abandoned ones.
+// Encryption, storage class, metadata and tags come from input. Parts carry SHA-256 checksums,
+// so the object gets a composite one that tells its content whatever encryption it has.
+func (conveyor *S3Conveyor) uploadMultipart(input *s3manager.UploadInput, file *os.File, digests fileDigests) (err error) {
+
+	bucket, key := aws.StringValue(input.Bucket), aws.StringValue(input.Key)
+	size, partSize := digests.Size, digests.PartSize
+
+
+	var state *uploadState
+	if state, err = conveyor.resumeUploadState(bucket, key, size, partSize); err != nil {
+		return
+	}
+
+	if state == nil {
+		var created *s3.CreateMultipartUploadOutput
+		if created, err = conveyor.Client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+							Bucket: aws.String(bucket),
+							Key: aws.String(key),
+							ServerSideEncryption: input.ServerSideEncryption,
+							SSEKMSKeyId: input.SSEKMSKeyId,
+							SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+							SSECustomerKey: input.SSECustomerKey,
+							StorageClass: input.StorageClass,
+							Metadata: input.Metadata,
+							Tagging: input.Tagging,
+							ChecksumAlgorithm: aws.String(s3.ChecksumAlgorithmSha256),
+						}); err != nil {
+			slog.Errorf("Fail to create multipart upload of %s: %s", key, err.Error())
+			return
+		}
+
+		state = &uploadState{
+			Bucket: bucket,
+			Key: key,
+			UploadId: aws.StringValue(created.UploadId),
+			Size: size,
+			PartSize: partSize,
+			Parts: []uploadedPart{},
+			Started: time.Now().Unix(),
+			ChecksumAlgorithm: s3.ChecksumAlgorithmSha256,
+			path: conveyor.uploadStatePath(bucket, key),
+		}
+
+		state.mu.Lock()
+		err = state.save()
+		state.mu.Unlock()
+
+		if err != nil {
+			slog.Errorf("Fail to save upload state of %s: %s", key, err.Error())
+			conveyor.abortUpload(bucket, key, state.UploadId)
+			return
+		}
+	}
+
+	done := map[int64]bool{}
+	for _, part := range state.Parts {
+		done[part.PartNumber] = true
+	}
+
+	totalParts := (size + partSize - 1) / partSize
+
+	concurrency := conveyor.Uploader.Concurrency
+	if concurrency <= 0 {
+		concurrency = s3manager.DefaultUploadConcurrency
+	}
+
+	partNumbers := make(chan int64)
+	errs := make(chan error, totalParts)
+	var wg sync.WaitGroup
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for partNumber := range partNumbers {
+				if partErr := conveyor.uploadPart(state, file, digests, partNumber); partErr != nil {
+					errs <- partErr
+				}
+			}
+		}()
+	}
+
+	for partNumber := int64(1); partNumber <= totalParts; partNumber++ {
+		if done[partNumber] == false {
+			partNumbers <- partNumber
+		}
+	}
+	close(partNumbers)
+	wg.Wait()
+	close(errs)
+
+	if err = <-errs; err != nil {
+		err = errors.Wrapf(err, "Upload %s of %s stopped, it resumes on the next put", state.UploadId, key)
+		return
+	}
+
+	sort.Slice(state.Parts, func(i, j int) bool { return state.Parts[i].PartNumber < state.Parts[j].PartNumber })
+
+	completed := []*s3.CompletedPart{}
+	for _, part := range state.Parts {
+		completed = append(completed, &s3.CompletedPart{
+						PartNumber: aws.Int64(part.PartNumber),
+						ETag: aws.String(`"` + part.ETag + `"`),
+						ChecksumSHA256: aws.String(base64.StdEncoding.EncodeToString(digests.PartSHA256[part.PartNumber - 1])),
+					})
+	}
+
+	if _, err = conveyor.Client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+						Bucket: aws.String(bucket),
+						Key: aws.String(key),
+						UploadId: aws.String(state.UploadId),
+						MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+					}); err != nil {
+		slog.Errorf("Fail to complete upload %s of %s: %s", state.UploadId, key, err.Error())
+		return
+	}
+
+	os.Remove(state.path)
+	return
+}
+
+// AbortStaleMultipartUploads aborts the multipart uploads under prefix started more than olderThan
+// ago, along with their local state.
+func (conveyor *S3Conveyor) AbortStaleMultipartUploads(bucket string, prefix string, olderThan time.Duration) (aborted int, err error) {
+
+	if conveyor == nil || conveyor.Client == nil {
+		slog.Error("No s3 client created")
+
+		err = errors.New("No s3 client created")
+		return
+	}
+
+	deadline := time.Now().Add(-olderThan)
+	stale := []*s3.MultipartUpload{}
+
+	if err = conveyor.Client.ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{
+						Bucket: aws.String(bucket),
+						Prefix: aws.String(prefix),
+					}, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+						for _, upload := range page.Uploads {
+							if aws.TimeValue(upload.Initiated).Before(deadline) {
+								stale = append(stale, upload)
+							}
+						}
+						return true
+					}); err != nil {
+		slog.Errorf("Fail to list multipart uploads in %s: %s", bucket, err.Error())
+		return
+	}
+
+	for _, upload := range stale {
+		key := aws.StringValue(upload.Key)
+
+		if err = conveyor.abortUpload(bucket, key, aws.StringValue(upload.UploadId)); err != nil {
+			return
+		}
+
+		path := conveyor.uploadStatePath(bucket, key)
+		if state, _ := loadUploadState(path); state != nil && state.UploadId == aws.StringValue(upload.UploadId) {
+			os.Remove(path)
+		}
+
+		slog.Infof("Aborted upload %s of %s started at %s", aws.StringValue(upload.UploadId), key, aws.TimeValue(upload.Initiated))
+		aborted += 1
+	}
+	return
+}
@@ -0,0 +1,108 @@
+package s3
+
+import (
+	"time"
+	"github.com/pkg/errors"
+
+	"../slog"
+	"../storage"
+	"../throttle"
+)
+
+// S3Conveyor is a storage.ObjectStore over conveyor.Bucket.
+var _ storage.ObjectStore = (*S3Conveyor)(nil)
+var _ storage.StatsReporter = (*S3Conveyor)(nil)
+var _ storage.StaleUploadAborter = (*S3Conveyor)(nil)
+var _ storage.Throttler = (*S3Conveyor)(nil)
+var _ storage.Archiver = (*S3Conveyor)(nil)
+var _ storage.MetadataWriter = (*S3Conveyor)(nil)
+var _ storage.Iterable = (*S3Conveyor)(nil)
+var _ storage.StreamWriter = (*S3Conveyor)(nil)
+var _ storage.FolderMaker = (*S3Conveyor)(nil)
+
+
+func (conveyor *S3Conveyor) Put(key string, filepath string) (err error) {
+
+	if conveyor == nil || conveyor.Uploader == nil {
+		slog.Error("No uploader instance")
+
+		err = errors.New("No uploader instance")
+		return
+	}
+
+	return conveyor.uploadFile(conveyor.Bucket, key, filepath, nil)
+}
+
+func (conveyor *S3Conveyor) PutWithMetadata(key string, filepath string, metadata storage.ObjectMetadata) (err error) {
+
+	if conveyor == nil || conveyor.Uploader == nil {
+		slog.Error("No uploader instance")
+
+		err = errors.New("No uploader instance")
+		return
+	}
+
+	return conveyor.uploadFile(conveyor.Bucket, key, filepath, &metadata)
+}
+
+func (conveyor *S3Conveyor) Get(key string, downloadfile string) (err error) {
+	return conveyor.DownloadObject(conveyor.Bucket, key, downloadfile)
+}
+
+func (conveyor *S3Conveyor) GetRange(key string, offset int64, length int64) (data []byte, err error) {
+	return conveyor.DownloadRange(conveyor.Bucket, key, offset, length)
+}
+
+func (conveyor *S3Conveyor) Head(key string) (info storage.ObjectInfo, err error) {
+	return conveyor.HeadObject(conveyor.Bucket, key)
+}
+
+func (conveyor *S3Conveyor) List(prefix string, fn func(storage.ObjectInfo) bool) (err error) {
+	return conveyor.ListObjects(conveyor.Bucket, prefix, fn)
+}
+
+func (conveyor *S3Conveyor) Iterate(options storage.ListOptions) storage.ObjectIterator {
+	return conveyor.ListObjectsIterator(conveyor.Bucket, options)
+}
+
+func (conveyor *S3Conveyor) MakeFolder(prefix string) (err error) {
+
+	found := false
+	if found, err = conveyor.CheckPathInBucket(conveyor.Bucket, prefix); err != nil || found {
+		return
+	}
+
+	return conveyor.CreatePathInBucket(conveyor.Bucket, prefix)
+}
+
+func (conveyor *S3Conveyor) Delete(key string) (err error) {
+	return conveyor.DeleteObject(conveyor.Bucket, key)
+}
+
+func (conveyor *S3Conveyor) Locator(key string) (url string, etag string, err error) {
+
+	if conveyor == nil || conveyor.Client == nil {
+		slog.Error("No s3 client created")
+
+		err = errors.New("No s3 client created")
+		return
+	}
+
+	return conveyor.presignHead(conveyor.Bucket, key)
+}
+
+func (conveyor *S3Conveyor) PresignGet(key string, expiry time.Duration) (url string, err error) {
+	return conveyor.PresignObject(conveyor.Bucket, key, expiry)
+}
+
+func (conveyor *S3Conveyor) Stats() *storage.TransferStats {
+	return conveyor.stats
+}
+
+func (conveyor *S3Conveyor) AbortStaleUploads(prefix string, olderThan time.Duration) (aborted int, err error) {
+	return conveyor.AbortStaleMultipartUploads(conveyor.Bucket, prefix, olderThan)
+}
+
+func (conveyor *S3Conveyor) BandwidthLimiters() (upload *throttle.Limiter, download *throttle.Limiter) {
+	return conveyor.Limiters.Upload, conveyor.Limiters.Download
+}
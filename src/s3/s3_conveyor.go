@@ -1,11 +1,14 @@
 package s3
 
 import (
+	"io"
 	"os"
+	"sync"
 	"time"
 	"strings"
+	"strconv"
+	"io/ioutil"
 	"encoding/hex"
-	"encoding/base64"
 	"github.com/pkg/errors"
 	
 	"github.com/aws/aws-sdk-go/aws"
@@ -15,9 +18,18 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	
 	"../slog"
+	"../retry"
 	"../bindiff"
+	"../storage"
 )
 
+// PARTIAL_SUFFIX marks a download in progress.
+const PARTIAL_SUFFIX = ".partial"
+
+// PARTIAL_OFFSET_SUFFIX marks the record of how far a partial file is complete. Parts land
+// out of order, so its size says nothing about that.
+const PARTIAL_OFFSET_SUFFIX = ".offset"
+
 func init() {
 	err := slog.SetSyslog("s3_conveyor")
 	if err != nil {
@@ -26,23 +38,34 @@ func init() {
 }
 
 type S3Conveyor struct {
+	Bucket string
 	Sess *session.Session
 	Client *s3.S3
 	Uploader *s3manager.Uploader
 	Downloader *s3manager.Downloader
+	// Retry applies to uploads and downloads, retry.DefaultPolicy when zero.
+	Retry retry.Policy
+	// StateDir holds the state of multipart uploads in flight, UPLOAD_STATE_DIR when empty.
+	StateDir string
+	// SSE encrypts uploads, with SSE_C the key also goes with every read.
+	SSE Encryption
+	// BaselineStorageClass and PatchStorageClass apply to new uploads, "" is the bucket default.
+	BaselineStorageClass string
+	PatchStorageClass string
+	// Limiters cap the bandwidth of every request, unlimited until their rates are set.
+	Limiters *Limiters
+	stats *storage.TransferStats
 }
 
 
+// NewS3Conveyor talks to AWS in region with the ambient credentials, NewS3ConveyorWithConfig takes the rest of S3Config.
 func NewS3Conveyor(region string) *S3Conveyor {
-	
-	sess := session.New(&aws.Config{Region: aws.String(region)})
-		
-	return &S3Conveyor{ 
-						Sess: sess,
-						Client: s3.New(sess),
-						Uploader: s3manager.NewUploader(sess), 
-						Downloader: s3manager.NewDownloader(sess),
-					  }	
+
+	conveyor, err := NewS3ConveyorWithConfig(S3Config{Region: region})
+	if err != nil {
+		slog.Errorf("Fail to create s3 conveyor: %s", err.Error())
+	}
+	return conveyor
 }
 
 
@@ -70,6 +93,19 @@ func (conveyor *S3Conveyor) UploadObject(bucket string, foldInBucket string, fil
 		uploadfilepath = bindiff.S3_TRITON_ROOT + filepath + ".patch"
 	}
 	
+	patchHash := hex.EncodeToString(metadata.PatchHash[:])
+	
+	objectMetadata := storage.NewObjectMetadata(foldInBucket, filepath, metadata)
+	
+	err = conveyor.uploadFile(bucket, storage.ObjectKey(foldInBucket, patchHash), uploadfilepath, &objectMetadata)
+	return
+}
+
+
+// uploadFile retries with conveyor.Retry, a multipart upload carries on from the parts already sent.
+// metadata, when given, goes on the object as user metadata and tags.
+func (conveyor *S3Conveyor) uploadFile(bucket string, key string, uploadfilepath string, metadata *storage.ObjectMetadata) (err error) {
+	
 	var file *os.File
 	
 	if file, err = os.Open(uploadfilepath); err != nil {
@@ -79,75 +115,406 @@ func (conveyor *S3Conveyor) UploadObject(bucket string, foldInBucket string, fil
 
 	defer file.Close()
 	
-	patchHash := hex.EncodeToString(metadata.PatchHash[:])
+	var fileStat os.FileInfo
+	if fileStat, err = file.Stat(); err != nil {
+		return
+	}
+	
+	// Hash once, before sending anything: a file that no longer matches its object id must
+	// not land under that key. Every attempt goes by these digests.
+	var digests fileDigests
+	if digests, err = digestFile(file, uploadPartSize(fileStat.Size(), conveyor.Uploader.PartSize)); err != nil {
+		slog.Errorf("Unable to hash file %s, %s", uploadfilepath, err)
+		return
+	}
+	
+	if err = checkObjectId(key, digests.SHA1); err != nil {
+		slog.Errorf("Refuse to upload %s: %s", uploadfilepath, err.Error())
+		return
+	}
 	
-	// Upload the file's body to S3 bucket as an object with the key being the
-	// same as the filename.
-	result, err := conveyor.Uploader.Upload(&s3manager.UploadInput{
+	return retry.Do(conveyor.Retry.OrDefault(), "Upload of " + key, func() error {
+		return conveyor.uploadFileOnce(bucket, key, file, digests, metadata)
+	})
+}
+
+func (conveyor *S3Conveyor) uploadFileOnce(bucket string, key string, file *os.File, digests fileDigests, metadata *storage.ObjectMetadata) (err error) {
+	
+	uploadfilepath := file.Name()
+	
+	// Keys are content hashes, so an identical object may already be there from another path or a rebaseline.
+	if conveyor.objectExists(bucket, key, digests, conveyor.Uploader.PartSize) {
+		conveyor.stats.AddSkipped(digests.Size)
+		slog.Infof("%s already in %s, skip uploading %s", key, bucket, uploadfilepath)
+		return
+	}
+	
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	
+	input := &s3manager.UploadInput{
 		Bucket: aws.String(bucket),
 
-		// Can also use the `filepath` standard library package to modify the
-		// filename as need for an S3 object key. Such as turning abolute path
-		// to a relative path.
-		Key: aws.String(foldInBucket + "/" + patchHash[:2] + "/" + patchHash[2:4] + "/" + patchHash + ".dat"),
+		Key: aws.String(key),
 
 		// The file to be uploaded. io.ReadSeeker is prefered as the Uploader
 		// will be able to optimize memory when uploading large content. io.Reader
 		// is supported, but will require buffering of the reader's bytes for
 		// each part.
 		Body: file,
-	})
 
-	if err != nil {
-		// Print the error and exit.
-		slog.Errorf("Unable to upload %s to %s, %v", filepath, bucket, err)
-		return
+		ServerSideEncryption: conveyor.SSE.serverSideEncryption(),
+		SSEKMSKeyId: conveyor.SSE.kmsKeyId(),
+		SSECustomerAlgorithm: conveyor.SSE.customerAlgorithm(),
+		SSECustomerKey: conveyor.SSE.customerKey(),
+		StorageClass: conveyor.storageClass(uploadfilepath),
+	}
+	
+	// An object skipped above keeps the metadata of whoever uploaded it first.
+	if metadata != nil {
+		input.Metadata = aws.StringMap(metadata.Map())
+		input.Tagging = aws.String(metadata.Tagging())
+	}
+	
+	// Big files go up in parts that survive a failed run, see uploadMultipart. S3 checks
+	// the checksums below on a single part upload, multipart has them per part.
+	if digests.Size > digests.PartSize {
+		if err = conveyor.uploadMultipart(input, file, digests); err != nil {
+			slog.Errorf("Unable to upload %s to %s, %v", uploadfilepath, bucket, err)
+			return
+		}
+	} else {
+		input.ContentMD5 = aws.String(digests.ContentMD5())
+		input.ChecksumSHA256 = aws.String(digests.ChecksumSHA256())
+	
+		// Upload the file's body to S3 bucket as an object with the key being the
+		// hash of its content.
+		var result *s3manager.UploadOutput
+		if result, err = conveyor.Uploader.Upload(input, s3manager.WithUploaderRequestOptions(sdkRetryOff)); err != nil {
+			// Print the error and exit.
+			slog.Errorf("Unable to upload %s to %s, %v", uploadfilepath, bucket, err)
+			return
+		}
+	
+		slog.Infof("location is %s\n", result.Location)
+		
+		if result.VersionID != nil {
+			slog.Infof("VersionID is %s\n", *result.VersionID)
+		}
 	}
-
-	slog.Infof("location is %s\n", result.Location)
 	
-	if result.VersionID != nil {
-		slog.Infof("VersionID is %s\n", *result.VersionID)
+	if err = conveyor.verifyUpload(bucket, key, digests, conveyor.Uploader.PartSize); err != nil {
+		slog.Errorf("Uploaded %s to %s is corrupt: %s", uploadfilepath, key, err.Error())
+		return
 	}
 	
-	slog.Infof("uploadID is %s\n", result.UploadID)
-	slog.Infof("Successfully uploaded %s to %s\n", filepath, bucket)
+	slog.Infof("Successfully uploaded %s to %s\n", uploadfilepath, bucket)
+	
+	conveyor.stats.AddUploaded(digests.Size)
 	
 	return
 }
 
 
+// DownloadObject fetches the object into downloadfile + PARTIAL_SUFFIX with ranged GETs of
+// Downloader.PartSize, Downloader.Concurrency at a time, and renames it into place once it
+// checks out. A retry, or the next call after an interruption, carries on from the end of
+// the part of the partial file that has no gaps.
 func (conveyor *S3Conveyor) DownloadObject(bucket string, filenameInBucket string, downloadfile string) (err error) {
 
-	if conveyor == nil || conveyor.Downloader == nil {
+	if conveyor == nil || conveyor.Client == nil || conveyor.Downloader == nil {
 		slog.Error("No downloader instance")
 		
 		err = errors.New("No downloader instance")
 		return
 	}
 
+	err = retry.Do(conveyor.Retry.OrDefault(), "Download of " + filenameInBucket, func() error {
+		return conveyor.downloadObjectOnce(bucket, filenameInBucket, downloadfile)
+	})
+	return
+}
+
+func (conveyor *S3Conveyor) downloadObjectOnce(bucket string, filenameInBucket string, downloadfile string) (err error) {
+
+	var info storage.ObjectInfo
+	if info, err = conveyor.HeadObject(bucket, filenameInBucket); err != nil {
+		slog.Errorf("Unable to download %s from %s, %v", filenameInBucket, bucket, err)
+		return
+	}
+
+	partial := downloadfile + PARTIAL_SUFFIX
+	progress := partial + PARTIAL_OFFSET_SUFFIX
+
 	var file *os.File
-	if file, err = os.Create(downloadfile); err != nil {
-	    slog.Errorf("failed to create file %s, %v", downloadfile, err)
+	if file, err = os.OpenFile(partial, os.O_RDWR | os.O_CREATE, 0666); err != nil {
+	    slog.Errorf("failed to create file %s, %v", partial, err)
 	    return
 	}
 	
 	defer file.Close()
 	
-	rc, err := conveyor.Downloader.Download(file, &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key: aws.String(filenameInBucket),
-	})
-
+	var offset int64
+	if offset, err = partialOffset(file, progress); err != nil {
+		return
+	}
+	
+	// Keys are content hashes, so whatever is in the partial file is a prefix of this object unless it outgrew it.
+	if offset > info.Size {
+		offset = 0
+	}
+	
+	// Parts past the prefix may have gaps before them.
+	if err = file.Truncate(offset); err != nil {
+		return
+	}
+	
+	if offset > 0 {
+		slog.Infof("Resuming download of %s at %d of %d", filenameInBucket, offset, info.Size)
+	}
+	
+	partSize := conveyor.Downloader.PartSize
+	if partSize <= 0 {
+		partSize = s3manager.DefaultDownloadPartSize
+	}
+	
+	concurrency := conveyor.Downloader.Concurrency
+	if concurrency <= 0 {
+		concurrency = s3manager.DefaultDownloadConcurrency
+	}
+	
+	var done, rc int64
+	done, rc, err = conveyor.downloadParts(file, progress, bucket, filenameInBucket, offset, info.Size, partSize, concurrency)
+	conveyor.stats.AddDownloaded(0, rc)
+	
 	if err != nil {
-		slog.Errorf("Unable to download %s from %s to %s, %v", filenameInBucket, bucket, downloadfile, err)
+		slog.Errorf("Unable to download %s from %s to %s at %d, %v", filenameInBucket, bucket, downloadfile, done, err)
+		file.Truncate(done)
+		return
+	}
+
+	if err = file.Sync(); err != nil {
+		return
+	}
+
+	// The bad file is gone by now, so another attempt starts from scratch.
+	if err = verifyDownload(filenameInBucket, file); err != nil {
+		os.Remove(progress)
+		err = retry.Transient(err)
 		return
 	}
 
+	if err = os.Rename(partial, downloadfile); err != nil {
+		slog.Errorf("Fail to move %s to %s: %s", partial, downloadfile, err.Error())
+		return
+	}
+	os.Remove(progress)
+
+	conveyor.stats.AddDownloaded(1, 0)
 	slog.Infof("download %d for %s from %s", rc, filenameInBucket, bucket)
 	return
 }
 
+// partialOffset is where the download into file carries on: the prefix recorded in progress,
+// or the size of file when nothing is recorded.
+func partialOffset(file *os.File, progress string) (offset int64, err error) {
+
+	var size int64
+	if size, err = file.Seek(0, io.SeekEnd); err != nil {
+		return
+	}
+
+	data, readErr := ioutil.ReadFile(progress)
+	if os.IsNotExist(readErr) {
+		offset = size
+		return
+	}
+
+	// A progress file that does not parse says nothing about the partial file.
+	if offset, readErr = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); readErr != nil || offset < 0 {
+		offset = 0
+	}
+
+	if offset > size {
+		offset = size
+	}
+	return
+}
+
+// downloadParts fetches [offset, size) of the object into file in parts of partSize,
+// concurrency of them at a time. done is how far file is complete without gaps, which
+// progress records as it grows, and written counts every byte received.
+func (conveyor *S3Conveyor) downloadParts(file *os.File, progress string, bucket string, filenameInBucket string, offset int64, size int64, partSize int64, concurrency int) (done int64, written int64, err error) {
+
+	done = offset
+	if offset >= size {
+		return
+	}
+
+	parts := (size - offset + partSize - 1) / partSize
+	finished := make([]bool, parts)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	indexes := make(chan int64)
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for idx := range indexes {
+				start := offset + idx * partSize
+				length := partSize
+				if start + length > size {
+					length = size - start
+				}
+
+				n, partErr := conveyor.downloadRangeTo(&offsetWriter{file: file, offset: start}, bucket, filenameInBucket, start, length)
+
+				mu.Lock()
+				written += n
+				if partErr != nil {
+					if err == nil {
+						err = partErr
+					}
+					mu.Unlock()
+					continue
+				}
+
+				finished[idx] = true
+				next := (done - offset) / partSize
+				for ; next < parts && finished[next]; next++ {
+				}
+
+				if end := offset + next * partSize; end > done {
+					if end > size {
+						end = size
+					}
+					if progressErr := saveProgress(file, progress, end); progressErr != nil && err == nil {
+						err = progressErr
+					}
+					done = end
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for idx := int64(0); idx < parts; idx++ {
+		mu.Lock()
+		failed := err != nil
+		mu.Unlock()
+
+		if failed {
+			break
+		}
+		indexes <- idx
+	}
+	close(indexes)
+
+	wg.Wait()
+	return
+}
+
+// saveProgress records that file is complete up to done, after what it holds is on disk.
+func saveProgress(file *os.File, progress string, done int64) (err error) {
+
+	if err = file.Sync(); err != nil {
+		return
+	}
+	err = ioutil.WriteFile(progress, []byte(strconv.FormatInt(done, 10)), 0666)
+	return
+}
+
+// offsetWriter writes to file from offset on, so parts can land side by side.
+type offsetWriter struct {
+	file *os.File
+	offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (n int, err error) {
+
+	n, err = w.file.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return
+}
+
+// downloadRangeTo writes length bytes of the object at offset to w.
+func (conveyor *S3Conveyor) downloadRangeTo(w io.Writer, bucket string, filenameInBucket string, offset int64, length int64) (written int64, err error) {
+
+	var resp *s3.GetObjectOutput
+	
+	if resp, err = conveyor.Client.GetObjectWithContext(aws.BackgroundContext(), &s3.GetObjectInput{
+						Bucket: aws.String(bucket),
+						Key: aws.String(filenameInBucket),
+						Range: aws.String("bytes=" + strconv.FormatInt(offset, 10) + "-" + strconv.FormatInt(offset + length - 1, 10)),
+						SSECustomerAlgorithm: conveyor.SSE.customerAlgorithm(),
+						SSECustomerKey: conveyor.SSE.customerKey(),
+					}, sdkRetryOff); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	
+	if written, err = io.Copy(w, resp.Body); err == nil && written != length {
+		err = errors.Errorf("Short read of %d bytes instead of %d", written, length)
+	}
+	return
+}
+
+
+func (conveyor *S3Conveyor) DownloadRange(bucket string, filenameInBucket string, offset int64, length int64) (data []byte, err error) {
+
+	if conveyor == nil || conveyor.Client == nil {
+		slog.Error("No s3 client created")
+		
+		err = errors.New("No s3 client created")
+		return
+	}
+	
+	if length <= 0 {
+		return
+	}
+	
+	// A range read restores a piece of a chain that may be hundreds of GB, a body cut off
+	// halfway is retried along with the request.
+	err = retry.Do(conveyor.Retry.OrDefault(), "Download of range " + strconv.FormatInt(offset, 10) + " of " + filenameInBucket, func() (err error) {
+		data, err = conveyor.downloadRangeOnce(bucket, filenameInBucket, offset, length)
+		return
+	})
+	
+	if err == nil {
+		conveyor.stats.AddDownloaded(0, int64(len(data)))
+	}
+	return
+}
+
+func (conveyor *S3Conveyor) downloadRangeOnce(bucket string, filenameInBucket string, offset int64, length int64) (data []byte, err error) {
+	
+	var resp *s3.GetObjectOutput
+	
+	resp, err = conveyor.Client.GetObjectWithContext(aws.BackgroundContext(), &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key: aws.String(filenameInBucket),
+		Range: aws.String("bytes=" + strconv.FormatInt(offset, 10) + "-" + strconv.FormatInt(offset + length - 1, 10)),
+		SSECustomerAlgorithm: conveyor.SSE.customerAlgorithm(),
+		SSECustomerKey: conveyor.SSE.customerKey(),
+	}, sdkRetryOff)
+	
+	if err != nil {
+		slog.Errorf("Unable to download range %d+%d of %s from %s, %v", offset, length, filenameInBucket, bucket, err)
+		return
+	}
+	defer resp.Body.Close()
+	
+	if data, err = ioutil.ReadAll(resp.Body); err != nil {
+		slog.Errorf("Unable to read range %d+%d of %s from %s, %v", offset, length, filenameInBucket, bucket, err)
+		return
+	}
+	return
+}
+
 
 func (conveyor *S3Conveyor) ListBuckets() (buckets []string, err error) {
 
@@ -174,6 +541,27 @@ func (conveyor *S3Conveyor) ListBuckets() (buckets []string, err error) {
 
 func (conveyor *S3Conveyor) CheckPathInBucket(bucket string, path string) (found bool, err error) {
 	
+	if strings.HasSuffix(path, "/") == false  {
+		path = path + "/"
+	}
+	
+	iterator := conveyor.ListObjectsIterator(bucket, storage.ListOptions{Prefix: path})
+	found = iterator.Next()
+	
+	if err = iterator.Err(); err != nil {
+		return
+	}
+	
+	if found {
+		slog.Infof("Found %s in bucket %s", path, bucket)
+	} else {
+		slog.Infof("%s in bucket %s not existed", path, bucket)
+	}
+	return
+}
+
+func (conveyor *S3Conveyor) HeadObject(bucket string, filenameInBucket string) (info storage.ObjectInfo, err error) {
+	
 	if conveyor == nil || conveyor.Client == nil {
 		slog.Error("No s3 client created")
 		
@@ -181,39 +569,70 @@ func (conveyor *S3Conveyor) CheckPathInBucket(bucket string, path string) (found
 		return
 	}
 	
-	if strings.HasSuffix(path, "/") == false  {
-		path = path + "/"
+	var headResp *s3.HeadObjectOutput
+	
+	headResp, err = conveyor.Client.HeadObject(conveyor.headObjectInput(bucket, filenameInBucket))
+	
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 404 {
+			err = storage.ErrNotFound
+			return
+		}
+		
+		slog.Errorf("Head request to %s failed: %s", filenameInBucket, err.Error())
+		return
+	}
+	
+	info = storage.ObjectInfo{
+		Key: filenameInBucket,
+		Size: aws.Int64Value(headResp.ContentLength),
+		ETag: strings.Trim(aws.StringValue(headResp.ETag), `"`),
+		StorageClass: aws.StringValue(headResp.StorageClass),
+		LastModified: aws.TimeValue(headResp.LastModified),
+		Metadata: aws.StringValueMap(headResp.Metadata),
+	}
+	return
+}
+
+func (conveyor *S3Conveyor) headObjectInput(bucket string, key string) *s3.HeadObjectInput {
+	return &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key: aws.String(key),
+		SSECustomerAlgorithm: conveyor.SSE.customerAlgorithm(),
+		SSECustomerKey: conveyor.SSE.customerKey(),
+	}
+}
+
+func (conveyor *S3Conveyor) ListObjects(bucket string, prefix string, fn func(storage.ObjectInfo) bool) (err error) {
+	
+	iterator := conveyor.ListObjectsIterator(bucket, storage.ListOptions{Prefix: prefix})
+	
+	for iterator.Next() {
+		if fn(iterator.Object()) == false {
+			break
+		}
 	}
 	
-	var listResponse *s3.ListObjectsV2Output 
+	err = iterator.Err()
+	return
+}
 
-	listResponse, err = conveyor.Client.ListObjectsV2(&s3.ListObjectsV2Input{
+func (conveyor *S3Conveyor) DeleteObject(bucket string, filenameInBucket string) (err error) {
+	
+	if conveyor == nil || conveyor.Client == nil {
+		slog.Error("No s3 client created")
+		
+		err = errors.New("No s3 client created")
+		return
+	}
+	
+	_, err = conveyor.Client.DeleteObject(&s3.DeleteObjectInput{
 						Bucket: aws.String(bucket),
-						Prefix: aws.String(path),
-					});
+						Key:    aws.String(filenameInBucket),
+					})
 	
 	if err != nil {
-	    if aerr, ok := err.(awserr.Error); ok {
-	        switch aerr.Code() {
-		        case s3.ErrCodeNoSuchBucket:
-		            slog.Error(s3.ErrCodeNoSuchBucket, aerr.Error())
-		        default:
-		            slog.Error(aerr)
-	        }
-	    } else {
-	        // Print the error, cast err to awserr.Error to get the Code and
-	        // Message from an error.
-	        slog.Error(aerr)
-	    }  
-	    
-	    return  
-	}
-	
-	if len(listResponse.Contents) > 0 {
-		found = true
-		slog.Infof("Found %s in bucket %s", *listResponse.Prefix, *listResponse.Name)
-	} else {
-		slog.Infof("%s in bucket %s not existed", *listResponse.Prefix, *listResponse.Name)
+		slog.Errorf("Fail to delete %s from %s: %s", filenameInBucket, bucket, err.Error())
 	}
 	return
 }
@@ -267,29 +686,31 @@ func (conveyor *S3Conveyor) GeneratePresignedURL(bucket string, foldInBucket str
 		}
 	}
 	
-	object = object + ".dat"
+	url, etag, err = conveyor.presignHead(bucket, storage.ObjectKey(foldInBucket, object))
+	return
+}
 
-	req, headResp := conveyor.Client.HeadObjectRequest(&s3.HeadObjectInput{
-                        	Bucket: aws.String(bucket),
-                        	Key:    aws.String(foldInBucket + "/" + object[0:2] + "/" + object[2:4] + "/" + object),
-			            })
+func (conveyor *S3Conveyor) presignHead(bucket string, key string) (url string, etag string, err error) {
+
+	// With SSE-C the key is signed into the URL, whoever uses it has to send the same headers.
+	req, headResp := conveyor.Client.HeadObjectRequest(conveyor.headObjectInput(bucket, key))
 
 	if err = req.Send(); err == nil {
 		slog.Info(headResp)
 	} else {
-		slog.Errorf("Head request to %s failed: %s\n", object, err.Error())
+		slog.Errorf("Head request to %s failed: %s\n", key, err.Error())
 		return
 	}
 
-	etag = *headResp.ETag
-	etag = etag[1 : len(etag) -1]
+	etag = strings.Trim(aws.StringValue(headResp.ETag), `"`)
 	
 	slog.Infof("etag is %s\n", etag)
 	
-	base64Etag := base64.StdEncoding.EncodeToString([]byte(etag))
-	slog.Infof("md5 is %s\n", base64Etag)
-	
-	req.HTTPRequest.Header.Set("Content-MD5", base64Etag)
+	// Only a single part ETag of an object without SSE-KMS or SSE-C is the MD5 of the object.
+	if contentMD5 := ContentMD5OfETag(etag); contentMD5 != "" && headETagIsMD5(headResp) {
+		slog.Infof("md5 is %s\n", contentMD5)
+		req.HTTPRequest.Header.Set("Content-MD5", contentMD5)
+	}
 
 	if url, err = req.Presign(15 * time.Minute); err != nil {
 		slog.Errorf("Failed to sign request", err)
@@ -299,3 +720,41 @@ func (conveyor *S3Conveyor) GeneratePresignedURL(bucket string, foldInBucket str
 	return
 }
 
+// PRESIGN_MAX_EXPIRY is the longest a SigV4 presigned URL stays valid.
+const PRESIGN_MAX_EXPIRY = 7 * 24 * time.Hour
+
+// PresignObject presigns a GET of key valid for expiry, for downloads by someone without credentials.
+func (conveyor *S3Conveyor) PresignObject(bucket string, key string, expiry time.Duration) (url string, err error) {
+
+	if conveyor == nil || conveyor.Client == nil {
+		slog.Error("No s3 client created")
+
+		err = errors.New("No s3 client created")
+		return
+	}
+
+	if expiry <= 0 || expiry > PRESIGN_MAX_EXPIRY {
+		err = errors.Errorf("Presigned URLs expire within %s, not %s", PRESIGN_MAX_EXPIRY, expiry)
+		return
+	}
+
+	// The customer key would have to go along with the URL, which defeats the point of it.
+	if conveyor.SSE.Mode == SSE_C {
+		err = errors.Errorf("Objects encrypted with %s can't be shared by URL", SSE_C)
+		return
+	}
+
+	if _, err = conveyor.HeadObject(bucket, key); err != nil {
+		return
+	}
+
+	req, _ := conveyor.Client.GetObjectRequest(&s3.GetObjectInput{
+						Bucket: aws.String(bucket),
+						Key: aws.String(key),
+					})
+
+	if url, err = req.Presign(expiry); err != nil {
+		slog.Errorf("Fail to presign GET of %s: %s", key, err.Error())
+	}
+	return
+}
@@ -1,134 +1,1382 @@
 package s3
 
 import (
+	"io"
+	"os"
+	"bytes"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 	"testing"
-	"flag"
+	"net/url"
+	"net/http"
+	"io/ioutil"
+	"strings"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/base64"
+	"github.com/pkg/errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+
+	"../retry"
+	"../s3fake"
 	"../bindiff"
+	"../storage"
 )
 
-var filename = flag.String("f", "", "test file name")
-var datapath = flag.String("p", "", "test file path")
+const TEST_BUCKET = "mozylab"
+
+// TestMain keeps the meta data of the tests out of the real S3_TRITON_ROOT.
+func TestMain(m *testing.M) {
+
+	root, err := ioutil.TempDir("", "s3_triton")
+	if err != nil {
+		panic(err)
+	}
+
+	bindiff.S3_TRITON_ROOT = root + "/"
+	code := m.Run()
+
+	os.RemoveAll(root)
+	os.Exit(code)
+}
+
+
+func newTestConveyor(t *testing.T) (conveyor *S3Conveyor, server *s3fake.Server) {
+
+	server = s3fake.NewServer()
+	server.CreateBucket(TEST_BUCKET)
+
+	var err error
+	if conveyor, err = NewS3ConveyorWithConfig(S3Config{
+							Endpoint: server.URL,
+							PathStyle: true,
+							AccessKey: "test",
+							SecretKey: "test",
+						}); err != nil {
+		server.Close()
+		t.Fatalf("Fail to create conveyor: %s", err.Error())
+	}
+
+	conveyor.Bucket = TEST_BUCKET
+	conveyor.Retry = retry.Policy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	return
+}
+
+// newBackupFile writes content to a temporary file and creates its baseline meta data.
+func newBackupFile(t *testing.T, content []byte) (filepath string, objectId string, cleanup func()) {
+
+	dir, err := ioutil.TempDir("", "s3_conveyor")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filepath = dir + "/test.txt"
+	if err = ioutil.WriteFile(filepath, content, 0666); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	cleanup = func() {
+		os.RemoveAll(dir)
+		os.RemoveAll(bindiff.S3_TRITON_ROOT + dir)
+	}
+
+	if err = bindiff.CreatePatch(filepath); err != nil {
+		cleanup()
+		t.Fatalf("Fail to create meta data under %s: %s", bindiff.S3_TRITON_ROOT, err.Error())
+	}
+
+	sum := sha1.Sum(content)
+	objectId = hex.EncodeToString(sum[:])
+	return
+}
+
+func TestS3Config(t *testing.T) {
+
+	if _, err := NewS3ConveyorWithConfig(S3Config{AccessKey: "test"}); err == nil {
+		t.Error("AccessKey without SecretKey should be rejected")
+	}
+
+	conveyor, err := NewS3ConveyorWithConfig(S3Config{Endpoint: "http://minio.local:9000", PathStyle: true})
+	if err != nil {
+		t.Fatalf("Fail to create conveyor: %s", err.Error())
+	}
+
+	if *conveyor.Sess.Config.Region != DEFAULT_REGION || *conveyor.Sess.Config.S3ForcePathStyle == false {
+		t.Errorf("Session region %s, path style %v", *conveyor.Sess.Config.Region, *conveyor.Sess.Config.S3ForcePathStyle)
+	}
+
+	req, _ := conveyor.Client.HeadObjectRequest(&s3.HeadObjectInput{Bucket: aws.String(TEST_BUCKET), Key: aws.String("key")})
+	if req.MaxRetries() == 0 {
+		t.Error("SDK doesn't retry requests outside retry.Do")
+	}
+
+	if req.ApplyOptions(sdkRetryOff); req.MaxRetries() != 0 {
+		t.Errorf("SDK retries %d times under retry.Do", req.MaxRetries())
+	}
+
+	if err = req.Build(); err != nil || req.HTTPRequest.URL.String() != "http://minio.local:9000/" + TEST_BUCKET + "/key" {
+		t.Errorf("Request url is %s: %v", req.HTTPRequest.URL, err)
+	}
+
+	// The environment's region beats DEFAULT_REGION, an explicit one beats both.
+	defer os.Setenv("AWS_REGION", os.Getenv("AWS_REGION"))
+	os.Setenv("AWS_REGION", "eu-west-1")
+
+	for region, want := range map[string]string{"": "eu-west-1", "ap-south-1": "ap-south-1"} {
+		if conveyor, err = NewS3ConveyorWithConfig(S3Config{Region: region}); err != nil {
+			t.Fatalf("Fail to create conveyor: %s", err.Error())
+		}
+
+		if *conveyor.Sess.Config.Region != want || *conveyor.Client.Config.Region != want {
+			t.Errorf("Region %q gave session region %s", region, *conveyor.Sess.Config.Region)
+		}
+	}
+}
+
+func TestEncryptionConfig(t *testing.T) {
+
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("k"), 32))
+
+	bad := []S3Config{
+		{Encryption: "rot13"},
+		{Encryption: SSE_S3, KMSKeyId: "alias/backup"},
+		{Encryption: SSE_C},
+		{Encryption: SSE_C, CustomerKey: base64.StdEncoding.EncodeToString([]byte("short"))},
+		{CustomerKey: key},
+		{BaselineStorageClass: "COLD"},
+	}
+
+	for _, config := range bad {
+		if _, err := NewS3ConveyorWithConfig(config); err == nil {
+			t.Errorf("%s should be rejected", config)
+		}
+	}
+
+	config := S3Config{Encryption: SSE_C, CustomerKey: key, PatchStorageClass: s3.StorageClassGlacierIr}
+	if strings.Contains(config.String(), key) {
+		t.Errorf("String shows the customer key: %s", config)
+	}
+
+	conveyor, err := NewS3ConveyorWithConfig(config)
+	if err != nil {
+		t.Fatalf("Fail to create conveyor: %s", err.Error())
+	}
+
+	if conveyor.SSE.CustomerKey != strings.Repeat("k", 32) || conveyor.SSE.Mode != SSE_C {
+		t.Errorf("SSE is %+v", conveyor.SSE)
+	}
+
+	if storageClass := conveyor.storageClass(bindiff.S3_TRITON_ROOT + "/home/file.patch"); aws.StringValue(storageClass) != s3.StorageClassGlacierIr {
+		t.Errorf("Patch storage class is %v", storageClass)
+	}
+
+	if storageClass := conveyor.storageClass("/home/file"); storageClass != nil {
+		t.Errorf("Baseline storage class is %v", aws.StringValue(storageClass))
+	}
+}
+
+func TestSSECustomerKey(t *testing.T) {
+
+	server := s3fake.NewTLSServer()
+	defer server.Close()
+	server.CreateBucket(TEST_BUCKET)
+
+	dir, err := ioutil.TempDir("", "s3_conveyor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = server.CAFile(dir + "/ca.pem"); err != nil {
+		t.Fatal(err)
+	}
+
+	config := S3Config{
+		Endpoint: server.URL,
+		PathStyle: true,
+		AccessKey: "test",
+		SecretKey: "test",
+		CABundle: dir + "/ca.pem",
+		Encryption: SSE_C,
+		CustomerKey: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("k"), 32)),
+		BaselineStorageClass: s3.StorageClassStandardIa,
+	}
+
+	conveyor, err := NewS3ConveyorWithConfig(config)
+	if err != nil {
+		t.Fatalf("Fail to create conveyor: %s", err.Error())
+	}
+	conveyor.Bucket = TEST_BUCKET
+
+	content := []byte("customer key encrypted content")
+	filepath, objectId, cleanup := newBackupFile(t, content)
+	defer cleanup()
+
+	key := storage.ObjectKey("test", objectId)
+
+	if err = conveyor.UploadObject(TEST_BUCKET, "test", filepath); err != nil {
+		t.Fatalf("Fail to upload %s: %s", filepath, err.Error())
+	}
+
+	object := server.GetObject(TEST_BUCKET, key)
+	if object == nil || object.Header.Get(s3fake.SSE_C_ALGORITHM_HEADER) != SSE_C_ALGORITHM || object.StorageClass != s3.StorageClassStandardIa {
+		t.Fatalf("Uploaded object is %+v", object)
+	}
+
+	// The ETag is no MD5, the stored checksum still lets the second upload be skipped.
+	if err = conveyor.UploadObject(TEST_BUCKET, "test", filepath); err != nil {
+		t.Fatalf("Fail to upload %s again: %s", filepath, err.Error())
+	}
+
+	if stats := conveyor.Stats().Snapshot(); stats.UploadedObjects != 1 || stats.SkippedObjects != 1 {
+		t.Errorf("Second upload was not skipped: %s", stats)
+	}
+
+	if err = conveyor.Get(key, dir + "/download"); err != nil {
+		t.Fatalf("Fail to download %s: %s", key, err.Error())
+	}
+
+	if data, err := conveyor.GetRange(key, 9, 3); err != nil || string(data) != "key" {
+		t.Errorf("Range of %s is %q: %v", key, data, err)
+	}
+
+	if url, _, err := conveyor.Locator(key); err != nil || url == "" {
+		t.Errorf("Fail to presign %s: %v", key, err)
+	}
+
+	// The copy out of the temporary key needs the customer key for both ends.
+	if err = conveyor.PutStream("test/tmp/1.stream", bytes.NewBufferString("streamed with a customer key"), 0, func() (string, storage.ObjectMetadata, error) {
+		return "test/streamed", storage.ObjectMetadata{VersionType: storage.VERSION_PATCH}, nil
+	}); err != nil {
+		t.Fatalf("Fail to stream with a customer key: %s", err.Error())
+	}
+
+	if data, err := conveyor.GetRange("test/streamed", 0, 8); err != nil || string(data) != "streamed" {
+		t.Errorf("Streamed object reads %q: %v", data, err)
+	}
+
+	config.Encryption, config.CustomerKey = "", ""
+	keyless, err := NewS3ConveyorWithConfig(config)
+	if err != nil {
+		t.Fatalf("Fail to create conveyor: %s", err.Error())
+	}
+
+	if _, err = keyless.HeadObject(TEST_BUCKET, key); err == nil {
+		t.Error("Head without the customer key should fail")
+	}
+}
+
+func TestUploadObject(t *testing.T) {
+
+	conveyor, server := newTestConveyor(t)
+	defer server.Close()
+
+	content := []byte("upload object content")
+	filepath, objectId, cleanup := newBackupFile(t, content)
+	defer cleanup()
+
+	if err := conveyor.UploadObject(TEST_BUCKET, "test", filepath); err != nil {
+		t.Fatalf("Fail to upload %s: %s", filepath, err.Error())
+	}
+
+	object := server.GetObject(TEST_BUCKET, storage.ObjectKey("test", objectId))
+	if object == nil || bytes.Equal(object.Data, content) == false {
+		t.Fatalf("Uploaded object is %v, keys are %v", object, server.Keys(TEST_BUCKET))
+	}
+
+	if object.Header.Get("X-Amz-Checksum-Sha256") == "" {
+		t.Error("Upload was sent without a SHA-256 checksum")
+	}
+
+	if object.Metadata[storage.META_MACHINE_ID] != "test" || object.Metadata[storage.META_VERSION_TYPE] != storage.VERSION_BASELINE {
+		t.Errorf("Uploaded object has metadata %v", object.Metadata)
+	}
+
+	if tags, _ := url.ParseQuery(object.Header.Get("X-Amz-Tagging")); tags.Get(storage.META_SOURCE_PATH_HASH) != storage.SourcePathHash(filepath) {
+		t.Errorf("Uploaded object has tags %s", object.Header.Get("X-Amz-Tagging"))
+	}
+
+	info, err := conveyor.Head(storage.ObjectKey("test", objectId))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metadata, err := storage.ParseObjectMetadata(info.Metadata); err != nil || metadata.SourcePathHash != storage.SourcePathHash(filepath) {
+		t.Errorf("Metadata read back is %+v: %v", metadata, err)
+	}
+
+	// The file no longer hashes to the object id its meta data names.
+	if err := ioutil.WriteFile(filepath, []byte("changed after the patch was made"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	server.PutObject(TEST_BUCKET, storage.ObjectKey("test", objectId), nil)
+
+	if err := conveyor.UploadObject(TEST_BUCKET, "test", filepath); err == nil {
+		t.Error("Upload of a file that does not match its object id should fail")
+	}
+
+	if object = server.GetObject(TEST_BUCKET, storage.ObjectKey("test", objectId)); len(object.Data) != 0 {
+		t.Errorf("Mismatching file was uploaded: %q", object.Data)
+	}
+}
+
+func TestMultipartUpload(t *testing.T) {
+
+	conveyor, server := newTestConveyor(t)
+	defer server.Close()
+
+	conveyor.Uploader.PartSize = s3manager.MinUploadPartSize
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), int(s3manager.MinUploadPartSize) / 16 * 2 + 1000)
+	filepath, objectId, cleanup := newBackupFile(t, content)
+	defer cleanup()
+
+	if err := conveyor.UploadObject(TEST_BUCKET, "test", filepath); err != nil {
+		t.Fatalf("Fail to upload %s: %s", filepath, err.Error())
+	}
+
+	object := server.GetObject(TEST_BUCKET, storage.ObjectKey("test", objectId))
+	if object == nil || bytes.Equal(object.Data, content) == false {
+		t.Fatalf("Multipart upload of %d bytes did not round trip", len(content))
+	}
+
+	if object.ETag[len(object.ETag) - 2:] != "-3" {
+		t.Errorf("Multipart ETag is %s", object.ETag)
+	}
+
+	if checksum := object.Header.Get(s3fake.CHECKSUM_SHA256_HEADER); strings.HasSuffix(checksum, "-3") == false {
+		t.Errorf("Multipart checksum is %q", checksum)
+	}
+
+	if object.Metadata[storage.META_VERSION_TYPE] != storage.VERSION_BASELINE || object.Header.Get("X-Amz-Tagging") == "" {
+		t.Errorf("Multipart upload lost its metadata %v or tags", object.Metadata)
+	}
+
+	if err := conveyor.UploadObject(TEST_BUCKET, "test", filepath); err != nil {
+		t.Fatalf("Fail to upload %s again: %s", filepath, err.Error())
+	}
+
+	if stats := conveyor.Stats().Snapshot(); stats.UploadedObjects != 1 || stats.SkippedBytes != int64(len(content)) {
+		t.Errorf("Second multipart upload was not skipped: %s", stats)
+	}
+}
+
+func TestPutStream(t *testing.T) {
+
+	conveyor, server := newTestConveyor(t)
+	defer server.Close()
+
+	conveyor.Uploader.PartSize = s3manager.MinUploadPartSize
+	conveyor.PatchStorageClass = s3.StorageClassStandardIa
+
+	content := bytes.Repeat([]byte("streamed patch 0"), int(s3manager.MinUploadPartSize) / 16 * 2 + 1000)
+	sum := sha1.Sum(content)
+	key := storage.ObjectKey("test", hex.EncodeToString(sum[:]))
+	metadata := storage.ObjectMetadata{MachineId: "test", SourcePathHash: storage.SourcePathHash("/data/file"),
+	                                   VersionType: storage.VERSION_PATCH, PreviousObjectId: strings.Repeat("a", 40), BackupTime: time.Now()}
+
+	put := func(finishErr error) error {
+		// Hide Seek, a stream can't be read twice.
+		reader := struct{ io.Reader }{bytes.NewReader(content)}
+		return conveyor.PutStream("test/tmp/0.stream", reader, int64(len(content)), func() (string, storage.ObjectMetadata, error) {
+			return key, metadata, finishErr
+		})
+	}
+
+	check := func(copies string) {
+		object := server.GetObject(TEST_BUCKET, key)
+		if object == nil || bytes.Equal(object.Data, content) == false {
+			t.Fatalf("%s copy of the streamed object did not round trip", copies)
+		}
+
+		if object.StorageClass != s3.StorageClassStandardIa || object.Metadata[storage.META_PREVIOUS_OBJECT_ID] != metadata.PreviousObjectId ||
+		   object.Header.Get("X-Amz-Tagging") == "" {
+			t.Errorf("%s copy lost its storage class, metadata %v or tags", copies, object.Metadata)
+		}
+
+		if keys := server.Keys(TEST_BUCKET); len(keys) != 1 {
+			t.Errorf("%s copy left %v", copies, keys)
+		}
+	}
+
+	if err := put(nil); err != nil {
+		t.Fatalf("Fail to stream %s: %s", key, err.Error())
+	}
+	check("Single")
+
+	sha256Sum := sha256.Sum256(content)
+	if checksum := server.GetObject(TEST_BUCKET, key).Header.Get(s3fake.CHECKSUM_SHA256_HEADER); checksum != base64.StdEncoding.EncodeToString(sha256Sum[:]) {
+		t.Errorf("Single copy has checksum %s", checksum)
+	}
+
+	conveyor.DeleteObject(TEST_BUCKET, key)
+
+	copyObjectLimit, copyPartSize = s3manager.MinUploadPartSize, s3manager.MinUploadPartSize
+	defer func() {
+		copyObjectLimit, copyPartSize = MAX_COPY_OBJECT_SIZE, COPY_PART_SIZE
+	}()
+
+	if err := put(nil); err != nil {
+		t.Fatalf("Fail to stream %s with a multipart copy: %s", key, err.Error())
+	}
+	check("Multipart")
+
+	if etag := server.GetObject(TEST_BUCKET, key).ETag; strings.HasSuffix(etag, "-3") == false {
+		t.Errorf("Multipart copy ETag is %s", etag)
+	}
+
+	if checksum := server.GetObject(TEST_BUCKET, key).Header.Get(s3fake.CHECKSUM_SHA256_HEADER); strings.HasSuffix(checksum, "-3") == false {
+		t.Errorf("Multipart copy checksum is %s", checksum)
+	}
+
+	if err := put(nil); err != nil {
+		t.Fatalf("Fail to stream %s again: %s", key, err.Error())
+	}
+	check("Skipped")
+
+	if stats := conveyor.Stats().Snapshot(); stats.UploadedObjects != 2 || stats.SkippedBytes != int64(len(content)) {
+		t.Errorf("Stream of an object already there was not skipped: %s", stats)
+	}
+
+	// A truncated object under the key is no reason to drop the stream.
+	server.PutObject(TEST_BUCKET, key, content[:1000])
+	if err := put(nil); err != nil {
+		t.Fatalf("Fail to stream %s over a truncated copy: %s", key, err.Error())
+	}
+	check("Replacing")
+
+	conveyor.DeleteObject(TEST_BUCKET, key)
+
+	if err := put(errors.New("no hash")); err == nil {
+		t.Error("A failed finish should fail the stream")
+	}
+
+	if keys := server.Keys(TEST_BUCKET); len(keys) != 0 {
+		t.Errorf("Failed stream left %v", keys)
+	}
+
+	// The key finish names has to be the hash of what was streamed.
+	key = storage.ObjectKey("test", strings.Repeat("b", 40))
+	if err := put(nil); errors.Cause(err) != ErrChecksumMismatch {
+		t.Errorf("Stream stored under the key of other content: %v", err)
+	}
+
+	if keys := server.Keys(TEST_BUCKET); len(keys) != 0 {
+		t.Errorf("Mismatched stream left %v", keys)
+	}
+}
+
+func TestPutStreamPartLimit(t *testing.T) {
+
+	conveyor, server := newTestConveyor(t)
+	defer server.Close()
+
+	conveyor.Uploader.PartSize = s3manager.MinUploadPartSize
+
+	defer func() { maxUploadParts = MAX_UPLOAD_PARTS }()
+	maxUploadParts = 3
+
+	put := func(content []byte, sizeHint int64) error {
+		sum := sha1.Sum(content)
+		key := storage.ObjectKey("test", hex.EncodeToString(sum[:]))
+		reader := struct{ io.Reader }{bytes.NewReader(content)}
+		return conveyor.PutStream("test/tmp/0.stream", reader, sizeHint, func() (string, storage.ObjectMetadata, error) {
+			return key, storage.ObjectMetadata{VersionType: storage.VERSION_PATCH}, nil
+		})
+	}
+
+	// Without a hint the parts are the uploader's, the stream fills them up to the limit.
+	content := bytes.Repeat([]byte("part limit"), int(s3manager.MinUploadPartSize) * 3 / 10)
+	if err := put(content, 0); err != nil {
+		t.Fatalf("Fail to stream %d parts: %s", maxUploadParts, err.Error())
+	}
+
+	content = append(content, "one byte over"...)
+	if err := put(content, 0); err == nil || strings.Contains(err.Error(), "over 3 parts") == false {
+		t.Errorf("Stream over the part limit gave %v", err)
+	}
+
+	if uploads := server.Uploads(); len(uploads) != 0 {
+		t.Errorf("Stream over the part limit left uploads %v", uploads)
+	}
+
+	// With the size it is expected to have, the parts grow to fit.
+	if err := put(content, int64(len(content))); err != nil {
+		t.Errorf("Fail to stream %d bytes with a size hint: %s", len(content), err.Error())
+	}
+
+	if size := streamPartSize(200 << 30, s3manager.MinUploadPartSize); (400 << 30) / size > maxUploadParts {
+		t.Errorf("Part size %d for 200 GB is too small", size)
+	}
+}
+
+func TestPutEmptyStream(t *testing.T) {
+
+	conveyor, server := newTestConveyor(t)
+	defer server.Close()
+
+	var puts int32
+	server.FailRequest = func(r *http.Request) bool {
+		if r.Method == "PUT" {
+			atomic.AddInt32(&puts, 1)
+		}
+		return false
+	}
+
+	// The patch of an unchanged file is empty, and turned down by finish: nothing goes up.
+	noPatch := errors.New("unchanged")
+	err := conveyor.PutStream("test/tmp/0.stream", bytes.NewReader(nil), 0, func() (string, storage.ObjectMetadata, error) {
+		return "", storage.ObjectMetadata{}, noPatch
+	})
+	if err != noPatch || atomic.LoadInt32(&puts) != 0 {
+		t.Errorf("Unchanged stream gave %v after %d puts", err, atomic.LoadInt32(&puts))
+	}
+
+	// An empty stream finish takes is an empty object like any other.
+	sum := sha1.Sum(nil)
+	key := storage.ObjectKey("test", hex.EncodeToString(sum[:]))
+	if err = conveyor.PutStream("test/tmp/0.stream", bytes.NewReader(nil), 0, func() (string, storage.ObjectMetadata, error) {
+		return key, storage.ObjectMetadata{VersionType: storage.VERSION_PATCH}, nil
+	}); err != nil {
+		t.Fatalf("Fail to stream an empty object: %s", err.Error())
+	}
+
+	if keys := server.Keys(TEST_BUCKET); len(keys) != 1 || keys[0] != key {
+		t.Errorf("Empty stream left %v", keys)
+	}
+}
+
+func TestResumeMultipartUpload(t *testing.T) {
+
+	conveyor, server := newTestConveyor(t)
+	defer server.Close()
+
+	stateDir, err := ioutil.TempDir("", "s3_upload_state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	conveyor.StateDir = stateDir
+	conveyor.Retry.MaxAttempts = 1
+	conveyor.Uploader.PartSize = s3manager.MinUploadPartSize
+
+	content := bytes.Repeat([]byte("fedcba9876543210"), int(s3manager.MinUploadPartSize) / 16 * 2 + 1000)
+	filepath, objectId, cleanup := newBackupFile(t, content)
+	defer cleanup()
+
+	server.FailPart = func(partNumber int) bool { return partNumber == 3 }
+
+	if err = conveyor.UploadObject(TEST_BUCKET, "test", filepath); err == nil {
+		t.Fatal("Upload should fail on the last part")
+	}
+
+	if states, _ := ioutil.ReadDir(stateDir); len(states) != 1 || len(server.Uploads()) != 1 || server.PartUploads() != 2 {
+		t.Fatalf("After the failure: %d states, uploads %v, %d parts", len(states), server.Uploads(), server.PartUploads())
+	}
+
+	server.FailPart = nil
+
+	if err = conveyor.UploadObject(TEST_BUCKET, "test", filepath); err != nil {
+		t.Fatalf("Fail to resume upload of %s: %s", filepath, err.Error())
+	}
+
+	if server.PartUploads() != 3 {
+		t.Errorf("Resume uploaded %d parts instead of the missing one", server.PartUploads() - 2)
+	}
+
+	object := server.GetObject(TEST_BUCKET, storage.ObjectKey("test", objectId))
+	if object == nil || bytes.Equal(object.Data, content) == false {
+		t.Errorf("Resumed upload did not round trip")
+	}
+
+	if states, _ := ioutil.ReadDir(stateDir); len(states) != 0 || len(server.Uploads()) != 0 {
+		t.Errorf("Left behind %d states and uploads %v", len(states), server.Uploads())
+	}
+}
+
+func TestUploadStateDir(t *testing.T) {
+
+	conveyor, server := newTestConveyor(t)
+	defer server.Close()
+
+	root, err := ioutil.TempDir("", "s3_triton")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	defer func(saved string) { bindiff.S3_TRITON_ROOT = saved }(bindiff.S3_TRITON_ROOT)
+	bindiff.S3_TRITON_ROOT = root + "/"
+
+	conveyor.StateDir = ""
+	conveyor.Retry.MaxAttempts = 1
+	conveyor.Uploader.PartSize = s3manager.MinUploadPartSize
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), int(s3manager.MinUploadPartSize) / 16 + 1000)
+	filepath, _, cleanup := newBackupFile(t, content)
+	defer cleanup()
+
+	server.FailPart = func(partNumber int) bool { return partNumber == 2 }
+
+	if err = conveyor.UploadObject(TEST_BUCKET, "test", filepath); err == nil {
+		t.Fatal("Upload should fail on the last part")
+	}
+
+	// Without a StateDir, the state of the interrupted upload is kept with the meta data.
+	if states, _ := ioutil.ReadDir(root + "/" + UPLOAD_STATE_DIR); len(states) != 1 {
+		t.Errorf("%d upload states under %s", len(states), root)
+	}
+
+	conveyor.StateDir = root + "/elsewhere"
+	if path := conveyor.uploadStatePath(TEST_BUCKET, "test"); strings.HasPrefix(path, root + "/elsewhere/") == false {
+		t.Errorf("Upload state with a StateDir is %s", path)
+	}
+}
+
+func TestAbortStaleUploads(t *testing.T) {
+
+	conveyor, server := newTestConveyor(t)
+	defer server.Close()
+
+	for _, key := range []string{"test/stale", "test/fresh", "other/stale"} {
+		created, err := conveyor.Client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{Bucket: aws.String(TEST_BUCKET), Key: aws.String(key)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if key != "test/fresh" {
+			server.SetUploadInitiated(aws.StringValue(created.UploadId), time.Now().Add(-10 * 24 * time.Hour))
+		}
+	}
+
+	aborted, err := conveyor.AbortStaleMultipartUploads(TEST_BUCKET, "test/", 7 * 24 * time.Hour)
+	if err != nil || aborted != 1 || len(server.Uploads()) != 2 {
+		t.Errorf("Aborted %d, left %v: %v", aborted, server.Uploads(), err)
+	}
+}
+
+func TestUploadSkipsExisting(t *testing.T) {
+
+	conveyor, server := newTestConveyor(t)
+	defer server.Close()
+
+	content := []byte("existing object content")
+	filepath, objectId, cleanup := newBackupFile(t, content)
+	defer cleanup()
+
+	key := storage.ObjectKey("test", objectId)
+
+	// Same size, different bytes: the ETag check must catch it and upload.
+	server.PutObject(TEST_BUCKET, key, bytes.Repeat([]byte("x"), len(content)))
+
+	if err := conveyor.UploadObject(TEST_BUCKET, "test", filepath); err != nil {
+		t.Fatalf("Fail to upload %s: %s", filepath, err.Error())
+	}
+
+	if object := server.GetObject(TEST_BUCKET, key); bytes.Equal(object.Data, content) == false {
+		t.Errorf("Corrupt object was kept: %q", object.Data)
+	}
 
-func TestUploadObject(t *testing.T) {
-		
-	t.Logf("Current path is %s, file name is %s", *datapath, *filename)	
-	
-	filepath := *datapath + "/" + *filename
-	bucket := "mozylab"
-	
-	s3Conveyor := NewS3Conveyor("us-east-2")
-	
-	if err := s3Conveyor.UploadObject(bucket, "test", filepath); err != nil {
-		t.Errorf("Fail to upload test.txt: %s", err.Error())
+	if err := conveyor.UploadObject(TEST_BUCKET, "test", filepath); err != nil {
+		t.Fatalf("Fail to upload %s again: %s", filepath, err.Error())
+	}
+
+	stats := conveyor.Stats().Snapshot()
+	if stats.UploadedObjects != 1 || stats.SkippedObjects != 1 || stats.SkippedBytes != int64(len(content)) {
+		t.Errorf("Unexpected stats: %s", stats)
+	}
+}
+
+func TestUploadBucketDefaultKMS(t *testing.T) {
+
+	conveyor, server := newTestConveyor(t)
+	defer server.Close()
+
+	// No encryption is configured, the bucket applies SSE-KMS anyway and no ETag is an MD5.
+	server.SetDefaultEncryption(TEST_BUCKET, SSE_KMS)
+	conveyor.Uploader.PartSize = s3manager.MinUploadPartSize
+
+	for i, content := range [][]byte{
+		[]byte("single part under the bucket's key"),
+		bytes.Repeat([]byte("0123456789abcdef"), int(s3manager.MinUploadPartSize) / 16 + 1000),
+	} {
+		filepath, objectId, cleanup := newBackupFile(t, content)
+		defer cleanup()
+
+		key := storage.ObjectKey("test", objectId)
+
+		if err := conveyor.UploadObject(TEST_BUCKET, "test", filepath); err != nil {
+			t.Fatalf("Fail to upload %d bytes to a bucket encrypting by default: %s", len(content), err.Error())
+		}
+
+		object := server.GetObject(TEST_BUCKET, key)
+		if object == nil || bytes.Equal(object.Data, content) == false || object.Header.Get(s3fake.SSE_HEADER) != SSE_KMS {
+			t.Fatalf("Upload of %d bytes stored %v", len(content), object)
+		}
+
+		if err := conveyor.UploadObject(TEST_BUCKET, "test", filepath); err != nil {
+			t.Fatalf("Fail to upload %s again: %s", filepath, err.Error())
+		}
+
+		if stats := conveyor.Stats().Snapshot(); stats.UploadedObjects != int64(i + 1) || stats.SkippedObjects != int64(i + 1) {
+			t.Errorf("Second upload of %d bytes was not skipped: %s", len(content), stats)
+		}
+
+		// What fails the check is kept, earlier versions may refer to the key.
+		file, _ := os.Open(filepath)
+		digests, err := digestFile(file, uploadPartSize(int64(len(content)), conveyor.Uploader.PartSize))
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		server.PutObject(TEST_BUCKET, key, bytes.Repeat([]byte("x"), len(content)))
+		object = server.GetObject(TEST_BUCKET, key)
+		object.Header.Set(s3fake.CHECKSUM_SHA256_HEADER, "bad")
+
+		if err = conveyor.verifyUpload(TEST_BUCKET, key, digests, conveyor.Uploader.PartSize); err == nil {
+			t.Errorf("Corrupt object of %d bytes passed verification", len(content))
+		}
+
+		if server.GetObject(TEST_BUCKET, key) == nil {
+			t.Errorf("Corrupt object of %d bytes was deleted", len(content))
+		}
 	}
 }
 
+func TestMatchStored(t *testing.T) {
+
+	content := bytes.Repeat([]byte("match stored "), 1000)
+
+	file, err := ioutil.TempFile("", "digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	file.Write(content)
+
+	digests, err := digestFile(file, 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plainETag := `"` + hex.EncodeToString(digests.MD5) + `"`
+	size := aws.Int64(int64(len(content)))
+
+	for _, c := range []struct {
+		name string
+		head s3.HeadObjectOutput
+		err error
+	}{
+		{"plain etag", s3.HeadObjectOutput{ContentLength: size, ETag: aws.String(plainETag)}, nil},
+		{"bad plain etag", s3.HeadObjectOutput{ContentLength: size, ETag: aws.String(`"00"`)}, ErrChecksumMismatch},
+		{"short", s3.HeadObjectOutput{ContentLength: aws.Int64(1), ETag: aws.String(plainETag)}, ErrChecksumMismatch},
+		{"checksum", s3.HeadObjectOutput{ContentLength: size, ChecksumSHA256: aws.String(digests.ChecksumSHA256()), ServerSideEncryption: aws.String(SSE_KMS)}, nil},
+		{"composite checksum", s3.HeadObjectOutput{ContentLength: size, ChecksumSHA256: aws.String(digests.CompositeChecksumSHA256()), SSECustomerAlgorithm: aws.String(SSE_C_ALGORITHM)}, nil},
+		{"bad checksum", s3.HeadObjectOutput{ContentLength: size, ChecksumSHA256: aws.String(digests.ChecksumSHA256() + "-3"), ETag: aws.String(plainETag)}, ErrChecksumMismatch},
+		{"kms without checksum", s3.HeadObjectOutput{ContentLength: size, ETag: aws.String(plainETag), ServerSideEncryption: aws.String(SSE_KMS)}, errUnverifiable},
+	} {
+		if err = matchStored(&c.head, digests, 5000); errors.Cause(err) != c.err {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.err)
+		}
+	}
+}
 
 func TestDownloadObject(t *testing.T) {
-		
-	t.Logf("Current path is %s, file name is %s", *datapath, *filename)
-	
-	downloadfile := *datapath + "/download_" + *filename
-	bucket := "mozylab"
-	
-	var metadata bindiff.FileMetaData
-	var err error
-	if metadata, err = bindiff.GetFileMetaData(*datapath + "/" + *filename); err != nil {
-		t.Errorf("Fail to get meta data: %s", err.Error())
-		return
+
+	conveyor, server := newTestConveyor(t)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "s3_conveyor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := []byte("download object content")
+	sum := sha1.Sum(content)
+	key := storage.ObjectKey("test", hex.EncodeToString(sum[:]))
+	server.PutObject(TEST_BUCKET, key, content)
+
+	downloadfile := dir + "/download"
+	if err = conveyor.DownloadObject(TEST_BUCKET, key, downloadfile); err != nil {
+		t.Fatalf("Fail to download %s: %s", key, err.Error())
+	}
+
+	if data, _ := ioutil.ReadFile(downloadfile); bytes.Equal(data, content) == false {
+		t.Errorf("Downloaded %q", data)
+	}
+
+	if data, err := conveyor.DownloadRange(TEST_BUCKET, key, 9, 6); err != nil || string(data) != "object" {
+		t.Errorf("Range of %s is %q: %v", key, data, err)
 	}
-	
-	s3Conveyor := NewS3Conveyor("us-east-2")
-	patchHash := hex.EncodeToString(metadata.PatchHash[:])
-	
-	if err = s3Conveyor.DownloadObject(bucket, 
-		      "test/" + patchHash[0:2] + "/" + patchHash[2:4] + "/" + patchHash + ".dat", downloadfile); err != nil {
-		t.Errorf("Fail to download test.txt: %s", err.Error())
+
+	if _, err = conveyor.HeadObject(TEST_BUCKET, key + ".missing"); err != storage.ErrNotFound {
+		t.Errorf("Head of a missing key should be not found, got %v", err)
 	}
 }
 
+func TestSDKRetries(t *testing.T) {
 
-func TestListBuckets(t *testing.T) {
-	
-	var buckets []string
-	var err error
-	
-	s3Conveyor := NewS3Conveyor("us-east-2")
-	
-	if buckets, err = s3Conveyor.ListBuckets(); err != nil {
-		t.Errorf("Fail to list buckets: %s", err.Error())
-		return
+	conveyor, server := newTestConveyor(t)
+	defer server.Close()
+
+	content := bytes.Repeat([]byte("retried "), 1000)
+	filepath, objectId, cleanup := newBackupFile(t, content)
+	defer cleanup()
+
+	if err := conveyor.UploadObject(TEST_BUCKET, "test", filepath); err != nil {
+		t.Fatal(err)
+	}
+	key := storage.ObjectKey("test", objectId)
+
+	// Every kind of request fails once, and the conveyor doesn't retry anything itself.
+	conveyor.Retry.MaxAttempts = 1
+	requests := map[string]int{}
+	server.FailRequest = func(r *http.Request) bool {
+		requests[r.Method] += 1
+		return requests[r.Method] == 1
+	}
+
+	// Single requests are left to the SDK's retries.
+	if info, err := conveyor.HeadObject(TEST_BUCKET, key); err != nil || info.Size != int64(len(content)) {
+		t.Errorf("Head after a 503 is %v: %v", info, err)
+	}
+
+	// Transfers are retried by the conveyor alone, so the attempts don't multiply.
+	if _, err := conveyor.DownloadRange(TEST_BUCKET, key, 8, 16); err == nil || requests["GET"] != 1 {
+		t.Errorf("Range download with one attempt took %d requests: %v", requests["GET"], err)
+	}
+
+	conveyor.Retry.MaxAttempts = 2
+	server.FailRange = func(start int64) bool { return requests["GET"] == 2 }
+	if data, err := conveyor.DownloadRange(TEST_BUCKET, key, 8, 16); err != nil || bytes.Equal(data, content[8:24]) == false {
+		t.Errorf("Range download after a failure is %q: %v", data, err)
+	}
+
+	if err := conveyor.DeleteObject(TEST_BUCKET, key); err != nil || server.GetObject(TEST_BUCKET, key) != nil {
+		t.Errorf("Delete after a 503 failed: %v", err)
+	}
+}
+
+func TestResumeDownload(t *testing.T) {
+
+	conveyor, server := newTestConveyor(t)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "s3_conveyor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conveyor.Downloader.PartSize = 4
+
+	content := []byte("resumed download content")
+	sum := sha1.Sum(content)
+	key := storage.ObjectKey("test", hex.EncodeToString(sum[:]))
+	server.PutObject(TEST_BUCKET, key, content)
+
+	downloadfile := dir + "/download"
+
+	// A partial file is taken as is, so a bad one shows up as a checksum failure, is dropped
+	// and the retry downloads the object from scratch.
+	if err = ioutil.WriteFile(downloadfile + PARTIAL_SUFFIX, []byte("RESUMED"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = conveyor.DownloadObject(TEST_BUCKET, key, downloadfile); err != nil {
+		t.Fatalf("Fail to recover from a bad partial file: %s", err.Error())
+	}
+
+	if data, _ := ioutil.ReadFile(downloadfile); bytes.Equal(data, content) == false {
+		t.Errorf("Recovered download is %q", data)
+	}
+
+	if stats := conveyor.Stats().Snapshot(); stats.DownloadedObjects != 1 || stats.DownloadedBytes != int64(len(content) - 7 + len(content)) {
+		t.Errorf("Unexpected stats: %s", stats)
+	}
+
+	if err = ioutil.WriteFile(downloadfile + PARTIAL_SUFFIX, content[:9], 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = conveyor.DownloadObject(TEST_BUCKET, key, downloadfile); err != nil {
+		t.Fatalf("Fail to resume download of %s: %s", key, err.Error())
+	}
+
+	if data, _ := ioutil.ReadFile(downloadfile); bytes.Equal(data, content) == false {
+		t.Errorf("Resumed download is %q", data)
+	}
+
+	if _, err = os.Stat(downloadfile + PARTIAL_SUFFIX); os.IsNotExist(err) == false {
+		t.Errorf("Partial file was left behind: %v", err)
+	}
+}
+
+func TestConcurrentDownload(t *testing.T) {
+
+	conveyor, server := newTestConveyor(t)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "s3_conveyor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conveyor.Retry.MaxAttempts = 1
+	conveyor.Downloader.PartSize = 4
+	conveyor.Downloader.Concurrency = 3
+
+	content := []byte("parts of this download land out of order")
+	sum := sha1.Sum(content)
+	key := storage.ObjectKey("test", hex.EncodeToString(sum[:]))
+	server.PutObject(TEST_BUCKET, key, content)
+
+	downloadfile := dir + "/download"
+
+	// Every part before the failed one is handed out first, so the prefix ends right at it.
+	server.FailRange = func(start int64) bool { return start == 20 }
+
+	if err = conveyor.DownloadObject(TEST_BUCKET, key, downloadfile); err == nil {
+		t.Fatal("Download should fail at 20")
+	}
+
+	partial, _ := ioutil.ReadFile(downloadfile + PARTIAL_SUFFIX)
+	recorded, _ := ioutil.ReadFile(downloadfile + PARTIAL_SUFFIX + PARTIAL_OFFSET_SUFFIX)
+	if bytes.Equal(partial, content[:20]) == false || string(recorded) != "20" {
+		t.Fatalf("After the failure the partial file is %q, recorded complete up to %q", partial, recorded)
+	}
+
+	var mu sync.Mutex
+	starts := []int64{}
+	server.FailRange = func(start int64) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		starts = append(starts, start)
+		return false
+	}
+
+	if err = conveyor.DownloadObject(TEST_BUCKET, key, downloadfile); err != nil {
+		t.Fatalf("Fail to resume download of %s: %s", key, err.Error())
+	}
+
+	if data, _ := ioutil.ReadFile(downloadfile); bytes.Equal(data, content) == false {
+		t.Errorf("Resumed download is %q", data)
+	}
+
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	if len(starts) != 5 || starts[0] != 20 {
+		t.Errorf("Resume fetched the ranges at %v", starts)
+	}
+
+	for _, leftover := range []string{downloadfile + PARTIAL_SUFFIX, downloadfile + PARTIAL_SUFFIX + PARTIAL_OFFSET_SUFFIX} {
+		if _, err = os.Stat(leftover); os.IsNotExist(err) == false {
+			t.Errorf("%s was left behind: %v", leftover, err)
+		}
+	}
+}
+
+func TestBandwidthLimits(t *testing.T) {
+
+	conveyor, server := newTestConveyor(t)
+	defer server.Close()
+
+	content := bytes.Repeat([]byte("x"), 300 * 1024)
+	key := "test/throttled"
+
+	// Past the first 100ms burst 200KB at 1MB/s take about 200ms each way.
+	conveyor.Limiters.Upload.SetRate(1 << 20)
+
+	start := time.Now()
+	if _, err := conveyor.Client.PutObject(&s3.PutObjectInput{
+						Bucket: aws.String(TEST_BUCKET),
+						Key: aws.String(key),
+						Body: bytes.NewReader(content),
+					}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 150 * time.Millisecond {
+		t.Errorf("Upload limited to 1MB/s took %s", elapsed)
+	}
+
+	conveyor.Limiters.Upload.SetRate(0)
+	conveyor.Limiters.Download.SetRate(1 << 20)
+
+	start = time.Now()
+	data, err := conveyor.DownloadRange(TEST_BUCKET, key, 0, int64(len(content)))
+	if err != nil || bytes.Equal(data, content) == false {
+		t.Fatalf("Fail to download %s: %v", key, err)
+	}
+	if elapsed := time.Since(start); elapsed < 150 * time.Millisecond {
+		t.Errorf("Download limited to 1MB/s took %s", elapsed)
+	}
+
+	upload, download := conveyor.BandwidthLimiters()
+	if upload.Rate() != 0 || download.Rate() != 1 << 20 {
+		t.Errorf("BandwidthLimiters returned rates %d, %d", upload.Rate(), download.Rate())
+	}
+}
+
+func TestArchiveRestore(t *testing.T) {
+
+	conveyor, server := newTestConveyor(t)
+	defer server.Close()
+
+	conveyor.Retry.MaxAttempts = 1
+
+	dir, err := ioutil.TempDir("", "s3_conveyor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := []byte("archived object content")
+	sum := sha1.Sum(content)
+	key := storage.ObjectKey("test", hex.EncodeToString(sum[:]))
+	server.PutObject(TEST_BUCKET, key, content)
+
+	if state, _, err := conveyor.ArchiveState(key); err != nil || state != storage.ARCHIVE_NONE {
+		t.Errorf("Standard object is in state %d: %v", state, err)
+	}
+
+	server.SetStorageClass(TEST_BUCKET, key, s3.StorageClassDeepArchive)
+
+	state, info, err := conveyor.ArchiveState(key)
+	if err != nil || state != storage.ARCHIVE_FROZEN || info.StorageClass != s3.StorageClassDeepArchive {
+		t.Fatalf("Archived object is in state %d, class %s: %v", state, info.StorageClass, err)
+	}
+
+	if err = conveyor.Get(key, dir + "/download"); err == nil {
+		t.Error("Download of an archived object should fail")
+	}
+
+	if err = conveyor.RestoreArchived(info, s3.TierBulk, 3); err != nil {
+		t.Fatalf("Fail to restore %s: %s", key, err.Error())
+	}
+
+	if err = conveyor.RestoreArchived(info, s3.TierBulk, 3); err != nil {
+		t.Errorf("A restore already in progress should count as requested: %s", err.Error())
+	}
+
+	if object := server.GetObject(TEST_BUCKET, key); object.RestoreTier != s3.TierBulk {
+		t.Errorf("Restore tier is %q", object.RestoreTier)
+	}
+
+	if state, _, _ = conveyor.ArchiveState(key); state != storage.ARCHIVE_RESTORING || state.Readable() {
+		t.Errorf("Object being restored is in state %d", state)
+	}
+
+	server.CompleteRestore(TEST_BUCKET, key)
+
+	if state, _, _ = conveyor.ArchiveState(key); state != storage.ARCHIVE_RESTORED {
+		t.Errorf("Restored object is in state %d", state)
+	}
+
+	if err = conveyor.Get(key, dir + "/download"); err != nil {
+		t.Errorf("Fail to download restored %s: %s", key, err.Error())
+	}
+}
+
+func TestDownloadCorruptObject(t *testing.T) {
+
+	conveyor, server := newTestConveyor(t)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "s3_conveyor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sum := sha1.Sum([]byte("original content"))
+	key := storage.ObjectKey("test", hex.EncodeToString(sum[:]))
+	server.PutObject(TEST_BUCKET, key, []byte("bit rotted content"))
+
+	downloadfile := dir + "/download"
+	if err = conveyor.DownloadObject(TEST_BUCKET, key, downloadfile); errors.Cause(err) != ErrChecksumMismatch {
+		t.Errorf("Download of a corrupt object returned %v", err)
+	}
+
+	if _, err = os.Stat(downloadfile); os.IsNotExist(err) == false {
+		t.Errorf("Corrupt download was left behind: %v", err)
+	}
+}
+
+func TestContentMD5OfETag(t *testing.T) {
+
+	if md5 := ContentMD5OfETag(`"9e107d9d372bb6826bd81d3542a419d6"`); md5 != "nhB9nTcrtoJr2B01QqQZ1g==" {
+		t.Errorf("Content-MD5 of a single part etag is %s", md5)
 	}
-	
-	for _, bucket := range buckets {
-		t.Logf("bucket is %s", bucket)
+
+	if md5 := ContentMD5OfETag("9e107d9d372bb6826bd81d3542a419d6-3"); md5 != "" {
+		t.Errorf("Content-MD5 of a multipart etag is %s", md5)
 	}
 }
 
+func TestDigestFile(t *testing.T) {
 
-func TestCreatePathInBucket(t *testing.T) {
-	
-	s3Conveyor := NewS3Conveyor("us-east-2")
-	
-	if err := s3Conveyor.CreatePathInBucket("mozylab", "test/"); err != nil {
-		t.Errorf("Fail to create test1/test2 in bucket: %s", err.Error())
-		return		
-	}	
+	partSize := int64(s3manager.MinUploadPartSize)
+	content := bytes.Repeat([]byte("0123456789"), int(partSize * 5 / 2 / 10))
+
+	file, err := ioutil.TempFile("", "digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	file.Write(content)
+
+	digests, err := digestFile(file, partSize)
+	if err != nil {
+		t.Fatalf("Fail to digest: %s", err.Error())
+	}
+
+	sum := sha1.Sum(content)
+	if digests.Size != int64(len(content)) || bytes.Equal(digests.SHA1, sum[:]) == false || len(digests.PartMD5) != 3 {
+		t.Fatalf("Digests of %d bytes: size %d, %d parts", len(content), digests.Size, len(digests.PartMD5))
+	}
+
+	// The ETag S3 gives the same parts: the MD5 of their MD5s.
+	concatenated := []byte{}
+	for offset := int64(0); offset < int64(len(content)); offset += partSize {
+		end := offset + partSize
+		if end > int64(len(content)) {
+			end = int64(len(content))
+		}
+		partSum := md5.Sum(content[offset:end])
+		concatenated = append(concatenated, partSum[:]...)
+	}
+	etagSum := md5.Sum(concatenated)
+	etag := hex.EncodeToString(etagSum[:]) + "-3"
+
+	if local := localETag(digests, etag, partSize); local != etag {
+		t.Errorf("Local etag is %s, want %s", local, etag)
+	}
+
+	if local := localETag(digests, "abc-4", partSize); local != "" {
+		t.Errorf("Etag of 4 parts reproduced as %s from 3", local)
+	}
+
+	wholeSum := md5.Sum(content)
+	if local := localETag(digests, "abc", partSize); local != hex.EncodeToString(wholeSum[:]) {
+		t.Errorf("Single part etag is %s", local)
+	}
 }
 
+func TestListBuckets(t *testing.T) {
+
+	conveyor, server := newTestConveyor(t)
+	defer server.Close()
+
+	buckets, err := conveyor.ListBuckets()
+	if err != nil {
+		t.Fatalf("Fail to list buckets: %s", err.Error())
+	}
+
+	if len(buckets) != 1 || buckets[0] != TEST_BUCKET {
+		t.Errorf("Listed buckets %v", buckets)
+	}
+}
 
 func TestCheckPathInBucket(t *testing.T) {
-	
-	s3Conveyor := NewS3Conveyor("us-east-2")
-	
-	found := false
-	var err error
-	if found, err = s3Conveyor.CheckPathInBucket("mozylab", "test/"); err != nil {
-		t.Error(err)
-	}
-	
-	if found {
-		t.Logf("Found test/ in bucket: mozylab")
-	} else {
-		t.Logf("Failed to find test/ in bucket: %s")
-	}
-	
-	if found, err = s3Conveyor.CheckPathInBucket("mozylab", "test3/"); err != nil {
-		t.Error(err)
-	}
-	
-	if found {
-		t.Log("Found test3/ in bucket: mozylab")
-	} else {
-		t.Log("Failed to find test3/ in bucket: mozylab")
-	}	
-}
-
-func TestGeneratePresignedURL(t *testing.T) { 
-		
-	bucket := "mozylab"
-	
-	t.Logf("Current path is %s, file name is %s", *datapath, *filename)	
-	
-	var metadata bindiff.FileMetaData
-	var err error
-	if metadata, err = bindiff.GetFileMetaData(*datapath + "/" + *filename); err != nil {
-		t.Errorf("Fail to get meta data: %s", err.Error())
+
+	conveyor, server := newTestConveyor(t)
+	defer server.Close()
+
+	if found, err := conveyor.CheckPathInBucket(TEST_BUCKET, "test/"); err != nil || found {
+		t.Errorf("test/ found %v before it was created: %v", found, err)
+	}
+
+	if err := conveyor.CreatePathInBucket(TEST_BUCKET, "test/"); err != nil {
+		t.Fatalf("Fail to create test/ in bucket: %s", err.Error())
+	}
+
+	if found, err := conveyor.CheckPathInBucket(TEST_BUCKET, "test/"); err != nil || found == false {
+		t.Errorf("test/ not found after it was created: %v", err)
+	}
+
+	if found, err := conveyor.CheckPathInBucket(TEST_BUCKET, "test3/"); err != nil || found {
+		t.Errorf("test3/ found %v: %v", found, err)
+	}
+}
+
+func TestMakeFolder(t *testing.T) {
+
+	conveyor, server := newTestConveyor(t)
+	defer server.Close()
+
+	if err := conveyor.MakeFolder("4097"); err != nil {
+		t.Fatalf("Fail to make folder: %s", err.Error())
+	}
+
+	if server.GetObject(TEST_BUCKET, "4097/") == nil {
+		t.Errorf("No folder marker in %v", server.Keys(TEST_BUCKET))
+	}
+
+	// A folder with objects in it needs no marker.
+	server.PutObject(TEST_BUCKET, "4098/ab/cd/object.dat", []byte("x"))
+	if err := conveyor.MakeFolder("4098"); err != nil || server.GetObject(TEST_BUCKET, "4098/") != nil {
+		t.Errorf("Folder with objects got a marker: %v", err)
+	}
+}
+
+func TestListObjects(t *testing.T) {
+
+	conveyor, server := newTestConveyor(t)
+	defer server.Close()
+
+	server.PageSize = 2
+
+	for _, key := range []string{"a/1", "a/2", "a/3", "a/4", "a/5", "b/1"} {
+		server.PutObject(TEST_BUCKET, key, []byte(key))
+	}
+
+	keys := []string{}
+	if err := conveyor.ListObjects(TEST_BUCKET, "a/", func(info storage.ObjectInfo) bool {
+		keys = append(keys, info.Key)
+		return true
+	}); err != nil || len(keys) != 5 {
+		t.Errorf("Listed %v across pages: %v", keys, err)
+	}
+}
+
+func TestPresignObject(t *testing.T) {
+
+	conveyor, server := newTestConveyor(t)
+	defer server.Close()
+
+	content := []byte("shared object content")
+	server.PutObject(TEST_BUCKET, "test/shared", content)
+
+	url, err := conveyor.PresignObject(TEST_BUCKET, "test/shared", 24 * time.Hour)
+	if err != nil {
+		t.Fatalf("Fail to presign test/shared: %s", err.Error())
+	}
+
+	if strings.Contains(url, "X-Amz-Expires=86400") == false {
+		t.Errorf("Presigned url %s doesn't expire in a day", url)
+	}
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Fail to get presigned url %s: %s", url, err.Error())
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if err != nil || resp.StatusCode != http.StatusOK || bytes.Equal(data, content) == false {
+		t.Errorf("Presigned url %s returned %s %q: %v", url, resp.Status, data, err)
+	}
+
+	if _, err = conveyor.PresignObject(TEST_BUCKET, "test/missing", time.Hour); err != storage.ErrNotFound {
+		t.Errorf("Presigning a missing object returned %v", err)
+	}
+
+	if _, err = conveyor.PresignObject(TEST_BUCKET, "test/shared", 8 * 24 * time.Hour); err == nil {
+		t.Error("Presigning beyond a week should fail")
+	}
+
+	conveyor.SSE = Encryption{Mode: SSE_C, CustomerKey: strings.Repeat("k", 32)}
+	if _, err = conveyor.PresignObject(TEST_BUCKET, "test/shared", time.Hour); err == nil {
+		t.Error("Presigning an SSE-C object should fail")
+	}
+}
+
+func TestObjectIterator(t *testing.T) {
+
+	conveyor, server := newTestConveyor(t)
+	defer server.Close()
+
+	server.PageSize = 2
+
+	for _, key := range []string{"a/1", "a/2", "a/x/1", "a/x/2", "a/y/1", "a/z", "b/1"} {
+		server.PutObject(TEST_BUCKET, key, []byte(key))
+	}
+
+	list := func(options storage.ListOptions) (keys []string) {
+		iterator := conveyor.ListObjectsIterator(TEST_BUCKET, options)
+		for iterator.Next() {
+			info := iterator.Object()
+			if info.CommonPrefix == false && (info.Size != int64(len(info.Key)) || info.ETag == "" || info.LastModified.IsZero()) {
+				t.Errorf("Listed %+v", info)
+			}
+			keys = append(keys, info.Key)
+		}
+
+		if err := iterator.Err(); err != nil {
+			t.Errorf("Fail to list %+v: %s", options, err.Error())
+		}
 		return
-	}	
-	
-	s3Conveyor := NewS3Conveyor("us-east-2")
-		
-	hash := make([]byte, len(metadata.PatchHash))
-	copy(hash, metadata.PatchHash[:])
-	object := hex.EncodeToString(hash)
-	
-	var url string
-	if url, _, err = s3Conveyor.GeneratePresignedURL(bucket, "test", object); err != nil {
-		t.Errorf("Fail to create presigned url for %s in bucket: %s", object, err.Error())
-		return			
-	}
-	
-	t.Logf("presigned url is %s", url)
+	}
+
+	for _, test := range []struct {
+		options storage.ListOptions
+		keys string
+	}{
+		{storage.ListOptions{Prefix: "a/"}, "a/1 a/2 a/x/1 a/x/2 a/y/1 a/z"},
+		{storage.ListOptions{Prefix: "a/", Delimiter: "/"}, "a/1 a/2 a/x/ a/y/ a/z"},
+		{storage.ListOptions{Prefix: "a/", StartAfter: "a/x/1"}, "a/x/2 a/y/1 a/z"},
+		{storage.ListOptions{Delimiter: "/"}, "a/ b/"},
+		{storage.ListOptions{Prefix: "c/"}, ""},
+	} {
+		if keys := strings.Join(list(test.options), " "); keys != test.keys {
+			t.Errorf("Listed %q for %+v, expect %q", keys, test.options, test.keys)
+		}
+	}
+
+	server.Close()
+
+	iterator := conveyor.ListObjectsIterator(TEST_BUCKET, storage.ListOptions{})
+	if iterator.Next() || iterator.Err() == nil {
+		t.Errorf("Listing a closed server did not fail")
+	}
+}
+
+func TestGeneratePresignedURL(t *testing.T) {
+
+	conveyor, server := newTestConveyor(t)
+	defer server.Close()
+
+	content := []byte("presigned object content")
+	sum := sha1.Sum(content)
+	object := hex.EncodeToString(sum[:])
+	server.PutObject(TEST_BUCKET, storage.ObjectKey("test", object), content)
+
+	if _, _, err := conveyor.GeneratePresignedURL(TEST_BUCKET, "test", "not-an-object"); err == nil {
+		t.Error("Invalid object id should be rejected")
+	}
+
+	url, etag, err := conveyor.GeneratePresignedURL(TEST_BUCKET, "test", object)
+	if err != nil {
+		t.Fatalf("Fail to create presigned url for %s: %s", object, err.Error())
+	}
+
+	if etag != server.GetObject(TEST_BUCKET, storage.ObjectKey("test", object)).ETag {
+		t.Errorf("Presigned etag is %s", etag)
+	}
+
+	resp, err := http.Head(url)
+	if err != nil {
+		t.Fatalf("Fail to head presigned url %s: %s", url, err.Error())
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Presigned url %s returned %s", url, resp.Status)
+	}
 }
@@ -0,0 +1,523 @@
+package s3
+
+import (
+	"io"
+	"hash"
+	"sort"
+	"sync"
+	"bytes"
+	"strconv"
+	"net/url"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/pkg/errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+
+	"../slog"
+	"../retry"
+	"../storage"
+)
+
+// MAX_COPY_OBJECT_SIZE is the largest object a single CopyObject takes, bigger ones are copied in parts.
+const MAX_COPY_OBJECT_SIZE = 5 * 1024 * 1024 * 1024
+
+const COPY_PART_SIZE = 512 * 1024 * 1024
+
+// MAX_UPLOAD_PARTS is the most parts S3 takes in one multipart upload.
+const MAX_UPLOAD_PARTS = 10000
+
+var maxUploadParts int64 = MAX_UPLOAD_PARTS
+
+var copyObjectLimit int64 = MAX_COPY_OBJECT_SIZE
+
+var copyPartSize int64 = COPY_PART_SIZE
+
+// rangeDigests takes the MD5 and SHA-256 of every size bytes written to it, and of what
+// is left at the end once close is called.
+type rangeDigests struct {
+	size int64
+	written int64
+	md5 hash.Hash
+	sha256 hash.Hash
+	MD5 [][]byte
+	SHA256 [][]byte
+}
+
+
+func (ranges *rangeDigests) Write(p []byte) (n int, err error) {
+
+	for len(p) > 0 {
+		if ranges.written == 0 {
+			ranges.md5, ranges.sha256 = md5.New(), sha256.New()
+		}
+
+		chunk := p
+		if left := ranges.size - ranges.written; int64(len(chunk)) > left {
+			chunk = chunk[:left]
+		}
+
+		ranges.md5.Write(chunk)
+		ranges.sha256.Write(chunk)
+		ranges.written += int64(len(chunk))
+
+		n += len(chunk)
+		p = p[len(chunk):]
+
+		if ranges.written == ranges.size {
+			ranges.close()
+		}
+	}
+	return
+}
+
+func (ranges *rangeDigests) close() {
+
+	if ranges.written > 0 {
+		ranges.MD5 = append(ranges.MD5, ranges.md5.Sum(nil))
+		ranges.SHA256 = append(ranges.SHA256, ranges.sha256.Sum(nil))
+		ranges.written = 0
+	}
+}
+
+type streamPart struct {
+	number int64
+	data []byte
+	md5 []byte
+	sha256 []byte
+}
+
+// streamPartSize is the part size for a stream of about sizeHint bytes. Its length is only
+// known at the end, so the parts are sized for twice the hint: a patch carries its table on
+// top of the data, and the file may grow while it is read.
+func streamPartSize(sizeHint int64, partSize int64) int64 {
+
+	if partSize < s3manager.MinUploadPartSize {
+		partSize = s3manager.DefaultUploadPartSize
+	}
+
+	if hinted := 2 * sizeHint / maxUploadParts + 1; hinted > partSize {
+		partSize = hinted
+	}
+	return partSize
+}
+
+// uploadStream sends reader to key in parts of streamPartSize, or in a single put
+// when it fits one part. Every part carries its MD5 and SHA-256, so S3 checks it on the way
+// in. Parts sit in memory and are retried one by one, a failed upload is aborted since a
+// stream can't resume. Nothing is put for an empty stream. digests are those of the object
+// copyObject makes of key, with parts of copyPartSize.
+func (conveyor *S3Conveyor) uploadStream(bucket string, key string, reader io.Reader, sizeHint int64) (digests fileDigests, err error) {
+
+	partSize := streamPartSize(sizeHint, conveyor.Uploader.PartSize)
+
+	sha1Hash, md5Hash, sha256Hash := sha1.New(), md5.New(), sha256.New()
+	ranges := &rangeDigests{size: copyPartSize}
+	hashes := io.MultiWriter(sha1Hash, md5Hash, sha256Hash, ranges)
+
+	// next reads the following part, an empty one at the end of the stream.
+	partNumber := int64(0)
+	next := func() (part streamPart, err error) {
+
+		data := make([]byte, partSize)
+
+		var n int
+		if n, err = io.ReadFull(reader, data); err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+
+		if err != nil {
+			return
+		}
+
+		partNumber += 1
+		part = streamPart{number: partNumber, data: data[:n]}
+
+		partMD5, partSHA256 := md5.Sum(part.data), sha256.Sum256(part.data)
+		part.md5, part.sha256 = partMD5[:], partSHA256[:]
+
+		hashes.Write(part.data)
+		digests.Size += int64(n)
+		return
+	}
+
+	var first streamPart
+	if first, err = next(); err != nil {
+		return
+	}
+
+	// An empty stream waits for PutStream to know it is an object at all.
+	if len(first.data) == 0 {
+		err = nil
+	} else if int64(len(first.data)) < partSize {
+		err = conveyor.putStreamPart(bucket, key, first)
+	} else {
+		err = conveyor.uploadStreamParts(bucket, key, first, next)
+	}
+
+	if err != nil {
+		return
+	}
+
+	ranges.close()
+
+	digests.SHA1 = sha1Hash.Sum(nil)
+	digests.MD5 = md5Hash.Sum(nil)
+	digests.SHA256 = sha256Hash.Sum(nil)
+	digests.PartSize = copyPartSize
+	digests.PartMD5 = ranges.MD5
+	digests.PartSHA256 = ranges.SHA256
+	return
+}
+
+// putStreamPart puts a stream that fits in one part.
+func (conveyor *S3Conveyor) putStreamPart(bucket string, key string, part streamPart) (err error) {
+
+	return retry.Do(conveyor.Retry.OrDefault(), "Upload of " + key, func() (err error) {
+		_, err = conveyor.Client.PutObjectWithContext(aws.BackgroundContext(), &s3.PutObjectInput{
+						Bucket: aws.String(bucket),
+						Key: aws.String(key),
+						Body: bytes.NewReader(part.data),
+						ContentLength: aws.Int64(int64(len(part.data))),
+						ContentMD5: aws.String(base64.StdEncoding.EncodeToString(part.md5)),
+						ChecksumSHA256: aws.String(base64.StdEncoding.EncodeToString(part.sha256)),
+						ServerSideEncryption: conveyor.SSE.serverSideEncryption(),
+						SSEKMSKeyId: conveyor.SSE.kmsKeyId(),
+						SSECustomerAlgorithm: conveyor.SSE.customerAlgorithm(),
+						SSECustomerKey: conveyor.SSE.customerKey(),
+					}, sdkRetryOff)
+		return
+	})
+}
+
+// uploadStreamParts uploads first and the parts next reads after it, until an empty one, in
+// a multipart upload with SHA-256 checksums. Only as many parts as the uploader's concurrency
+// are held at once.
+func (conveyor *S3Conveyor) uploadStreamParts(bucket string, key string, first streamPart, next func() (streamPart, error)) (err error) {
+
+	var created *s3.CreateMultipartUploadOutput
+	if created, err = conveyor.Client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+							Bucket: aws.String(bucket),
+							Key: aws.String(key),
+							ServerSideEncryption: conveyor.SSE.serverSideEncryption(),
+							SSEKMSKeyId: conveyor.SSE.kmsKeyId(),
+							SSECustomerAlgorithm: conveyor.SSE.customerAlgorithm(),
+							SSECustomerKey: conveyor.SSE.customerKey(),
+							ChecksumAlgorithm: aws.String(s3.ChecksumAlgorithmSha256),
+						}); err != nil {
+		slog.Errorf("Fail to create multipart upload of %s: %s", key, err.Error())
+		return
+	}
+
+	uploadId := aws.StringValue(created.UploadId)
+
+	concurrency := conveyor.Uploader.Concurrency
+	if concurrency <= 0 {
+		concurrency = s3manager.DefaultUploadConcurrency
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	parts := make(chan streamPart)
+	completed := []*s3.CompletedPart{}
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for part := range parts {
+				mu.Lock()
+				failed := err != nil
+				mu.Unlock()
+
+				if failed {
+					continue
+				}
+
+				etag, partErr := conveyor.uploadStreamPart(bucket, key, uploadId, part)
+
+				mu.Lock()
+				if partErr != nil && err == nil {
+					err = partErr
+				}
+
+				if partErr == nil {
+					completed = append(completed, &s3.CompletedPart{
+									PartNumber: aws.Int64(part.number),
+									ETag: etag,
+									ChecksumSHA256: aws.String(base64.StdEncoding.EncodeToString(part.sha256)),
+								})
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var readErr error
+	for part := first; len(part.data) > 0; {
+		if part.number > maxUploadParts {
+			readErr = errors.Errorf("Stream is over %d parts", maxUploadParts)
+			break
+		}
+
+		mu.Lock()
+		failed := err != nil
+		mu.Unlock()
+
+		if failed {
+			break
+		}
+
+		parts <- part
+
+		if part, readErr = next(); readErr != nil {
+			break
+		}
+	}
+	close(parts)
+	wg.Wait()
+
+	if err == nil {
+		err = readErr
+	}
+
+	if err == nil {
+		sort.Slice(completed, func(i, j int) bool { return aws.Int64Value(completed[i].PartNumber) < aws.Int64Value(completed[j].PartNumber) })
+
+		_, err = conveyor.Client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+							Bucket: aws.String(bucket),
+							Key: aws.String(key),
+							UploadId: aws.String(uploadId),
+							MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+						})
+	}
+
+	if err != nil {
+		slog.Errorf("Fail to upload stream to %s: %s", key, err.Error())
+		conveyor.abortUpload(bucket, key, uploadId)
+	}
+	return
+}
+
+func (conveyor *S3Conveyor) uploadStreamPart(bucket string, key string, uploadId string, part streamPart) (etag *string, err error) {
+
+	err = retry.Do(conveyor.Retry.OrDefault(), "Upload of part " + strconv.FormatInt(part.number, 10) + " of " + key, func() (err error) {
+		var resp *s3.UploadPartOutput
+		if resp, err = conveyor.Client.UploadPartWithContext(aws.BackgroundContext(), &s3.UploadPartInput{
+							Bucket: aws.String(bucket),
+							Key: aws.String(key),
+							UploadId: aws.String(uploadId),
+							PartNumber: aws.Int64(part.number),
+							ContentLength: aws.Int64(int64(len(part.data))),
+							ContentMD5: aws.String(base64.StdEncoding.EncodeToString(part.md5)),
+							ChecksumSHA256: aws.String(base64.StdEncoding.EncodeToString(part.sha256)),
+							SSECustomerAlgorithm: conveyor.SSE.customerAlgorithm(),
+							SSECustomerKey: conveyor.SSE.customerKey(),
+							Body: bytes.NewReader(part.data),
+						}, sdkRetryOff); err != nil {
+			return
+		}
+
+		etag = resp.ETag
+		return
+	})
+	return
+}
+
+// PutStream uploads reader to tmpKey as it is produced, so no copy of it has to sit on local disk,
+// then copies it server side to the key finish names and deletes tmpKey. The copy is checked
+// against the digests taken on the way: its key has to be the SHA-1 of the stream, and S3's
+// checksum of what it holds the SHA-256. sizeHint, the size the stream is expected to have,
+// sets the part size. A tmpKey left by a crash is removed by AbortStaleUploads.
+func (conveyor *S3Conveyor) PutStream(tmpKey string, reader io.Reader, sizeHint int64, finish func() (string, storage.ObjectMetadata, error)) (err error) {
+
+	if conveyor == nil || conveyor.Uploader == nil {
+		slog.Error("No uploader instance")
+
+		err = errors.New("No uploader instance")
+		return
+	}
+
+	// The temporary object stays in the default storage class, it only lives until the copy.
+	var digests fileDigests
+	if digests, err = conveyor.uploadStream(conveyor.Bucket, tmpKey, reader, sizeHint); err != nil {
+		slog.Errorf("Unable to stream upload to %s: %s", tmpKey, err.Error())
+		return
+	}
+
+	var key string
+	var metadata storage.ObjectMetadata
+	finished := false
+
+	// The patch of an unchanged file is empty and finish turns it down, it is only put once
+	// finish names a key for it.
+	if digests.Size == 0 {
+		if key, metadata, err = finish(); err != nil {
+			return
+		}
+		finished = true
+
+		empty := streamPart{number: 1, data: []byte{}}
+		emptyMD5, emptySHA256 := md5.Sum(nil), sha256.Sum256(nil)
+		empty.md5, empty.sha256 = emptyMD5[:], emptySHA256[:]
+
+		if err = conveyor.putStreamPart(conveyor.Bucket, tmpKey, empty); err != nil {
+			slog.Errorf("Unable to upload empty stream to %s: %s", tmpKey, err.Error())
+			return
+		}
+	}
+
+	defer conveyor.DeleteObject(conveyor.Bucket, tmpKey)
+
+	if finished == false {
+		if key, metadata, err = finish(); err != nil {
+			return
+		}
+	}
+
+	if err = checkObjectId(key, digests.SHA1); err != nil {
+		slog.Errorf("Refuse to store the stream in %s: %s", tmpKey, err.Error())
+		return
+	}
+
+	// Only a copy that matches the stream makes it redundant, a damaged one is replaced.
+	if conveyor.objectExists(conveyor.Bucket, key, digests, copyPartSize) {
+		conveyor.stats.AddSkipped(digests.Size)
+		slog.Infof("%s already in %s, dropping the streamed copy", key, conveyor.Bucket)
+		return
+	}
+
+	if err = conveyor.copyObject(conveyor.Bucket, tmpKey, key, digests.Size, metadata); err != nil {
+		slog.Errorf("Fail to copy %s to %s: %s", tmpKey, key, err.Error())
+		return
+	}
+
+	if err = conveyor.verifyUpload(conveyor.Bucket, key, digests, copyPartSize); err != nil {
+		slog.Errorf("Copy of %s to %s does not match the stream: %s", tmpKey, key, err.Error())
+		return
+	}
+
+	slog.Infof("Successfully streamed %d bytes to %s", digests.Size, key)
+
+	conveyor.stats.AddUploaded(digests.Size)
+	return
+}
+
+func copySource(bucket string, key string) *string {
+	return aws.String((&url.URL{Path: bucket + "/" + key}).EscapedPath())
+}
+
+func (conveyor *S3Conveyor) metadataStorageClass(metadata storage.ObjectMetadata) *string {
+
+	storageClass := conveyor.BaselineStorageClass
+	if metadata.VersionType == storage.VERSION_PATCH {
+		storageClass = conveyor.PatchStorageClass
+	}
+
+	if storageClass == "" {
+		return nil
+	}
+	return aws.String(storageClass)
+}
+
+// copyObject copies sourceKey to key within bucket, replacing its metadata and tags with metadata.
+func (conveyor *S3Conveyor) copyObject(bucket string, sourceKey string, key string, size int64, metadata storage.ObjectMetadata) (err error) {
+
+	if size > copyObjectLimit {
+		return conveyor.copyMultipart(bucket, sourceKey, key, size, metadata)
+	}
+
+	_, err = conveyor.Client.CopyObject(&s3.CopyObjectInput{
+						Bucket: aws.String(bucket),
+						Key: aws.String(key),
+						CopySource: copySource(bucket, sourceKey),
+						CopySourceSSECustomerAlgorithm: conveyor.SSE.customerAlgorithm(),
+						CopySourceSSECustomerKey: conveyor.SSE.customerKey(),
+						MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+						Metadata: aws.StringMap(metadata.Map()),
+						TaggingDirective: aws.String(s3.TaggingDirectiveReplace),
+						Tagging: aws.String(metadata.Tagging()),
+						ServerSideEncryption: conveyor.SSE.serverSideEncryption(),
+						SSEKMSKeyId: conveyor.SSE.kmsKeyId(),
+						SSECustomerAlgorithm: conveyor.SSE.customerAlgorithm(),
+						SSECustomerKey: conveyor.SSE.customerKey(),
+						StorageClass: conveyor.metadataStorageClass(metadata),
+						ChecksumAlgorithm: aws.String(s3.ChecksumAlgorithmSha256),
+					})
+	return
+}
+
+// copyMultipart copies in ranges of copyPartSize, the ones uploadStream takes digests of, so
+// the copy's composite checksum can be checked.
+func (conveyor *S3Conveyor) copyMultipart(bucket string, sourceKey string, key string, size int64, metadata storage.ObjectMetadata) (err error) {
+
+	partSize := copyPartSize
+	if (size + partSize - 1) / partSize > maxUploadParts {
+		err = errors.Errorf("%d bytes take over %d parts of %d", size, maxUploadParts, partSize)
+		return
+	}
+
+	var created *s3.CreateMultipartUploadOutput
+	if created, err = conveyor.Client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+							Bucket: aws.String(bucket),
+							Key: aws.String(key),
+							Metadata: aws.StringMap(metadata.Map()),
+							Tagging: aws.String(metadata.Tagging()),
+							ServerSideEncryption: conveyor.SSE.serverSideEncryption(),
+							SSEKMSKeyId: conveyor.SSE.kmsKeyId(),
+							SSECustomerAlgorithm: conveyor.SSE.customerAlgorithm(),
+							SSECustomerKey: conveyor.SSE.customerKey(),
+							StorageClass: conveyor.metadataStorageClass(metadata),
+							ChecksumAlgorithm: aws.String(s3.ChecksumAlgorithmSha256),
+						}); err != nil {
+		return
+	}
+
+	uploadId := aws.StringValue(created.UploadId)
+	parts := []*s3.CompletedPart{}
+
+	for offset, partNumber := int64(0), int64(1); offset < size; offset, partNumber = offset + partSize, partNumber + 1 {
+		end := offset + partSize
+		if end > size {
+			end = size
+		}
+
+		var copied *s3.UploadPartCopyOutput
+		if copied, err = conveyor.Client.UploadPartCopy(&s3.UploadPartCopyInput{
+								Bucket: aws.String(bucket),
+								Key: aws.String(key),
+								UploadId: aws.String(uploadId),
+								PartNumber: aws.Int64(partNumber),
+								CopySource: copySource(bucket, sourceKey),
+								CopySourceRange: aws.String("bytes=" + strconv.FormatInt(offset, 10) + "-" + strconv.FormatInt(end - 1, 10)),
+								CopySourceSSECustomerAlgorithm: conveyor.SSE.customerAlgorithm(),
+								CopySourceSSECustomerKey: conveyor.SSE.customerKey(),
+								SSECustomerAlgorithm: conveyor.SSE.customerAlgorithm(),
+								SSECustomerKey: conveyor.SSE.customerKey(),
+							}); err != nil {
+			conveyor.abortUpload(bucket, key, uploadId)
+			return
+		}
+
+		parts = append(parts, &s3.CompletedPart{
+						ETag: copied.CopyPartResult.ETag,
+						PartNumber: aws.Int64(partNumber),
+						ChecksumSHA256: copied.CopyPartResult.ChecksumSHA256,
+					})
+	}
+
+	if _, err = conveyor.Client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+							Bucket: aws.String(bucket),
+							Key: aws.String(key),
+							UploadId: aws.String(uploadId),
+							MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+						}); err != nil {
+		conveyor.abortUpload(bucket, key, uploadId)
+	}
+	return
+}
@@ -0,0 +1,45 @@
+package s3
+
+import (
+	"net/http"
+
+	"../throttle"
+)
+
+// Limiters cap what the conveyor sends and receives, a throttle.Controller moves
+// their rates along the configured schedule.
+type Limiters struct {
+	Upload *throttle.Limiter
+	Download *throttle.Limiter
+}
+
+// throttledTransport limits request and response bodies on the wire. Wrapping the bodies
+// handed to the SDK instead would also throttle the reads it makes to hash and sign them.
+type throttledTransport struct {
+	base http.RoundTripper
+	limiters *Limiters
+}
+
+
+func newThrottledTransport(base http.RoundTripper, limiters *Limiters) *throttledTransport {
+	return &throttledTransport{base: base, limiters: limiters}
+}
+
+func (transport *throttledTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+
+	if req.Body != nil && req.Body != http.NoBody {
+		throttled := new(http.Request)
+		*throttled = *req
+		throttled.Body = throttle.NewReadCloser(req.Body, transport.limiters.Upload)
+		req = throttled
+	}
+
+	if resp, err = transport.base.RoundTrip(req); err != nil {
+		return
+	}
+
+	if resp.Body != nil {
+		resp.Body = throttle.NewReadCloser(resp.Body, transport.limiters.Download)
+	}
+	return
+}
@@ -0,0 +1,1037 @@
+// Package s3fake is an in-process S3 API emulator for hermetic tests. It speaks
+// path-style requests only and does not check signatures.
+package s3fake
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"bytes"
+	"strings"
+	"strconv"
+	"net/url"
+	"net/http"
+	"net/http/httptest"
+	"io/ioutil"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/base64"
+	"encoding/xml"
+	"encoding/pem"
+)
+
+const DEFAULT_PAGE_SIZE = 1000
+
+// DEFAULT_COPY_LIMIT is the largest object CopyObject copies, bigger ones take UploadPartCopy.
+const DEFAULT_COPY_LIMIT = 5 * 1024 * 1024 * 1024
+
+// requestOnlyHeaders are x-amz- headers that describe the request rather than the object.
+var requestOnlyHeaders = map[string]bool{
+	"x-amz-date": true,
+	"x-amz-content-sha256": true,
+	"x-amz-security-token": true,
+	"x-amz-user-agent": true,
+	"x-amz-copy-source": true,
+	"x-amz-copy-source-range": true,
+	"x-amz-copy-source-server-side-encryption-customer-algorithm": true,
+	"x-amz-copy-source-server-side-encryption-customer-key": true,
+	"x-amz-copy-source-server-side-encryption-customer-key-md5": true,
+	"x-amz-tagging-directive": true,
+	"x-amz-metadata-directive": true,
+	"x-amz-server-side-encryption-customer-key": true,
+	"x-amz-checksum-algorithm": true,
+	"x-amz-sdk-checksum-algorithm": true,
+}
+
+const (
+	SSE_HEADER = "X-Amz-Server-Side-Encryption"
+	SSE_C_ALGORITHM_HEADER = "X-Amz-Server-Side-Encryption-Customer-Algorithm"
+	SSE_C_KEY_MD5_HEADER = "X-Amz-Server-Side-Encryption-Customer-Key-Md5"
+	CHECKSUM_ALGORITHM_HEADER = "X-Amz-Checksum-Algorithm"
+	CHECKSUM_SHA256_HEADER = "X-Amz-Checksum-Sha256"
+	COPY_SOURCE_HEADER = "X-Amz-Copy-Source"
+	COPY_SOURCE_SSE_C_KEY_MD5_HEADER = "X-Amz-Copy-Source-Server-Side-Encryption-Customer-Key-Md5"
+)
+
+type Object struct {
+	Data []byte
+	ETag string
+	LastModified time.Time
+	StorageClass string
+	// RestoreTier is the tier of the last RestoreObject, "" if there was none.
+	RestoreTier string
+	Metadata map[string]string
+	Header http.Header
+}
+
+type part struct {
+	data []byte
+	etag string
+	checksum string
+}
+
+type multipartUpload struct {
+	bucket string
+	key string
+	initiated time.Time
+	header http.Header
+	parts map[int]part
+}
+
+type Server struct {
+	*httptest.Server
+
+	// PageSize caps the keys returned by one ListObjectsV2 call, lower it to exercise pagination.
+	PageSize int
+
+	// FailPart, when set, makes UploadPart answer 500 for the part numbers it returns true for.
+	FailPart func(partNumber int) bool
+
+	// FailRange, when set, makes a ranged GetObject answer 500 for the range starts it returns true for.
+	FailRange func(start int64) bool
+
+	// FailRequest, when set, makes any request it returns true for answer 503 Slow Down.
+	FailRequest func(r *http.Request) bool
+
+	// CopyLimit caps the objects CopyObject takes, lower it to exercise multipart copies.
+	CopyLimit int64
+
+	mu sync.Mutex
+	buckets map[string]map[string]*Object
+	encryption map[string]string
+	uploads map[string]*multipartUpload
+	nextUploadId int
+	partUploads int
+}
+
+
+func newServer() *Server {
+	return &Server{
+		PageSize: DEFAULT_PAGE_SIZE,
+		CopyLimit: DEFAULT_COPY_LIMIT,
+		buckets: map[string]map[string]*Object{},
+		encryption: map[string]string{},
+		uploads: map[string]*multipartUpload{},
+	}
+}
+
+func NewServer() *Server {
+
+	server := newServer()
+	server.Server = httptest.NewServer(server)
+	return server
+}
+
+// NewTLSServer serves over https, which the SDK insists on before it sends an SSE-C key.
+func NewTLSServer() *Server {
+
+	server := newServer()
+	server.Server = httptest.NewTLSServer(server)
+	return server
+}
+
+// CAFile writes the certificate of a TLS server as PEM to path.
+func (server *Server) CAFile(path string) error {
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)
+}
+
+func (server *Server) CreateBucket(bucket string) {
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if _, ok := server.buckets[bucket]; ok == false {
+		server.buckets[bucket] = map[string]*Object{}
+	}
+}
+
+// SetDefaultEncryption makes bucket encrypt objects with sse, such as "aws:kms", when the
+// request asks for no encryption.
+func (server *Server) SetDefaultEncryption(bucket string, sse string) {
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.encryption[bucket] = sse
+}
+
+// withDefaultEncryption is header with the default encryption of bucket applied.
+func (server *Server) withDefaultEncryption(bucket string, header http.Header) http.Header {
+
+	sse, ok := server.encryption[bucket]
+	if ok == false || header.Get(SSE_HEADER) != "" || header.Get(SSE_C_ALGORITHM_HEADER) != "" {
+		return header
+	}
+
+	header = header.Clone()
+	header.Set(SSE_HEADER, sse)
+	return header
+}
+
+func (server *Server) PutObject(bucket string, key string, data []byte) {
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.putObject(bucket, key, data, md5Hex(data), http.Header{})
+}
+
+// GetObject returns a copy of the object stored under key, or nil.
+func (server *Server) GetObject(bucket string, key string) *Object {
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	object, ok := server.buckets[bucket][key]
+	if ok == false {
+		return nil
+	}
+
+	copied := *object
+	return &copied
+}
+
+func (server *Server) Keys(bucket string) (keys []string) {
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	for key := range server.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
+
+// PartUploads counts the UploadPart requests that stored a part.
+func (server *Server) PartUploads() int {
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	return server.partUploads
+}
+
+// Uploads returns the ids of the multipart uploads in flight.
+func (server *Server) Uploads() (uploadIds []string) {
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	for uploadId := range server.uploads {
+		uploadIds = append(uploadIds, uploadId)
+	}
+	sort.Strings(uploadIds)
+	return
+}
+
+// SetUploadInitiated backdates a multipart upload.
+func (server *Server) SetUploadInitiated(uploadId string, initiated time.Time) {
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if upload, ok := server.uploads[uploadId]; ok {
+		upload.initiated = initiated
+	}
+}
+
+
+func base64Encode(data []byte) string {
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func md5Hex(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// encryptedETag stands in for the ETag S3 gives SSE-KMS and SSE-C objects, which is not their MD5.
+func encryptedETag(etag string, header http.Header) string {
+
+	if header.Get(SSE_C_ALGORITHM_HEADER) == "" && strings.HasPrefix(header.Get(SSE_HEADER), "aws:kms") == false {
+		return etag
+	}
+
+	sum := md5.Sum([]byte("encrypted " + etag))
+	return hex.EncodeToString(sum[:]) + etag[strings.Index(etag + "-", "-"):]
+}
+
+// checkCustomerKey answers false, after writing the error, when a request lacks the SSE-C key
+// stored with header.
+func checkCustomerKey(w http.ResponseWriter, r *http.Request, header http.Header) bool {
+
+	keyMD5 := header.Get(SSE_C_KEY_MD5_HEADER)
+	if keyMD5 == "" || r.Header.Get(SSE_C_KEY_MD5_HEADER) == keyMD5 {
+		return true
+	}
+
+	if r.Header.Get(SSE_C_KEY_MD5_HEADER) == "" {
+		writeError(w, r, http.StatusBadRequest, "InvalidRequest", "The object was stored using a form of Server Side Encryption")
+	} else {
+		writeError(w, r, http.StatusForbidden, "AccessDenied", "The SSE-C key does not match the one the object was stored with")
+	}
+	return false
+}
+
+func (server *Server) putObject(bucket string, key string, data []byte, etag string, header http.Header) *Object {
+
+	object := &Object{
+		Data: data,
+		ETag: etag,
+		LastModified: time.Now().UTC(),
+		StorageClass: header.Get("X-Amz-Storage-Class"),
+		Metadata: map[string]string{},
+		Header: http.Header{},
+	}
+
+	if object.StorageClass == "" {
+		object.StorageClass = "STANDARD"
+	}
+
+	for name, values := range header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-meta-") {
+			object.Metadata[strings.TrimPrefix(lower, "x-amz-meta-")] = values[0]
+		} else if (strings.HasPrefix(lower, "x-amz-") && requestOnlyHeaders[lower] == false) || lower == "content-type" {
+			object.Header[name] = values
+		}
+	}
+
+	server.buckets[bucket][key] = object
+	return object
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, code string, message string) {
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+
+	if r.Method != "HEAD" {
+		fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<Error><Code>%s</Code><Message>%s</Message></Error>", code, message)
+	}
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+
+	w.Header().Set("Content-Type", "application/xml")
+	data, _ := xml.Marshal(v)
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key := path, ""
+	if slash := strings.Index(path, "/"); slash != -1 {
+		bucket, key = path[:slash], path[slash + 1:]
+	}
+
+	query := r.URL.Query()
+
+	if server.FailRequest != nil && server.FailRequest(r) {
+		writeError(w, r, http.StatusServiceUnavailable, "SlowDown", "Injected failure")
+		return
+	}
+
+	if bucket == "" {
+		server.listBuckets(w, r)
+		return
+	}
+
+	if key == "" && r.Method == "PUT" {
+		if _, ok := server.buckets[bucket]; ok == false {
+			server.buckets[bucket] = map[string]*Object{}
+		}
+		return
+	}
+
+	objects, ok := server.buckets[bucket]
+	if ok == false {
+		writeError(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+
+	switch {
+		case key == "" && r.Method == "GET" && query["uploads"] != nil:
+			server.listMultipartUploads(w, r, bucket)
+		case key == "" && r.Method == "GET":
+			server.listObjectsV2(w, r, bucket, objects)
+		case r.Method == "GET" && query.Get("uploadId") != "":
+			server.listParts(w, r, bucket, key)
+		case r.Method == "POST" && query["restore"] != nil:
+			server.restoreObject(w, r, objects, key)
+		case r.Method == "POST" && query["uploads"] != nil:
+			server.createMultipartUpload(w, r, bucket, key)
+		case r.Method == "PUT" && query.Get("uploadId") != "":
+			server.uploadPart(w, r)
+		case r.Method == "PUT" && r.Header.Get(COPY_SOURCE_HEADER) != "":
+			server.copyObject(w, r, bucket, key)
+		case r.Method == "POST" && query.Get("uploadId") != "":
+			server.completeMultipartUpload(w, r, bucket, key)
+		case r.Method == "DELETE" && query.Get("uploadId") != "":
+			delete(server.uploads, query.Get("uploadId"))
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == "PUT":
+			server.putObjectRequest(w, r, bucket, key)
+		case r.Method == "GET" || r.Method == "HEAD":
+			server.getObject(w, r, objects, key)
+		case r.Method == "DELETE":
+			delete(objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, r, http.StatusNotImplemented, "NotImplemented", r.Method + " is not supported")
+	}
+}
+
+func (server *Server) listBuckets(w http.ResponseWriter, r *http.Request) {
+
+	type bucketEntry struct {
+		Name string
+		CreationDate string
+	}
+
+	result := struct {
+		XMLName xml.Name        `xml:"ListAllMyBucketsResult"`
+		Buckets []bucketEntry   `xml:"Buckets>Bucket"`
+	}{}
+
+	names := []string{}
+	for name := range server.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		result.Buckets = append(result.Buckets, bucketEntry{name, time.Now().UTC().Format(time.RFC3339)})
+	}
+
+	writeXML(w, result)
+}
+
+// checkSHA256 answers false, after writing the error, when data does not match the
+// x-amz-checksum-sha256 of the request.
+func checkSHA256(w http.ResponseWriter, r *http.Request, data []byte) bool {
+
+	checksum := r.Header.Get(CHECKSUM_SHA256_HEADER)
+	if checksum == "" {
+		return true
+	}
+
+	if sum := sha256.Sum256(data); checksum != base64Encode(sum[:]) {
+		writeError(w, r, http.StatusBadRequest, "BadDigest", "The SHA256 you specified did not match the calculated checksum")
+		return false
+	}
+	return true
+}
+
+func (server *Server) putObjectRequest(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+
+	if contentMD5 := r.Header.Get("Content-MD5"); contentMD5 != "" {
+		sum := md5.Sum(data)
+		if contentMD5 != base64Encode(sum[:]) {
+			writeError(w, r, http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received")
+			return
+		}
+	}
+
+	if checkSHA256(w, r, data) == false {
+		return
+	}
+
+	header := server.withDefaultEncryption(bucket, r.Header)
+	object := server.putObject(bucket, key, data, encryptedETag(md5Hex(data), header), header)
+	w.Header().Set("ETag", `"` + object.ETag + `"`)
+}
+
+func (server *Server) getObject(w http.ResponseWriter, r *http.Request, objects map[string]*Object, key string) {
+
+	object, ok := objects[key]
+	if ok == false {
+		writeError(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+		return
+	}
+
+	if checkCustomerKey(w, r, object.Header) == false {
+		return
+	}
+
+	if r.Method == "GET" && object.frozen() {
+		writeError(w, r, http.StatusForbidden, "InvalidObjectState", "The operation is not valid for the object's storage class")
+		return
+	}
+
+	for name, values := range object.Header {
+		w.Header()[name] = values
+	}
+
+	for name, value := range object.Metadata {
+		w.Header().Set("X-Amz-Meta-" + name, value)
+	}
+
+	w.Header().Set("ETag", `"` + object.ETag + `"`)
+	w.Header().Set("Last-Modified", object.LastModified.Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Del("X-Amz-Storage-Class")
+	if object.StorageClass != "STANDARD" {
+		w.Header().Set("X-Amz-Storage-Class", object.StorageClass)
+	}
+
+	data := object.Data
+	status := http.StatusOK
+
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		start, end, ok := parseRange(rangeHeader, int64(len(data)))
+		if ok == false {
+			w.Header().Set("Content-Range", "bytes */" + strconv.Itoa(len(data)))
+			writeError(w, r, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+			return
+		}
+
+		if r.Method == "GET" && server.FailRange != nil && server.FailRange(start) {
+			writeError(w, r, http.StatusInternalServerError, "InternalError", "Injected failure")
+			return
+		}
+
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		data = data[start : end + 1]
+		status = http.StatusPartialContent
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+
+	if r.Method == "GET" {
+		w.Write(data)
+	}
+}
+
+// parseRange supports the single "bytes=a-b", "bytes=a-" and "bytes=-n" forms the SDK sends.
+func parseRange(rangeHeader string, size int64) (start int64, end int64, ok bool) {
+
+	spec := strings.TrimPrefix(rangeHeader, "bytes=")
+	dash := strings.Index(spec, "-")
+	if dash == -1 || strings.Contains(spec, ",") {
+		return
+	}
+
+	var err error
+	end = size - 1
+
+	if dash == 0 {
+		var suffix int64
+		if suffix, err = strconv.ParseInt(spec[1:], 10, 64); err != nil || suffix <= 0 {
+			return
+		}
+		start = size - suffix
+		if start < 0 {
+			start = 0
+		}
+	} else {
+		if start, err = strconv.ParseInt(spec[:dash], 10, 64); err != nil {
+			return
+		}
+
+		if spec[dash + 1:] != "" {
+			if end, err = strconv.ParseInt(spec[dash + 1:], 10, 64); err != nil {
+				return
+			}
+			if end >= size {
+				end = size - 1
+			}
+		}
+	}
+
+	ok = start < size && start <= end
+	return
+}
+
+func isArchiveClass(storageClass string) bool {
+	return storageClass == "GLACIER" || storageClass == "DEEP_ARCHIVE"
+}
+
+// frozen tells whether the object sits in an archive class without a finished restore.
+func (object *Object) frozen() bool {
+	return isArchiveClass(object.StorageClass) && strings.Contains(object.Header.Get("X-Amz-Restore"), `ongoing-request="false"`) == false
+}
+
+// SetStorageClass moves an object to storageClass the way a lifecycle rule would.
+func (server *Server) SetStorageClass(bucket string, key string, storageClass string) {
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if object, ok := server.buckets[bucket][key]; ok {
+		object.StorageClass = storageClass
+		object.Header.Del("X-Amz-Restore")
+	}
+}
+
+// CompleteRestore finishes a restore requested for key, which S3 takes hours for.
+func (server *Server) CompleteRestore(bucket string, key string) {
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if object, ok := server.buckets[bucket][key]; ok && object.RestoreTier != "" {
+		expiry := time.Now().Add(24 * time.Hour).UTC().Format(http.TimeFormat)
+		object.Header.Set("X-Amz-Restore", `ongoing-request="false", expiry-date="` + expiry + `"`)
+	}
+}
+
+func (server *Server) restoreObject(w http.ResponseWriter, r *http.Request, objects map[string]*Object, key string) {
+
+	object, ok := objects[key]
+	if ok == false {
+		writeError(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+		return
+	}
+
+	if isArchiveClass(object.StorageClass) == false {
+		writeError(w, r, http.StatusForbidden, "InvalidObjectState", "Restore is not allowed for the object's current storage class")
+		return
+	}
+
+	if strings.Contains(object.Header.Get("X-Amz-Restore"), `ongoing-request="true"`) {
+		writeError(w, r, http.StatusConflict, "RestoreAlreadyInProgress", "Object restore is already in progress")
+		return
+	}
+
+	request := struct {
+		Days int
+		Tier string `xml:"GlacierJobParameters>Tier"`
+	}{}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := xml.Unmarshal(body, &request); err != nil || request.Days <= 0 {
+		writeError(w, r, http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed")
+		return
+	}
+
+	object.RestoreTier = request.Tier
+	if object.RestoreTier == "" {
+		object.RestoreTier = "Standard"
+	}
+
+	object.Header.Set("X-Amz-Restore", `ongoing-request="true"`)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (server *Server) listObjectsV2(w http.ResponseWriter, r *http.Request, bucket string, objects map[string]*Object) {
+
+	type content struct {
+		Key string
+		LastModified string
+		ETag string
+		Size int64
+		StorageClass string
+	}
+
+	type commonPrefix struct {
+		Prefix string
+	}
+
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+
+	maxKeys := server.PageSize
+	if value := query.Get("max-keys"); value != "" {
+		if requested, err := strconv.Atoi(value); err == nil && requested < maxKeys {
+			maxKeys = requested
+		}
+	}
+
+	after := query.Get("start-after")
+	if token := query.Get("continuation-token"); token != "" {
+		after = token
+	}
+
+	keys := []string{}
+	for key := range objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := struct {
+		XMLName xml.Name                `xml:"ListBucketResult"`
+		Name string
+		Prefix string
+		Delimiter string                `xml:",omitempty"`
+		StartAfter string               `xml:",omitempty"`
+		ContinuationToken string        `xml:",omitempty"`
+		NextContinuationToken string    `xml:",omitempty"`
+		KeyCount int
+		MaxKeys int
+		IsTruncated bool
+		Contents []content
+		CommonPrefixes []commonPrefix
+	}{Name: bucket, Prefix: prefix, Delimiter: delimiter, StartAfter: query.Get("start-after"),
+	  ContinuationToken: query.Get("continuation-token"), MaxKeys: maxKeys}
+
+	seenPrefixes := map[string]bool{}
+
+	for _, key := range keys {
+		if strings.HasPrefix(key, prefix) == false || key <= after {
+			continue
+		}
+
+		common := ""
+		if delimiter != "" {
+			if index := strings.Index(key[len(prefix):], delimiter); index != -1 {
+				common = key[:len(prefix) + index + len(delimiter)]
+
+				// A token inside common means the prefix went out on an earlier page.
+				if seenPrefixes[common] || strings.HasPrefix(after, common) {
+					continue
+				}
+			}
+		}
+
+		if result.KeyCount >= maxKeys {
+			result.IsTruncated = true
+			break
+		}
+
+		result.KeyCount += 1
+		result.NextContinuationToken = key
+
+		if common != "" {
+			seenPrefixes[common] = true
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{common})
+			continue
+		}
+
+		object := objects[key]
+		result.Contents = append(result.Contents, content{key, object.LastModified.Format("2006-01-02T15:04:05.000Z"),
+		                                                  `"` + object.ETag + `"`, int64(len(object.Data)), object.StorageClass})
+	}
+
+	if result.IsTruncated == false {
+		result.NextContinuationToken = ""
+	}
+
+	writeXML(w, result)
+}
+
+func (server *Server) createMultipartUpload(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+
+	server.nextUploadId += 1
+	uploadId := "upload-" + strconv.Itoa(server.nextUploadId)
+
+	header := server.withDefaultEncryption(bucket, r.Header)
+	server.uploads[uploadId] = &multipartUpload{bucket: bucket, key: key, initiated: time.Now().UTC(), header: header, parts: map[int]part{}}
+
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket string
+		Key string
+		UploadId string
+	}{Bucket: bucket, Key: key, UploadId: uploadId})
+}
+
+func (server *Server) uploadPart(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+
+	upload, ok := server.uploads[query.Get("uploadId")]
+	if ok == false {
+		writeError(w, r, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+
+	partNumber, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil || partNumber < 1 {
+		writeError(w, r, http.StatusBadRequest, "InvalidArgument", "Invalid part number")
+		return
+	}
+
+	var data []byte
+
+	if r.Header.Get(COPY_SOURCE_HEADER) != "" {
+		source := server.copySource(w, r)
+		if source == nil {
+			return
+		}
+
+		data = source.Data
+		if rangeHeader := r.Header.Get("X-Amz-Copy-Source-Range"); rangeHeader != "" {
+			start, end, ok := parseRange(rangeHeader, int64(len(data)))
+			if ok == false {
+				writeError(w, r, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+				return
+			}
+			data = data[start : end + 1]
+		}
+	} else {
+		if data, err = ioutil.ReadAll(r.Body); err != nil {
+			writeError(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+	}
+
+	if contentMD5 := r.Header.Get("Content-MD5"); contentMD5 != "" {
+		sum := md5.Sum(data)
+		if contentMD5 != base64Encode(sum[:]) {
+			writeError(w, r, http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received")
+			return
+		}
+	}
+
+	if checkSHA256(w, r, data) == false || checkCustomerKey(w, r, upload.header) == false {
+		return
+	}
+
+	if server.FailPart != nil && server.FailPart(partNumber) {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", "Injected failure")
+		return
+	}
+
+	etag := md5Hex(data)
+	checksum := r.Header.Get(CHECKSUM_SHA256_HEADER)
+
+	// A copied part gets the checksum of the upload's algorithm computed from what was copied.
+	copied := r.Header.Get(COPY_SOURCE_HEADER) != ""
+	if copied && upload.header.Get(CHECKSUM_ALGORITHM_HEADER) == "SHA256" {
+		sum := sha256.Sum256(data)
+		checksum = base64Encode(sum[:])
+	}
+
+	upload.parts[partNumber] = part{data, etag, checksum}
+	server.partUploads += 1
+
+	if copied {
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CopyPartResult"`
+			ETag string
+			LastModified string
+			ChecksumSHA256 string `xml:",omitempty"`
+		}{ETag: `"` + etag + `"`, LastModified: time.Now().UTC().Format("2006-01-02T15:04:05.000Z"), ChecksumSHA256: checksum})
+		return
+	}
+
+	w.Header().Set("ETag", `"` + etag + `"`)
+}
+
+// copySource finds the object x-amz-copy-source names, or writes the error S3 would.
+func (server *Server) copySource(w http.ResponseWriter, r *http.Request) *Object {
+
+	source, err := url.PathUnescape(strings.TrimPrefix(r.Header.Get(COPY_SOURCE_HEADER), "/"))
+	if err != nil || strings.Contains(source, "/") == false {
+		writeError(w, r, http.StatusBadRequest, "InvalidArgument", "Invalid copy source")
+		return nil
+	}
+
+	slash := strings.Index(source, "/")
+	object, ok := server.buckets[source[:slash]][source[slash + 1:]]
+	if ok == false {
+		writeError(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+		return nil
+	}
+
+	if keyMD5 := object.Header.Get(SSE_C_KEY_MD5_HEADER); keyMD5 != "" && r.Header.Get(COPY_SOURCE_SSE_C_KEY_MD5_HEADER) != keyMD5 {
+		writeError(w, r, http.StatusForbidden, "AccessDenied", "The SSE-C key of the copy source is missing or wrong")
+		return nil
+	}
+
+	if object.frozen() {
+		writeError(w, r, http.StatusForbidden, "InvalidObjectState", "The operation is not valid for the object's storage class")
+		return nil
+	}
+	return object
+}
+
+// copyObject copies in one go what CopyLimit allows. With a COPY metadata directive, the
+// metadata and encryption headers of the source carry over. A checksum algorithm gives the
+// copy a checksum of its whole content.
+func (server *Server) copyObject(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+
+	source := server.copySource(w, r)
+	if source == nil {
+		return
+	}
+
+	if int64(len(source.Data)) > server.CopyLimit {
+		writeError(w, r, http.StatusBadRequest, "InvalidRequest", "The specified copy source is larger than the maximum allowable size for a copy source")
+		return
+	}
+
+	header := r.Header
+	if r.Header.Get("X-Amz-Metadata-Directive") != "REPLACE" {
+		header = http.Header{}
+		for name, values := range source.Header {
+			header[name] = values
+		}
+		for name, value := range source.Metadata {
+			header.Set("X-Amz-Meta-" + name, value)
+		}
+	}
+
+	etag := source.ETag
+	if strings.Contains(etag, "-") {
+		etag = md5Hex(source.Data)
+	}
+
+	object := server.putObject(bucket, key, source.Data, encryptedETag(etag, header), header)
+	if r.Header.Get(CHECKSUM_ALGORITHM_HEADER) == "SHA256" {
+		sum := sha256.Sum256(source.Data)
+		object.Header.Set(CHECKSUM_SHA256_HEADER, base64Encode(sum[:]))
+	}
+
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CopyObjectResult"`
+		ETag string
+		LastModified string
+	}{ETag: `"` + object.ETag + `"`, LastModified: object.LastModified.Format("2006-01-02T15:04:05.000Z")})
+}
+
+func (server *Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+
+	uploadId := r.URL.Query().Get("uploadId")
+
+	upload, ok := server.uploads[uploadId]
+	if ok == false {
+		writeError(w, r, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+
+	request := struct {
+		Parts []struct {
+			PartNumber int
+			ETag string
+			ChecksumSHA256 string
+		} `xml:"Part"`
+	}{}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := xml.Unmarshal(body, &request); err != nil {
+		writeError(w, r, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+
+	var data bytes.Buffer
+	var digests []byte
+	checksums := sha256.New()
+	withChecksums := upload.header.Get(CHECKSUM_ALGORITHM_HEADER) == "SHA256"
+
+	for i, requested := range request.Parts {
+		uploaded, ok := upload.parts[requested.PartNumber]
+		if ok == false || strings.Trim(requested.ETag, `"`) != uploaded.etag ||
+		   (i > 0 && requested.PartNumber <= request.Parts[i - 1].PartNumber) {
+			writeError(w, r, http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found")
+			return
+		}
+
+		// An upload created with a checksum algorithm takes only parts with that checksum.
+		if withChecksums && (uploaded.checksum == "" || requested.ChecksumSHA256 != uploaded.checksum) {
+			writeError(w, r, http.StatusBadRequest, "InvalidPart", "The checksum of a part is missing or does not match")
+			return
+		}
+
+		data.Write(uploaded.data)
+		digest, _ := hex.DecodeString(uploaded.etag)
+		digests = append(digests, digest...)
+		checksum, _ := base64.StdEncoding.DecodeString(uploaded.checksum)
+		checksums.Write(checksum)
+	}
+
+	etag := encryptedETag(md5Hex(digests) + "-" + strconv.Itoa(len(request.Parts)), upload.header)
+	object := server.putObject(bucket, key, data.Bytes(), etag, upload.header)
+	if withChecksums {
+		object.Header.Set(CHECKSUM_SHA256_HEADER, base64Encode(checksums.Sum(nil)) + "-" + strconv.Itoa(len(request.Parts)))
+	}
+	delete(server.uploads, uploadId)
+
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Location string
+		Bucket string
+		Key string
+		ETag string
+	}{Location: server.URL + "/" + bucket + "/" + key, Bucket: bucket, Key: key, ETag: `"` + etag + `"`})
+}
+
+func (server *Server) listParts(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+
+	type partEntry struct {
+		PartNumber int
+		ETag string
+		Size int
+	}
+
+	uploadId := r.URL.Query().Get("uploadId")
+
+	upload, ok := server.uploads[uploadId]
+	if ok == false || upload.bucket != bucket || upload.key != key {
+		writeError(w, r, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+
+	partNumbers := []int{}
+	for partNumber := range upload.parts {
+		partNumbers = append(partNumbers, partNumber)
+	}
+	sort.Ints(partNumbers)
+
+	result := struct {
+		XMLName xml.Name    `xml:"ListPartsResult"`
+		Bucket string
+		Key string
+		UploadId string
+		IsTruncated bool
+		Parts []partEntry   `xml:"Part"`
+	}{Bucket: bucket, Key: key, UploadId: uploadId}
+
+	for _, partNumber := range partNumbers {
+		uploaded := upload.parts[partNumber]
+		result.Parts = append(result.Parts, partEntry{partNumber, `"` + uploaded.etag + `"`, len(uploaded.data)})
+	}
+
+	writeXML(w, result)
+}
+
+func (server *Server) listMultipartUploads(w http.ResponseWriter, r *http.Request, bucket string) {
+
+	type uploadEntry struct {
+		Key string
+		UploadId string
+		Initiated string
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+
+	uploadIds := []string{}
+	for uploadId, upload := range server.uploads {
+		if upload.bucket == bucket && strings.HasPrefix(upload.key, prefix) {
+			uploadIds = append(uploadIds, uploadId)
+		}
+	}
+	sort.Strings(uploadIds)
+
+	result := struct {
+		XMLName xml.Name        `xml:"ListMultipartUploadsResult"`
+		Bucket string
+		Prefix string
+		IsTruncated bool
+		Uploads []uploadEntry   `xml:"Upload"`
+	}{Bucket: bucket, Prefix: prefix}
+
+	for _, uploadId := range uploadIds {
+		upload := server.uploads[uploadId]
+		result.Uploads = append(result.Uploads, uploadEntry{upload.key, uploadId, upload.initiated.Format("2006-01-02T15:04:05.000Z")})
+	}
+
+	writeXML(w, result)
+}
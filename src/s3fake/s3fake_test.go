@@ -0,0 +1,95 @@
+package s3fake
+
+import (
+	"strings"
+	"testing"
+	"net/http"
+	"io/ioutil"
+)
+
+func TestRangeAndErrors(t *testing.T) {
+
+	server := NewServer()
+	defer server.Close()
+
+	server.CreateBucket("bucket")
+	server.PutObject("bucket", "dir/object", []byte("0123456789"))
+
+	for _, c := range []struct {
+		rangeHeader string
+		status int
+		body string
+	}{
+		{"", http.StatusOK, "0123456789"},
+		{"bytes=2-4", http.StatusPartialContent, "234"},
+		{"bytes=7-", http.StatusPartialContent, "789"},
+		{"bytes=-2", http.StatusPartialContent, "89"},
+		{"bytes=8-100", http.StatusPartialContent, "89"},
+		{"bytes=10-", http.StatusRequestedRangeNotSatisfiable, ""},
+	} {
+		req, _ := http.NewRequest("GET", server.URL + "/bucket/dir/object", nil)
+		if c.rangeHeader != "" {
+			req.Header.Set("Range", c.rangeHeader)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != c.status || (c.status != http.StatusRequestedRangeNotSatisfiable && string(body) != c.body) {
+			t.Errorf("Range %q returned %d %q", c.rangeHeader, resp.StatusCode, body)
+		}
+	}
+
+	resp, err := http.Get(server.URL + "/bucket/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound || strings.Contains(string(body), "NoSuchKey") == false {
+		t.Errorf("Missing key returned %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestListObjectsV2Pages(t *testing.T) {
+
+	server := NewServer()
+	defer server.Close()
+
+	server.CreateBucket("bucket")
+	server.PageSize = 2
+
+	for _, key := range []string{"a/1", "a/2", "a/b/1", "a/b/2", "a/3", "c"} {
+		server.PutObject("bucket", key, []byte(key))
+	}
+
+	resp, err := http.Get(server.URL + "/bucket?list-type=2&prefix=a/&delimiter=/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if strings.Contains(string(body), "<IsTruncated>true</IsTruncated>") == false ||
+	   strings.Contains(string(body), "<NextContinuationToken>a/2</NextContinuationToken>") == false {
+		t.Fatalf("First page is %s", body)
+	}
+
+	resp, err = http.Get(server.URL + "/bucket?list-type=2&prefix=a/&delimiter=/&continuation-token=a/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if strings.Contains(string(body), "<Key>a/3</Key>") == false || strings.Contains(string(body), "<Prefix>a/b/</Prefix>") == false ||
+	   strings.Contains(string(body), "<IsTruncated>false</IsTruncated>") == false {
+		t.Errorf("Second page is %s", body)
+	}
+}
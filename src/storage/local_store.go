@@ -0,0 +1,412 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"hash"
+	"time"
+	"strings"
+	"crypto/md5"
+	"crypto/sha1"
+	"io/ioutil"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"github.com/pkg/errors"
+
+	"../journal"
+)
+
+// LOCAL_METADATA_SUFFIX names the file next to an object that keeps its ObjectMetadata,
+// what S3 keeps as user metadata.
+const LOCAL_METADATA_SUFFIX = ".metadata"
+
+// LocalStore keeps objects as files under Root, in the same layout as the S3 keys.
+// It suits air-gapped sites, NFS mounts and tests.
+type LocalStore struct {
+	Root string
+}
+
+var _ ObjectStore = (*LocalStore)(nil)
+var _ MetadataWriter = (*LocalStore)(nil)
+
+
+func NewLocalStore(root string) (store *LocalStore, err error) {
+
+	if root == "" {
+		err = errors.New("No local store root")
+		return
+	}
+
+	if err = os.MkdirAll(root, 0755); err != nil {
+		return
+	}
+
+	store = &LocalStore{Root: strings.TrimSuffix(root, "/")}
+	return
+}
+
+func (store *LocalStore) path(key string) (path string, err error) {
+
+	if key == "" || strings.HasPrefix(key, "/") {
+		err = errors.Errorf("Invalid key: %s", key)
+		return
+	}
+
+	for _, part := range strings.Split(key, "/") {
+		if part == ".." || part == "." {
+			err = errors.Errorf("Invalid key: %s", key)
+			return
+		}
+	}
+
+	path = store.Root + "/" + key
+	return
+}
+
+func syncDir(dir string) (err error) {
+
+	var file *os.File
+	if file, err = os.Open(dir); err != nil {
+		return
+	}
+	defer file.Close()
+
+	err = file.Sync()
+	return
+}
+
+func fileDigest(path string, h hash.Hash) (digest string, err error) {
+
+	var file *os.File
+	if file, err = os.Open(path); err != nil {
+		return
+	}
+	defer file.Close()
+
+	if _, err = io.Copy(h, file); err != nil {
+		return
+	}
+
+	digest = hex.EncodeToString(h.Sum(nil))
+	return
+}
+
+
+// Put writes to a temporary <hash>.dat.<random> file next to the object and renames
+// it into place, so a reader never sees a partial object.
+func (store *LocalStore) Put(key string, filepath string) (err error) {
+
+	var path string
+	if path, err = store.path(key); err != nil {
+		return
+	}
+
+	dir := path[:strings.LastIndex(path, "/")]
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+
+	var infile, outfile *os.File
+
+	if infile, err = os.Open(filepath); err != nil {
+		return
+	}
+	defer infile.Close()
+
+	if outfile, err = ioutil.TempFile(dir, key[strings.LastIndex(key, "/") + 1:] + "."); err != nil {
+		return
+	}
+	tmpPath := outfile.Name()
+
+	if _, err = io.Copy(outfile, infile); err == nil {
+		err = outfile.Sync()
+	}
+
+	if closeErr := outfile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+
+	if err != nil {
+		os.Remove(tmpPath)
+		return
+	}
+
+	err = syncDir(dir)
+	return
+}
+
+// PutWithMetadata puts the object, then keeps metadata in <key>.metadata for Head to return.
+func (store *LocalStore) PutWithMetadata(key string, filepath string, metadata ObjectMetadata) (err error) {
+
+	var path string
+	if path, err = store.path(key); err != nil {
+		return
+	}
+
+	var data []byte
+	if data, err = json.Marshal(metadata.Map()); err != nil {
+		return
+	}
+
+	if err = store.Put(key, filepath); err != nil {
+		return
+	}
+
+	err = journal.WriteFileDurable(path + LOCAL_METADATA_SUFFIX, data)
+	return
+}
+
+// Get writes to a temporary file next to downloadfile and renames it into place once the
+// content hashes to the object id in the key, so a corrupt object never replaces a good file.
+func (store *LocalStore) Get(key string, downloadfile string) (err error) {
+
+	var path string
+	if path, err = store.path(key); err != nil {
+		return
+	}
+
+	var infile, outfile *os.File
+
+	if infile, err = os.Open(path); err != nil {
+		if os.IsNotExist(err) {
+			err = ErrNotFound
+		}
+		return
+	}
+	defer infile.Close()
+
+	dir, name := ".", downloadfile
+	if lastSlash := strings.LastIndex(downloadfile, "/"); lastSlash != -1 {
+		dir, name = downloadfile[:lastSlash + 1], downloadfile[lastSlash + 1:]
+	}
+
+	if outfile, err = ioutil.TempFile(dir, name + "."); err != nil {
+		return
+	}
+	tmpPath := outfile.Name()
+
+	h := sha1.New()
+	if _, err = io.Copy(io.MultiWriter(outfile, h), infile); err == nil {
+		err = outfile.Sync()
+	}
+
+	if closeErr := outfile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if objectId, ok := ObjectIdOfKey(key); err == nil && ok {
+		if digest := hex.EncodeToString(h.Sum(nil)); digest != objectId {
+			err = errors.Errorf("%s content hash is %s", key, digest)
+		}
+	}
+
+	if err == nil {
+		err = os.Rename(tmpPath, downloadfile)
+	}
+
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return
+}
+
+func (store *LocalStore) GetRange(key string, offset int64, length int64) (data []byte, err error) {
+
+	var path string
+	if path, err = store.path(key); err != nil {
+		return
+	}
+
+	var file *os.File
+	if file, err = os.Open(path); err != nil {
+		if os.IsNotExist(err) {
+			err = ErrNotFound
+		}
+		return
+	}
+	defer file.Close()
+
+	data = make([]byte, length)
+
+	var rc int
+	rc, err = file.ReadAt(data, offset)
+	if err == io.EOF {
+		err = nil
+	}
+
+	data = data[:rc]
+	return
+}
+
+// Head leaves ETag empty, use Locator when the ETag is needed. Metadata is what
+// PutWithMetadata kept, nil for an object put without.
+func (store *LocalStore) Head(key string) (info ObjectInfo, err error) {
+
+	var path string
+	if path, err = store.path(key); err != nil {
+		return
+	}
+
+	var fileInfo os.FileInfo
+	if fileInfo, err = os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			err = ErrNotFound
+		}
+		return
+	}
+
+	info = ObjectInfo{Key: key, Size: fileInfo.Size(), LastModified: fileInfo.ModTime()}
+
+	var data []byte
+	if data, err = ioutil.ReadFile(path + LOCAL_METADATA_SUFFIX); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	if err = json.Unmarshal(data, &info.Metadata); err != nil {
+		err = errors.Wrapf(err, "Invalid metadata of %s", key)
+	}
+	return
+}
+
+func (store *LocalStore) List(prefix string, fn func(ObjectInfo) bool) (err error) {
+
+	// Walk from the deepest directory the prefix names, then filter by the rest of it.
+	walkRoot := store.Root
+	if lastSlash := strings.LastIndex(prefix, "/"); lastSlash != -1 {
+		if walkRoot, err = store.path(prefix[:lastSlash]); err != nil {
+			return
+		}
+	}
+
+	stopped := errors.New("stopped")
+
+	err = filepath.Walk(walkRoot, func(path string, fileInfo os.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			if os.IsNotExist(walkErr) && path == walkRoot {
+				return filepath.SkipDir
+			}
+			return walkErr
+		}
+
+		if fileInfo.IsDir() {
+			return nil
+		}
+
+		// Temporary files of Put and the metadata of objects are named <hash>.dat.<something>.
+		key := strings.TrimPrefix(path, store.Root + "/")
+		if strings.HasPrefix(key, prefix) == false || strings.Contains(fileInfo.Name(), ".dat.") {
+			return nil
+		}
+
+		if fn(ObjectInfo{Key: key, Size: fileInfo.Size(), LastModified: fileInfo.ModTime()}) == false {
+			return stopped
+		}
+		return nil
+	})
+
+	if err == stopped || err == filepath.SkipDir {
+		err = nil
+	}
+	return
+}
+
+func (store *LocalStore) Delete(key string) (err error) {
+
+	var path string
+	if path, err = store.path(key); err != nil {
+		return
+	}
+
+	if err = os.Remove(path); err != nil && os.IsNotExist(err) {
+		err = nil
+	}
+
+	if metaErr := os.Remove(path + LOCAL_METADATA_SUFFIX); err == nil && metaErr != nil && os.IsNotExist(metaErr) == false {
+		err = metaErr
+	}
+	return
+}
+
+// Locator hands out a file URL, which works as long as the Triton side can reach the same mount.
+func (store *LocalStore) Locator(key string) (url string, etag string, err error) {
+
+	var path string
+	if path, err = store.path(key); err != nil {
+		return
+	}
+
+	if etag, err = fileDigest(path, md5.New()); err != nil {
+		if os.IsNotExist(err) {
+			err = ErrNotFound
+		}
+		return
+	}
+
+	var absPath string
+	if absPath, err = filepath.Abs(path); err != nil {
+		return
+	}
+
+	url = "file://" + absPath
+	return
+}
+
+// PresignGet hands out a file URL, there is nothing to sign and it doesn't expire.
+func (store *LocalStore) PresignGet(key string, expiry time.Duration) (url string, err error) {
+
+	var path string
+	if path, err = store.path(key); err != nil {
+		return
+	}
+
+	if _, err = os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			err = ErrNotFound
+		}
+		return
+	}
+
+	var absPath string
+	if absPath, err = filepath.Abs(path); err != nil {
+		return
+	}
+
+	url = "file://" + absPath
+	return
+}
+
+// Verify checks that the object under key still hashes to the object id in its name.
+func (store *LocalStore) Verify(key string) (err error) {
+
+	objectId, ok := ObjectIdOfKey(key)
+	if ok == false {
+		err = errors.Errorf("%s is not an object key", key)
+		return
+	}
+
+	var path string
+	if path, err = store.path(key); err != nil {
+		return
+	}
+
+	var digest string
+	if digest, err = fileDigest(path, sha1.New()); err != nil {
+		if os.IsNotExist(err) {
+			err = ErrNotFound
+		}
+		return
+	}
+
+	if digest != objectId {
+		err = errors.Errorf("%s content hash is %s", key, digest)
+	}
+	return
+}
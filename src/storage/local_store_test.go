@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"os"
+	"time"
+	"strings"
+	"testing"
+	"io/ioutil"
+	"crypto/sha1"
+	"encoding/hex"
+)
+
+func TestLocalStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "local_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := []byte("local store object content")
+	sum := sha1.Sum(content)
+	objectId := hex.EncodeToString(sum[:])
+
+	source := dir + "/source"
+	if err = ioutil.WriteFile(source, content, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewLocalStore(dir + "/objects")
+	if err != nil {
+		t.Fatalf("Fail to create local store: %s", err.Error())
+	}
+
+	key := ObjectKey("4097", objectId)
+
+	if _, err = store.Head(key); err != ErrNotFound {
+		t.Errorf("Head before put should be not found, got %v", err)
+	}
+
+	if err = store.Put(key, source); err != nil {
+		t.Fatalf("Fail to put %s: %s", key, err.Error())
+	}
+
+	info, err := store.Head(key)
+	if err != nil || info.Size != int64(len(content)) {
+		t.Errorf("Head of %s is %v: %v", key, info, err)
+	}
+
+	if err = store.Verify(key); err != nil {
+		t.Errorf("Fail to verify %s: %s", key, err.Error())
+	}
+
+	if err = store.Get(key, dir + "/download"); err != nil {
+		t.Fatalf("Fail to get %s: %s", key, err.Error())
+	}
+
+	if data, _ := ioutil.ReadFile(dir + "/download"); string(data) != string(content) {
+		t.Errorf("Downloaded %q", data)
+	}
+
+	if data, err := store.GetRange(key, 6, 100); err != nil || string(data) != string(content[6:]) {
+		t.Errorf("Range of %s is %q: %v", key, data, err)
+	}
+
+	if url, etag, err := store.Locator(key); err != nil || etag == "" || url == "" {
+		t.Errorf("Locator of %s is %s %s: %v", key, url, etag, err)
+	}
+
+	if url, err := store.PresignGet(key, time.Hour); err != nil || strings.HasPrefix(url, "file:///") == false {
+		t.Errorf("Presigned URL of %s is %s: %v", key, url, err)
+	}
+
+	keys := []string{}
+	if err = store.List("4097/", func(info ObjectInfo) bool {
+		keys = append(keys, info.Key)
+		return true
+	}); err != nil || len(keys) != 1 || keys[0] != key {
+		t.Errorf("Listed %v: %v", keys, err)
+	}
+
+	if err = store.List("4098/", func(info ObjectInfo) bool {
+		t.Errorf("Unexpected %s", info.Key)
+		return true
+	}); err != nil {
+		t.Errorf("Fail to list a missing prefix: %s", err.Error())
+	}
+
+	if err = store.Delete(key); err != nil {
+		t.Errorf("Fail to delete %s: %s", key, err.Error())
+	}
+
+	if _, err = store.Head(key); err != ErrNotFound {
+		t.Errorf("Head after delete should be not found, got %v", err)
+	}
+
+	if _, err = store.PresignGet(key, time.Hour); err != ErrNotFound {
+		t.Errorf("Presigning a deleted object should be not found, got %v", err)
+	}
+
+	if err = store.Put("4097/../../escape", source); err == nil {
+		t.Error("Keys outside the root should be rejected")
+	}
+}
+
+func TestLocalStoreGetVerifies(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "local_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewLocalStore(dir + "/objects")
+	if err != nil {
+		t.Fatalf("Fail to create local store: %s", err.Error())
+	}
+
+	source := dir + "/source"
+	if err = ioutil.WriteFile(source, []byte("what the object should hold"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key names the hash of other content, as a corrupted object would.
+	sum := sha1.Sum([]byte("what it held when put"))
+	key := ObjectKey("4097", hex.EncodeToString(sum[:]))
+	if err = store.Put(key, source); err != nil {
+		t.Fatal(err)
+	}
+
+	download := dir + "/download"
+	if err = ioutil.WriteFile(download, []byte("good copy"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = store.Get(key, download); err == nil || strings.Contains(err.Error(), "content hash") == false {
+		t.Errorf("Get of a corrupt object gave %v", err)
+	}
+
+	if data, _ := ioutil.ReadFile(download); string(data) != "good copy" {
+		t.Errorf("Corrupt object replaced the download: %q", data)
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 3 {
+		t.Errorf("Get left %d files behind", len(files) - 3)
+	}
+}
+
+func TestLocalStoreMetadata(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "local_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewLocalStore(dir + "/objects")
+	if err != nil {
+		t.Fatalf("Fail to create local store: %s", err.Error())
+	}
+
+	content := []byte("patch content")
+	sum := sha1.Sum(content)
+	key := ObjectKey("4097", hex.EncodeToString(sum[:]))
+
+	source := dir + "/source"
+	if err = ioutil.WriteFile(source, content, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := ObjectMetadata{MachineId: "4097", VersionType: VERSION_PATCH, PreviousObjectId: strings.Repeat("ab", 20), BackupTime: time.Unix(1760000000, 0)}
+	if err = store.PutWithMetadata(key, source, metadata); err != nil {
+		t.Fatalf("Fail to put %s with metadata: %s", key, err.Error())
+	}
+
+	info, err := store.Head(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored, err := ParseObjectMetadata(info.Metadata); err != nil || stored.VersionType != VERSION_PATCH || stored.PreviousObjectId != metadata.PreviousObjectId {
+		t.Errorf("Head returned metadata %v: %v", info.Metadata, err)
+	}
+
+	// The metadata is no object of its own.
+	keys := []string{}
+	store.List("4097/", func(info ObjectInfo) bool {
+		keys = append(keys, info.Key)
+		return true
+	})
+
+	if len(keys) != 1 || keys[0] != key {
+		t.Errorf("Listed %v", keys)
+	}
+
+	if err = store.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+
+	path, _ := store.path(key)
+	if _, err = os.Stat(path + LOCAL_METADATA_SUFFIX); os.IsNotExist(err) == false {
+		t.Errorf("Delete left the metadata: %v", err)
+	}
+}
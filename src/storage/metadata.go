@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"io"
+	"time"
+	"strings"
+	"net/url"
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/pkg/errors"
+
+	"../bindiff"
+)
+
+const (
+	VERSION_BASELINE = "baseline"
+	VERSION_PATCH = "patch"
+)
+
+// Names of the metadata and tags every upload carries.
+const (
+	META_MACHINE_ID = "machine-id"
+	META_SOURCE_PATH_HASH = "source-path-hash"
+	META_VERSION_TYPE = "version-type"
+	META_PREVIOUS_OBJECT_ID = "previous-object-id"
+	META_BACKUP_TIME = "backup-time"
+)
+
+// ObjectMetadata ties an object to the backup it came from, enough for lifecycle rules to
+// tell patches from baselines and for a recovery tool to rebuild the version chains
+// without Triton. The source path goes in hashed, the bucket shouldn't list file names.
+type ObjectMetadata struct {
+	MachineId string
+	SourcePathHash string
+	VersionType string
+	// PreviousObjectId is the object a patch applies to, "" for a baseline.
+	PreviousObjectId string
+	BackupTime time.Time
+}
+
+type MetadataWriter interface {
+	// PutWithMetadata is Put attaching metadata to the object, as user metadata and as tags.
+	PutWithMetadata(key string, filepath string, metadata ObjectMetadata) error
+}
+
+// StreamWriter is implemented by stores that can take an object while it is being produced,
+// before its key, the hash of its content, is known.
+type StreamWriter interface {
+	// PutStream stores what it reads from reader under tmpKey, then moves it to the key finish
+	// returns, with metadata. finish is called once reader is drained. sizeHint is about how
+	// much reader has, 0 when that is unknown.
+	PutStream(tmpKey string, reader io.Reader, sizeHint int64, finish func() (key string, metadata ObjectMetadata, err error)) error
+}
+
+
+func SourcePathHash(path string) string {
+	sum := sha1.Sum([]byte(path))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewObjectMetadata describes the object uploaded for the version of path that fileMetaData records.
+func NewObjectMetadata(machineId string, path string, fileMetaData bindiff.FileMetaData) (metadata ObjectMetadata) {
+
+	metadata = ObjectMetadata{
+		MachineId: machineId,
+		SourcePathHash: SourcePathHash(path),
+		VersionType: VERSION_BASELINE,
+		BackupTime: time.Unix(fileMetaData.Backuptime, 0).UTC(),
+	}
+
+	if fileMetaData.PatchType != bindiff.FORMAT_BASELINE {
+		metadata.VersionType = VERSION_PATCH
+		metadata.PreviousObjectId = hex.EncodeToString(fileMetaData.PrevPatchHash[:])
+	}
+	return
+}
+
+func (metadata ObjectMetadata) Map() map[string]string {
+
+	values := map[string]string{
+		META_MACHINE_ID: metadata.MachineId,
+		META_SOURCE_PATH_HASH: metadata.SourcePathHash,
+		META_VERSION_TYPE: metadata.VersionType,
+		META_BACKUP_TIME: metadata.BackupTime.UTC().Format(time.RFC3339),
+	}
+
+	if metadata.PreviousObjectId != "" {
+		values[META_PREVIOUS_OBJECT_ID] = metadata.PreviousObjectId
+	}
+	return values
+}
+
+// Tagging is Map in the query string form S3 takes for object tags.
+func (metadata ObjectMetadata) Tagging() string {
+
+	tags := url.Values{}
+	for name, value := range metadata.Map() {
+		tags.Set(name, value)
+	}
+	return tags.Encode()
+}
+
+// ParseObjectMetadata reads back what Map wrote. Names are matched regardless of case,
+// HTTP clients tend to canonicalize them.
+func ParseObjectMetadata(values map[string]string) (metadata ObjectMetadata, err error) {
+
+	lower := map[string]string{}
+	for name, value := range values {
+		lower[strings.ToLower(name)] = value
+	}
+
+	metadata = ObjectMetadata{
+		MachineId: lower[META_MACHINE_ID],
+		SourcePathHash: lower[META_SOURCE_PATH_HASH],
+		VersionType: lower[META_VERSION_TYPE],
+		PreviousObjectId: lower[META_PREVIOUS_OBJECT_ID],
+	}
+
+	if metadata.VersionType != VERSION_BASELINE && metadata.VersionType != VERSION_PATCH {
+		err = errors.Errorf("Unknown version type %q", metadata.VersionType)
+		return
+	}
+
+	if metadata.BackupTime, err = time.Parse(time.RFC3339, lower[META_BACKUP_TIME]); err != nil {
+		err = errors.Wrapf(err, "Invalid backup time")
+	}
+	return
+}
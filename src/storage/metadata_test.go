@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"time"
+	"testing"
+	"net/url"
+	"net/http"
+
+	"../bindiff"
+)
+
+func TestObjectMetadata(t *testing.T) {
+
+	fileMetaData := bindiff.FileMetaData{Backuptime: 1760000000, PatchType: bindiff.FORMAT_PATCH}
+	fileMetaData.PrevPatchHash[0] = 0xab
+
+	metadata := NewObjectMetadata("machine", "/home/user/file.txt", fileMetaData)
+
+	if metadata.VersionType != VERSION_PATCH || metadata.PreviousObjectId[:4] != "ab00" || len(metadata.PreviousObjectId) != 40 {
+		t.Errorf("Patch metadata is %+v", metadata)
+	}
+
+	if metadata.SourcePathHash != SourcePathHash("/home/user/file.txt") || metadata.SourcePathHash == SourcePathHash("/home/user/other.txt") {
+		t.Errorf("Source path hash is %s", metadata.SourcePathHash)
+	}
+
+	// HTTP clients hand the names back canonicalized.
+	canonical := map[string]string{}
+	for name, value := range metadata.Map() {
+		canonical[http.CanonicalHeaderKey(name)] = value
+	}
+
+	parsed, err := ParseObjectMetadata(canonical)
+	if err != nil || parsed != metadata {
+		t.Errorf("Parsed %+v: %v, want %+v", parsed, err, metadata)
+	}
+
+	tags, err := url.ParseQuery(metadata.Tagging())
+	if err != nil || tags.Get(META_VERSION_TYPE) != VERSION_PATCH || tags.Get(META_BACKUP_TIME) != metadata.BackupTime.Format(time.RFC3339) {
+		t.Errorf("Tagging is %s: %v", metadata.Tagging(), err)
+	}
+
+	baseline := NewObjectMetadata("machine", "/home/user/file.txt", bindiff.FileMetaData{Backuptime: 1760000000})
+	if _, ok := baseline.Map()[META_PREVIOUS_OBJECT_ID]; ok || baseline.VersionType != VERSION_BASELINE {
+		t.Errorf("Baseline metadata is %+v", baseline)
+	}
+
+	if _, err = ParseObjectMetadata(map[string]string{META_VERSION_TYPE: "snapshot"}); err == nil {
+		t.Error("Unknown version type was accepted")
+	}
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// TransferStats counts what a job moved to and from the object store. The methods
+// are safe for concurrent use and do nothing on a nil receiver.
+type TransferStats struct {
+	UploadedObjects int64
+	UploadedBytes int64
+	SkippedObjects int64
+	SkippedBytes int64
+	DownloadedObjects int64
+	DownloadedBytes int64
+}
+
+// StatsReporter is implemented by stores that keep TransferStats.
+type StatsReporter interface {
+	Stats() *TransferStats
+}
+
+
+func (stats *TransferStats) AddUploaded(size int64) {
+	if stats != nil {
+		atomic.AddInt64(&stats.UploadedObjects, 1)
+		atomic.AddInt64(&stats.UploadedBytes, size)
+	}
+}
+
+func (stats *TransferStats) AddSkipped(size int64) {
+	if stats != nil {
+		atomic.AddInt64(&stats.SkippedObjects, 1)
+		atomic.AddInt64(&stats.SkippedBytes, size)
+	}
+}
+
+// AddDownloaded counts objects and ranges alike, objects is 0 for a range.
+func (stats *TransferStats) AddDownloaded(objects int64, size int64) {
+	if stats != nil {
+		atomic.AddInt64(&stats.DownloadedObjects, objects)
+		atomic.AddInt64(&stats.DownloadedBytes, size)
+	}
+}
+
+// Snapshot returns a consistent enough copy to print.
+func (stats *TransferStats) Snapshot() (snapshot TransferStats) {
+
+	if stats == nil {
+		return
+	}
+
+	snapshot.UploadedObjects = atomic.LoadInt64(&stats.UploadedObjects)
+	snapshot.UploadedBytes = atomic.LoadInt64(&stats.UploadedBytes)
+	snapshot.SkippedObjects = atomic.LoadInt64(&stats.SkippedObjects)
+	snapshot.SkippedBytes = atomic.LoadInt64(&stats.SkippedBytes)
+	snapshot.DownloadedObjects = atomic.LoadInt64(&stats.DownloadedObjects)
+	snapshot.DownloadedBytes = atomic.LoadInt64(&stats.DownloadedBytes)
+	return
+}
+
+func (stats TransferStats) String() string {
+	return fmt.Sprintf("uploaded %d objects (%d bytes), skipped %d existing objects (%d bytes), downloaded %d objects (%d bytes)",
+	                   stats.UploadedObjects, stats.UploadedBytes, stats.SkippedObjects, stats.SkippedBytes,
+	                   stats.DownloadedObjects, stats.DownloadedBytes)
+}
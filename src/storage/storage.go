@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"time"
+	"strings"
+	"github.com/pkg/errors"
+
+	"../throttle"
+)
+
+var ErrNotFound = errors.New("Object not found")
+
+type ObjectInfo struct {
+	Key string
+	Size int64
+	ETag string
+	StorageClass string
+	LastModified time.Time
+	// Metadata is the user metadata Head found on the object, see ParseObjectMetadata.
+	Metadata map[string]string
+	// CommonPrefix entries stand for all the keys under Key that a delimited listing rolled
+	// up, only Key is set.
+	CommonPrefix bool
+}
+
+// ObjectStore is where the backup objects live. Keys are laid out by ObjectKey.
+type ObjectStore interface {
+	// Put stores the content of the local file at filepath under key.
+	Put(key string, filepath string) error
+
+	// Get writes the object stored under key to downloadfile.
+	Get(key string, downloadfile string) error
+
+	// GetRange returns length bytes of the object starting at offset, less at the end of the object.
+	GetRange(key string, offset int64, length int64) ([]byte, error)
+
+	// Head returns ErrNotFound when there is no object under key.
+	Head(key string) (ObjectInfo, error)
+
+	// List calls fn for every object whose key starts with prefix until fn returns false.
+	List(prefix string, fn func(ObjectInfo) bool) error
+
+	Delete(key string) error
+
+	// Locator returns a URL Triton can reach the object by, and its ETag.
+	Locator(key string) (url string, etag string, err error)
+
+	// PresignGet returns a URL anyone holding it can download the object by until expiry passes.
+	PresignGet(key string, expiry time.Duration) (url string, err error)
+}
+
+
+func IsObjectId(object string) bool {
+
+	if len(object) != 40 {
+		return false
+	}
+
+	for _, ch := range object {
+		if ch >= '0' && ch <= '9' || ch >= 'a' && ch <= 'f' || ch >= 'A' && ch <= 'F' {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// ObjectKey shards objects by the first two bytes of their hash: <folder>/<aa>/<bb>/<hash>.dat
+func ObjectKey(foldInBucket string, objectId string) string {
+	return foldInBucket + "/" + objectId[0:2] + "/" + objectId[2:4] + "/" + objectId + ".dat"
+}
+
+func ObjectIdOfKey(key string) (objectId string, ok bool) {
+
+	if strings.HasSuffix(key, ".dat") == false {
+		return
+	}
+
+	objectId = strings.ToLower(strings.TrimSuffix(key[strings.LastIndex(key, "/") + 1:], ".dat"))
+	ok = IsObjectId(objectId)
+	return
+}
+
+// ListOptions narrows a listing. With a Delimiter, the keys that share what follows Prefix
+// up to the next Delimiter are listed once, as a common prefix.
+type ListOptions struct {
+	Prefix string
+	Delimiter string
+	// StartAfter lists only the keys sorting after it, to pick up an interrupted listing.
+	StartAfter string
+}
+
+// ObjectIterator goes through a listing in key order, fetching it a page at a time:
+//
+//	for it.Next() { info := it.Object() ... }
+//	if err := it.Err(); err != nil { ... }
+type ObjectIterator interface {
+	Next() bool
+	Object() ObjectInfo
+	// Err is the error that ended the listing early, nil once it went through.
+	Err() error
+}
+
+// Iterable is implemented by stores that can list with ListOptions without holding
+// the whole listing in memory.
+type Iterable interface {
+	Iterate(options ListOptions) ObjectIterator
+}
+
+// FolderMaker is implemented by stores that keep an empty marker object for every folder.
+type FolderMaker interface {
+	// MakeFolder creates the marker of prefix unless something is stored under it already.
+	MakeFolder(prefix string) error
+}
+
+// StaleUploadAborter is implemented by stores that can be left with half done uploads.
+type StaleUploadAborter interface {
+	AbortStaleUploads(prefix string, olderThan time.Duration) (aborted int, err error)
+}
+
+// Throttler is implemented by stores whose bandwidth can be capped, see throttle.Controller.
+type Throttler interface {
+	BandwidthLimiters() (upload *throttle.Limiter, download *throttle.Limiter)
+}
+
+type ArchiveState int
+
+const (
+	// ARCHIVE_NONE objects can be read right away.
+	ARCHIVE_NONE ArchiveState = iota
+	// ARCHIVE_FROZEN objects need a restore before they can be read.
+	ARCHIVE_FROZEN
+	ARCHIVE_RESTORING
+	// ARCHIVE_RESTORED objects can be read until the restored copy expires.
+	ARCHIVE_RESTORED
+)
+
+func (state ArchiveState) Readable() bool {
+	return state == ARCHIVE_NONE || state == ARCHIVE_RESTORED
+}
+
+// Archiver is implemented by stores with storage classes that can't be read without a restore,
+// such as S3 GLACIER and DEEP_ARCHIVE.
+type Archiver interface {
+	ArchiveState(key string) (state ArchiveState, info ObjectInfo, err error)
+	// RestoreArchived starts making the object readable for days, at a tier that trades speed for cost.
+	RestoreArchived(info ObjectInfo, tier string, days int) error
+}
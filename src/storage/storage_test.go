@@ -0,0 +1,25 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestObjectKey(t *testing.T) {
+
+	objectId := "0123456789abcdef0123456789abcdef01234567"
+
+	key := ObjectKey("4097", objectId)
+	if key != "4097/01/23/" + objectId + ".dat" {
+		t.Errorf("Object key is %s", key)
+	}
+
+	if parsed, ok := ObjectIdOfKey(key); ok == false || parsed != objectId {
+		t.Errorf("Object id of %s is %s", key, parsed)
+	}
+
+	for _, key := range []string{"4097/", "4097/01/23/nothex.dat", "4097/01/23/" + objectId + ".tmp"} {
+		if _, ok := ObjectIdOfKey(key); ok {
+			t.Errorf("%s should not be an object key", key)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package throttle
+
+import (
+	"os"
+	"sync"
+	"time"
+	"strconv"
+	"syscall"
+	"os/signal"
+
+	"../slog"
+)
+
+// CHECK_INTERVAL is how often a Controller looks at the clock and the config file.
+const CHECK_INTERVAL = 30 * time.Second
+
+// Controller keeps an upload and a download Limiter on the rates of the current schedule.
+// It loads the config again when the file at Path changes or on SIGHUP, so a running
+// daemon picks up new limits without a restart.
+type Controller struct {
+	Upload *Limiter
+	Download *Limiter
+	Path string
+	Load func() (Config, error)
+
+	mu sync.Mutex
+	schedule *Schedule
+	modTime time.Time
+	stop chan struct{}
+}
+
+
+func NewController(upload *Limiter, download *Limiter, path string, load func() (Config, error)) *Controller {
+	return &Controller{Upload: upload, Download: download, Path: path, Load: load, schedule: &Schedule{}}
+}
+
+// Reload loads the config and applies it, a bad config keeps the previous schedule.
+func (controller *Controller) Reload() (err error) {
+
+	if info, statErr := os.Stat(controller.Path); statErr == nil {
+		controller.mu.Lock()
+		controller.modTime = info.ModTime()
+		controller.mu.Unlock()
+	}
+
+	var config Config
+	if config, err = controller.Load(); err != nil {
+		slog.Errorf("Fail to load throttle config: %s", err.Error())
+		return
+	}
+
+	var schedule *Schedule
+	if schedule, err = NewSchedule(config); err != nil {
+		slog.Errorf("Fail to parse throttle config: %s", err.Error())
+		return
+	}
+
+	controller.mu.Lock()
+	controller.schedule = schedule
+	controller.mu.Unlock()
+
+	controller.Apply(time.Now())
+	return
+}
+
+// Apply sets the limiters to the rates in force at now.
+func (controller *Controller) Apply(now time.Time) {
+
+	controller.mu.Lock()
+	upload, download := controller.schedule.RatesAt(now)
+	controller.mu.Unlock()
+
+	if upload != controller.Upload.Rate() || download != controller.Download.Rate() {
+		slog.Infof("Bandwidth limits now upload %s, download %s", FormatRate(upload), FormatRate(download))
+	}
+
+	controller.Upload.SetRate(upload)
+	controller.Download.SetRate(download)
+}
+
+func (controller *Controller) changed() bool {
+
+	info, err := os.Stat(controller.Path)
+	if err != nil {
+		return false
+	}
+
+	controller.mu.Lock()
+	defer controller.mu.Unlock()
+
+	return info.ModTime().Equal(controller.modTime) == false
+}
+
+// Start loads the config and keeps following it until Stop.
+func (controller *Controller) Start() (err error) {
+
+	err = controller.Reload()
+
+	controller.stop = make(chan struct{})
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	go func() {
+		ticker := time.NewTicker(CHECK_INTERVAL)
+		defer ticker.Stop()
+		defer signal.Stop(hangup)
+
+		for {
+			select {
+				case <-controller.stop:
+					return
+				case <-hangup:
+					slog.Info("SIGHUP received, reloading throttle config")
+					controller.Reload()
+				case now := <-ticker.C:
+					if controller.Path != "" && controller.changed() {
+						slog.Infof("%s changed, reloading throttle config", controller.Path)
+						controller.Reload()
+						continue
+					}
+					controller.Apply(now)
+			}
+		}
+	}()
+	return
+}
+
+func (controller *Controller) Stop() {
+	if controller.stop != nil {
+		close(controller.stop)
+		controller.stop = nil
+	}
+}
+
+func FormatRate(rate int64) string {
+
+	if rate <= 0 {
+		return "unlimited"
+	}
+
+	switch {
+		case rate >= 1 << 30 && rate % (1 << 30) == 0:
+			return strconv.FormatInt(rate >> 30, 10) + "GB/s"
+		case rate >= 1 << 20 && rate % (1 << 20) == 0:
+			return strconv.FormatInt(rate >> 20, 10) + "MB/s"
+		case rate >= 1 << 10 && rate % (1 << 10) == 0:
+			return strconv.FormatInt(rate >> 10, 10) + "KB/s"
+	}
+	return strconv.FormatInt(rate, 10) + "B/s"
+}
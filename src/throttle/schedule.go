@@ -0,0 +1,210 @@
+package throttle
+
+import (
+	"time"
+	"strings"
+	"strconv"
+	"github.com/pkg/errors"
+)
+
+// Config is the <Throttle> element of the account file, for example
+//
+//   <Throttle>
+//     <Upload>0</Upload>
+//     <Download>0</Download>
+//     <Rule days="Mon-Fri" from="08:00" to="18:00" upload="2M" download="4M"/>
+//   </Throttle>
+//
+// Rates are bytes per second with an optional K, M or G suffix, 0 or empty is unlimited.
+// The first rule covering the local time wins, Upload and Download apply otherwise.
+type Config struct {
+	Upload string    `xml:"Upload"`
+	Download string  `xml:"Download"`
+	Rules []Rule     `xml:"Rule"`
+}
+
+// Rule covers from..to on days, to before from runs past midnight. Days is a list like
+// "Mon-Fri", "Sat,Sun" or "*", empty means every day.
+type Rule struct {
+	Days string      `xml:"days,attr"`
+	From string      `xml:"from,attr"`
+	To string        `xml:"to,attr"`
+	Upload string    `xml:"upload,attr"`
+	Download string  `xml:"download,attr"`
+}
+
+type rule struct {
+	days [7]bool
+	from int
+	to int
+	upload int64
+	download int64
+}
+
+type Schedule struct {
+	upload int64
+	download int64
+	rules []rule
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+
+func ParseRate(rate string) (bytesPerSecond int64, err error) {
+
+	rate = strings.ToUpper(strings.TrimSpace(rate))
+	rate = strings.TrimSuffix(rate, "/S")
+	rate = strings.TrimSuffix(rate, "B")
+	rate = strings.TrimSuffix(rate, "I")
+
+	if rate == "" {
+		return
+	}
+
+	multiplier := int64(1)
+	switch rate[len(rate) - 1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+	}
+
+	if multiplier > 1 {
+		rate = rate[:len(rate) - 1]
+	}
+
+	var value float64
+	if value, err = strconv.ParseFloat(strings.TrimSpace(rate), 64); err != nil || value < 0 {
+		err = errors.Errorf("Invalid rate: %s", rate)
+		return
+	}
+
+	bytesPerSecond = int64(value * float64(multiplier))
+	return
+}
+
+func parseDays(days string) (parsed [7]bool, err error) {
+
+	days = strings.ToLower(strings.TrimSpace(days))
+
+	if days == "" || days == "*" {
+		for i := range parsed {
+			parsed[i] = true
+		}
+		return
+	}
+
+	for _, part := range strings.Split(days, ",") {
+		part = strings.TrimSpace(part)
+
+		first, last := part, part
+		if dash := strings.Index(part, "-"); dash != -1 {
+			first, last = strings.TrimSpace(part[:dash]), strings.TrimSpace(part[dash + 1:])
+		}
+
+		from, ok := weekdays[first]
+		to, ok2 := weekdays[last]
+		if ok == false || ok2 == false {
+			err = errors.Errorf("Invalid days: %s", days)
+			return
+		}
+
+		// Ranges may wrap, as in Sat-Sun or Fri-Mon.
+		for day := from; ; day = (day + 1) % 7 {
+			parsed[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+	return
+}
+
+// parseClock returns minutes since midnight, "24:00" is allowed as an end.
+func parseClock(clock string) (minutes int, err error) {
+
+	var parsed time.Time
+	if strings.TrimSpace(clock) == "24:00" {
+		minutes = 24 * 60
+		return
+	}
+
+	if parsed, err = time.Parse("15:04", strings.TrimSpace(clock)); err != nil {
+		err = errors.Errorf("Invalid time of day: %s", clock)
+		return
+	}
+
+	minutes = parsed.Hour() * 60 + parsed.Minute()
+	return
+}
+
+func NewSchedule(config Config) (schedule *Schedule, err error) {
+
+	schedule = &Schedule{}
+
+	if schedule.upload, err = ParseRate(config.Upload); err != nil {
+		return
+	}
+
+	if schedule.download, err = ParseRate(config.Download); err != nil {
+		return
+	}
+
+	for _, configRule := range config.Rules {
+		var parsed rule
+
+		if parsed.days, err = parseDays(configRule.Days); err != nil {
+			return
+		}
+
+		if parsed.from, err = parseClock(configRule.From); err != nil {
+			return
+		}
+
+		if parsed.to, err = parseClock(configRule.To); err != nil {
+			return
+		}
+
+		if parsed.upload, err = ParseRate(configRule.Upload); err != nil {
+			return
+		}
+
+		if parsed.download, err = ParseRate(configRule.Download); err != nil {
+			return
+		}
+
+		schedule.rules = append(schedule.rules, parsed)
+	}
+	return
+}
+
+func (r rule) covers(t time.Time) bool {
+
+	minute := t.Hour() * 60 + t.Minute()
+
+	if r.from <= r.to {
+		return r.days[t.Weekday()] && minute >= r.from && minute < r.to
+	}
+
+	// Past midnight the evening belongs to the day the rule started on.
+	if minute >= r.from {
+		return r.days[t.Weekday()]
+	}
+	return minute < r.to && r.days[(t.Weekday() + 6) % 7]
+}
+
+// RatesAt returns the upload and download rates in force at t, 0 is unlimited.
+func (schedule *Schedule) RatesAt(t time.Time) (upload int64, download int64) {
+
+	for _, r := range schedule.rules {
+		if r.covers(t) {
+			return r.upload, r.download
+		}
+	}
+	return schedule.upload, schedule.download
+}
@@ -0,0 +1,120 @@
+package throttle
+
+import (
+	"os"
+	"testing"
+	"time"
+	"io/ioutil"
+)
+
+
+func TestParseRate(t *testing.T) {
+
+	cases := map[string]int64{
+		"": 0,
+		"0": 0,
+		"1048576": 1 << 20,
+		"2M": 2 << 20,
+		"2 MB/s": 2 << 20,
+		"512k": 512 << 10,
+		"1.5MiB": 3 << 19,
+		"1G": 1 << 30,
+	}
+
+	for rate, want := range cases {
+		if got, err := ParseRate(rate); err != nil || got != want {
+			t.Errorf("ParseRate(%q) = %d, %v, want %d", rate, got, err, want)
+		}
+	}
+
+	for _, rate := range []string{"fast", "-1M", "M"} {
+		if _, err := ParseRate(rate); err == nil {
+			t.Errorf("ParseRate(%q) succeeded", rate)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+
+	schedule, err := NewSchedule(Config{
+		Download: "8M",
+		Rules: []Rule{
+			{Days: "Mon-Fri", From: "08:00", To: "18:00", Upload: "2M", Download: "4M"},
+			{Days: "Sat", From: "22:00", To: "02:00", Upload: "1M"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2026-10-19 is a Monday.
+	cases := []struct {
+		at string
+		upload int64
+		download int64
+	}{
+		{"2026-10-19 07:59", 0, 8 << 20},
+		{"2026-10-19 08:00", 2 << 20, 4 << 20},
+		{"2026-10-23 17:59", 2 << 20, 4 << 20},
+		{"2026-10-23 18:00", 0, 8 << 20},
+		{"2026-10-24 12:00", 0, 8 << 20},
+		{"2026-10-24 23:00", 1 << 20, 0},
+		{"2026-10-25 01:59", 1 << 20, 0},
+		{"2026-10-25 02:00", 0, 8 << 20},
+		{"2026-10-25 23:00", 0, 8 << 20},
+	}
+
+	for _, c := range cases {
+		at, _ := time.ParseInLocation("2006-01-02 15:04", c.at, time.Local)
+		if upload, download := schedule.RatesAt(at); upload != c.upload || download != c.download {
+			t.Errorf("RatesAt(%s) = %d, %d, want %d, %d", c.at, upload, download, c.upload, c.download)
+		}
+	}
+
+	for _, rule := range []Rule{{Days: "Someday"}, {From: "8am"}, {To: "25:00"}, {Upload: "lots"}} {
+		if _, err := NewSchedule(Config{Rules: []Rule{rule}}); err == nil {
+			t.Errorf("NewSchedule accepted %+v", rule)
+		}
+	}
+}
+
+func TestControllerReload(t *testing.T) {
+
+	file, err := ioutil.TempFile("", "throttle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.Close()
+
+	config := Config{Upload: "1M"}
+	upload, download := NewLimiter(0), NewLimiter(0)
+	controller := NewController(upload, download, file.Name(), func() (Config, error) { return config, nil })
+
+	if err = controller.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if upload.Rate() != 1 << 20 || download.Rate() != 0 {
+		t.Errorf("Rates are %d, %d after load", upload.Rate(), download.Rate())
+	}
+
+	if controller.changed() {
+		t.Error("Untouched config reported as changed")
+	}
+
+	config = Config{Upload: "bogus", Download: "1M"}
+	if err = controller.Reload(); err == nil {
+		t.Error("Bad config was accepted")
+	}
+	if upload.Rate() != 1 << 20 || download.Rate() != 0 {
+		t.Errorf("Bad config changed the rates to %d, %d", upload.Rate(), download.Rate())
+	}
+
+	later := time.Now().Add(time.Minute)
+	if err = os.Chtimes(file.Name(), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if controller.changed() == false {
+		t.Error("Touched config not reported as changed")
+	}
+}
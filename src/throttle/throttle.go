@@ -0,0 +1,155 @@
+// Package throttle limits transfer rates with a token bucket whose rate follows a weekly schedule.
+package throttle
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// BURST is how much transfer time a limiter lets through at once after being idle.
+const BURST = 100 * time.Millisecond
+
+// MAX_CHUNK caps a single throttled read so that waits stay short and smooth.
+const MAX_CHUNK = 32 * 1024
+
+// Limiter hands out bytes at Rate per second, a rate of 0 or less is unlimited.
+// It is safe for concurrent use and a nil *Limiter is unlimited.
+type Limiter struct {
+	mu sync.Mutex
+	rate int64
+	next time.Time
+	generation int
+}
+
+
+func NewLimiter(rate int64) *Limiter {
+	return &Limiter{rate: rate}
+}
+
+func (limiter *Limiter) Rate() int64 {
+
+	if limiter == nil {
+		return 0
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	return limiter.rate
+}
+
+// SetRate takes effect at once, also for callers already waiting.
+func (limiter *Limiter) SetRate(rate int64) {
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	if rate == limiter.rate {
+		return
+	}
+
+	limiter.rate = rate
+	limiter.next = time.Time{}
+	limiter.generation += 1
+}
+
+// chunk is the most a reader should move before calling Wait.
+func (limiter *Limiter) chunk() int {
+
+	rate := limiter.Rate()
+	if rate <= 0 {
+		return 0
+	}
+
+	chunk := rate * int64(BURST) / int64(time.Second)
+	if chunk > MAX_CHUNK {
+		chunk = MAX_CHUNK
+	}
+	if chunk < 1 {
+		chunk = 1
+	}
+	return int(chunk)
+}
+
+// Wait blocks until n more bytes fit in the rate.
+func (limiter *Limiter) Wait(n int) {
+
+	if limiter == nil || n <= 0 {
+		return
+	}
+
+	limiter.mu.Lock()
+
+	if limiter.rate <= 0 {
+		limiter.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+
+	// An idle limiter has saved up at most BURST worth of bytes.
+	if earliest := now.Add(-BURST); limiter.next.Before(earliest) {
+		limiter.next = earliest
+	}
+
+	limiter.next = limiter.next.Add(time.Duration(int64(n) * int64(time.Second) / limiter.rate))
+	wait := limiter.next.Sub(now)
+	generation := limiter.generation
+
+	limiter.mu.Unlock()
+
+	// Sleep in steps so that a rate change releases the waiters.
+	for wait > 0 {
+		step := wait
+		if step > BURST {
+			step = BURST
+		}
+		time.Sleep(step)
+		wait -= step
+
+		limiter.mu.Lock()
+		changed := limiter.generation != generation
+		limiter.mu.Unlock()
+
+		if changed {
+			return
+		}
+	}
+}
+
+
+type Reader struct {
+	reader io.Reader
+	limiter *Limiter
+}
+
+func NewReader(reader io.Reader, limiter *Limiter) *Reader {
+	return &Reader{reader: reader, limiter: limiter}
+}
+
+func (reader *Reader) Read(p []byte) (n int, err error) {
+
+	if reader.limiter != nil {
+		if chunk := reader.limiter.chunk(); chunk > 0 && len(p) > chunk {
+			p = p[:chunk]
+		}
+	}
+
+	n, err = reader.reader.Read(p)
+	reader.limiter.Wait(n)
+	return
+}
+
+type ReadCloser struct {
+	*Reader
+	closer io.Closer
+}
+
+func NewReadCloser(readCloser io.ReadCloser, limiter *Limiter) *ReadCloser {
+	return &ReadCloser{Reader: NewReader(readCloser, limiter), closer: readCloser}
+}
+
+func (readCloser *ReadCloser) Close() error {
+	return readCloser.closer.Close()
+}
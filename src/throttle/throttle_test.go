@@ -0,0 +1,62 @@
+package throttle
+
+import (
+	"bytes"
+	"testing"
+	"time"
+	"io/ioutil"
+)
+
+
+func TestLimiterRate(t *testing.T) {
+
+	data := make([]byte, 300 * 1024)
+
+	start := time.Now()
+	if _, err := ioutil.ReadAll(NewReader(bytes.NewReader(data), nil)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100 * time.Millisecond {
+		t.Errorf("Unlimited read took %s", elapsed)
+	}
+
+	// The first BURST worth is free, the other 200KB take about 200ms at 1MB/s.
+	limiter := NewLimiter(1 << 20)
+
+	start = time.Now()
+	read, err := ioutil.ReadAll(NewReader(bytes.NewReader(data), limiter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != len(data) {
+		t.Fatalf("Read %d bytes, want %d", len(read), len(data))
+	}
+	if elapsed := time.Since(start); elapsed < 150 * time.Millisecond || elapsed > time.Second {
+		t.Errorf("300KB at 1MB/s took %s", elapsed)
+	}
+}
+
+func TestLimiterSetRate(t *testing.T) {
+
+	limiter := NewLimiter(1024)
+
+	done := make(chan struct{})
+	go func() {
+		// 10 seconds worth at 1KB/s.
+		limiter.Wait(10 * 1024)
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	limiter.SetRate(0)
+
+	select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Lifting the limit did not release the waiter")
+	}
+
+	if limiter.Rate() != 0 {
+		t.Errorf("Rate is %d, want 0", limiter.Rate())
+	}
+}
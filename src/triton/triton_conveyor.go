@@ -4,6 +4,7 @@ import (
 	"os"
 	"time"
 	"strings"
+	"context"
 	"strconv"
 	"net/http"
 	"net/url"
@@ -16,6 +17,7 @@ import (
 	
 	"../bindiff"
 	"../slog"
+	"../retry"
 )
 
 
@@ -34,6 +36,11 @@ type Version struct {
 	Ordinal int64     `xml:"monotonicOrdinal"`
 }
 
+// IsDeleted takes anything but deleted="false" for deleted, the way ListFile always has.
+func (version Version) IsDeleted() bool {
+	return version.Deleted != "false"
+}
+
 type VersionList struct {
 	Versions []Version `xml:"Version"`
 }
@@ -48,6 +55,9 @@ type NamedObject struct {
 	Versions VersionList `xml:"VersionList"`
 }
 
+func (namedObject NamedObject) IsDeleted() bool {
+	return namedObject.Deleted != "false"
+}
 
 type ObjectList struct {
 	XMLName xml.Name            `xml:"ObjectList"`
@@ -56,9 +66,20 @@ type ObjectList struct {
 
 type ListNamedObjectResults struct {
 	XMLName xml.Name   `xml:"ListNamedObjectResults"`
+	// IsTruncated is "true" on every page of a container listing but the last, which says
+	// "false". NextMarker is where the next page starts. A Triton that doesn't page listings
+	// sends neither, see ListAllNamedObjects.
+	IsTruncated string `xml:"IsTruncated"`
+	NextMarker string  `xml:"NextMarker"`
 	Objects ObjectList `xml:"ObjectList"`
 }
 
+// Complete tells whether the listing says it holds everything. One that says nothing about
+// it can't be told apart from a partial one.
+func (result ListNamedObjectResults) Complete() bool {
+	return result.IsTruncated == "false"
+}
+
 func init() {
 	err := slog.SetSyslog("triton_conveyor")
 	if err != nil {
@@ -82,11 +103,62 @@ type TritonClient struct {
 type TritonConveyor struct {
 	Account TritonClient
 	Endpoints []string
+	Client *http.Client
+	// Retry applies to posts and listings, retry.DefaultPolicy when zero.
+	Retry retry.Policy
 }
 
+const TRITON_TIMEOUT = 2 * time.Minute
+
+// TRITON_LIST_PAGE_SIZE is the most named objects Triton returns in one answer to a listing.
+const TRITON_LIST_PAGE_SIZE = 1000
+
+var listPageSize = TRITON_LIST_PAGE_SIZE
+
+// TRITON_MIN_POST_RATE is the slowest a post body may go up, in bytes per second, before the
+// post times out. A post gets TRITON_TIMEOUT on top of the time its body takes at this rate.
+const TRITON_MIN_POST_RATE = 256 * 1024
+
 func NewTritonConveyor() *TritonConveyor {
 			
-	return &TritonConveyor{Account: TritonClient{},  Endpoints: []string{}}
+	return &TritonConveyor{Account: TritonClient{},  Endpoints: []string{}, Client: &http.Client{}}
+}
+
+// httpClient has no timeout of its own, do gives each request one that fits its body.
+func (conveyor *TritonConveyor) httpClient() *http.Client {
+
+	if conveyor.Client == nil {
+		conveyor.Client = &http.Client{}
+	}
+	return conveyor.Client
+}
+
+// do sends req within timeout and returns the body of a 200 or 201 response, anything else is a *retry.StatusError.
+func (conveyor *TritonConveyor) do(req *http.Request, timeout time.Duration) (body []byte, err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var resp *http.Response 
+
+	if resp, err = conveyor.httpClient().Do(req.WithContext(ctx)); err != nil {
+		slog.Errorf("error sending request %s: %s", req.URL, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	slog.Infoln(resp.Status)
+	slog.Infoln(resp.Header)
+
+	if body, err = ioutil.ReadAll(resp.Body); err != nil {
+		slog.Errorf("error getting response %s: %s", req.URL, err.Error())
+		return		
+	}
+	
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		err = &retry.StatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: string(body)}
+	}
+	return
 }
 
 
@@ -122,24 +194,125 @@ func (conveyor *TritonConveyor) PickEndpoint() (endpoint string, err error) {
 }  
 
 
+// PostNamedObjects retries with conveyor.Retry, each attempt may go to another endpoint.
+// A post is not idempotent, Triton takes one it got twice as two versions. So after a
+// failure Triton may have applied, such as a timeout or a dropped connection, the next
+// attempt first lists filepath and only posts again if the object is not there.
 func (conveyor *TritonConveyor) PostNamedObjects(filepath string, presignedURL string, xmeta map[string] string)  (err error) {
 	
-	var tds string
-	if tds, err = conveyor.PickEndpoint(); err != nil {
-		slog.Error(err)
-		return
-	} 
-
 	var metadata bindiff.FileMetaData
 	if metadata, err = bindiff.GetFileMetaData(filepath); err != nil {
 		slog.Errorf("Fail to get meta data for %s: %s", filepath, err.Error())
 		return
 	}
 	
+	objectId := hex.EncodeToString(metadata.PatchHash[:])
+	mayHavePosted := false
+	
+	// Objects are content addressed, an unchanged file posts the object of a version it already
+	// has. Only a version newer than the ones listed before the first post can be the lost one.
+	// Without that listing a post that may have gone through is posted again, a duplicate
+	// version is better than a lost one.
+	newest, listErr := conveyor.newestVersion(filepath)
+	if listErr != nil {
+		slog.Warningf("Fail to list versions of %s before posting it: %s", filepath, listErr.Error())
+	}
+	
+	err = retry.Do(conveyor.Retry.OrDefault(), "Post of " + filepath, func() (err error) {
+		if mayHavePosted && listErr == nil {
+			var posted bool
+			if posted, err = conveyor.hasObject(filepath, objectId, newest); err != nil || posted {
+				return
+			}
+		}
+		
+		if err = conveyor.postNamedObjects(filepath, presignedURL, xmeta, metadata); err != nil && postNotTaken(err) == false {
+			mayHavePosted = true
+		}
+		return
+	})
+	return
+}
+
+// postNotTaken tells the failures of a post Triton cannot have taken: the connection was
+// refused, or Triton answered 503 Service Unavailable.
+func postNotTaken(err error) bool {
+
+	if statusErr, ok := err.(*retry.StatusError); ok {
+		return statusErr.StatusCode == http.StatusServiceUnavailable
+	}
+	return strings.Contains(err.Error(), "connection refused")
+}
+
+// versionsOf lists the versions of filepath in Triton, newest first. Unlike ListNamedObjects it
+// tries once, PostNamedObjects retries the whole check.
+func (conveyor *TritonConveyor) versionsOf(filepath string) (versions []Version, err error) {
+
+	var body []byte
+	if body, err = conveyor.fetchNamedObjects(namedObjectQuery(filepath)); err != nil {
+		return
+	}
+
+	var result ListNamedObjectResults
+	if err = xml.Unmarshal(body, &result); err != nil {
+		slog.Errorf("Parse xml error: %s", err.Error())
+		return
+	}
+
+	for _, namedObject := range result.Objects.NamedObjects {
+		if namedObject.Fullpath == filepath {
+			versions = namedObject.Versions.Versions
+			return
+		}
+	}
+	return
+}
+
+// newestVersion is the id of the newest version of filepath, "" when it has none.
+func (conveyor *TritonConveyor) newestVersion(filepath string) (versionId string, err error) {
+
+	var versions []Version
+	if versions, err = conveyor.versionsOf(filepath); err == nil && len(versions) > 0 {
+		versionId = versions[0].VersionId
+	}
+	return
+}
+
+// hasObject tells if the newest version of filepath is of objectId and newer than the version
+// that was newest before, so the post that creates it went through.
+func (conveyor *TritonConveyor) hasObject(filepath string, objectId string, before string) (found bool, err error) {
+
+	var versions []Version
+	if versions, err = conveyor.versionsOf(filepath); err != nil || len(versions) == 0 {
+		return
+	}
+
+	if versions[0].VersionId != before && strings.EqualFold(versions[0].ObjectId, objectId) {
+		slog.Infof("%s already has version %s of object %s, not posting it again", filepath, versions[0].VersionId, objectId)
+		found = true
+	}
+	return
+}
+
+// postTimeout gives a post TRITON_TIMEOUT plus the time its body takes at TRITON_MIN_POST_RATE.
+func postTimeout(bodySize int64) time.Duration {
+
+	return TRITON_TIMEOUT + time.Duration(bodySize / TRITON_MIN_POST_RATE) * time.Second
+}
+
+func (conveyor *TritonConveyor) postNamedObjects(filepath string, presignedURL string, xmeta map[string] string, metadata bindiff.FileMetaData)  (err error) {
+	
+	var tds string
+	if tds, err = conveyor.PickEndpoint(); err != nil {
+		slog.Error(err)
+		return
+	} 
+
 	postURL := "http://" + tds + "/namedObjects/" + conveyor.Account.Container + "/" + url.QueryEscape(filepath) + "?presignedURL=" + presignedURL
 
 	var req *http.Request	
 	var rangefile *os.File
+	var bodySize int64
 
 	if metadata.PatchType == bindiff.FORMAT_BASELINE {
 		
@@ -151,6 +324,7 @@ func (conveyor *TritonConveyor) PostNamedObjects(filepath string, presignedURL s
 		req.Header.Set("X-Eventual-Content-Length", strconv.FormatInt(metadata.FileSize, 10))
 	} else {
 		
+		// Reopened on every attempt, a failed one may have read part of it.
 		if rangefile, err = os.Open(bindiff.S3_TRITON_ROOT + filepath + ".range"); err != nil {
 			slog.Error(err)
 			return
@@ -162,6 +336,13 @@ func (conveyor *TritonConveyor) PostNamedObjects(filepath string, presignedURL s
 			return
 		}
 		
+		var info os.FileInfo
+		if info, err = rangefile.Stat(); err != nil {
+			slog.Error(err)
+			return
+		}
+		bodySize = info.Size()
+		
 		req.Header.Set("X-Triton-Legacy-Patch-Headers", "true")
 		req.Header.Set("X-Eventual-Patch-Length", strconv.FormatInt(metadata.PatchSize, 10))
 		
@@ -186,33 +367,82 @@ func (conveyor *TritonConveyor) PostNamedObjects(filepath string, presignedURL s
 		req.Header.Set("X-Meta", xmetaStr[: len(xmetaStr) - 1])
 	}
 	
-	var resp *http.Response 
+	var body []byte
+	body, err = conveyor.do(req, postTimeout(bodySize))
+	slog.Infoln(string(body))
+	return
+}
 
-	if resp, err = http.DefaultClient.Do(req); err != nil {
-		slog.Errorf("error sending request %s: %s", postURL, err.Error())
-		return
-	}
-	defer resp.Body.Close()
+func (conveyor *TritonConveyor) ListNamedObjects(result *ListNamedObjectResults, filepath string)  (err error) {
+	
+	return conveyor.listNamedObjects(result, namedObjectQuery(filepath))
+}
 
-	slog.Infoln(resp.Status)
-	slog.Infoln(resp.Header)
+func namedObjectQuery(filepath string) string {
 
-	var body []byte
-	if body, err = ioutil.ReadAll(resp.Body); err != nil {
-		slog.Errorf("error getting response %s: %s", postURL, err.Error())
-		return		
+	return "?FullPath=" + url.QueryEscape(filepath) + "&includeObjectId=1&ReverseVersionOrder=1"
+}
+
+// ListAllNamedObjects lists the container page by page, following NextMarker, and leaves
+// IsTruncated of the last page in result. See Complete. A Triton that doesn't say whether
+// a listing is truncated has it complete only when it is shorter than a page.
+func (conveyor *TritonConveyor) ListAllNamedObjects(result *ListNamedObjectResults)  (err error) {
+	
+	marker := ""
+	
+	for {
+		query := "?includeObjectId=1&ReverseVersionOrder=1"
+		if marker != "" {
+			query += "&marker=" + url.QueryEscape(marker)
+		}
+		
+		var page ListNamedObjectResults
+		if err = conveyor.listNamedObjects(&page, query); err != nil {
+			return
+		}
+		
+		result.Objects.NamedObjects = append(result.Objects.NamedObjects, page.Objects.NamedObjects...)
+		result.IsTruncated, result.NextMarker = page.IsTruncated, page.NextMarker
+		
+		if page.IsTruncated == "" && marker == "" && len(page.Objects.NamedObjects) < listPageSize {
+			result.IsTruncated = "false"
+		}
+		
+		if page.IsTruncated != "true" {
+			return
+		}
+		
+		if page.NextMarker == "" || page.NextMarker == marker {
+			err = errors.Errorf("Listing of %s is truncated after %d named objects without a marker to go on", conveyor.Account.Container, len(result.Objects.NamedObjects))
+			slog.Error(err)
+			return
+		}
+		marker = page.NextMarker
 	}
-	slog.Infoln(string(body))
+}
+
+func (conveyor *TritonConveyor) listNamedObjects(result *ListNamedObjectResults, query string)  (err error) {
+	
+	var body []byte
 	
-	if strings.Contains(resp.Status, "200") || strings.Contains(resp.Status, "201") {
+	if err = retry.Do(conveyor.Retry.OrDefault(), "Listing of " + query, func() (err error) {
+		body, err = conveyor.fetchNamedObjects(query)
 		return
-	} else {
-		err = errors.New(string(body))
+	}); err != nil {
 		return
-	}	
+	}
+	
+	err = xml.Unmarshal(body, result)
+	if err != nil {
+	    slog.Errorf("Parse xml error: %s", err.Error())
+	    return
+	}
+	slog.Infoln(result)
+	
+	return	
 }
 
-func (conveyor *TritonConveyor) ListNamedObjects(result *ListNamedObjectResults, filepath string)  (err error) {
+func (conveyor *TritonConveyor) fetchNamedObjects(query string)  (body []byte, err error) {
 	
 	var tds string
 	if tds, err = conveyor.PickEndpoint(); err != nil {
@@ -220,8 +450,7 @@ func (conveyor *TritonConveyor) ListNamedObjects(result *ListNamedObjectResults,
 		return
 	} 
 	
-	listURL := "http://" + tds + "/namedObjects/" + conveyor.Account.Container + "/?FullPath=" + url.QueryEscape(filepath) + 
-	           "&includeObjectId=1&ReverseVersionOrder=1"
+	listURL := "http://" + tds + "/namedObjects/" + conveyor.Account.Container + "/" + query
 	
 	var req *http.Request
 	
@@ -232,30 +461,6 @@ func (conveyor *TritonConveyor) ListNamedObjects(result *ListNamedObjectResults,
 	
 	req.Header.Set("Authorization", "Basic " + basicAuth(conveyor.Account.Name, conveyor.Account.Passwd))
 	
-	var resp *http.Response 
-
-	if resp, err = http.DefaultClient.Do(req); err != nil {
-		slog.Errorf("error sending request %s: %s", listURL, err.Error())
-		return
-	}
-	defer resp.Body.Close()
-
-	slog.Infoln(resp.Status)
-	slog.Infoln(resp.Header)
-
-	var body []byte
-	if body, err = ioutil.ReadAll(resp.Body); err != nil {
-		slog.Errorf("error getting response %s: %s", listURL, err.Error())
-		return		
-	}
-	
-	err = xml.Unmarshal(body, result)
-	if err != nil {
-	    slog.Errorf("Parse xml error: %s", err.Error())
-	    return
-	}
-	slog.Infoln(result)
-	
-	return	
+	body, err = conveyor.do(req, TRITON_TIMEOUT)
+	return
 }
-
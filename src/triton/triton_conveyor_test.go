@@ -1,10 +1,18 @@
 package triton
 
 import (
+	"os"
+	"fmt"
+	"time"
+	"strings"
 	"testing"
 	"flag"
+	"net/http"
+	"io/ioutil"
+	"net/http/httptest"
 	"encoding/hex"
 	"../bindiff"
+	"../retry"
 	"../s3"
 )
 
@@ -80,3 +88,213 @@ func TestListNamedObjects(t *testing.T) {
 	
 	t.Log(result)
 }
+
+
+func TestListNamedObjectsRetry(t *testing.T) {
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests += 1
+
+		switch {
+			case r.URL.Query().Get("FullPath") == "/denied":
+				w.WriteHeader(http.StatusUnauthorized)
+			case requests == 1:
+				w.WriteHeader(http.StatusServiceUnavailable)
+			default:
+				w.Write([]byte(`<ListNamedObjectResults><ObjectList><NamedObject deleted="false"><fullpath>/a/b</fullpath>` +
+				              `<VersionList><Version deleted="false"><versionId>1</versionId></Version></VersionList></NamedObject></ObjectList></ListNamedObjectResults>`))
+		}
+	}))
+	defer server.Close()
+
+	tritonConveyor := NewTritonConveyor()
+	tritonConveyor.SetAccount("test", "test", "4097")
+	tritonConveyor.AddEndpoints([]string{server.Listener.Addr().String()})
+	tritonConveyor.Retry = retry.Policy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+
+	var result ListNamedObjectResults
+	if err := tritonConveyor.ListNamedObjects(&result, "/a/b"); err != nil {
+		t.Fatalf("Fail to list after a 503: %s", err.Error())
+	}
+
+	if requests != 2 || len(result.Objects.NamedObjects) != 1 || result.Objects.NamedObjects[0].Versions.Versions[0].VersionId != "1" {
+		t.Errorf("%d requests gave %+v", requests, result)
+	}
+
+	requests = 0
+	if err := tritonConveyor.ListNamedObjects(&result, "/denied"); err == nil || requests != 1 {
+		t.Errorf("Unauthorized listing was tried %d times: %v", requests, err)
+	}
+}
+
+func TestPostNamedObjectsRetry(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "triton")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	defer func(saved string) { bindiff.S3_TRITON_ROOT = saved }(bindiff.S3_TRITON_ROOT)
+	bindiff.S3_TRITON_ROOT = root + "/"
+
+	filepath := root + "/file"
+	if err = ioutil.WriteFile(filepath, []byte("posted once"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = bindiff.CreatePatch(filepath); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := bindiff.GetFileMetaData(filepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objectId := hex.EncodeToString(metadata.PatchHash[:])
+
+	// failures are the answers to the first posts: "503", "lost" after Triton took the post
+	// or "dropped" before it did. Later posts succeed. versions are the object ids of the
+	// versions Triton has, newest first.
+	var failures []string
+	var versions []string
+	posts, listFails := 0, false
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && listFails {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		} else if r.Method == "GET" {
+			listed := ""
+			for i, version := range versions {
+				listed += fmt.Sprintf(`<Version deleted="false"><versionId>%d</versionId><objectId>%s</objectId></Version>`, len(versions) - i, version)
+			}
+			w.Write([]byte(`<ListNamedObjectResults><ObjectList><NamedObject deleted="false"><fullpath>` + filepath + `</fullpath>` +
+			              `<VersionList>` + listed + `</VersionList></NamedObject></ObjectList></ListNamedObjectResults>`))
+			return
+		}
+
+		posts += 1
+		failure := ""
+		if posts <= len(failures) {
+			failure = failures[posts - 1]
+		}
+
+		switch failure {
+			case "503":
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			case "lost":
+				versions = append([]string{objectId}, versions...)
+				fallthrough
+			case "dropped":
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+		}
+
+		versions = append([]string{objectId}, versions...)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	tritonConveyor := NewTritonConveyor()
+	tritonConveyor.SetAccount("test", "test", "4097")
+	tritonConveyor.AddEndpoints([]string{server.Listener.Addr().String()})
+	tritonConveyor.Retry = retry.Policy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+
+	// An unchanged file posts the object its newest version has again, in upper case from
+	// some Tritons. A change back to earlier content posts the object of an older version.
+	other := strings.Repeat("a", 40)
+	for _, c := range []struct {
+		versions []string
+		failures []string
+		posts int
+	}{
+		{nil, nil, 1},
+		{nil, []string{"503"}, 2},
+		{nil, []string{"lost"}, 1},
+		{nil, []string{"dropped"}, 2},
+		{nil, []string{"503", "lost"}, 2},
+		{[]string{strings.ToUpper(objectId)}, []string{"dropped"}, 2},
+		{[]string{strings.ToUpper(objectId)}, []string{"lost"}, 1},
+		{[]string{other, objectId}, []string{"dropped"}, 2},
+	} {
+		versions, failures, posts = c.versions, c.failures, 0
+
+		if err = tritonConveyor.PostNamedObjects(filepath, "url", nil); err != nil {
+			t.Errorf("Fail to post after %v: %s", c.failures, err.Error())
+		}
+
+		if posts != c.posts || len(versions) != len(c.versions) + 1 {
+			t.Errorf("Failures %v over %v took %d posts, want %d, versions are %v", c.failures, c.versions, posts, c.posts, versions)
+		}
+	}
+
+	// Without a listing to go by, a post whose answer was lost is posted again.
+	versions, failures, posts, listFails = nil, []string{"lost"}, 0, true
+	if err = tritonConveyor.PostNamedObjects(filepath, "url", nil); err != nil || posts != 2 {
+		t.Errorf("Unlisted lost post took %d posts: %v", posts, err)
+	}
+
+	if postTimeout(0) != TRITON_TIMEOUT || postTimeout(100 * TRITON_MIN_POST_RATE) != TRITON_TIMEOUT + 100 * time.Second {
+		t.Errorf("Post timeouts %s and %s", postTimeout(0), postTimeout(100 * TRITON_MIN_POST_RATE))
+	}
+}
+
+func TestListAllNamedObjectsPages(t *testing.T) {
+
+	// pages are the answers by marker, "stuck" repeats its own marker.
+	pages := map[string]string{
+		"": `<IsTruncated>true</IsTruncated><NextMarker>/b</NextMarker><ObjectList><NamedObject><fullpath>/a</fullpath></NamedObject></ObjectList>`,
+		"/b": `<IsTruncated>false</IsTruncated><ObjectList><NamedObject><fullpath>/b</fullpath></NamedObject></ObjectList>`,
+		"stuck": `<IsTruncated>true</IsTruncated><NextMarker>stuck</NextMarker><ObjectList></ObjectList>`,
+		"unsaid": `<ObjectList><NamedObject><fullpath>/c</fullpath></NamedObject></ObjectList>`,
+		"unsaid full": `<ObjectList><NamedObject><fullpath>/c</fullpath></NamedObject><NamedObject><fullpath>/d</fullpath></NamedObject></ObjectList>`,
+	}
+	first := ""
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		marker := r.URL.Query().Get("marker")
+		if marker == "" {
+			marker = first
+		}
+		w.Write([]byte(`<ListNamedObjectResults>` + pages[marker] + `</ListNamedObjectResults>`))
+	}))
+	defer server.Close()
+
+	tritonConveyor := NewTritonConveyor()
+	tritonConveyor.SetAccount("test", "test", "4097")
+	tritonConveyor.AddEndpoints([]string{server.Listener.Addr().String()})
+
+	var result ListNamedObjectResults
+	if err := tritonConveyor.ListAllNamedObjects(&result); err != nil {
+		t.Fatalf("Fail to list two pages: %s", err.Error())
+	}
+
+	if len(result.Objects.NamedObjects) != 2 || result.Objects.NamedObjects[1].Fullpath != "/b" || result.Complete() == false {
+		t.Errorf("Two pages gave %+v", result)
+	}
+
+	first = "stuck"
+	if err := tritonConveyor.ListAllNamedObjects(&ListNamedObjectResults{}); err == nil {
+		t.Error("Truncated listing that does not move on was taken")
+	}
+
+	// Without paging, a listing shorter than a page holds everything, a full one may not.
+	defer func(size int) { listPageSize = size }(listPageSize)
+	listPageSize = 2
+
+	first = "unsaid"
+	result = ListNamedObjectResults{}
+	if err := tritonConveyor.ListAllNamedObjects(&result); err != nil || len(result.Objects.NamedObjects) != 1 || result.Complete() == false {
+		t.Errorf("Short listing that says nothing about being complete gave %+v: %v", result, err)
+	}
+
+	first = "unsaid full"
+	result = ListNamedObjectResults{}
+	if err := tritonConveyor.ListAllNamedObjects(&result); err != nil || len(result.Objects.NamedObjects) != 2 || result.Complete() {
+		t.Errorf("Full listing that says nothing about being complete gave %+v: %v", result, err)
+	}
+}